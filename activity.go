@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/robodone/robosla-common/pkg/autoupdate"
+)
+
+// ActivityTracker keeps track of long operations (jobs, snapshot packs, etc), which must not be
+// interrupted by an autoupdate. Updates are disabled while at least one activity is running,
+// and enabled back only when the agent is fully idle.
+type ActivityTracker struct {
+	mu      sync.Mutex
+	active  map[string]int
+	disable func()
+	enable  func()
+}
+
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{
+		active:  make(map[string]int),
+		disable: autoupdate.DisableUpdates,
+		enable:  autoupdate.EnableUpdates,
+	}
+}
+
+// Begin registers a running activity. The caller MUST call the returned function, when the activity is over.
+// It's safe to call it more than once.
+func (at *ActivityTracker) Begin(name string) (end func()) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.numActiveLocked() == 0 {
+		at.disable()
+	}
+	at.active[name]++
+	var once sync.Once
+	return func() {
+		once.Do(func() { at.end(name) })
+	}
+}
+
+func (at *ActivityTracker) end(name string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.active[name]--
+	if at.active[name] == 0 {
+		delete(at.active, name)
+	}
+	if at.numActiveLocked() == 0 {
+		at.enable()
+	}
+}
+
+func (at *ActivityTracker) numActiveLocked() int {
+	var n int
+	for _, cnt := range at.active {
+		n += cnt
+	}
+	return n
+}
+
+// Busy returns true, if any activity is running.
+func (at *ActivityTracker) Busy() bool {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.numActiveLocked() > 0
+}
+
+// Active returns the sorted names of the running activities.
+func (at *ActivityTracker) Active() []string {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	var names []string
+	for name := range at.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
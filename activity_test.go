@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestActivityTrackerDisablesUpdates(t *testing.T) {
+	at := NewActivityTracker()
+	var disabled bool
+	var numEnabled int
+	at.disable = func() { disabled = true }
+	at.enable = func() {
+		disabled = false
+		numEnabled++
+	}
+	endJob := at.Begin("job")
+	endPack := at.Begin("realsense-train-pack")
+	if !disabled || !at.Busy() {
+		t.Fatalf("want updates disabled while activities are running")
+	}
+	endJob()
+	endJob() // Must be a no-op
+	if !disabled {
+		t.Errorf("want updates disabled while realsense-train-pack is still running")
+	}
+	if got := at.Active(); len(got) != 1 || got[0] != "realsense-train-pack" {
+		t.Errorf("Active: want [realsense-train-pack], got %q", got)
+	}
+	endPack()
+	if disabled || at.Busy() {
+		t.Errorf("want updates enabled once the agent is idle")
+	}
+	if numEnabled != 1 {
+		t.Errorf("want updates enabled exactly once, got %d", numEnabled)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upper limit of temperature limits. Anything above is a typo.
+const maxTempLimit = 500
+
+// cmdlineFlags are the flags given on the command line. They are recorded in main before
+// the config bundle is applied, because flag.Set makes the flags look like they were given.
+var cmdlineFlags map[string]bool
+
+var (
+	validBaudRates   = []int{9600, 19200, 38400, 57600, 115200, 230400, 250000, 460800, 500000, 921600, 1000000}
+	validDeviceTypes = []string{"usb-gcode", "ur3", "usb-gcode+ur3"}
+)
+
+// AgentConfig is the config bundle pushed by the server with the config command. It's stored
+// in agent.json in the config dir and is applied at start on top of the flag defaults.
+// The flags given on the command line take precedence, because the operator knows the rig better.
+type AgentConfig struct {
+	BaudRate     int    `json:"baud_rate,omitempty"`
+	DeviceType   string `json:"device_type,omitempty"`
+	SerialDevice string `json:"serial_device,omitempty"`
+	FrameDisplay string `json:"frame_display,omitempty"`
+	// MaxTemps are the temperature limits of jobs. A job is aborted, if one is exceeded.
+	MaxTemps   TempLimits `json:"max_temps,omitempty"`
+	StartGcode []string   `json:"start_gcode,omitempty"`
+	EndGcode   []string   `json:"end_gcode,omitempty"`
+	// AbortGcode is sent after a job fails or is canceled, like turning off the UV LED.
+	AbortGcode []string `json:"abort_gcode,omitempty"`
+
+	startCmds []*Cmd
+	endCmds   []*Cmd
+	abortCmds []*Cmd
+}
+
+func getAgentConfigPath() string {
+	return path.Join(getConfigDir(), "agent.json")
+}
+
+func parseGcodeLines(name string, lines []string) ([]*Cmd, error) {
+	var cmds []*Cmd
+	for i, line := range lines {
+		cmd, err := parseGcodeCommand("", line)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %v", name, i, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// parseAgentConfig parses and validates a config bundle.
+func parseAgentConfig(data []byte) (*AgentConfig, error) {
+	cfg := new(AgentConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %v", err)
+	}
+	if cfg.BaudRate != 0 && !containsInt(validBaudRates, cfg.BaudRate) {
+		return nil, fmt.Errorf("unsupported baud_rate %d", cfg.BaudRate)
+	}
+	if cfg.DeviceType != "" && !containsString(validDeviceTypes, cfg.DeviceType) {
+		return nil, fmt.Errorf("unsupported device_type %q, want one of %s", cfg.DeviceType, strings.Join(validDeviceTypes, ", "))
+	}
+	if cfg.FrameDisplay != "" && !containsString(validFrameDisplays, cfg.FrameDisplay) {
+		return nil, fmt.Errorf("unsupported frame_display %q, want one of %s", cfg.FrameDisplay, strings.Join(validFrameDisplays, ", "))
+	}
+	if cfg.SerialDevice != "" && !strings.HasPrefix(cfg.SerialDevice, "/dev/") {
+		return nil, fmt.Errorf("serial_device %q is not in /dev", cfg.SerialDevice)
+	}
+	for heater, limit := range cfg.MaxTemps {
+		if heater == "" || limit <= 0 || limit > maxTempLimit {
+			return nil, fmt.Errorf("invalid max_temps for %q: %v, want (0, %d]", heater, limit, maxTempLimit)
+		}
+	}
+	var err error
+	if cfg.startCmds, err = parseGcodeLines("start_gcode", cfg.StartGcode); err != nil {
+		return nil, err
+	}
+	if cfg.endCmds, err = parseGcodeLines("end_gcode", cfg.EndGcode); err != nil {
+		return nil, err
+	}
+	if cfg.abortCmds, err = parseGcodeLines("abort_gcode", cfg.AbortGcode); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func readAgentConfig() (*AgentConfig, error) {
+	data, err := ioutil.ReadFile(getAgentConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseAgentConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", getAgentConfigPath(), err)
+	}
+	return cfg, nil
+}
+
+func saveAgentConfig(cfg *AgentConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(getConfigDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create config dir: %v", err)
+	}
+	return writeFileAtomic(getAgentConfigPath(), data, 0644, func(tmpName string) error {
+		data, err := ioutil.ReadFile(tmpName)
+		if err != nil {
+			return err
+		}
+		_, err = parseAgentConfig(data)
+		return err
+	})
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags() map[string]bool {
+	res := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { res[f.Name] = true })
+	return res
+}
+
+// flagValues maps the flags to the values from the config, which are set.
+func (cfg *AgentConfig) flagValues() map[string]string {
+	res := make(map[string]string)
+	if cfg.BaudRate != 0 {
+		res["rate"] = strconv.Itoa(cfg.BaudRate)
+	}
+	if cfg.DeviceType != "" {
+		res["device_type"] = cfg.DeviceType
+	}
+	if cfg.SerialDevice != "" {
+		res["serial_device"] = cfg.SerialDevice
+	}
+	if cfg.FrameDisplay != "" {
+		res["frame_display"] = cfg.FrameDisplay
+	}
+	return res
+}
+
+// applyFlags sets the flags, which are not given on the command line, to the values from the config.
+// The connection settings and the frame display are only read at start, so that must be done before the downlink is created.
+func (cfg *AgentConfig) applyFlags(explicit map[string]bool) error {
+	values := cfg.flagValues()
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			logf("-%s is given on the command line, so the value from %s is ignored", name, getAgentConfigPath())
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			return fmt.Errorf("failed to set -%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// needsRestart returns true, if the config changes the connection settings or the frame display, which are only read at start.
+func (cfg *AgentConfig) needsRestart(explicit map[string]bool) bool {
+	for name, value := range cfg.flagValues() {
+		if !explicit[name] && flag.Lookup(name).Value.String() != value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyExecutor applies the job settings. It's safe to call while a job is running: the new settings
+// take effect with the next job.
+func (cfg *AgentConfig) applyExecutor(exe *Executor, explicit map[string]bool) {
+	start, end := cfg.startCmds, cfg.endCmds
+	if explicit["start_gcode"] {
+		start = exe.jobGcode().start
+	}
+	if explicit["end_gcode"] {
+		end = exe.jobGcode().end
+	}
+	exe.SetJobGcode(start, end, cfg.abortCmds)
+	exe.SetMaxTemps(cfg.MaxTemps)
+}
+
+// ApplyConfig validates and saves the config bundle and applies it. If the connection settings
+// or the frame display are changed, the agent is restarted to apply them, unless it's busy.
+func (sh *Shell) ApplyConfig(data string) error {
+	if strings.TrimSpace(data) == "" {
+		return errors.New("the config is empty")
+	}
+	cfg, err := parseAgentConfig([]byte(data))
+	if err != nil {
+		return err
+	}
+	if err := saveAgentConfig(cfg); err != nil {
+		return fmt.Errorf("failed to save the config: %v", err)
+	}
+	cfg.applyExecutor(sh.exe, cmdlineFlags)
+	if cfg.needsRestart(cmdlineFlags) {
+		// The restart would kill the running job. The saved config is applied with the next restart.
+		if err := sh.checkIdle(); err != nil {
+			return fmt.Errorf("the config is saved, but the agent is not restarted to apply the new connection settings: %v", err)
+		}
+		sh.up.logf("The config is saved. Restarting to apply the new connection settings...")
+		return sh.restart()
+	}
+	sh.up.logf("The config is applied")
+	return nil
+}
+
+func containsInt(list []int, val int) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// restartAgent replaces the current process with a fresh copy of the agent binary.
+func restartAgent() error {
+	logf("Restarting the agent...")
+	// Allow the delivery of the pending uplink messages.
+	time.Sleep(time.Second)
+	return syscall.Exec(mustGetExecutablePath(), os.Args, os.Environ())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withConfigDir points -config_dir to a temp dir and restores the connection flags after the test.
+func withConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "robosla-config")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	oldDir, oldRate, oldType, oldDev, oldDisp := *configDir, *baudRate, *deviceType, *serialDev, *frameDisp
+	*configDir = dir
+	t.Cleanup(func() {
+		*configDir, *baudRate, *deviceType, *serialDev, *frameDisp = oldDir, oldRate, oldType, oldDev, oldDisp
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestParseAgentConfig(t *testing.T) {
+	cfg, err := parseAgentConfig([]byte(`{"baud_rate": 250000, "start_gcode": ["M204 S500", "G1 Z1 F100"], "max_temps": {"T": 250}}`))
+	if err != nil {
+		t.Fatalf("parseAgentConfig: %v", err)
+	}
+	if len(cfg.startCmds) != 2 || cfg.startCmds[1].Text != "G1 Z1 F100" {
+		t.Errorf("want 2 start commands, got %+v", cfg.startCmds)
+	}
+	for _, str := range []string{
+		`{"baud_rate": 12345}`,
+		`{"device_type": "toaster"}`,
+		`{"serial_device": "/etc/passwd"}`,
+		`{"frame_display": "hdmi"}`,
+		`{"max_temps": {"T": 9000}}`,
+		`{"abort_gcode": ["M112"]}`,
+		`{"uv_power": 100}`,
+		`not json`,
+	} {
+		if _, err := parseAgentConfig([]byte(str)); err == nil {
+			t.Errorf("parseAgentConfig(%s): want an error", str)
+		}
+	}
+}
+
+func TestShellApplyConfig(t *testing.T) {
+	withConfigDir(t)
+	sh, _, _ := newTestShell()
+	var restarts int
+	sh.restart = func() error {
+		restarts++
+		return nil
+	}
+
+	// A running job is not killed by the restart.
+	endJob := sh.exe.activities.Begin("job benchy")
+	if sh.handleCommand(`config {"baud_rate": 250000, "device_type": "usb-gcode+ur3"}`) {
+		t.Errorf("the config command must fail, when the restart is refused")
+	}
+	if restarts != 0 {
+		t.Errorf("want no restarts while a job is running, got %d", restarts)
+	}
+	endJob()
+
+	if !sh.handleCommand(`config {"baud_rate": 250000, "device_type": "usb-gcode+ur3", "abort_gcode": ["M107"], "max_temps": {"T": 250}}`) {
+		t.Fatalf("the config command failed")
+	}
+	if restarts != 1 {
+		t.Errorf("want the agent restarted once to apply the connection settings, got %d restarts", restarts)
+	}
+	if got := sh.exe.jobGcode().abort; len(got) != 1 || got[0].Text != "M107" {
+		t.Errorf("want the abort commands applied right away, got %+v", got)
+	}
+	if got := sh.exe.MaxTemps()["T"]; got != 250 {
+		t.Errorf("want the temperature limit of T applied right away, got %v", got)
+	}
+
+	// After the restart, the saved config is applied on top of the flag defaults.
+	cfg, err := readAgentConfig()
+	if err != nil {
+		t.Fatalf("readAgentConfig: %v", err)
+	}
+	if err := cfg.applyFlags(nil); err != nil {
+		t.Fatalf("applyFlags: %v", err)
+	}
+	if *baudRate != 250000 || *deviceType != "usb-gcode+ur3" {
+		t.Errorf("want 250000 bps and usb-gcode+ur3, got %d bps and %s", *baudRate, *deviceType)
+	}
+	if cfg.needsRestart(nil) {
+		t.Errorf("the config is applied, but a restart is still needed")
+	}
+
+	// The flags given on the command line win.
+	*baudRate = 57600
+	if err := cfg.applyFlags(map[string]bool{"rate": true}); err != nil {
+		t.Fatalf("applyFlags: %v", err)
+	}
+	if *baudRate != 57600 {
+		t.Errorf("want -rate from the command line kept, got %d", *baudRate)
+	}
+
+	if sh.handleCommand(`config {"baud_rate": 12345}`) {
+		t.Errorf("an invalid config is accepted")
+	}
+	if cfg, err := readAgentConfig(); err != nil || cfg.DeviceType != "usb-gcode+ur3" {
+		t.Errorf("an invalid config must not replace the saved one, got %+v, %v", cfg, err)
+	}
+}
+
+func TestExecuteGcodeAbortOnOverTemp(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	abort, err := parseGcodeLines("abort_gcode", []string{"M107", "M84"})
+	if err != nil {
+		t.Fatalf("parseGcodeLines: %v", err)
+	}
+	exe.SetJobGcode(nil, nil, abort)
+	exe.SetMaxTemps(map[string]float64{"T": 250})
+	up.NotifyTemperature(map[string]Temperature{"T": {Actual: 260, Target: 200}})
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+
+	err = exe.ExecuteGcode(context.Background(), "hot", job)
+	if err == nil || !strings.Contains(err.Error(), "above the limit") {
+		t.Fatalf("ExecuteGcode: want an error about the temperature limit, got %v", err)
+	}
+	if got, want := strings.Join(down.Written(), "; "), "M107; M84"; got != want {
+		t.Errorf("Written: want only the abort commands %q, got %q", want, got)
+	}
+}
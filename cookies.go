@@ -7,6 +7,14 @@ import (
 	"log"
 	"os"
 	"path"
+	"sync"
+)
+
+// The cookies could be provided with environment variables instead of user.json and device.json.
+// That's handy for containers and systemd units. The environment takes precedence over the files.
+const (
+	userCookieEnv   = "ROBOSLA_USER_COOKIE"
+	deviceCookieEnv = "ROBOSLA_DEVICE_COOKIE"
 )
 
 func mustGetExecutablePath() string {
@@ -17,12 +25,100 @@ func mustGetExecutablePath() string {
 	return execPath
 }
 
+// systemConfigDir is the default config dir, if the agent may write there, like when it runs as root.
+var systemConfigDir = "/etc/robosla"
+
+var (
+	defaultConfigDirOnce sync.Once
+	defaultConfigDir     string
+)
+
+// getConfigDir returns the directory for user.json, device.json and the other state of the agent:
+// -config_dir, if specified, $XDG_CONFIG_HOME/robosla, if set, or the first writable one of
+// /etc/robosla, $HOME/.config/robosla and the directory with the binary otherwise.
+func getConfigDir() string {
+	if *configDir != "" {
+		return *configDir
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return path.Join(xdg, "robosla")
+	}
+	defaultConfigDirOnce.Do(func() {
+		dirs := []string{systemConfigDir}
+		if home, err := os.UserHomeDir(); err == nil {
+			dirs = append(dirs, path.Join(home, ".config", "robosla"))
+		}
+		defaultConfigDir = pickConfigDir(append(dirs, path.Dir(mustGetExecutablePath())))
+	})
+	return defaultConfigDir
+}
+
+// pickConfigDir returns the first writable dir. An agent, which does not run as root, can't write to /etc,
+// and it would never save the device cookie there. If none is writable, the first one is returned,
+// and saving fails with a clear error.
+func pickConfigDir(dirs []string) string {
+	for _, dir := range dirs {
+		if checkWritable(dir, ioutil.TempFile) == nil {
+			return dir
+		}
+	}
+	return dirs[0]
+}
+
+// migrateLegacyCookies copies user.json and device.json from the directory with the binary, where they were
+// stored historically, to the config dir, so that the device cookie is read from and saved to the same place.
+func migrateLegacyCookies() error {
+	legacyDir := path.Dir(mustGetExecutablePath())
+	if legacyDir == getConfigDir() {
+		return nil
+	}
+	for _, name := range []string{"user.json", "device.json"} {
+		fname := path.Join(getConfigDir(), name)
+		if _, err := os.Stat(fname); err == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(legacyDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(getConfigDir(), 0755); err != nil {
+			return fmt.Errorf("failed to create config dir: %v", err)
+		}
+		if err := writeFileAtomic(fname, data, 0644, func(tmpName string) error {
+			_, err := readCookie(tmpName)
+			return err
+		}); err != nil {
+			return err
+		}
+		logf("Copied %s from %s to %s", name, legacyDir, getConfigDir())
+	}
+	return nil
+}
+
+// getConfigPath returns the path to the config file with the given name. Historically, the config files
+// were stored next to the binary, which is often read-only. They are still read from there,
+// if they are not in the config dir.
+func getConfigPath(name string) string {
+	fname := path.Join(getConfigDir(), name)
+	if _, err := os.Stat(fname); err == nil {
+		return fname
+	}
+	legacy := path.Join(path.Dir(mustGetExecutablePath()), name)
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return fname
+}
+
 func getUserJsonPath() string {
-	return path.Join(path.Dir(mustGetExecutablePath()), "user.json")
+	return getConfigPath("user.json")
 }
 
 func getDeviceJsonPath() string {
-	return path.Join(path.Dir(mustGetExecutablePath()), "device.json")
+	return getConfigPath("device.json")
 }
 
 func readCookie(fname string) (string, error) {
@@ -46,10 +142,16 @@ func readCookie(fname string) (string, error) {
 }
 
 func readUserCookie() (string, error) {
+	if cookie := os.Getenv(userCookieEnv); cookie != "" {
+		return cookie, nil
+	}
 	return readCookie(getUserJsonPath())
 }
 
 func readDeviceCookie() (string, error) {
+	if cookie := os.Getenv(deviceCookieEnv); cookie != "" {
+		return cookie, nil
+	}
 	return readCookie(getDeviceJsonPath())
 }
 
@@ -60,13 +162,68 @@ func saveDeviceCookie(cookie string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(getDeviceJsonPath(), data, 0644)
+	// New device.json always goes to the config dir, even if there's a legacy one near the binary.
+	if err := os.MkdirAll(getConfigDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create config dir: %v", err)
+	}
+	// Without device.json, the agent can never authenticate, so it must not be corrupted by a power cut.
+	return writeFileAtomic(path.Join(getConfigDir(), "device.json"), data, 0644, func(tmpName string) error {
+		got, err := readCookie(tmpName)
+		if err != nil {
+			return err
+		}
+		if got != cookie {
+			return fmt.Errorf("cookie mismatch after writing %s", tmpName)
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic writes data to a temporary file next to fname, checks it with validate
+// and renames it to fname. Renaming is atomic on the same filesystem, so fname either has
+// the old or the new content, even after a power cut.
+func writeFileAtomic(fname string, data []byte, perm os.FileMode, validate func(tmpName string) error) (err error) {
+	f, err := ioutil.TempFile(path.Dir(fname), path.Base(fname)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	if validate != nil {
+		if err = validate(f.Name()); err != nil {
+			return fmt.Errorf("%s is not replaced, because the new content is invalid: %v", fname, err)
+		}
+	}
+	return os.Rename(f.Name(), fname)
 }
 
 func isFirstRun() (bool, error) {
 	// In the first run, we have user.json, but not device.json near the binary.
-	if _, err := os.Stat(getUserJsonPath()); err != nil {
-		return false, fmt.Errorf("failed to access user.json: %v", err)
+	// The cookies could also come from the environment.
+	if os.Getenv(deviceCookieEnv) != "" {
+		return false, nil
+	}
+	if os.Getenv(userCookieEnv) == "" {
+		if _, err := os.Stat(getUserJsonPath()); err != nil {
+			return false, fmt.Errorf("failed to access user.json (and %s is not set): %v", userCookieEnv, err)
+		}
 	}
 	_, err := os.Stat(getDeviceJsonPath())
 	if err == nil {
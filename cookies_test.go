@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// setTestConfigDir points the config dir to a new temporary directory.
+func setTestConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "robosla-test-config")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	old := *configDir
+	*configDir = dir
+	t.Cleanup(func() {
+		*configDir = old
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestReadUserCookieEnvOverFile(t *testing.T) {
+	dir := setTestConfigDir(t)
+	if err := ioutil.WriteFile(path.Join(dir, "user.json"), []byte(`{"cookie": "from-file"}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cookie, err := readUserCookie()
+	if err != nil {
+		t.Fatalf("readUserCookie: %v", err)
+	}
+	if cookie != "from-file" {
+		t.Errorf("readUserCookie without env: want from-file, got %q", cookie)
+	}
+
+	t.Setenv(userCookieEnv, "from-env")
+	cookie, err = readUserCookie()
+	if err != nil {
+		t.Fatalf("readUserCookie: %v", err)
+	}
+	if cookie != "from-env" {
+		t.Errorf("readUserCookie: want the cookie from the environment, got %q", cookie)
+	}
+}
+
+func TestIsFirstRunEnv(t *testing.T) {
+	setTestConfigDir(t)
+	t.Setenv(userCookieEnv, "user")
+	firstRun, err := isFirstRun()
+	if err != nil {
+		t.Fatalf("isFirstRun: %v", err)
+	}
+	if !firstRun {
+		t.Errorf("isFirstRun: want true, if there's a user cookie, but no device cookie")
+	}
+	t.Setenv(deviceCookieEnv, "device")
+	if firstRun, err = isFirstRun(); err != nil || firstRun {
+		t.Errorf("isFirstRun: want false, if the device cookie is in the environment, got: %v, %v", firstRun, err)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	dir := setTestConfigDir(t)
+	if got, want := getDeviceJsonPath(), path.Join(dir, "device.json"); got != want {
+		t.Errorf("getDeviceJsonPath: want %q, got %q", want, got)
+	}
+	if err := saveDeviceCookie("device"); err != nil {
+		t.Fatalf("saveDeviceCookie: %v", err)
+	}
+	cookie, err := readCookie(path.Join(dir, "device.json"))
+	if err != nil || cookie != "device" {
+		t.Errorf("device.json in the config dir: want cookie 'device', got %q, err: %v", cookie, err)
+	}
+
+	*configDir = ""
+	t.Setenv("XDG_CONFIG_HOME", "/home/robosla/.config")
+	if got, want := getConfigDir(), "/home/robosla/.config/robosla"; got != want {
+		t.Errorf("getConfigDir with XDG_CONFIG_HOME: want %q, got %q", want, got)
+	}
+}
+
+func TestWriteFileAtomicPreservesOldFile(t *testing.T) {
+	dir := setTestConfigDir(t)
+	fname := path.Join(dir, "device.json")
+	if err := saveDeviceCookie("old"); err != nil {
+		t.Fatalf("saveDeviceCookie: %v", err)
+	}
+	// A truncated write.
+	err := writeFileAtomic(fname, []byte(`{"cookie": "ne`), 0644, func(tmpName string) error {
+		_, err := readCookie(tmpName)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("writeFileAtomic: want an error for invalid content")
+	}
+	cookie, err := readDeviceCookie()
+	if err != nil || cookie != "old" {
+		t.Errorf("readDeviceCookie: want the old cookie, got %q, err: %v", cookie, err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(names) != 1 {
+		t.Errorf("want only device.json in the config dir, got %d files", len(names))
+	}
+
+	if err := saveDeviceCookie("new"); err != nil {
+		t.Fatalf("saveDeviceCookie: %v", err)
+	}
+	if cookie, err = readDeviceCookie(); err != nil || cookie != "new" {
+		t.Errorf("readDeviceCookie: want the new cookie, got %q, err: %v", cookie, err)
+	}
+}
+
+func TestPickConfigDir(t *testing.T) {
+	dir := setTestConfigDir(t)
+	// A dir can't be created under a file, like /etc/robosla can't be created by a user.
+	notDir := path.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	home := path.Join(dir, "home", ".config", "robosla")
+	if got := pickConfigDir([]string{path.Join(notDir, "robosla"), home}); got != home {
+		t.Errorf("pickConfigDir: want the writable %q, got %q", home, got)
+	}
+	if got, want := pickConfigDir([]string{path.Join(notDir, "a"), path.Join(notDir, "b")}), path.Join(notDir, "a"); got != want {
+		t.Errorf("pickConfigDir: want the first dir %q, if none is writable, got %q", want, got)
+	}
+}
+
+func TestMigrateLegacyCookies(t *testing.T) {
+	dir := setTestConfigDir(t)
+	legacy := path.Join(path.Dir(mustGetExecutablePath()), "device.json")
+	if err := ioutil.WriteFile(legacy, []byte(`{"cookie": "legacy"}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	defer os.Remove(legacy)
+
+	if err := migrateLegacyCookies(); err != nil {
+		t.Fatalf("migrateLegacyCookies: %v", err)
+	}
+	cookie, err := readCookie(path.Join(dir, "device.json"))
+	if err != nil || cookie != "legacy" {
+		t.Errorf("device.json in the config dir: want cookie 'legacy', got %q, err: %v", cookie, err)
+	}
+	// The cookie, which is already in the config dir, is not overwritten.
+	if err := saveDeviceCookie("new"); err != nil {
+		t.Fatalf("saveDeviceCookie: %v", err)
+	}
+	if err := migrateLegacyCookies(); err != nil {
+		t.Fatalf("migrateLegacyCookies: %v", err)
+	}
+	if cookie, err := readDeviceCookie(); err != nil || cookie != "new" {
+		t.Errorf("readDeviceCookie: want 'new', got %q, err: %v", cookie, err)
+	}
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/robodone/robosla-agent/gcode"
 	"github.com/samofly/serial"
@@ -19,11 +23,30 @@ import (
 var ErrPrinterDeviceNotFound = errors.New("printer device is not found. May be it's turned off?")
 var ErrNoDownlinkConnection = errors.New("no downlink connection to the device")
 var ErrConnectionReset = errors.New("downlink connection was reset")
+var ErrPrinterHalted = errors.New("the printer is halted by the firmware (kill() called). Reset it with the reconnect command")
+var ErrDeviceReset = errors.New("the printer has reset unexpectedly (brownout, firmware watchdog or M997). Its state is lost")
+
+// TempCutoffError is returned by DFADownlink.WriteAndWaitForOK after a heater has exceeded its safety cutoff.
+// M112 is sent to the printer, which ignores everything until reset.
+type TempCutoffError struct {
+	Heater string
+	Actual float64
+	Limit  float64
+}
+
+func (e *TempCutoffError) Error() string {
+	return fmt.Sprintf("%s is %.1f°C, above the safety cutoff of %.1f°C. The printer is stopped with M112. Reset it with the reconnect command",
+		e.Heater, e.Actual, e.Limit)
+}
 
 type Downlink interface {
 	WriteAndWaitForOK(ctx context.Context, cmd string) error
 	WaitForConnection(wait time.Duration) bool
 	Connected() bool
+	// Disconnect drops the connection to the device and does not reconnect until Reconnect is called.
+	Disconnect() error
+	// Reconnect drops the connection to the device, if any, and connects again.
+	Reconnect() error
 }
 
 // DFADownlink is empowered by Deterministic Finite Automata to track
@@ -37,13 +60,148 @@ type DFADownlink struct {
 	// These are pending writes which we have not yet processed at all.
 	pendingWrites []*DFAMsg
 	lineno        int
+	// If resyncLineno is true, the line numbers are resynchronized with M110 N<lastLineno> after connect,
+	// before any other command. It's set, when the connection is lost, while a command is pending.
+	// lastLineno is the line number of the last confirmed command.
+	resyncLineno bool
+	lastLineno   int
+	// resumed is true, if the connection resumes the one, on which a command was lost. If the device resets on it,
+	// like a printer, which reboots when the port is opened, the commands queued for it fail with ErrDeviceReset.
+	// connResets is the number of resets before the connection. Nothing is resynced after a reset.
+	resumed    bool
+	connResets int64
+	// The command we are waiting an OK for. pendingRaw is true, if it's sent without a line number.
+	pendingCmd string
+	pendingRaw bool
+	// If some reply, but no OK, has been received for that long, the command is considered accepted.
+	// It does not apply to chatty commands. See isChattyCommand.
+	acceptOnReplyAfter time.Duration
+	// noAckDelay is the pause after every command, if the firmware does not send acks at all.
+	// That's the only flow control for such firmwares: longer delays reduce the throughput,
+	// shorter ones may overrun the firmware buffer.
+	noAckDelay time.Duration
+	// minCmdInterval is the shortest pause between the end of a command and the write of the next one.
+	// Some cheap boards drop commands sent back-to-back, even though they ack them. Zero disables it.
+	minCmdInterval time.Duration
+	// maxLineLen is the longest line accepted from the device. Longer lines drop the connection.
+	maxLineLen int
+	// If startMarker is not empty, no commands are sent after connect, until the device prints
+	// a line with it, like Marlin's "start", or until startMarkerTimeout.
+	startMarker string
+	// startCh is closed, when startMarker is received on the current connection.
+	startCh chan bool
+
+	// If a reported temperature exceeds its cutoff, M112 is sent right away and the printer is halted.
+	// It does not depend on the setpoints or jobs, so it catches a thermal runaway, which the firmware misses.
+	cutoffs TempLimits
+
+	// If halted is true, the firmware has killed the printer, which ignores everything until reset.
+	// All commands fail right away until Reconnect is called. cutoff is set, if it's halted by the agent
+	// because of a temperature above the safety cutoff.
+	haltedMu sync.Mutex
+	halted   bool
+	cutoff   *TempCutoffError
 
 	lastWriteMu sync.Mutex
 	lastWrite   string
+	// writeMu serializes the writes to the connection, so that the emergency M112 from readFromDevice
+	// does not interleave with a command. See writeConn.
+	writeMu sync.Mutex
+
+	// lastCmdDone is when the last command has completed. See minCmdInterval. It's only used by the state machine.
+	lastCmdDone time.Time
+
+	bufMu   sync.Mutex
+	lastBuf *BufferInfo
+
+	statsMu sync.Mutex
+	stats   LinkStats
+
+	// Firmware capabilities are queried at connect. See queryFirmwareCaps.
+	capsMu sync.Mutex
+	caps   FirmwareCaps
+
+	// If the DFA makes no progress for that long while waiting for a command to complete,
+	// the watchdog forces a reconnect. Zero disables the watchdog.
+	watchdogTimeout time.Duration
+	watchdogTimer   *time.Timer
+	watchdogGen     int
+	// The number of writes given up by the watchdog or because the printer is halted. Their MsgWritten could still arrive later.
+	abandonedWrites int
+	// If hold is true, the DFA does not try to connect to the device. See Disconnect.
+	hold bool
+
+	// These are overridden in tests.
+	findDev func() (string, error)
+	open    func(ttyDev string, baudRate int) (io.ReadWriteCloser, error)
+}
+
+const (
+	defaultDFAWatchdogTimeout = 5 * time.Minute
+	// 10 seconds was not enough; it confused things too often.
+	// It's not fully understood what exactly was wrong.
+	defaultAcceptOnReplyAfter = 60 * time.Second
+	defaultNoAckDelay         = 20 * time.Millisecond
+	// Long enough for M503 and EEPROM reports, which may exceed the 64 KB default of bufio.Scanner.
+	defaultMaxLineLen = 1 << 20
+	// If the start marker is not received for that long after connect, the device is assumed to be ready.
+	startMarkerTimeout = 10 * time.Second
+	// Link stats are logged that often.
+	statsHeartbeatPeriod = 10 * time.Minute
+	// Flush discards the input, until nothing is received for flushQuietPeriod, but not longer than flushMaxTime.
+	flushQuietPeriod = 200 * time.Millisecond
+	flushMaxTime     = 5 * time.Second
+)
+
+// LinkStats are the diagnostic counters of the serial link.
+type LinkStats struct {
+	// The serial device and baud rate of the last successful connection.
+	Device       string
+	BaudRate     int
+	CommandsSent int64
+	OKs          int64
+	Resends      int64
+	Reconnects   int64
+	Resets       int64 // Unexpected resets of the device. See isResetLine.
+	BytesIn      int64
+	BytesOut     int64
+	// The number of connections to the device. The first one is not a reconnect.
+	connections int64
+	// The number of connections lost, while a command was pending. See ErrConnectionReset.
+	pendingLost int64
+}
+
+func (st LinkStats) String() string {
+	return fmt.Sprintf("device: %s at %d bps, commands sent: %d, oks: %d, resends: %d, reconnects: %d, resets: %d, bytes in: %d, bytes out: %d",
+		st.Device, st.BaudRate, st.CommandsSent, st.OKs, st.Resends, st.Reconnects, st.Resets, st.BytesIn, st.BytesOut)
+}
+
+// inputFlusher is implemented by downlinks which can discard the stale input from the device. See DFADownlink.Flush.
+type inputFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// statsReporter is implemented by downlinks which collect link stats.
+type statsReporter interface {
+	Stats() LinkStats
 }
 
 func NewDFADownlink(up *Uplink, baudRate int) *DFADownlink {
-	return &DFADownlink{up: up, baudRate: baudRate, reqCh: make(chan *DFAMsg)}
+	return &DFADownlink{
+		up:                 up,
+		baudRate:           baudRate,
+		reqCh:              make(chan *DFAMsg),
+		watchdogTimeout:    defaultDFAWatchdogTimeout,
+		acceptOnReplyAfter: defaultAcceptOnReplyAfter,
+		noAckDelay:         defaultNoAckDelay,
+		maxLineLen:         defaultMaxLineLen,
+		findDev:            findTTYDev,
+		open:               openSerial,
+	}
+}
+
+func openSerial(ttyDev string, baudRate int) (io.ReadWriteCloser, error) {
+	return serial.Open(ttyDev, baudRate)
 }
 
 type State int
@@ -56,6 +214,8 @@ const (
 	Normal            = State(3)
 	WaitingForOK      = State(4)
 	WaitingForWritten = State(5)
+	Recovering        = State(6)
+	Held              = State(7)
 )
 
 type MsgType int
@@ -69,6 +229,11 @@ const (
 	MsgWritten           = MsgType(6)
 	MsgResend            = MsgType(7)
 	MsgSomeReply         = MsgType(8)
+	MsgWatchdog          = MsgType(9)
+	MsgDisconnect        = MsgType(10)
+	MsgReconnect         = MsgType(11)
+	// MsgFlush discards the input from the device, until it's quiet. See Flush.
+	MsgFlush = MsgType(12)
 )
 
 type DFAMsg struct {
@@ -77,6 +242,88 @@ type DFAMsg struct {
 	Cmd    string
 	Err    error
 	RespCh chan<- bool
+	// Gen is the generation of the watchdog for MsgWatchdog. Stale watchdog messages are ignored.
+	Gen int
+	// Buf is the free space in the firmware buffers, if reported in MsgOK.
+	Buf *BufferInfo
+	// Raw commands of MsgWriteAndWaitForOK are sent without a line number and a checksum.
+	Raw bool
+}
+
+// BufferInfo is the free space in the firmware buffers, reported by some firmwares in ok responses,
+// like "ok N12 P15 B4" (Marlin's ADVANCED_OK).
+type BufferInfo struct {
+	// Planner is the number of free slots in the planner (moves) buffer (P).
+	Planner int
+	// Block is the number of free slots in the command buffer (B).
+	Block int
+}
+
+// parseOK parses the fields after "ok", like "12 P15 B4" or "N12 P15 B4".
+// Only the line number and the buffer counts are extracted; unknown fields are ignored.
+func parseOK(rest string) (lineno int, buf *BufferInfo, err error) {
+	var planner, block = -1, -1
+	for i, field := range strings.Fields(rest) {
+		num := field
+		letter := byte(0)
+		if field[0] < '0' || field[0] > '9' {
+			letter = field[0]
+			num = field[1:]
+		}
+		if letter == 0 && i != 0 {
+			// A bare number is only expected to be the line number.
+			continue
+		}
+		val, perr := strconv.ParseUint(num, 10, 32)
+		if perr != nil {
+			if letter == 0 || letter == 'N' {
+				err = fmt.Errorf("failed to parse a line number from %q: %v", field, perr)
+			}
+			continue
+		}
+		switch letter {
+		case 0, 'N':
+			lineno = int(val)
+		case 'P':
+			planner = int(val)
+		case 'B':
+			block = int(val)
+		}
+	}
+	if planner >= 0 && block >= 0 {
+		buf = &BufferInfo{Planner: planner, Block: block}
+	}
+	return
+}
+
+// FreeBuffers returns the free space in the firmware buffers from the last ok response.
+// ok is false, if the firmware does not report it.
+func (dl *DFADownlink) FreeBuffers() (buf BufferInfo, ok bool) {
+	dl.bufMu.Lock()
+	defer dl.bufMu.Unlock()
+	if dl.lastBuf == nil {
+		return BufferInfo{}, false
+	}
+	return *dl.lastBuf, true
+}
+
+func (dl *DFADownlink) Stats() LinkStats {
+	dl.statsMu.Lock()
+	defer dl.statsMu.Unlock()
+	return dl.stats
+}
+
+func (dl *DFADownlink) updateStats(update func(st *LinkStats)) {
+	dl.statsMu.Lock()
+	defer dl.statsMu.Unlock()
+	update(&dl.stats)
+}
+
+func (dl *DFADownlink) runStatsHeartbeat(period time.Duration) {
+	for {
+		time.Sleep(period)
+		dl.up.logf("Serial link stats: %v", dl.Stats())
+	}
 }
 
 func (dl *DFADownlink) Connected() bool {
@@ -99,17 +346,46 @@ func (dl *DFADownlink) WaitForConnection(wait time.Duration) bool {
 }
 
 func (dl *DFADownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	return dl.writeAndWaitForOK(ctx, cmd, false)
+}
+
+// writeRawAndWaitForOK is WriteAndWaitForOK for the commands, which must be sent without a line number and
+// a checksum, whatever the firmware is, like the M115 query, which finds out the firmware.
+func (dl *DFADownlink) writeRawAndWaitForOK(ctx context.Context, cmd string) error {
+	return dl.writeAndWaitForOK(ctx, cmd, true)
+}
+
+func (dl *DFADownlink) writeAndWaitForOK(ctx context.Context, cmd string, raw bool) error {
+	// Once queued, the command is sent, even if it's canceled, so the canceled ones are not queued.
+	if ctx.Err() != nil {
+		return context.Canceled
+	}
+	if dl.Halted() {
+		return dl.haltedErr()
+	}
+	st := dl.Stats()
+	resets, pendingLost := st.Resets, st.pendingLost
 	respCh := make(chan bool, 1)
-	dl.reqCh <- &DFAMsg{Type: MsgWriteAndWaitForOK, Cmd: cmd, RespCh: respCh}
+	dl.reqCh <- &DFAMsg{Type: MsgWriteAndWaitForOK, Cmd: cmd, RespCh: respCh, Raw: raw}
 	select {
 	case ack, ok := <-respCh:
 		if ok && !ack {
 			// If we have not got an positive ack, but still got something out of the channel,
-			// it means that this firmware does not send acks at all. Impose an artificial
-			// delay of 20ms.
-			time.Sleep(20 * time.Millisecond)
+			// it means that this firmware does not send acks at all. Impose an artificial delay.
+			time.Sleep(dl.noAckDelay)
 		}
 		if !ok {
+			if dl.Halted() {
+				return dl.haltedErr()
+			}
+			st := dl.Stats()
+			if st.Resets != resets {
+				return ErrDeviceReset
+			}
+			if st.pendingLost != pendingLost {
+				// The command may or may not have been executed.
+				return ErrConnectionReset
+			}
 			return errors.New("OK not received")
 		}
 		return nil
@@ -118,8 +394,144 @@ func (dl *DFADownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error
 	}
 }
 
+// waitCmdInterval waits, until minCmdInterval has passed since the last command has completed.
+// The state machine is blocked meanwhile, so it's enforced for all the writers at once.
+func (dl *DFADownlink) waitCmdInterval() {
+	if dl.minCmdInterval <= 0 {
+		return
+	}
+	if wait := dl.lastCmdDone.Add(dl.minCmdInterval).Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Halted returns true, if the firmware has killed the printer. See ErrPrinterHalted.
+func (dl *DFADownlink) Halted() bool {
+	dl.haltedMu.Lock()
+	defer dl.haltedMu.Unlock()
+	return dl.halted
+}
+
+func (dl *DFADownlink) setHalted(halted bool) {
+	dl.haltedMu.Lock()
+	dl.halted = halted
+	if !halted {
+		dl.cutoff = nil
+	}
+	dl.haltedMu.Unlock()
+}
+
+// haltedErr returns the reason, why the printer is halted: ErrPrinterHalted or *TempCutoffError.
+func (dl *DFADownlink) haltedErr() error {
+	dl.haltedMu.Lock()
+	defer dl.haltedMu.Unlock()
+	if dl.cutoff != nil {
+		return dl.cutoff
+	}
+	return ErrPrinterHalted
+}
+
+// checkTempCutoff sends M112 to the printer and halts it, if a temperature exceeds its safety cutoff.
+// It returns true, if it's done. M112 bypasses the queue, because the pending command may take minutes,
+// like heating. Marlin's emergency parser handles it even while busy.
+func (dl *DFADownlink) checkTempCutoff(conn io.Writer, temps map[string]Temperature) bool {
+	heater, limit := dl.cutoffs.Exceeded(temps)
+	if heater == "" || dl.Halted() {
+		return false
+	}
+	cutoff := &TempCutoffError{Heater: heater, Actual: temps[heater].Actual, Limit: limit}
+	dl.up.logf("EMERGENCY STOP: %v", cutoff)
+	dl.haltedMu.Lock()
+	dl.halted = true
+	dl.cutoff = cutoff
+	dl.haltedMu.Unlock()
+	n, err := dl.writeConn(conn, "M112\n")
+	dl.updateStats(func(st *LinkStats) { st.BytesOut += int64(n) })
+	if err != nil {
+		dl.up.logf("Failed to send M112: %v", err)
+	}
+	return true
+}
+
+// TempLimits maps heater names (T, B, C, T0, etc) to the highest allowed actual temperature.
+// The limit of a letter applies to all heaters of that kind, like T to T0 and T1, unless they have their own.
+// Non-positive limits are disabled.
+type TempLimits map[string]float64
+
+// Exceeded returns the first heater in the order of names, which is above its limit, and the limit.
+// The heater is empty, if none is.
+func (limits TempLimits) Exceeded(temps map[string]Temperature) (heater string, limit float64) {
+	if len(limits) == 0 {
+		return "", 0
+	}
+	var heaters []string
+	for heater := range temps {
+		heaters = append(heaters, heater)
+	}
+	sort.Strings(heaters)
+	for _, heater := range heaters {
+		limit, ok := limits[heater]
+		if !ok {
+			limit = limits[heater[:1]]
+		}
+		if limit > 0 && temps[heater].Actual > limit {
+			return heater, limit
+		}
+	}
+	return "", 0
+}
+
+// isHaltLine returns true for the line, which the firmware prints before it stops, like Marlin's
+// "Error:Printer halted. kill() called!". The printer ignores everything until it's reset.
+func isHaltLine(txt string) bool {
+	return strings.HasPrefix(txt, "Error:") && strings.Contains(txt, "Printer halted")
+}
+
+// isResetLine returns true for the lines, which the firmware prints when it boots: Marlin's "start" and the reset
+// reason, like "echo: Watchdog Reset", or the GRBL banner. startMarker is the start line of a custom firmware, if any.
+// It must be the whole line: the marker may occur in other lines, like "echo: start print" for the marker "start".
+func isResetLine(txt, startMarker string) bool {
+	if txt == "start" || strings.HasPrefix(txt, "Grbl ") {
+		return true
+	}
+	if strings.HasPrefix(txt, "echo:") && strings.HasSuffix(strings.ToLower(txt), " reset") {
+		return true
+	}
+	return startMarker != "" && txt == startMarker
+}
+
+func (dl *DFADownlink) Disconnect() error {
+	dl.reqCh <- &DFAMsg{Type: MsgDisconnect}
+	return nil
+}
+
+func (dl *DFADownlink) Reconnect() error {
+	dl.reqCh <- &DFAMsg{Type: MsgReconnect}
+	return nil
+}
+
+// Flush discards the stale input from the device, like the replies left in the OS buffer from a previous session,
+// so that they are not taken for the acks of the next commands. It waits until the device is quiet.
+func (dl *DFADownlink) Flush(ctx context.Context) error {
+	respCh := make(chan bool, 1)
+	dl.reqCh <- &DFAMsg{Type: MsgFlush, RespCh: respCh}
+	select {
+	case _, ok := <-respCh:
+		if !ok {
+			return ErrNoDownlinkConnection
+		}
+		return nil
+	case <-ctx.Done():
+		return context.Canceled
+	}
+}
+
 func (dl *DFADownlink) Run() error {
-	st := Disconnected
+	go dl.runStatsHeartbeat(statsHeartbeatPeriod)
+	return dl.run(Disconnected)
+}
+
+func (dl *DFADownlink) run(st State) error {
 	for {
 		switch st {
 		case Disconnected:
@@ -134,14 +546,83 @@ func (dl *DFADownlink) Run() error {
 			st = dl.handleWaitingForOK()
 		case WaitingForWritten:
 			st = dl.handleWaitingForWritten()
+		case Recovering:
+			st = dl.handleRecovering()
+		case Held:
+			st = dl.handleHeld()
 		default:
 			return fmt.Errorf("unknown state %v", st)
 		}
 	}
 }
 
+// armWatchdog (re)starts the watchdog. Unless it's rearmed or disarmed within watchdogTimeout,
+// MsgWatchdog with the current generation will be delivered to the DFA.
+func (dl *DFADownlink) armWatchdog() {
+	dl.disarmWatchdog()
+	if dl.watchdogTimeout <= 0 {
+		return
+	}
+	gen := dl.watchdogGen
+	dl.watchdogTimer = time.AfterFunc(dl.watchdogTimeout, func() {
+		dl.reqCh <- &DFAMsg{Type: MsgWatchdog, Gen: gen}
+	})
+}
+
+func (dl *DFADownlink) disarmWatchdog() {
+	// Bumping the generation makes the message from an already fired timer stale.
+	dl.watchdogGen++
+	if dl.watchdogTimer != nil {
+		dl.watchdogTimer.Stop()
+		dl.watchdogTimer = nil
+	}
+}
+
+func (dl *DFADownlink) isStaleWatchdog(msg *DFAMsg) bool {
+	return msg.Gen != dl.watchdogGen
+}
+
+// ignoreAbandonedWrite returns true, if MsgWritten belongs to a write given up by the watchdog or on halt.
+func (dl *DFADownlink) ignoreAbandonedWrite() bool {
+	if dl.abandonedWrites == 0 {
+		return false
+	}
+	dl.abandonedWrites--
+	dl.up.logf("Received MsgWritten of an abandoned write. Ignoring.")
+	return true
+}
+
+// handleControl handles MsgDisconnect and MsgReconnect. An explicit reconnect resets the printer, so it clears the halted state.
+func (dl *DFADownlink) handleControl(msg *DFAMsg) {
+	dl.hold = msg.Type == MsgDisconnect
+	if msg.Type == MsgReconnect && dl.Halted() {
+		dl.up.logf("Reconnecting to reset the halted printer")
+		dl.setHalted(false)
+	}
+}
+
+// resetConnection closes the connection and fails the pending write, if any.
+// The DFA must then wait for MsgDisconnected from readFromDevice in the Recovering state.
+func (dl *DFADownlink) resetConnection(gotWritten bool) State {
+	if dl.pendingOKAck != nil {
+		close(dl.pendingOKAck)
+		dl.pendingOKAck = nil
+		if !gotWritten {
+			dl.abandonedWrites++
+		}
+	}
+	// Closing the connection makes readFromDevice to exit and send MsgDisconnected.
+	if err := dl.conn.Close(); err != nil {
+		dl.up.logf("Failed to close the connection: %v", err)
+	}
+	return Recovering
+}
+
 func (dl *DFADownlink) handleDisconnected() State {
 	dl.up.logf("State: Disconnected")
+	if dl.hold {
+		return Held
+	}
 	// We are disconnected. Our only choice is to try to connect to the device.
 	// We do not accept any input in this node.
 	go dl.connect()
@@ -152,7 +633,7 @@ func (dl *DFADownlink) connect() {
 	var lastAttempt time.Time
 	for {
 		dl.up.WaitForConnection()
-		ttyDev, err := findTTYDev()
+		ttyDev, err := dl.findDev()
 		if err != nil {
 			now := time.Now()
 			// Avoid log spam
@@ -164,7 +645,7 @@ func (dl *DFADownlink) connect() {
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		conn, err := serial.Open(ttyDev, dl.baudRate)
+		conn, err := dl.open(ttyDev, dl.baudRate)
 		if err != nil {
 			dl.up.logf("Could not open serial port %s at %d bps. Error: %v", ttyDev, dl.baudRate, err)
 			// Avoid immediate reconnects.
@@ -172,8 +653,18 @@ func (dl *DFADownlink) connect() {
 			continue
 		}
 		dl.up.logf("Opened %s at %d bps.", ttyDev, dl.baudRate)
+		dl.updateStats(func(st *LinkStats) {
+			st.Device = ttyDev
+			st.BaudRate = dl.baudRate
+		})
+		dl.up.NotifySerialPort(ttyDev, dl.baudRate)
+		// The device could have been replaced with another one.
+		dl.capsMu.Lock()
+		dl.caps = FirmwareCaps{}
+		dl.capsMu.Unlock()
 		dl.conn = conn
 		dl.reqCh <- &DFAMsg{Type: MsgConnected}
+		go dl.queryFirmwareCaps()
 		return
 	}
 }
@@ -184,10 +675,24 @@ func (dl *DFADownlink) handleConnecting() State {
 	dl.lastWriteMu.Lock()
 	dl.lastWrite = ""
 	dl.lastWriteMu.Unlock()
+	if dl.resumed && dl.Stats().Resets != dl.connResets {
+		// The resync and the resent command would run on a rebooted printer.
+		dl.up.logf("The device has reset after the reconnect. Failing %d queued commands.", len(dl.pendingWrites))
+		for _, msg := range dl.pendingWrites {
+			close(msg.RespCh)
+		}
+		dl.pendingWrites = nil
+	}
+	dl.resumed = false
 
 	for msg := range dl.reqCh {
 		switch msg.Type {
 		case MsgConnected:
+			if dl.hold {
+				// Disconnect was requested while we were connecting.
+				dl.conn.Close()
+				return Held
+			}
 			// Yay! We are connected. Transferring to the normal state.
 			return Connected
 		case MsgIsConnected:
@@ -195,6 +700,9 @@ func (dl *DFADownlink) handleConnecting() State {
 			msg.RespCh <- false
 		case MsgDisconnected:
 			dl.up.Fatalf("handleConnecting: received MsgDisconnected. Inconceivable!")
+		case MsgDisconnect, MsgReconnect:
+			// We are connecting anyway.
+			dl.handleControl(msg)
 		case MsgOK:
 			dl.up.Fatalf("handleConnecting: received MsgOK. Inconceivable!")
 		case MsgWriteAndWaitForOK:
@@ -202,12 +710,19 @@ func (dl *DFADownlink) handleConnecting() State {
 			// This is a valid possibility, but we have to decline this request.
 			dl.up.logf("handleConnecting: unable to write a command (%q), because we are not connected. May be the printer is turned off?", msg.Cmd)
 			msg.RespCh <- false
+		case MsgFlush:
+			// Nothing to flush.
+			close(msg.RespCh)
 		case MsgWritten:
-			dl.up.Fatalf("handleConnecting: received MsgWritten. Inconceivable!")
+			if !dl.ignoreAbandonedWrite() {
+				dl.up.Fatalf("handleConnecting: received MsgWritten. Inconceivable!")
+			}
 		case MsgResend:
 			dl.up.Fatalf("handleConnecting: received MsgResend. Inconceivable!")
 		case MsgSomeReply:
 			// Just ignore.
+		case MsgWatchdog:
+			// Stale watchdog. Just ignore.
 		default:
 			dl.up.Fatalf("handleConnecting: unexpected message type: %v, full message: %+v", msg.Type, msg)
 		}
@@ -219,20 +734,162 @@ func (dl *DFADownlink) handleConnecting() State {
 
 func (dl *DFADownlink) handleConnected() State {
 	dl.up.logf("State: Connected")
-	go dl.readFromDevice(dl.conn)
-	return Normal
+	dl.updateStats(func(st *LinkStats) {
+		if st.connections > 0 {
+			st.Reconnects++
+		}
+		st.connections++
+	})
+	dl.startCh = nil
+	if dl.startMarker != "" {
+		dl.startCh = make(chan bool)
+	}
+	dl.resumed, dl.connResets = dl.resyncLineno, dl.Stats().Resets
+	go dl.readFromDevice(dl.conn, dl.resumed)
+	if dl.resyncLineno {
+		// A printer, which has not reset, still expects the next line number of the lost connection.
+		// The resync goes first, so that no other command is rejected. Nobody waits for the result.
+		dl.resyncLineno = false
+		resync := &DFAMsg{Type: MsgWriteAndWaitForOK, Cmd: fmt.Sprintf("M110 N%d", dl.lastLineno), RespCh: make(chan bool, 1)}
+		dl.pendingWrites = append([]*DFAMsg{resync}, dl.pendingWrites...)
+	}
+	if dl.startCh == nil {
+		return Normal
+	}
+	return dl.waitForStartMarker()
 }
 
-func (dl *DFADownlink) readFromDevice(conn io.ReadWriteCloser) {
+// waitForStartMarker waits until the device has printed the start marker. Printers often emit
+// a burst of garbage after the port is opened, and the commands sent before they are ready are lost.
+// The commands received meanwhile are queued.
+func (dl *DFADownlink) waitForStartMarker() State {
+	timeout := time.After(startMarkerTimeout)
+	for {
+		select {
+		case <-dl.startCh:
+			dl.up.logf("The device is ready: %q received", dl.startMarker)
+			return Normal
+		case <-timeout:
+			dl.up.logf("The device has not printed %q in %v. Assuming it's ready.", dl.startMarker, startMarkerTimeout)
+			return Normal
+		case msg := <-dl.reqCh:
+			switch msg.Type {
+			case MsgIsConnected:
+				msg.RespCh <- true
+			case MsgWriteAndWaitForOK, MsgFlush:
+				dl.pendingWrites = append(dl.pendingWrites, msg)
+			case MsgDisconnected:
+				dl.up.logf("waitForStartMarker: received MsgDisconnected")
+				return Disconnected
+			case MsgDisconnect, MsgReconnect:
+				dl.up.logf("waitForStartMarker: dropping the connection by request")
+				dl.handleControl(msg)
+				return dl.resetConnection(true)
+			case MsgWritten:
+				if !dl.ignoreAbandonedWrite() {
+					dl.up.Fatalf("waitForStartMarker: received MsgWritten. Inconceivable!")
+				}
+			case MsgOK, MsgResend, MsgSomeReply, MsgWatchdog:
+				// Leftovers or the noise before the device is ready. Just ignore.
+			default:
+				dl.up.Fatalf("waitForStartMarker: unexpected message type: %v, full message: %+v", msg.Type, msg)
+			}
+		}
+	}
+}
+
+// isGarbageLine returns true, if the line is not a text, like the binary burst some printers send after reset.
+func isGarbageLine(txt string) bool {
+	if !utf8.ValidString(txt) {
+		return true
+	}
+	for _, r := range txt {
+		if r != '\t' && unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dl *DFADownlink) readFromDevice(conn io.ReadWriteCloser, resumed bool) {
 	defer func() {
 		// Most likely, the connection is already closed, but we make the best effort, if it is not.
 		conn.Close()
 		dl.reqCh <- &DFAMsg{Type: MsgDisconnected}
 	}()
+	startCh := dl.startCh
+	// The device boots, when the connection is opened. After it has sent an ok, the start banner means
+	// that it has reset. A resumed connection expects the device still running, so any banner is a reset.
+	ready := resumed
+	// Consecutive identical busy lines, like "echo:busy: processing" every 2 seconds during homing, are logged once.
+	// When another line arrives, they are summarized with their count, like "echo:busy: processing x12".
+	var busyLine string
+	var busyCount int
+	flushBusy := func() {
+		if busyCount > 1 {
+			dl.up.logf("%s x%d", busyLine, busyCount)
+		}
+		busyLine, busyCount = "", 0
+	}
+	defer flushBusy()
 	in := bufio.NewScanner(conn)
+	in.Buffer(make([]byte, 4096), dl.maxLineLen)
+	in.Split(scanLines())
 	for in.Scan() {
 		txt := strings.TrimSpace(in.Text())
-		dl.up.logf("%s\n", txt)
+		if isGarbageLine(txt) {
+			dl.up.logf("Skipping garbage from the device: %q", txt)
+			dl.updateStats(func(st *LinkStats) { st.BytesIn += int64(len(in.Bytes()) + 1) })
+			continue
+		}
+		if txt == "wait" {
+			// Some firmwares print it every second, while they are idle and wait for input. It's not a reply to
+			// the pending command and not a sign of progress, so it's neither logged nor passed to the state machine.
+			dl.updateStats(func(st *LinkStats) { st.BytesIn += int64(len(in.Bytes()) + 1) })
+			continue
+		}
+		if isBusyLine(txt) && txt == busyLine {
+			busyCount++
+		} else {
+			flushBusy()
+			if isBusyLine(txt) {
+				busyLine, busyCount = txt, 1
+			}
+			dl.up.logf("%s\n", txt)
+		}
+		if ready && isResetLine(txt, dl.startMarker) {
+			// The line numbers, the positions and the temperatures are lost. Continuing would be a disaster,
+			// so the pending command fails with ErrDeviceReset and the connection is reestablished from scratch.
+			// It's checked before the start marker, so that nothing is sent on a resumed connection after the reset.
+			dl.up.logf("The printer has reset unexpectedly (%q received). Reconnecting.", txt)
+			dl.updateStats(func(st *LinkStats) {
+				st.BytesIn += int64(len(in.Bytes()) + 1)
+				st.Resets++
+			})
+			return
+		}
+		if startCh != nil && strings.Contains(txt, dl.startMarker) {
+			close(startCh)
+			startCh = nil
+		}
+		if isHaltLine(txt) {
+			dl.up.logf("The printer is halted. All commands fail until reconnect.")
+			dl.setHalted(true)
+		}
+		isOK := txt == "ok" || strings.HasPrefix(txt, "ok ")
+		if isOK {
+			ready = true
+		}
+		isResend := strings.HasPrefix(txt, "Resend:")
+		dl.updateStats(func(st *LinkStats) {
+			st.BytesIn += int64(len(in.Bytes()) + 1)
+			if isOK {
+				st.OKs++
+			}
+			if isResend {
+				st.Resends++
+			}
+		})
 		if txt == "ok" {
 			// The firmware did not send us a lineno. Okay.
 			dl.up.logf("Sending MsgOK without a lineno...")
@@ -240,12 +897,22 @@ func (dl *DFADownlink) readFromDevice(conn io.ReadWriteCloser) {
 			continue
 		}
 		if strings.HasPrefix(txt, "ok ") {
-			lineno, err := strconv.ParseUint(txt[3:], 10, 64)
+			if temps, ok := parseTemperatures(txt[3:]); ok {
+				// A response to M105.
+				dl.up.NotifyTemperature(temps)
+				dl.checkTempCutoff(conn, temps)
+			}
+			lineno, buf, err := parseOK(txt[3:])
 			if err != nil {
-				dl.up.logf("Failed to parse a line number from an ok response %q: %v. Just ignoring the lineno.", txt, err)
+				dl.up.logf("Failed to parse an ok response %q: %v. Just ignoring the lineno.", txt, err)
 				lineno = 0
 			}
-			dl.reqCh <- &DFAMsg{Type: MsgOK, Lineno: int(lineno)}
+			if buf != nil {
+				dl.bufMu.Lock()
+				dl.lastBuf = buf
+				dl.bufMu.Unlock()
+			}
+			dl.reqCh <- &DFAMsg{Type: MsgOK, Lineno: lineno, Buf: buf}
 			continue
 		}
 		// Resend:17206
@@ -259,6 +926,37 @@ func (dl *DFADownlink) readFromDevice(conn io.ReadWriteCloser) {
 			dl.reqCh <- &DFAMsg{Type: MsgResend, Lineno: int(lineno)}
 			continue
 		}
+		if temps, ok := parseTemperatures(txt); ok {
+			// Temperatures are auto-reported by the firmware. They are not related to the pending command,
+			// so they don't count as a reply, unless the printer is halted by the safety cutoff:
+			// then the pending command must fail right away.
+			dl.up.NotifyTemperature(temps)
+			if dl.checkTempCutoff(conn, temps) {
+				dl.reqCh <- &DFAMsg{Type: MsgSomeReply}
+			}
+			continue
+		}
+		if strings.HasPrefix(txt, "error:") {
+			// GRBL rejects a command with "error:<code>" instead of ok, like the M115 probe with "error:20".
+			dl.reqCh <- &DFAMsg{Type: MsgSomeReply, Err: fmt.Errorf("the device replied %q", txt)}
+			continue
+		}
+		if dl.parseFirmwareLine(txt) {
+			// A part of the M115 response. It's followed by ok.
+			dl.reqCh <- &DFAMsg{Type: MsgSomeReply}
+			continue
+		}
+		if res, ok := parseProbeResult(txt); ok {
+			// A response to G38.2. It's followed by ok.
+			dl.up.NotifyProbe(res)
+		}
+		if done, total, ok := parseSDProgress(txt); ok && total > 0 {
+			// A response to M27: the printer is printing from its own SD card.
+			// Without a current job, there is nothing to attribute the progress to.
+			if jobName := dl.up.getJobName(); jobName != "" {
+				dl.up.NotifyJobProgress(jobName, 100*float64(done)/float64(total), 0 /*elapsed*/, 0 /*remaining*/)
+			}
+		}
 		dl.reqCh <- &DFAMsg{Type: MsgSomeReply}
 	}
 	if err := in.Err(); err != nil {
@@ -266,15 +964,129 @@ func (dl *DFADownlink) readFromDevice(conn io.ReadWriteCloser) {
 	}
 }
 
+// parseM110 returns the line number set by M110 N<n>.
+func parseM110(cmd string) (n int, ok bool) {
+	fields := strings.Fields(cmd)
+	if len(fields) != 2 || fields[0] != "M110" || !strings.HasPrefix(fields[1], "N") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(fields[1][1:])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// isBusyLine returns true for the keepalive lines, which Marlin prints while a long command runs,
+// like "echo:busy: processing" or "busy: paused for user". They still count as replies.
+func isBusyLine(txt string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(txt, "echo:"), "busy:")
+}
+
+// parseSDProgress parses the M27 response, like "SD printing byte 1234/5678".
+func parseSDProgress(txt string) (done, total int64, ok bool) {
+	const prefix = "SD printing byte "
+	if !strings.HasPrefix(txt, prefix) {
+		return 0, 0, false
+	}
+	parts := strings.Split(strings.TrimSpace(txt[len(prefix):]), "/")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	done, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return done, total, true
+}
+
+// parseProbeResult parses the G38.2 response, like "[PRB:1.000,2.000,-3.250:1]".
+// The last field is 1, if the probe was triggered, and 0, if it reached the target without a contact.
+func parseProbeResult(txt string) (res ProbeResult, ok bool) {
+	if !strings.HasPrefix(txt, "[PRB:") || !strings.HasSuffix(txt, "]") {
+		return res, false
+	}
+	parts := strings.Split(txt[len("[PRB:"):len(txt)-1], ":")
+	if len(parts) != 2 || (parts[1] != "0" && parts[1] != "1") {
+		return res, false
+	}
+	coords := strings.Split(parts[0], ",")
+	if len(coords) != 3 {
+		return res, false
+	}
+	var vals [3]float64
+	for i, c := range coords {
+		v, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		if err != nil {
+			return res, false
+		}
+		vals[i] = v
+	}
+	return ProbeResult{X: vals[0], Y: vals[1], Z: vals[2], Triggered: parts[1] == "1"}, true
+}
+
+// scanLines returns a split function, which treats \r, \n and \r\n as line boundaries.
+// Some firmwares (and RS-485 bridges) terminate lines with a bare \r.
+func scanLines() bufio.SplitFunc {
+	// A line ending with \r is returned right away, because more data may never arrive.
+	// If it's a \r\n after all, the \n is skipped with the next call.
+	var afterCR bool
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		var skip int
+		if afterCR && len(data) > 0 {
+			afterCR = false
+			if data[0] == '\n' {
+				// bufio.Scanner reads more data after an empty advance, so the rest of data is scanned right away.
+				skip = 1
+			}
+		}
+		if i := bytes.IndexAny(data[skip:], "\r\n"); i >= 0 {
+			afterCR = data[skip+i] == '\r'
+			return skip + i + 1, data[skip : skip+i], nil
+		}
+		if atEOF && len(data) > skip {
+			return len(data), data[skip:], nil
+		}
+		return skip, nil, nil
+	}
+}
+
 func (dl *DFADownlink) handleNormal() State {
 	dl.up.logf("State: Normal")
 	wr := func(msg *DFAMsg) State {
 		if msg.RespCh == nil {
 			dl.up.Fatalf("RespCh == nil in MsgWriteAndWaitForOK message. Inconceivable!")
 		}
+		if msg.Type == MsgFlush {
+			return dl.flushInput(msg)
+		}
+		if dl.Halted() {
+			// The printer ignores everything until reset. Fail the command right away.
+			close(msg.RespCh)
+			return Normal
+		}
 		dl.pendingOKAck = msg.RespCh
-		dl.lineno++
-		go dl.write(dl.conn, gcode.AddLineAndHash(dl.lineno, msg.Cmd), false)
+		dl.pendingCmd = msg.Cmd
+		dl.pendingRaw = msg.Raw
+		line := msg.Cmd
+		if !msg.Raw {
+			// The firmware does not count the lines without a number, so the raw ones keep the line number.
+			if n, ok := parseM110(msg.Cmd); ok {
+				// M110 N<n> sets the line number of the firmware. The line itself must have the same number.
+				dl.lineno = n
+			} else {
+				dl.lineno++
+			}
+			if dl.FirmwareCaps().LineNumbers() {
+				line = gcode.AddLineAndHash(dl.lineno, msg.Cmd)
+			}
+		}
+		dl.waitCmdInterval()
+		go dl.write(dl.conn, line, false)
 		return WaitingForOK
 	}
 	if len(dl.pendingWrites) > 0 {
@@ -293,18 +1105,26 @@ func (dl *DFADownlink) handleNormal() State {
 		case MsgDisconnected:
 			dl.up.logf("handleNormal: received MsgDisconnected")
 			return Disconnected
+		case MsgDisconnect, MsgReconnect:
+			dl.up.logf("handleNormal: dropping the connection by request")
+			dl.handleControl(msg)
+			return dl.resetConnection(true)
 		case MsgOK:
 			dl.up.logf("handleNormal: received MsgOK. Could be a leftover since previous connection. Ignore (mildly dangerous)")
-		case MsgWriteAndWaitForOK:
+		case MsgWriteAndWaitForOK, MsgFlush:
 			// This is exactly the message we want to receive here.
 			return wr(msg)
 		case MsgWritten:
-			dl.up.Fatalf("handleNormal: received MsgWritten. Inconceivable!")
+			if !dl.ignoreAbandonedWrite() {
+				dl.up.Fatalf("handleNormal: received MsgWritten. Inconceivable!")
+			}
 		case MsgResend:
 			// It is possible to receive MsgResend, if we screwed up something earlier. Or may be there was some glitch on the wire.
 			dl.up.logf("handleNormal: MsgResend is not expected at this stage. Ignoring...")
 		case MsgSomeReply:
 			// Just ignore.
+		case MsgWatchdog:
+			// Stale watchdog. Just ignore.
 		default:
 			dl.up.Fatalf("handleNormal: unexpected message type: %v, full message: %+v", msg.Type, msg)
 		}
@@ -313,6 +1133,54 @@ func (dl *DFADownlink) handleNormal() State {
 	return Terminated
 }
 
+// flushInput discards everything received from the device, until it's quiet for flushQuietPeriod or for up to flushMaxTime.
+// Nothing is sent meanwhile: the commands are queued.
+func (dl *DFADownlink) flushInput(req *DFAMsg) State {
+	dl.up.logf("State: Normal, flushing the input")
+	quiet := time.After(flushQuietPeriod)
+	timeout := time.After(flushMaxTime)
+	discarded := 0
+	for {
+		select {
+		case <-quiet:
+			dl.up.logf("Flushed the input: %d stale replies discarded", discarded)
+			req.RespCh <- true
+			return Normal
+		case <-timeout:
+			dl.up.logf("The device has not gone quiet in %v. %d replies discarded.", flushMaxTime, discarded)
+			req.RespCh <- true
+			return Normal
+		case msg := <-dl.reqCh:
+			switch msg.Type {
+			case MsgOK, MsgResend, MsgSomeReply:
+				discarded++
+				quiet = time.After(flushQuietPeriod)
+			case MsgIsConnected:
+				msg.RespCh <- true
+			case MsgWriteAndWaitForOK, MsgFlush:
+				dl.pendingWrites = append(dl.pendingWrites, msg)
+			case MsgDisconnected:
+				dl.up.logf("flushInput: received MsgDisconnected")
+				close(req.RespCh)
+				return Disconnected
+			case MsgDisconnect, MsgReconnect:
+				dl.up.logf("flushInput: dropping the connection by request")
+				close(req.RespCh)
+				dl.handleControl(msg)
+				return dl.resetConnection(true)
+			case MsgWritten:
+				if !dl.ignoreAbandonedWrite() {
+					dl.up.Fatalf("flushInput: received MsgWritten. Inconceivable!")
+				}
+			case MsgWatchdog:
+				// Stale watchdog. Just ignore.
+			default:
+				dl.up.Fatalf("flushInput: unexpected message type: %v, full message: %+v", msg.Type, msg)
+			}
+		}
+	}
+}
+
 func (dl *DFADownlink) write(conn io.ReadWriteCloser, cmd string, isResend bool) {
 	dl.up.logf("> %s", cmd)
 	var err error
@@ -330,10 +1198,23 @@ func (dl *DFADownlink) write(conn io.ReadWriteCloser, cmd string, isResend bool)
 	dl.lastWriteMu.Lock()
 	dl.lastWrite = cmd
 	dl.lastWriteMu.Unlock()
-	_, err = dl.conn.Write([]byte(cmd))
+	n, err := dl.writeConn(conn, cmd)
+	dl.updateStats(func(st *LinkStats) {
+		st.BytesOut += int64(n)
+		if !isResend {
+			st.CommandsSent++
+		}
+	})
 	return
 }
 
+// writeConn writes to the connection. All writes go through it. See writeMu.
+func (dl *DFADownlink) writeConn(conn io.Writer, data string) (int, error) {
+	dl.writeMu.Lock()
+	defer dl.writeMu.Unlock()
+	return conn.Write([]byte(data))
+}
+
 func (dl *DFADownlink) resend() {
 	dl.lastWriteMu.Lock()
 	lastWrite := dl.lastWrite
@@ -344,19 +1225,37 @@ func (dl *DFADownlink) resend() {
 	dl.write(dl.conn, lastWrite, true /*isResend*/)
 }
 
+// isChattyCommand returns true for long commands, which print many lines before ok, like G29 (auto bed leveling).
+// A reply is not a sign that such a command has been accepted.
+func isChattyCommand(cmd string) bool {
+	words := strings.Fields(strings.ToUpper(cmd))
+	return len(words) > 0 && words[0] == "G29"
+}
+
 func (dl *DFADownlink) handleWaitingForOK() State {
 	dl.up.logf("State: WaitingForOK")
 	start := time.Now()
 	gotOK := false
 	gotWritten := false
 	gotSomeReply := false
+	// Whatever the outcome, the command is over, when this state is.
+	defer func() { dl.lastCmdDone = time.Now() }()
+	// acceptedOnReply is true, if the command is considered accepted without an OK. The firmware may not send acks
+	// at all, so the caller gets a negative ack and imposes noAckDelay.
+	acceptedOnReply := false
+	dl.armWatchdog()
+	defer dl.disarmWatchdog()
 	for msg := range dl.reqCh {
+		switch msg.Type {
+		case MsgOK, MsgWritten, MsgResend, MsgSomeReply:
+			// Some progress has been made.
+			dl.armWatchdog()
+		}
 		dur := time.Now().Sub(start)
-		// 10 seconds was not enough; it confused things too often.
-		// It's not fully understood what exactly was wrong.
-		if dur > 60*time.Second && gotSomeReply && !gotOK {
+		if dur > dl.acceptOnReplyAfter && gotSomeReply && !gotOK && !isChattyCommand(dl.pendingCmd) {
 			dl.up.logf("handleWaitingForOK: %v passed, some reply (!OK) received, consider the command is accepted", dur)
 			gotOK = true
+			acceptedOnReply = true
 		}
 		switch msg.Type {
 		case MsgConnected:
@@ -367,6 +1266,14 @@ func (dl *DFADownlink) handleWaitingForOK() State {
 			msg.RespCh <- true
 		case MsgDisconnected:
 			dl.up.logf("handleWaitingForOK: received MsgDisconnected")
+			// The pending command is not confirmed. Its line number is used again after a reconnect,
+			// unless the device has reset and has lost the line numbers anyway.
+			dl.resyncLineno = dl.FirmwareCaps().LineNumbers() && dl.Stats().Resets == dl.connResets
+			dl.lastLineno = dl.lineno - 1
+			if dl.pendingRaw {
+				dl.lastLineno = dl.lineno
+			}
+			dl.updateStats(func(st *LinkStats) { st.pendingLost++ })
 			close(dl.pendingOKAck)
 			dl.pendingOKAck = nil
 			if gotWritten {
@@ -389,19 +1296,24 @@ func (dl *DFADownlink) handleWaitingForOK() State {
 				return Normal
 			}
 			dl.up.logf("handleWaitingForOK: got OK, now waiting for MsgWritten.")
-		case MsgWriteAndWaitForOK:
+		case MsgWriteAndWaitForOK, MsgFlush:
 			// It's expected that new commands could arrive while we wait for OK. Adding them to the |pendingWrites| queue.
 			dl.pendingWrites = append(dl.pendingWrites, msg)
 			dl.up.logf("Added command %q to the queue. Current queue length: %d", msg.Cmd, len(dl.pendingWrites))
 			continue
 		case MsgWritten:
+			// A write abandoned on a previous connection may complete only now. MsgWritten does not tell,
+			// which write it belongs to, but the counts match in the end.
+			if dl.ignoreAbandonedWrite() {
+				continue
+			}
 			if gotWritten {
 				dl.up.Fatalf("handleWaitingForOK: got duplicate MsgWritten. Inconceivable!")
 				return Terminated
 			}
 			gotWritten = true
 			if gotOK && gotWritten {
-				dl.pendingOKAck <- true
+				dl.pendingOKAck <- !acceptedOnReply
 				dl.pendingOKAck = nil
 				return Normal
 			}
@@ -411,6 +1323,42 @@ func (dl *DFADownlink) handleWaitingForOK() State {
 			dl.resend()
 		case MsgSomeReply:
 			gotSomeReply = true
+			if msg.Err != nil && dl.pendingRaw {
+				// No ok follows the error, so waiting for acceptOnReplyAfter would only hold the queued commands.
+				dl.up.logf("handleWaitingForOK: %v. The pending command is failed.", msg.Err)
+				close(dl.pendingOKAck)
+				dl.pendingOKAck = nil
+				if !gotWritten {
+					dl.abandonedWrites++
+				}
+				return Normal
+			}
+			if dl.Halted() {
+				// ok will never come. The pending command and the queued ones are failed.
+				dl.up.logf("handleWaitingForOK: the printer is halted. The pending command is failed.")
+				close(dl.pendingOKAck)
+				dl.pendingOKAck = nil
+				if !gotWritten {
+					dl.abandonedWrites++
+				}
+				return Normal
+			}
+			if acceptedOnReply && gotWritten {
+				dl.pendingOKAck <- false
+				dl.pendingOKAck = nil
+				return Normal
+			}
+		case MsgWatchdog:
+			if dl.isStaleWatchdog(msg) {
+				continue
+			}
+			dl.up.logf("handleWaitingForOK: watchdog: no progress for %v (lineno: %d, gotOK: %v, gotWritten: %v, gotSomeReply: %v, pending writes: %d). Forcing a reconnect.",
+				time.Now().Sub(start), dl.lineno, gotOK, gotWritten, gotSomeReply, len(dl.pendingWrites))
+			return dl.resetConnection(gotWritten)
+		case MsgDisconnect, MsgReconnect:
+			dl.up.logf("handleWaitingForOK: dropping the connection by request. The pending command is failed.")
+			dl.handleControl(msg)
+			return dl.resetConnection(gotWritten)
 		default:
 			dl.up.Fatalf("handleWaitingForOK: unexpected message type: %v, full message: %+v", msg.Type, msg)
 		}
@@ -423,6 +1371,8 @@ func (dl *DFADownlink) handleWaitingForWritten() State {
 	// We arrive to this state, when Disconnected was received while WaitingForOK. We need to wait until the write is completed
 	// before transferring to the Disconnected state to maintain the invariant that MsgWritten is only expected during WaitingForOK or WaitingForWritten.
 	dl.up.logf("State: WaitingForWritten")
+	dl.armWatchdog()
+	defer dl.disarmWatchdog()
 	for msg := range dl.reqCh {
 		switch msg.Type {
 		case MsgConnected:
@@ -433,17 +1383,29 @@ func (dl *DFADownlink) handleWaitingForWritten() State {
 			msg.RespCh <- false
 		case MsgDisconnected:
 			dl.up.Fatalf("handleWaitingForWritten: MsgDisconnected received. Inconceivable!")
+		case MsgDisconnect, MsgReconnect:
+			// We are disconnected anyway.
+			dl.handleControl(msg)
 		case MsgOK:
 			dl.up.Fatalf("handleWaitingForWritten: MsgOK received. Inconceivable!")
 		case MsgWriteAndWaitForOK:
 			dl.up.logf("handleWaitingForWritten: unable to write a command (%q), because we are not connected. May be the printer was just turned off?", msg.Cmd)
 			msg.RespCh <- false
+		case MsgFlush:
+			close(msg.RespCh)
 		case MsgWritten:
 			return Disconnected
 		case MsgResend:
 			dl.up.Fatalf("handleWaitingForWritten: MsgResend received. Inconceivable!")
 		case MsgSomeReply:
 			// Just ignore
+		case MsgWatchdog:
+			if dl.isStaleWatchdog(msg) {
+				continue
+			}
+			dl.up.logf("handleWaitingForWritten: watchdog: the write is stuck. Abandoning it.")
+			dl.abandonedWrites++
+			return Disconnected
 		default:
 			dl.up.Fatalf("handleWaitingForWritten: unexpected message type: %v, full message: %+v", msg.Type, msg)
 		}
@@ -452,6 +1414,68 @@ func (dl *DFADownlink) handleWaitingForWritten() State {
 	return Terminated
 }
 
+func (dl *DFADownlink) handleRecovering() State {
+	// We arrive to this state, when the watchdog has closed a wedged connection. We wait until readFromDevice notices that
+	// and sends MsgDisconnected. Nothing is sent to the device meanwhile.
+	dl.up.logf("State: Recovering")
+	for msg := range dl.reqCh {
+		switch msg.Type {
+		case MsgIsConnected:
+			msg.RespCh <- false
+		case MsgDisconnected:
+			return Disconnected
+		case MsgDisconnect, MsgReconnect:
+			dl.handleControl(msg)
+		case MsgWriteAndWaitForOK:
+			dl.up.logf("handleRecovering: unable to write a command (%q), because the connection is being reset.", msg.Cmd)
+			close(msg.RespCh)
+		case MsgFlush:
+			close(msg.RespCh)
+		case MsgWritten:
+			if !dl.ignoreAbandonedWrite() {
+				dl.up.Fatalf("handleRecovering: received MsgWritten. Inconceivable!")
+			}
+		case MsgOK, MsgResend, MsgSomeReply, MsgWatchdog:
+			// The device is not trusted anymore. Just ignore.
+		default:
+			dl.up.Fatalf("handleRecovering: unexpected message type: %v, full message: %+v", msg.Type, msg)
+		}
+	}
+	dl.up.Fatalf("handleRecovering: reqCh is closed")
+	return Terminated
+}
+
+func (dl *DFADownlink) handleHeld() State {
+	// We arrive to this state, when Disconnect was requested. We stay disconnected until Reconnect is requested.
+	dl.up.logf("State: Held")
+	for msg := range dl.reqCh {
+		switch msg.Type {
+		case MsgIsConnected:
+			msg.RespCh <- false
+		case MsgReconnect:
+			dl.handleControl(msg)
+			return Disconnected
+		case MsgDisconnect:
+			// Already disconnected.
+		case MsgWriteAndWaitForOK:
+			dl.up.logf("handleHeld: unable to write a command (%q), because the device is disconnected by request. Use reconnect.", msg.Cmd)
+			close(msg.RespCh)
+		case MsgFlush:
+			close(msg.RespCh)
+		case MsgWritten:
+			if !dl.ignoreAbandonedWrite() {
+				dl.up.Fatalf("handleHeld: received MsgWritten. Inconceivable!")
+			}
+		case MsgOK, MsgResend, MsgSomeReply, MsgWatchdog:
+			// Leftovers from the previous connection. Just ignore.
+		default:
+			dl.up.Fatalf("handleHeld: unexpected message type: %v, full message: %+v", msg.Type, msg)
+		}
+	}
+	dl.up.Fatalf("handleHeld: reqCh is closed")
+	return Terminated
+}
+
 // Find tty dev for the printer. As we work in a relatively stable environment,
 // it's going to be either /dev/ttyACM? or /dev/ttyUSB?. The numbers will also likely be low, like 0 or 1.
 // For now, just have a short list and go through it.
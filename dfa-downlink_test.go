@@ -0,0 +1,954 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-agent/gcode"
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+// fakeSerial is a fake serial connection to a printer. The test plays the printer:
+// it writes the responses with Reply and reads what the agent has written with Written.
+type fakeSerial struct {
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	// If true, writes block until the connection is closed.
+	blockWrites bool
+
+	mu      sync.Mutex
+	written []string
+	closed  chan bool
+}
+
+func newFakeSerial() *fakeSerial {
+	pr, pw := io.Pipe()
+	return &fakeSerial{pr: pr, pw: pw, closed: make(chan bool)}
+}
+
+func (f *fakeSerial) Read(p []byte) (int, error) { return f.pr.Read(p) }
+
+func (f *fakeSerial) Write(p []byte) (int, error) {
+	if f.blockWrites {
+		<-f.closed
+		return 0, io.ErrClosedPipe
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, string(p))
+	return len(p), nil
+}
+
+func (f *fakeSerial) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.closed:
+	default:
+		close(f.closed)
+		f.pw.Close()
+	}
+	return nil
+}
+
+// Reply sends a line to the agent, as if the printer has sent it.
+func (f *fakeSerial) Reply(line string) {
+	f.pw.Write([]byte(line + "\n"))
+}
+
+func (f *fakeSerial) Written() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.written...)
+}
+
+func TestDFADownlinkWatchdog(t *testing.T) {
+	conn := newFakeSerial()
+	// The write never completes, so MsgWritten is never sent.
+	conn.blockWrites = true
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.watchdogTimeout = 100 * time.Millisecond
+	dl.conn = conn
+	go dl.run(Connected)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G28 Z0") }()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("WriteAndWaitForOK: want an error, because the write has never completed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteAndWaitForOK is still blocked. The watchdog has not fired.")
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("the watchdog has not closed the wedged connection")
+	}
+	// The downlink is trying to reconnect now.
+	until := time.Now().Add(time.Second)
+	for dl.Connected() {
+		if time.Now().After(until) {
+			t.Fatalf("the downlink is still connected after the watchdog has fired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDFADownlinkReadOKWithFields(t *testing.T) {
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	conn.Reply("ok 12 P15 B4")
+	msg := <-dl.reqCh
+	if msg.Type != MsgOK {
+		t.Fatalf("want MsgOK, got %+v", msg)
+	}
+	if msg.Lineno != 12 {
+		t.Errorf("lineno: want 12, got %d", msg.Lineno)
+	}
+	if msg.Buf == nil || *msg.Buf != (BufferInfo{Planner: 15, Block: 4}) {
+		t.Errorf("buffers: want P15 B4, got %+v", msg.Buf)
+	}
+
+	conn.Reply("ok N13 P3 B1")
+	if msg = <-dl.reqCh; msg.Lineno != 13 || msg.Buf == nil || msg.Buf.Planner != 3 {
+		t.Errorf("ok N13 P3 B1: got %+v (buf: %+v)", msg, msg.Buf)
+	}
+	conn.Close()
+}
+
+func TestDFADownlinkStats(t *testing.T) {
+	conn := newFakeSerial()
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.conn = conn
+	go dl.run(Connected)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G28") }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Reply("Resend: 1")
+	for len(conn.Written()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Reply("ok")
+	if err := <-errCh; err != nil {
+		t.Fatalf("WriteAndWaitForOK: %v", err)
+	}
+	st := dl.Stats()
+	if st.Resends != 1 {
+		t.Errorf("Resends: want 1, got %d", st.Resends)
+	}
+	if st.CommandsSent != 1 || st.OKs != 1 {
+		t.Errorf("want 1 command sent and 1 ok, got %+v", st)
+	}
+	if want := int64(2 * len(conn.Written()[0])); st.BytesOut != want {
+		t.Errorf("BytesOut: want %d, got %d", want, st.BytesOut)
+	}
+	if want := int64(len("Resend: 1\nok\n")); st.BytesIn != want {
+		t.Errorf("BytesIn: want %d, got %d", want, st.BytesIn)
+	}
+	conn.Close()
+}
+
+func TestDFADownlinkLineEndings(t *testing.T) {
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	for _, tc := range []struct {
+		data   string
+		numOKs int
+	}{
+		{"ok\r", 1},
+		{"ok\rok\r", 2},
+		{"ok\r\nok\n", 2},
+	} {
+		go conn.pw.Write([]byte(tc.data))
+		for i := 0; i < tc.numOKs; i++ {
+			if msg := <-dl.reqCh; msg.Type != MsgOK {
+				t.Fatalf("%q: want MsgOK #%d, got %+v", tc.data, i+1, msg)
+			}
+		}
+	}
+	// If \r\n was split into two lines, there would be a blank line here.
+	go conn.Reply("ok 7")
+	if msg := <-dl.reqCh; msg.Type != MsgOK || msg.Lineno != 7 {
+		t.Errorf("want MsgOK with lineno 7, got %+v", msg)
+	}
+	conn.Close()
+}
+
+func TestDFADownlinkNoAckDelay(t *testing.T) {
+	conn := newFakeSerial()
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.noAckDelay = 200 * time.Millisecond
+	// The firmware replies, but never sends ok, so the command is accepted on a reply.
+	dl.acceptOnReplyAfter = 0
+	dl.conn = conn
+	go dl.run(Connected)
+	defer conn.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G28") }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The first reply is only noted. The acceptance is checked on the next one.
+	start := time.Now()
+	conn.Reply("X:0.00 Y:0.00 Z:0.00")
+	conn.Reply("X:0.00 Y:0.00 Z:0.00")
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("WriteAndWaitForOK: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the command is not accepted on a reply")
+	}
+	if elapsed := time.Now().Sub(start); elapsed < dl.noAckDelay {
+		t.Errorf("WriteAndWaitForOK returned after %v, want at least %v", elapsed, dl.noAckDelay)
+	}
+	if st := dl.Stats(); st.OKs != 0 {
+		t.Errorf("OKs: want 0, got %d", st.OKs)
+	}
+}
+
+func TestDFADownlinkMinCmdInterval(t *testing.T) {
+	conn := newFakeSerial()
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.minCmdInterval = 200 * time.Millisecond
+	dl.conn = conn
+	go dl.run(Connected)
+	defer conn.Close()
+
+	var done time.Time
+	for i, cmd := range []string{"G90", "G1 Z4 F100"} {
+		errCh := make(chan error, 1)
+		go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), cmd) }()
+		for len(conn.Written()) <= i {
+			time.Sleep(time.Millisecond)
+		}
+		if i > 0 {
+			if elapsed := time.Now().Sub(done); elapsed < dl.minCmdInterval {
+				t.Errorf("%s is written %v after the previous command, want at least %v", cmd, elapsed, dl.minCmdInterval)
+			}
+		}
+		conn.Reply("ok")
+		if err := <-errCh; err != nil {
+			t.Fatalf("WriteAndWaitForOK(%s): %v", cmd, err)
+		}
+		done = time.Now()
+	}
+}
+
+func TestDFADownlinkMinCmdIntervalConcurrent(t *testing.T) {
+	conn := newFakeSerial()
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.minCmdInterval = 200 * time.Millisecond
+	dl.conn = conn
+	go dl.run(Connected)
+	defer conn.Close()
+
+	// The second command is queued, while the first one waits for ok.
+	errCh := make(chan error, 2)
+	for _, cmd := range []string{"G90", "G1 Z4 F100"} {
+		go func(cmd string) { errCh <- dl.WriteAndWaitForOK(context.Background(), cmd) }(cmd)
+	}
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Reply("ok")
+	okSent := time.Now()
+	for len(conn.Written()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Now().Sub(okSent); elapsed < dl.minCmdInterval {
+		t.Errorf("the queued command is written %v after the previous one has completed, want at least %v", elapsed, dl.minCmdInterval)
+	}
+	conn.Reply("ok")
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("WriteAndWaitForOK: %v", err)
+		}
+	}
+}
+
+func TestDFADownlinkLongLine(t *testing.T) {
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	// Longer than bufio.MaxScanTokenSize, which is the default limit of bufio.Scanner.
+	long := "echo:" + strings.Repeat("M92 X80.00 Y80.00 Z400.00 E93.00 ", 3000)
+	go conn.Reply(long)
+	if msg := <-dl.reqCh; msg.Type != MsgSomeReply {
+		t.Fatalf("want MsgSomeReply for a %d bytes line, got %+v", len(long), msg)
+	}
+	go conn.Reply("ok")
+	if msg := <-dl.reqCh; msg.Type != MsgOK {
+		t.Errorf("want MsgOK after the long line, got %+v", msg)
+	}
+	conn.Close()
+}
+
+func TestDFADownlinkCoalescesBusy(t *testing.T) {
+	up, _ := newTestUplink()
+	var mu sync.Mutex
+	var logged []string
+	defer up.addLogTap(func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, line)
+	})()
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	var lines []string
+	for i := 0; i < 12; i++ {
+		lines = append(lines, "echo:busy: processing")
+	}
+	for i := 0; i < 3; i++ {
+		lines = append(lines, "busy: paused for user")
+	}
+	go func() {
+		for _, line := range append(lines, "ok") {
+			conn.Reply(line)
+		}
+	}()
+	// Every busy line is still a reply, which keeps the pending command alive.
+	for i := range lines {
+		if msg := <-dl.reqCh; msg.Type != MsgSomeReply {
+			t.Fatalf("line %d: want MsgSomeReply for a busy line, got %+v", i, msg)
+		}
+	}
+	if msg := <-dl.reqCh; msg.Type != MsgOK {
+		t.Fatalf("want MsgOK, got %+v", msg)
+	}
+	conn.Close()
+	<-dl.reqCh // MsgDisconnected
+
+	mu.Lock()
+	defer mu.Unlock()
+	var busy []string
+	for _, line := range logged {
+		if strings.Contains(line, "busy") {
+			busy = append(busy, line)
+		}
+	}
+	want := []string{
+		"echo:busy: processing",
+		"echo:busy: processing x12",
+		"busy: paused for user",
+		"busy: paused for user x3",
+	}
+	if strings.Join(busy, "\n") != strings.Join(want, "\n") {
+		t.Errorf("busy lines logged:\n%s\nwant:\n%s", strings.Join(busy, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDFADownlinkIgnoresWait(t *testing.T) {
+	conn := newFakeSerial()
+	up, _ := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	dl.conn = conn
+	// Any reply would be taken as an acceptance right away.
+	dl.acceptOnReplyAfter = 0
+	go dl.run(Connected)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G28") }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		conn.Reply("wait")
+	}
+	for dl.Stats().BytesIn < int64(5*len("wait\n")) {
+		time.Sleep(time.Millisecond)
+	}
+	// Every message to the state machine checks the acceptance heuristic.
+	dl.Connected()
+	select {
+	case err := <-errCh:
+		t.Fatalf("the command is accepted after idle wait lines: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Reply("ok")
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("WriteAndWaitForOK: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the command is not completed by ok")
+	}
+	if st := dl.Stats(); st.OKs != 1 {
+		t.Errorf("OKs: want 1, got %d", st.OKs)
+	}
+	conn.Close()
+}
+
+func TestDFADownlinkHalted(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	conn := newFakeSerial()
+	dl.conn = conn
+	go dl.run(Connected)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G28") }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Reply("Error:Printer halted. kill() called!")
+	select {
+	case err := <-errCh:
+		if err != ErrPrinterHalted {
+			t.Fatalf("WriteAndWaitForOK: want ErrPrinterHalted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the pending command is not failed after the printer is halted")
+	}
+	if err := dl.WriteAndWaitForOK(context.Background(), "G1 Z10"); err != ErrPrinterHalted {
+		t.Errorf("WriteAndWaitForOK after halt: want ErrPrinterHalted, got %v", err)
+	}
+	if written := conn.Written(); len(written) != 1 {
+		t.Errorf("want no writes after halt, got %q", written)
+	}
+
+	if err := dl.Reconnect(); err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	waitForClose(t, conn)
+	waitForOpen(t, opens)
+	if dl.Halted() {
+		t.Errorf("the printer is still halted after reconnect")
+	}
+}
+
+func TestExecuteGcodePrinterReset(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	conn := newFakeSerial()
+	dl.conn = conn
+	go dl.run(Connected)
+	exe := NewExecutor(dl.up, true /*virtual*/, nil)
+	exe.down = dl
+
+	// The printer acks two commands and then reboots instead of acking the third one.
+	go func() {
+		for acked := 0; acked < 3; {
+			if len(conn.Written()) <= acked {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			acked++
+			if acked < 3 {
+				conn.Reply("ok")
+			} else {
+				conn.Reply("start")
+			}
+		}
+	}()
+	job := writeTestJob(t, "G90\nG1 Z1 F100\nG1 Z2 F100\nG1 Z3 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "reset", job); err != ErrDeviceReset {
+		t.Errorf("ExecuteGcode: want ErrDeviceReset, got %v", err)
+	}
+	if written := conn.Written(); len(written) != 3 {
+		t.Errorf("want no commands sent after the reset, got %q", written)
+	}
+	if resets := dl.Stats().Resets; resets != 1 {
+		t.Errorf("want 1 reset in the link stats, got %d", resets)
+	}
+	// The connection is reestablished from scratch.
+	waitForClose(t, conn)
+	waitForOpen(t, opens)
+}
+
+func TestTempLimitsExceeded(t *testing.T) {
+	temps := map[string]Temperature{"B": {Actual: 90}, "T0": {Actual: 230}, "T1": {Actual: 260}}
+	for _, tc := range []struct {
+		limits TempLimits
+		heater string
+		limit  float64
+	}{
+		{nil, "", 0},
+		{TempLimits{"T": 250}, "T1", 250},
+		{TempLimits{"T": 250, "T1": 270}, "", 0},
+		{TempLimits{"T": 0, "B": 80}, "B", 80},
+		{TempLimits{"T": 220, "B": 80}, "B", 80},
+		{TempLimits{"C": 40}, "", 0},
+	} {
+		if heater, limit := tc.limits.Exceeded(temps); heater != tc.heater || limit != tc.limit {
+			t.Errorf("%v.Exceeded: want %q above %v, got %q above %v", tc.limits, tc.heater, tc.limit, heater, limit)
+		}
+	}
+}
+
+func TestExecuteGcodeTempCutoff(t *testing.T) {
+	dl, _, _ := newFakeDFADownlink()
+	dl.cutoffs = TempLimits{"T": 280, "B": 120}
+	conn := newFakeSerial()
+	dl.conn = conn
+	go dl.run(Connected)
+	exe := NewExecutor(dl.up, true /*virtual*/, nil)
+	exe.down = dl
+
+	// The printer acks two commands. While the third one is pending, the hotend runs away.
+	go func() {
+		for acked := 0; acked < 3; {
+			if len(conn.Written()) <= acked {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			acked++
+			if acked < 3 {
+				conn.Reply("T:210.00 /210.00 B:60.00 /60.00 @:127 B@:0")
+				conn.Reply("ok")
+			} else {
+				conn.Reply("T:291.50 /210.00 B:60.00 /60.00 @:0 B@:0")
+			}
+		}
+	}()
+	job := writeTestJob(t, "G90\nG1 Z1 F100\nG1 Z2 F100\nG1 Z3 F100\n")
+	err := exe.ExecuteGcode(context.Background(), "runaway", job)
+	if e, ok := err.(*TempCutoffError); !ok || e.Heater != "T" || e.Actual != 291.5 || e.Limit != 280 {
+		t.Errorf("ExecuteGcode: want a TempCutoffError for T, got %v", err)
+	}
+	written := conn.Written()
+	if len(written) != 4 || written[3] != "M112\n" {
+		t.Errorf("want M112 sent right after the runaway and nothing else, got %q", written)
+	}
+	if err := dl.WriteAndWaitForOK(context.Background(), "G1 Z4"); err == nil {
+		t.Errorf("WriteAndWaitForOK: want an error after the emergency stop")
+	}
+	conn.Close()
+}
+
+func TestExecuteGcodeFlushesStaleInput(t *testing.T) {
+	dl, _, _ := newFakeDFADownlink()
+	conn := newFakeSerial()
+	dl.conn = conn
+	go dl.run(Connected)
+	exe := NewExecutor(dl.up, true /*virtual*/, nil)
+	exe.down = dl
+	exe.homeCmd = "G28 Z0"
+
+	// The acks of a previous session are still trickling in from the OS buffer, when the job starts.
+	staleDone := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			conn.Reply("ok")
+			time.Sleep(50 * time.Millisecond)
+		}
+		close(staleDone)
+	}()
+	early := make(chan string, 10)
+	go func() {
+		for acked := 0; acked < 3; {
+			written := conn.Written()
+			if len(written) <= acked {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			select {
+			case <-staleDone:
+			default:
+				early <- written[acked]
+			}
+			acked++
+			conn.Reply("ok")
+		}
+	}()
+	job := writeTestJob(t, "G90\nG1 Z1 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "flushed", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	select {
+	case cmd := <-early:
+		t.Errorf("%q is sent before the stale input is drained", cmd)
+	default:
+	}
+	if written := conn.Written(); len(written) != 3 || !strings.Contains(written[0], "G28 Z0") {
+		t.Errorf("want G28 Z0 and 2 job commands written, got %q", written)
+	}
+	if oks := dl.Stats().OKs; oks != 6 {
+		t.Errorf("want 3 stale and 3 real oks received, got %d", oks)
+	}
+	conn.Close()
+}
+
+// ackUntil replies ok to every line written to conn. If glitch returns true for a line, the connection is closed
+// instead, like after a USB glitch.
+func ackUntil(conn *fakeSerial, glitch func(line string) bool) {
+	for acked := 0; ; {
+		written := conn.Written()
+		if len(written) <= acked {
+			select {
+			case <-conn.closed:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			continue
+		}
+		if glitch(written[acked]) {
+			conn.Close()
+			return
+		}
+		acked++
+		conn.Reply("ok")
+	}
+}
+
+func TestExecuteGcodeConnectionReset(t *testing.T) {
+	for _, resume := range []bool{false, true} {
+		dl, opens, _ := newFakeDFADownlink()
+		go dl.Run()
+		exe := NewExecutor(dl.up, true /*virtual*/, nil)
+		exe.down = dl
+		exe.resumeOnReset = resume
+		exe.maxWriteRetries = 3
+
+		first := waitForOpen(t, opens)
+		go ackUntil(first, func(line string) bool { return strings.Contains(line, "G1 Z2 ") })
+		reconnected := make(chan *fakeSerial, 1)
+		go func() {
+			conn := <-opens
+			reconnected <- conn
+			ackUntil(conn, func(string) bool { return false })
+		}()
+		job := writeTestJob(t, "G90\nG1 Z1 F100\nG1 Z2 F100\nG1 Z3 F100\n")
+		err := exe.ExecuteGcode(context.Background(), "glitched", job)
+		second := <-reconnected
+		if !resume {
+			if err != ErrConnectionReset {
+				t.Errorf("ExecuteGcode: want %v without resume, got %v", ErrConnectionReset, err)
+			}
+			second.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ExecuteGcode: %v", err)
+		}
+		// The line numbers continue from the last confirmed command of the lost connection.
+		var lost string
+		for _, line := range first.Written() {
+			if strings.Contains(line, "G1 Z2 ") {
+				lost = line
+			}
+		}
+		var n int
+		if _, err := fmt.Sscanf(lost, "N%d ", &n); err != nil {
+			t.Fatalf("failed to parse the line number of %q: %v", lost, err)
+		}
+		written := second.Written()
+		if len(written) == 0 || written[0] != gcode.AddLineAndHash(n-1, fmt.Sprintf("M110 N%d", n-1))+"\n" {
+			t.Fatalf("want M110 N%d sent first after the reconnect, got %q", n-1, written)
+		}
+		var job2 []string
+		for _, line := range written[1:] {
+			if strings.Contains(line, "G1 ") {
+				job2 = append(job2, line)
+			}
+		}
+		if len(job2) != 2 || !strings.Contains(job2[0], "G1 Z2 F100") || !strings.Contains(job2[1], "G1 Z3 F100") {
+			t.Errorf("want G1 Z2 F100 sent again, then G1 Z3 F100, got %q", job2)
+		}
+		second.Close()
+	}
+}
+
+func TestExecuteGcodeResumeAfterReboot(t *testing.T) {
+	for _, marker := range []string{"", "start"} {
+		dl, opens, _ := newFakeDFADownlink()
+		dl.startMarker = marker
+		go dl.Run()
+		exe := NewExecutor(dl.up, true /*virtual*/, nil)
+		exe.down = dl
+		exe.resumeOnReset = true
+		exe.maxWriteRetries = 3
+
+		first := waitForOpen(t, opens)
+		if marker != "" {
+			first.Reply(marker)
+		}
+		go ackUntil(first, func(line string) bool { return strings.Contains(line, "G1 Z2 ") })
+		// The printer reboots, when the port is opened again, so the job is not resumed.
+		third := make(chan *fakeSerial, 1)
+		go func() {
+			second := <-opens
+			second.Reply("start")
+			conn := <-opens
+			third <- conn
+			conn.Reply("start")
+			ackUntil(conn, func(string) bool { return false })
+		}()
+		job := writeTestJob(t, "G90\nG1 Z1 F100\nG1 Z2 F100\nG1 Z3 F100\n")
+		if err := exe.ExecuteGcode(context.Background(), "rebooted", job); err != ErrDeviceReset {
+			t.Errorf("marker %q: ExecuteGcode: want ErrDeviceReset, got %v", marker, err)
+		}
+		if resets := dl.Stats().Resets; resets != 1 {
+			t.Errorf("marker %q: want 1 reset in the link stats, got %d", marker, resets)
+		}
+		conn := <-third
+		for _, line := range conn.Written() {
+			if strings.Contains(line, "M110") || strings.Contains(line, "G1 ") {
+				t.Errorf("marker %q: want nothing resumed after the reboot, got %q", marker, line)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestIsResetLine(t *testing.T) {
+	for _, tc := range []struct {
+		txt, marker string
+		want        bool
+	}{
+		{"start", "", true},
+		{"echo: Watchdog Reset", "", true},
+		{"echo: External Reset", "", true},
+		{"Grbl 1.1h ['$' for help]", "", true},
+		{"ready", "ready", true},
+		{"Klipper ready", "ready", false},
+		{"echo: start print", "start", false},
+		{"ok", "", false},
+		{"echo:busy: processing", "", false},
+		{"echo:Settings Stored (625 bytes; crc 12345)", "", false},
+	} {
+		if got := isResetLine(tc.txt, tc.marker); got != tc.want {
+			t.Errorf("isResetLine(%q, %q): want %v, got %v", tc.txt, tc.marker, tc.want, got)
+		}
+	}
+}
+
+func TestIsGarbageLine(t *testing.T) {
+	for _, tc := range []struct {
+		txt  string
+		want bool
+	}{
+		{"ok", false},
+		{"echo:  M92 X80.00\tY80.00", false},
+		{"Temperatur °C", false},
+		{"\x00\x13\x7f", true},
+		{"st\xffa\xfert", true},
+	} {
+		if got := isGarbageLine(tc.txt); got != tc.want {
+			t.Errorf("isGarbageLine(%q): want %v, got %v", tc.txt, tc.want, got)
+		}
+	}
+}
+
+func TestDFADownlinkWaitsForStartMarker(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	dl.startMarker = "start"
+	go dl.Run()
+	conn := waitForOpen(t, opens)
+
+	go conn.pw.Write([]byte("\x00\xff\xfe\x13garbage\x01\n\xc3\n"))
+	// The M115 query is queued, until the device is ready.
+	time.Sleep(200 * time.Millisecond)
+	if written := conn.Written(); len(written) != 0 {
+		t.Fatalf("commands are sent before the start marker: %q", written)
+	}
+	go conn.Reply("start")
+	until := time.Now().Add(5 * time.Second)
+	for len(conn.Written()) == 0 {
+		if time.Now().After(until) {
+			t.Fatalf("no commands are sent after the start marker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if first := conn.Written()[0]; !strings.Contains(first, "M115") {
+		t.Errorf("want M115 sent first, got %q", first)
+	}
+}
+
+func TestParseSDProgress(t *testing.T) {
+	tests := []struct {
+		txt         string
+		done, total int64
+		ok          bool
+	}{
+		{"SD printing byte 1234/5678", 1234, 5678, true},
+		{"SD printing byte 0/0", 0, 0, true},
+		{"Not SD printing", 0, 0, false},
+		{"SD printing byte 12", 0, 0, false},
+	}
+	for _, tt := range tests {
+		done, total, ok := parseSDProgress(tt.txt)
+		if done != tt.done || total != tt.total || ok != tt.ok {
+			t.Errorf("parseSDProgress(%q): want %d, %d, %v, got %d, %d, %v", tt.txt, tt.done, tt.total, tt.ok, done, total, ok)
+		}
+	}
+}
+
+func TestDFADownlinkSDProgress(t *testing.T) {
+	up, rec := newTestUplink()
+	up.SetJobName("benchy")
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	go conn.Reply("SD printing byte 250/1000")
+	if msg := <-dl.reqCh; msg.Type != MsgSomeReply {
+		t.Errorf("want MsgSomeReply, got %+v", msg)
+	}
+	msgs := rec.ByType("notify-job-progress")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-job-progress message, got %d", len(msgs))
+	}
+	if msgs[0].JobName != "benchy" || msgs[0].Progress != 25 {
+		t.Errorf("want benchy at 25%%, got %s at %v%%", msgs[0].JobName, msgs[0].Progress)
+	}
+
+	// Without a current job, the progress is not reported.
+	up.SetJobName("")
+	go conn.Reply("SD printing byte 500/1000")
+	if msg := <-dl.reqCh; msg.Type != MsgSomeReply {
+		t.Errorf("want MsgSomeReply, got %+v", msg)
+	}
+	if msgs := rec.ByType("notify-job-progress"); len(msgs) != 1 {
+		t.Errorf("want no more notify-job-progress messages without a job, got %d", len(msgs))
+	}
+	conn.Close()
+}
+
+// newFakeDFADownlink returns a DFA downlink, which opens fake serial connections and sends them to opens.
+func newFakeDFADownlink() (dl *DFADownlink, opens chan *fakeSerial, rec *notifyRecorder) {
+	up, rec := newTestUplink()
+	// The downlink does not try to connect to the device until the uplink is connected.
+	up.setClientAndDeviceName(&device_api.Client{}, "test-device")
+	dl = NewDFADownlink(up, 115200)
+	opens = make(chan *fakeSerial, 10)
+	dl.findDev = func() (string, error) { return "/dev/ttyFAKE0", nil }
+	dl.open = func(ttyDev string, baudRate int) (io.ReadWriteCloser, error) {
+		conn := newFakeSerial()
+		opens <- conn
+		return conn, nil
+	}
+	return dl, opens, rec
+}
+
+func waitForOpen(t *testing.T, opens chan *fakeSerial) *fakeSerial {
+	select {
+	case conn := <-opens:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the downlink has not opened a connection")
+	}
+	return nil
+}
+
+func waitForClose(t *testing.T, conn *fakeSerial) {
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the downlink has not closed the connection")
+	}
+}
+
+func TestDFADownlinkReconnect(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	go dl.Run()
+
+	first := waitForOpen(t, opens)
+	if !dl.WaitForConnection(5 * time.Second) {
+		t.Fatalf("the downlink is not connected")
+	}
+	dl.Reconnect()
+	waitForClose(t, first)
+	waitForOpen(t, opens)
+	if !dl.WaitForConnection(5 * time.Second) {
+		t.Fatalf("the downlink has not reconnected")
+	}
+}
+
+func TestDFADownlinkDisconnect(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	go dl.Run()
+
+	first := waitForOpen(t, opens)
+	if !dl.WaitForConnection(5 * time.Second) {
+		t.Fatalf("the downlink is not connected")
+	}
+	dl.Disconnect()
+	waitForClose(t, first)
+	if dl.Connected() {
+		t.Errorf("the downlink is still connected after Disconnect")
+	}
+	if err := dl.WriteAndWaitForOK(context.Background(), "G28"); err == nil {
+		t.Errorf("WriteAndWaitForOK: want an error, because the device is disconnected")
+	}
+	select {
+	case <-opens:
+		t.Fatalf("the downlink has reconnected without Reconnect")
+	case <-time.After(100 * time.Millisecond):
+	}
+	dl.Reconnect()
+	waitForOpen(t, opens)
+}
+
+func TestDFADownlinkNotifySerialPort(t *testing.T) {
+	dl, opens, rec := newFakeDFADownlink()
+	go dl.Run()
+
+	waitForOpen(t, opens)
+	if !dl.WaitForConnection(5 * time.Second) {
+		t.Fatalf("the downlink is not connected")
+	}
+	msgs := rec.ByType("notify-serial-port")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-serial-port message, got %d", len(msgs))
+	}
+	var port SerialPort
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &port); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", msgs[0].Comment, err)
+	}
+	if port != (SerialPort{Device: "/dev/ttyFAKE0", BaudRate: 115200}) {
+		t.Errorf("want /dev/ttyFAKE0 at 115200 bps, got %+v", port)
+	}
+	if st := dl.Stats(); st.Device != "/dev/ttyFAKE0" || st.BaudRate != 115200 {
+		t.Errorf("Stats: want /dev/ttyFAKE0 at 115200 bps, got %+v", st)
+	}
+}
+
+func TestParseProbeResult(t *testing.T) {
+	tests := []struct {
+		txt  string
+		want ProbeResult
+		ok   bool
+	}{
+		{"[PRB:1.000,2.000,-3.250:1]", ProbeResult{X: 1, Y: 2, Z: -3.25, Triggered: true}, true},
+		{"[PRB:0.000,0.000,-10.000:0]", ProbeResult{Z: -10}, true},
+		{"[PRB:1.000,2.000:1]", ProbeResult{}, false},
+		{"[PRB:1.000,2.000,x:1]", ProbeResult{}, false},
+		{"[PRB:1.000,2.000,3.000]", ProbeResult{}, false},
+		{"ok", ProbeResult{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseProbeResult(tt.txt)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseProbeResult(%q): want %+v, %v, got %+v, %v", tt.txt, tt.want, tt.ok, got, ok)
+		}
+	}
+}
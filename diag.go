@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vincent-petithory/dataurl"
+)
+
+// maxDiagEntrySize is the largest file in a diagnostic bundle. Longer ones, like the gcode of a big job, are truncated.
+const maxDiagEntrySize = 1 << 20
+
+// CollectDiag gathers what remote support usually asks for into a zip archive and sends it with notify-diag:
+// the recent logs, the flags and the config, the last loaded job, the status with the link counters and dmesg.
+// A source, which fails, does not fail the bundle. Its error is saved in errors.txt instead.
+func (sh *Shell) CollectDiag(ctx context.Context) error {
+	files := make(map[string][]byte)
+	var errs []string
+
+	files["logs.txt"] = []byte(strings.Join(sh.up.RecentLogs(), "\n") + "\n")
+
+	var flags bytes.Buffer
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&flags, "-%s=%s\n", f.Name, f.Value)
+	})
+	files["flags.txt"] = flags.Bytes()
+
+	if data, err := ioutil.ReadFile(getAgentConfigPath()); err == nil {
+		files["agent.json"] = data
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, fmt.Sprintf("agent.json: %v", err))
+	}
+
+	if jobName, cmds := sh.exe.LoadedJob(); cmds != nil {
+		var gcode bytes.Buffer
+		fmt.Fprintf(&gcode, "; %s\n", jobName)
+		for _, cmd := range cmds {
+			gcode.WriteString(cmd.Text + "\n")
+		}
+		files["last-job.gcode"] = gcode.Bytes()
+	}
+
+	files["status.json"] = []byte(sh.up.bestJson(NewStatusServer(sh.up, sh.exe.down, Version).Status()) + "\n")
+	if sr, ok := sh.exe.down.(statsReporter); ok {
+		files["link-stats.txt"] = []byte(sr.Stats().String() + "\n")
+	}
+
+	if err := sh.checkAllowed("dmesg"); err != nil {
+		errs = append(errs, fmt.Sprintf("dmesg: %v", err))
+	} else if data, err := sh.execCommand(ctx, "dmesg"); err != nil {
+		errs = append(errs, fmt.Sprintf("dmesg: %v\nOutput:\n%s", err, data))
+	} else {
+		files["dmesg.txt"] = data
+	}
+
+	if len(errs) > 0 {
+		files["errors.txt"] = []byte(strings.Join(errs, "\n") + "\n")
+	}
+	bundle, err := zipDiagFiles(files)
+	if err != nil {
+		return fmt.Errorf("failed to zip the diagnostic bundle: %v", err)
+	}
+	sh.up.NotifyDiag(dataurl.New(bundle, "application/zip").String())
+	sh.up.logf("Sent a diagnostic bundle with %d files, %d bytes", len(files), len(bundle))
+	return nil
+}
+
+// zipDiagFiles makes a zip archive of files, sorted by name. The files longer than maxDiagEntrySize are truncated.
+func zipDiagFiles(files map[string][]byte) ([]byte, error) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		data := files[name]
+		if len(data) > maxDiagEntrySize {
+			data = append(data[:maxDiagEntrySize:maxDiagEntrySize], fmt.Sprintf("\n[truncated, %d bytes total]\n", len(files[name]))...)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
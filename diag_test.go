@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsDryRunDownlink is a dry-run downlink, which reports fixed link stats.
+type statsDryRunDownlink struct {
+	*DryRunDownlink
+	stats LinkStats
+}
+
+func (dl *statsDryRunDownlink) Stats() LinkStats { return dl.stats }
+
+// collectTestDiag runs collect-diag and returns the files of the bundle sent to the server.
+func collectTestDiag(t *testing.T, sh *Shell, rec *notifyRecorder) map[string]string {
+	prev := len(rec.ByType("notify-diag"))
+	if !sh.handleCommand("collect-diag") {
+		t.Fatalf("collect-diag failed")
+	}
+	msgs := rec.ByType("notify-diag")
+	for deadline := time.Now().Add(5 * time.Second); len(msgs) == prev && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		msgs = rec.ByType("notify-diag")
+	}
+	if len(msgs) != prev+1 {
+		t.Fatalf("want a notify-diag message, got %d", len(msgs)-prev)
+	}
+	url := msgs[len(msgs)-1].Comment
+	if prefix := "data:application/zip;base64,"; !strings.HasPrefix(url, prefix) {
+		t.Fatalf("want a data URL starting with %q, got %.40q", prefix, url)
+	}
+	data, err := base64.StdEncoding.DecodeString(url[strings.Index(url, ",")+1:])
+	if err != nil {
+		t.Fatalf("failed to decode the data URL: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to read the bundle: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open(%s): %v", f.Name, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("ReadAll(%s): %v", f.Name, err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestShellCollectDiag(t *testing.T) {
+	dir := withConfigDir(t)
+	config := `{"baud_rate": 250000}`
+	if err := ioutil.WriteFile(path.Join(dir, "agent.json"), []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	sh, down, rec := newTestShell()
+	sh.exe.down = &statsDryRunDownlink{down, LinkStats{Device: "/dev/ttyFAKE0", BaudRate: 250000, Resends: 7}}
+	sh.execCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name != "dmesg" {
+			t.Errorf("want dmesg run, got %s", name)
+		}
+		return []byte("[12.345] usb 1-1: new device\n"), nil
+	}
+	job := writeTestJob(t, "G90\nG1 Z5 F100\n")
+	if err := sh.exe.ExecuteGcode(context.Background(), "diagnosed", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	sh.up.logf("Something went wrong")
+
+	files := collectTestDiag(t, sh, rec)
+	for name, want := range map[string]string{
+		"logs.txt":       "Something went wrong",
+		"flags.txt":      "-frame_display=fbi",
+		"agent.json":     config,
+		"last-job.gcode": "; diagnosed\nG90\nG1 Z5 F100\n",
+		"status.json":    `"device_connected":true`,
+		"link-stats.txt": "resends: 7",
+		"dmesg.txt":      "usb 1-1: new device",
+	} {
+		if got, ok := files[name]; !ok {
+			t.Errorf("%s is missing", name)
+		} else if !strings.Contains(got, want) {
+			t.Errorf("%s: want %q in it, got %q", name, want, got)
+		}
+	}
+	if _, ok := files["errors.txt"]; ok {
+		t.Errorf("want no errors.txt, got %q", files["errors.txt"])
+	}
+
+	// dmesg is not allowed, which does not fail the bundle.
+	sh.bashAllow = parseBashAllow("ls")
+	files = collectTestDiag(t, sh, rec)
+	if _, ok := files["dmesg.txt"]; ok {
+		t.Errorf("dmesg.txt is collected, but dmesg is not in -bash_allow")
+	}
+	if got := files["errors.txt"]; !strings.Contains(got, "dmesg") {
+		t.Errorf("errors.txt: want the dmesg error, got %q", got)
+	}
+	if _, ok := files["logs.txt"]; !ok {
+		t.Errorf("logs.txt is missing")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultFrameDisplay = "fbi"
+	defaultFramebuffer  = "/dev/fb0"
+)
+
+var validFrameDisplays = []string{"fbi", "framebuffer", "none"}
+
+// FrameDisplay shows the frames of SLA jobs on the LCD. It's an interface, so that rigs
+// without fbi (or without a display at all) can run jobs too.
+type FrameDisplay interface {
+	Show(fname string) error
+}
+
+// NewFrameDisplay returns the frame display by name, one of validFrameDisplays.
+func NewFrameDisplay(name string) (FrameDisplay, error) {
+	switch name {
+	case "fbi":
+		return FbiDisplay{}, nil
+	case "framebuffer":
+		return NewFramebufferDisplay(defaultFramebuffer), nil
+	case "none":
+		return NoopDisplay{}, nil
+	}
+	return nil, fmt.Errorf("unsupported frame display %q, want one of %s", name, strings.Join(validFrameDisplays, ", "))
+}
+
+// FbiDisplay shows frames with the fbi image viewer. It's killed and restarted for every frame.
+type FbiDisplay struct{}
+
+func (FbiDisplay) Show(fname string) error {
+	data, err := exec.Command("killall", "fbi").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "killall fbi: %v, %v\n", string(data), err)
+	}
+	data, err = exec.Command("fbi", "-noverbose", "-a", "-T", "1", fname).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to display a frame: %v, %v", string(data), err)
+	}
+	return nil
+}
+
+// NoopDisplay shows nothing. It's for headless rigs, where the frames are displayed by other means.
+type NoopDisplay struct{}
+
+func (NoopDisplay) Show(fname string) error { return nil }
+
+// FramebufferDisplay draws frames to a Linux framebuffer device in-process. A frame is scaled to fit
+// the screen with the aspect ratio kept and centered, like fbi -a does.
+type FramebufferDisplay struct {
+	dev string
+	// sysfsDir has the geometry of the framebuffer, like /sys/class/graphics/fb0.
+	sysfsDir string
+}
+
+func NewFramebufferDisplay(dev string) *FramebufferDisplay {
+	return &FramebufferDisplay{dev: dev, sysfsDir: path.Join("/sys/class/graphics", path.Base(dev))}
+}
+
+func (fb *FramebufferDisplay) readSysfs(name string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(fb.sysfsDir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// geometry returns the size of the screen in pixels, the bits per pixel and the length of a line in bytes.
+func (fb *FramebufferDisplay) geometry() (width, height, bpp, stride int, err error) {
+	size, err := fb.readSysfs("virtual_size")
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(size, "%d,%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid virtual_size of %s: %q", fb.dev, size)
+	}
+	str, err := fb.readSysfs("bits_per_pixel")
+	if err != nil {
+		return
+	}
+	if bpp, err = strconv.Atoi(str); err != nil || bpp != 16 && bpp != 24 && bpp != 32 {
+		return 0, 0, 0, 0, fmt.Errorf("unsupported bits_per_pixel of %s: %q", fb.dev, str)
+	}
+	// Not all drivers report the stride. Without padding, it's the width.
+	stride = width * bpp / 8
+	if str, err := fb.readSysfs("stride"); err == nil {
+		if v, err := strconv.Atoi(str); err == nil && v >= stride {
+			stride = v
+		}
+	}
+	return width, height, bpp, stride, nil
+}
+
+func (fb *FramebufferDisplay) Show(fname string) error {
+	width, height, bpp, stride, err := fb.geometry()
+	if err != nil {
+		return fmt.Errorf("failed to get the geometry of %s: %v", fb.dev, err)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", fname, err)
+	}
+	buf := renderFrame(img, width, height, bpp, stride)
+	out, err := os.OpenFile(fb.dev, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to display a frame: %v", err)
+	}
+	if _, err := out.Write(buf); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to display a frame: %v", err)
+	}
+	return out.Close()
+}
+
+// renderFrame scales img to fit the screen (nearest neighbor), centers it on black and encodes the pixels
+// the way little-endian framebuffers expect them: BGRX for 32 bpp, BGR for 24 bpp and RGB565 for 16 bpp.
+func renderFrame(img image.Image, width, height, bpp, stride int) []byte {
+	buf := make([]byte, stride*height)
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return buf
+	}
+	// Scale to fit the screen with the aspect ratio kept.
+	w, h := width, b.Dy()*width/b.Dx()
+	if h > height {
+		w, h = b.Dx()*height/b.Dy(), height
+	}
+	x0, y0 := (width-w)/2, (height-h)/2
+	for y := 0; y < h; y++ {
+		line := buf[(y0+y)*stride:]
+		sy := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			c := color.RGBAModel.Convert(img.At(b.Min.X+x*b.Dx()/w, sy)).(color.RGBA)
+			switch off := (x0 + x) * bpp / 8; bpp {
+			case 32:
+				line[off], line[off+1], line[off+2], line[off+3] = c.B, c.G, c.R, 0xff
+			case 24:
+				line[off], line[off+1], line[off+2] = c.B, c.G, c.R
+			case 16:
+				v := uint16(c.R>>3)<<11 | uint16(c.G>>2)<<5 | uint16(c.B>>3)
+				line[off], line[off+1] = byte(v), byte(v>>8)
+			}
+		}
+	}
+	return buf
+}
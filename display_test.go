@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestFrame saves a w x h PNG filled with c.
+func writeTestFrame(t *testing.T, fname string, w, h int, c color.Color) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+}
+
+func TestNoopDisplayFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-test-job")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFrame(t, path.Join(dir, "frame-000001.png"), 4, 4, color.White)
+	// No external program can be found, so a frame command fails, if it runs one.
+	t.Setenv("PATH", dir)
+
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, false /*virtual*/, nil)
+	cmd, err := parseGcodeCommand(dir, "M7820 S1")
+	if err != nil {
+		t.Fatalf("parseGcodeCommand: %v", err)
+	}
+	if err := cmd.Run(context.Background(), "job", 3, up, exe, false); err == nil {
+		t.Fatalf("Run: want an error with fbi, which is not installed")
+	}
+
+	exe.display = NoopDisplay{}
+	if err := cmd.Run(context.Background(), "job", 3, up, exe, false); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	msgs := rec.ByType("notify-frame-index")
+	if len(msgs) != 1 || msgs[0].FrameIndex != 1 || msgs[0].NumFrames != 3 {
+		t.Errorf("want frame 1 of 3 reported once, got %+v", msgs)
+	}
+}
+
+func TestFramebufferDisplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-test-fb")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, val := range map[string]string{"virtual_size": "4,2\n", "bits_per_pixel": "32\n"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(val), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	fb := &FramebufferDisplay{dev: path.Join(dir, "fb0"), sysfsDir: dir}
+	if err := ioutil.WriteFile(fb.dev, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	// A square frame on a 4x2 screen is scaled to 2x2 and centered.
+	frame := path.Join(dir, "frame.png")
+	writeTestFrame(t, frame, 10, 10, color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff})
+	if err := fb.Show(frame); err != nil {
+		t.Fatalf("Show: %v", err)
+	}
+	got, err := ioutil.ReadFile(fb.dev)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	black, pixel := []byte{0, 0, 0, 0}, []byte{0x30, 0x20, 0x10, 0xff}
+	var want []byte
+	for y := 0; y < 2; y++ {
+		want = append(want, black...)
+		want = append(want, pixel...)
+		want = append(want, pixel...)
+		want = append(want, black...)
+	}
+	if string(got) != string(want) {
+		t.Errorf("framebuffer: want %x, got %x", want, got)
+	}
+}
+
+func TestFrameSettleDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-test-job")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFrame(t, path.Join(dir, "frame-000001.png"), 4, 4, color.White)
+
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, false /*virtual*/, nil)
+	exe.display = NoopDisplay{}
+	exe.frameSettleDelay = 200 * time.Millisecond
+	cmd, err := parseGcodeCommand(dir, "M7820 S1")
+	if err != nil {
+		t.Fatalf("parseGcodeCommand: %v", err)
+	}
+	start := time.Now()
+	if err := cmd.Run(context.Background(), "job", 3, up, exe, false); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < exe.frameSettleDelay {
+		t.Errorf("Run returned after %v, want it to wait for the settle delay of %v", elapsed, exe.frameSettleDelay)
+	}
+
+	// The settle delay is canceled with the job.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cmd.Run(ctx, "job", 3, up, exe, false); err != context.Canceled {
+		t.Errorf("Run: want %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// The time to connect to the server (and the proxy, if any) and to complete the TLS handshake.
+	defaultDownloadConnectTimeout = 30 * time.Second
+	// A download fails, if the server sends nothing for that long, either the response headers or the body.
+	defaultDownloadReadTimeout = time.Minute
+)
+
+// newDownloadClient returns an HTTP client for job downloads. It honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY,
+// so that downloads work behind a corporate proxy. The body read timeout is enforced by getURL, see stallReader.
+func newDownloadClient(connectTimeout, readTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: readTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// stallReader calls stall, if no data is read for timeout. Unlike http.Client.Timeout, it does not limit
+// the time of the whole download, so large jobs on slow links are fine, as long as the data flows.
+// Zero timeout disables it.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, stall func()) *stallReader {
+	sr := &stallReader{r: r, timeout: timeout}
+	if timeout > 0 {
+		sr.timer = time.AfterFunc(timeout, stall)
+	}
+	return sr
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 && sr.timer != nil {
+		sr.timer.Reset(sr.timeout)
+	}
+	return n, err
+}
+
+// Stop stops the timer. It returns false, if the stall func has already been called.
+func (sr *stallReader) Stop() bool {
+	if sr.timer == nil {
+		return true
+	}
+	return sr.timer.Stop()
+}
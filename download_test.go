@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDownloadExecutor(readTimeout time.Duration) *Executor {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	exe.httpClient = newDownloadClient(time.Second, readTimeout)
+	exe.downloadReadTimeout = readTimeout
+	return exe
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall-body" {
+			w.Write([]byte("G90\n"))
+			w.(http.Flusher).Flush()
+		}
+		// Never respond (or never finish the body).
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	exe := newTestDownloadExecutor(200 * time.Millisecond)
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/stall-headers", "timeout awaiting response headers"},
+		{"/stall-body", "the download has stalled"},
+	} {
+		start := time.Now()
+		_, err := exe.download(context.Background(), srv.URL+tc.path)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("download(%s): want an error with %q, got %v", tc.path, tc.want, err)
+		}
+		if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+			t.Errorf("download(%s): took %v, want it to time out soon after 200ms", tc.path, elapsed)
+		}
+	}
+}
+
+func TestDownloadSlowBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The whole download takes longer than the read timeout, but the data keeps flowing.
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("G1 Z1\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	exe := newTestDownloadExecutor(300 * time.Millisecond)
+	data, err := exe.download(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 5 {
+		t.Errorf("want 5 lines, got %d: %q", got, data)
+	}
+}
+
+func TestDownloadNoReadTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("G90\n"))
+	}))
+	defer srv.Close()
+
+	// Zero disables the read timeout.
+	exe := newTestDownloadExecutor(0)
+	data, err := exe.download(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if string(data) != "G90\n" {
+		t.Errorf("want G90, got %q", data)
+	}
+}
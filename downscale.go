@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+const snapshotJPEGQuality = 85
+
+// Image formats of the supported mime types, as named by image.Decode.
+var mimeFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+// downscaleImage scales a PNG or JPEG image down, so that neither dimension exceeds maxDim,
+// and encodes it in the same format. The aspect ratio is kept. If maxDim is not positive
+// or the image is small enough, the data is returned as is.
+func downscaleImage(data []byte, maxDim int) ([]byte, error) {
+	return convertImage(data, maxDim, "")
+}
+
+// convertImage is like downscaleImage, but encodes the image as mimeType, if it's in another format.
+// An empty mimeType keeps the format.
+func convertImage(data []byte, maxDim int, mimeType string) ([]byte, error) {
+	if maxDim <= 0 && mimeType == "" {
+		return data, nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	want := format
+	if mimeType != "" {
+		var ok bool
+		if want, ok = mimeFormats[mimeType]; !ok {
+			return nil, fmt.Errorf("unsupported mime type %q", mimeType)
+		}
+	}
+	small := maxDim <= 0 || cfg.Width <= maxDim && cfg.Height <= maxDim
+	if small && want == format {
+		return data, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	res := img
+	if !small {
+		w, h := maxDim, cfg.Height*maxDim/cfg.Width
+		if cfg.Height > cfg.Width {
+			w, h = cfg.Width*maxDim/cfg.Height, maxDim
+		}
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+		if gray, ok := img.(*image.Gray16); ok {
+			// Depth frames. Averaging would make up distances on the edges of objects, so the nearest pixel is taken.
+			res = scaleNearest(gray, w, h)
+		} else {
+			res = scaleBox(img, w, h)
+		}
+	}
+	var buf bytes.Buffer
+	switch want {
+	case "jpeg":
+		err = jpeg.Encode(&buf, res, &jpeg.Options{Quality: snapshotJPEGQuality})
+	case "png":
+		err = png.Encode(&buf, res)
+	default:
+		err = fmt.Errorf("unsupported image format %q", want)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func scaleNearest(src *image.Gray16, w, h int) *image.Gray16 {
+	b := src.Bounds()
+	dst := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + (2*y+1)*b.Dy()/(2*h)
+		for x := 0; x < w; x++ {
+			sx := b.Min.X + (2*x+1)*b.Dx()/(2*w)
+			dst.SetGray16(x, y, src.Gray16At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// scaleBox averages the source pixels, which fall into every destination pixel.
+func scaleBox(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func encodeTestJPEG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownscaleImage(t *testing.T) {
+	data := encodeTestJPEG(t, 1920, 1080)
+	res, err := downscaleImage(data, 640)
+	if err != nil {
+		t.Fatalf("downscaleImage: %v", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(res))
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if format != "jpeg" || cfg.Width != 640 || cfg.Height != 360 {
+		t.Errorf("want a 640x360 jpeg, got a %dx%d %s", cfg.Width, cfg.Height, format)
+	}
+
+	// Small images and disabled downscaling keep the data as is.
+	for _, maxDim := range []int{0, 1920} {
+		if res, err := downscaleImage(data, maxDim); err != nil || !bytes.Equal(res, data) {
+			t.Errorf("downscaleImage(maxDim=%d): want the data as is, got %d bytes, %v", maxDim, len(res), err)
+		}
+	}
+}
+
+func TestDownscaleImageDepth(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 100, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 100; x++ {
+			img.SetGray16(x, y, color.Gray16{Y: uint16(1000 * (y / 200))})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	res, err := downscaleImage(buf.Bytes(), 100)
+	if err != nil {
+		t.Fatalf("downscaleImage: %v", err)
+	}
+	scaled, err := png.Decode(bytes.NewReader(res))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	gray, ok := scaled.(*image.Gray16)
+	if !ok {
+		t.Fatalf("want a 16-bit depth image, got %T", scaled)
+	}
+	if b := gray.Bounds(); b.Dx() != 25 || b.Dy() != 100 {
+		t.Errorf("want 25x100, got %dx%d", b.Dx(), b.Dy())
+	}
+	// No made up depths on the edge.
+	for y := 0; y < 100; y++ {
+		if d := gray.Gray16At(0, y).Y; d != 0 && d != 1000 {
+			t.Errorf("depth at row %d: want 0 or 1000, got %d", y, d)
+		}
+	}
+}
+
+// imageSnapshotter saves the same JPEG for every snapshot.
+type imageSnapshotter struct {
+	data []byte
+}
+
+func (s *imageSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
+	return ioutil.WriteFile(prefix+"camera0.jpg", s.data, 0644)
+}
+
+func TestSnapshotDownscaled(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, &imageSnapshotter{data: encodeTestJPEG(t, 1920, 1080)})
+	exe.SetSnapshotMaxDim(800)
+
+	if err := exe.Snapshot(context.Background()); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	msgs := rec.ByType("notify-snapshot")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-snapshot message, got %d", len(msgs))
+	}
+	url, ok := msgs[0].Cameras["realsense-camera0"]
+	if !ok {
+		t.Fatalf("no realsense-camera0 in the snapshot, got %d cameras", len(msgs[0].Cameras))
+	}
+	data, err := base64.StdEncoding.DecodeString(url[strings.Index(url, ",")+1:])
+	if err != nil {
+		t.Fatalf("failed to decode the data URL: %v", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if cfg.Width != 800 || cfg.Height != 450 {
+		t.Errorf("want 800x450, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DryRunDownlink pretends to be a connected device, but never talks to one.
+// Unlike VirtualDownlink, it does not emulate timing of the commands: every command
+// is validated, logged and immediately acknowledged. It's useful to check a job end-to-end
+// against the real UI without risking the hardware.
+type DryRunDownlink struct {
+	up *Uplink
+
+	mu      sync.Mutex
+	written []string
+}
+
+func NewDryRunDownlink(up *Uplink) *DryRunDownlink {
+	return &DryRunDownlink{up: up}
+}
+
+func (dl *DryRunDownlink) Connected() bool { return true }
+
+func (dl *DryRunDownlink) WaitForConnection(wait time.Duration) bool { return true }
+
+func (dl *DryRunDownlink) Disconnect() error {
+	dl.up.logf("dry run: disconnect")
+	return nil
+}
+
+func (dl *DryRunDownlink) Reconnect() error {
+	dl.up.logf("dry run: reconnect")
+	return nil
+}
+
+func (dl *DryRunDownlink) WriteAndWaitForOK(ctx context.Context, line string) error {
+	dl.up.logf("dry run> %s", line)
+	if _, err := parseGcodeCommand("" /*baseDir*/, line); err != nil {
+		return fmt.Errorf("failed to parse gcode %q: %v", line, err)
+	}
+	dl.mu.Lock()
+	dl.written = append(dl.written, line)
+	dl.mu.Unlock()
+	return nil
+}
+
+// Written returns all commands which would have been sent to the device.
+func (dl *DryRunDownlink) Written() []string {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return append([]string(nil), dl.written...)
+}
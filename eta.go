@@ -0,0 +1,54 @@
+package main
+
+import "time"
+
+const (
+	// Weight of the last layer in the moving average of the layer time.
+	layerTimeAlpha = 0.3
+	// The layer-based estimate is only used after that many layers are timed.
+	minTimedLayers = 3
+)
+
+// layerETA learns the time per layer from the frame index changes during a print
+// and estimates the remaining time from the moving average of it. The time before the first frame
+// is not counted, because it includes homing and heating. The slow early layers fade out of the average.
+type layerETA struct {
+	numFrames int
+	lastFrame int
+	lastTime  time.Time
+	avg       float64 // Seconds per layer.
+	timed     int
+}
+
+func newLayerETA(numFrames int) *layerETA {
+	return &layerETA{numFrames: numFrames, lastFrame: -1}
+}
+
+// Frame records that the frame with the given index is displayed at the given time.
+func (e *layerETA) Frame(idx int, now time.Time) {
+	if e.lastFrame >= 0 && idx > e.lastFrame {
+		perLayer := now.Sub(e.lastTime).Seconds() / float64(idx-e.lastFrame)
+		if e.timed == 0 {
+			e.avg = perLayer
+		} else {
+			e.avg += layerTimeAlpha * (perLayer - e.avg)
+		}
+		e.timed++
+	}
+	if idx > e.lastFrame {
+		e.lastFrame = idx
+		e.lastTime = now
+	}
+}
+
+// Remaining returns the estimated remaining time. ok is false, if not enough layers are timed yet.
+func (e *layerETA) Remaining() (remaining time.Duration, ok bool) {
+	if e.timed < minTimedLayers || e.numFrames <= 0 {
+		return 0, false
+	}
+	left := e.numFrames - e.lastFrame
+	if left < 0 {
+		left = 0
+	}
+	return time.Duration(e.avg * float64(left) * float64(time.Second)), true
+}
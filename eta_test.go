@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLayerETAConverges(t *testing.T) {
+	eta := newLayerETA(100)
+	now := time.Now()
+	eta.Frame(0, now)
+	if _, ok := eta.Remaining(); ok {
+		t.Errorf("Remaining: want no estimate before any layer is timed")
+	}
+	// Slow early layers (heating, first layers with long exposure), then steady 10 second layers.
+	for idx := 1; idx <= 50; idx++ {
+		layer := 10 * time.Second
+		if idx <= 3 {
+			layer = time.Minute
+		}
+		now = now.Add(layer)
+		eta.Frame(idx, now)
+	}
+	remaining, ok := eta.Remaining()
+	if !ok {
+		t.Fatalf("Remaining: want an estimate after 50 layers")
+	}
+	want := 50 * 10 * time.Second
+	if diff := math.Abs(remaining.Seconds() - want.Seconds()); diff > 0.05*want.Seconds() {
+		t.Errorf("Remaining: want about %v, got %v", want, remaining)
+	}
+}
+
+func TestLayerETASkippedFrames(t *testing.T) {
+	eta := newLayerETA(10)
+	now := time.Now()
+	eta.Frame(0, now)
+	for _, idx := range []int{2, 4, 6} {
+		now = now.Add(20 * time.Second)
+		eta.Frame(idx, now)
+	}
+	// A repeated frame index does not count as a layer.
+	eta.Frame(6, now.Add(time.Hour))
+	if remaining, ok := eta.Remaining(); !ok || remaining != 40*time.Second {
+		t.Errorf("Remaining: want 40s for 4 layers of 10s, got %v (ok: %v)", remaining, ok)
+	}
+}
@@ -8,27 +8,75 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
-	"github.com/robodone/robosla-common/pkg/autoupdate"
 	"github.com/vincent-petithory/dataurl"
 )
 
 const (
 	numSaturationDelays = 20
+	// The current command is reported not more often than that.
+	currentCommandNotifyPeriod = time.Second
+	// A job is dumped in chunks of jobDumpChunk commands, one chunk per jobDumpInterval. See DumpJob.
+	jobDumpChunk    = 100
+	jobDumpInterval = 100 * time.Millisecond
+
+	// With buffer flow control enabled, we pause before sending the next command,
+	// if there are that few free slots in the firmware buffers.
+	lowFreeBuffers = 1
+	// How long to pause, when the firmware buffers are almost full.
+	bufferPacingDelay = 50 * time.Millisecond
+	// After that many pauses, the next command is sent anyway. The resends are the worst that can happen then.
+	maxBufferPauses = 20
+	// The free buffer counts are only reported with an ok of a queued command: M105 is answered right away,
+	// and its ok carries no buffer counts. After a pause, they are refreshed with this command.
+	bufferQueryCmd = "G4 P0"
 
 	MDisplayFrame = 7820
 	MHostDwell    = 7821
 	MSnapshot     = 7822
 	MWaitForIdle  = 7823
+	MFanRamp      = 7824
+
+	// A job command, which fails, is retried with the backoff growing from minRetryBackoff to maxRetryBackoff.
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+	// The job fails, if a command still fails after that many retries or that long.
+	defaultMaxWriteRetries   = 10
+	defaultMaxWriteRetryTime = 5 * time.Minute
+
+	// The fan speed is changed that often during a fan ramp. See MFanRamp.
+	fanRampStep = 250 * time.Millisecond
+
+	defaultBaseDir = "/opt/robodone"
+
+	defaultMaxDownloadSize = 256 << 20
+
+	// Manual commands longer than that are rejected.
+	maxCommandLen = 256
+
+	// M-codes, which take free text instead of letter/number words:
+	// M23 (select SD file), M117 (LCD message) and M118 (print to the host).
+	defaultRawTextMCodes = "23,117,118"
+
+	// defaultFramePatterns cover the frame names produced by the supported slicers.
+	defaultFramePatterns = "frame-%06d.png"
+
+	// The post-snapshot hook is killed, if it runs longer than that.
+	postSnapshotTimeout = time.Minute
+	// Only that much of the hook output is logged.
+	maxHookOutput = 8000
 )
 
 type Executor struct {
@@ -36,14 +84,128 @@ type Executor struct {
 	down    Downlink
 	virtual bool
 	rss     Snapshotter
+	// maxZ is the maximum Z a job is allowed to command. Zero means no limit.
+	maxZ float64
+	// homeCmd is sent to the device at the start of every job. "none" disables it.
+	homeCmd string
+	// If bufferFlowControl is true, the free space reported by the firmware is used to pace the commands.
+	bufferFlowControl bool
+	// maxDownloadSize limits the size of downloaded jobs. Zero means no limit.
+	maxDownloadSize int64
+	// httpClient downloads jobs. See newDownloadClient.
+	httpClient *http.Client
+	// A download fails, if no data is received for downloadReadTimeout.
+	downloadReadTimeout time.Duration
+	// baseDir is where jobs and snapshot packs are stored. It must be writable.
+	baseDir string
+	// createTemp is ioutil.TempFile. It's replaced in tests.
+	createTemp func(dir, pattern string) (*os.File, error)
+	// activities block autoupdates while long operations are running.
+	activities *ActivityTracker
+	// framePatterns are fmt patterns of frame file names relative to the job dir. The first existing one is used.
+	framePatterns []string
+	// display shows the frames on the LCD. See NewFrameDisplay.
+	display FrameDisplay
+	// If frameProgress is true, the progress of the jobs with frames is the index of the displayed frame out of
+	// the number of frames. Otherwise, it's guessed from the command index. M73 is preferred anyway.
+	frameProgress bool
+	// frameSettleDelay is the pause after a frame is shown, so that the LCD is fully updated before the exposure starts.
+	frameSettleDelay time.Duration
+	// postSnapshotCmd is run after every snapshot with the snapshot prefix as the last argument.
+	// It's set by the operator with a flag only, so the cloud can't run arbitrary commands with it.
+	postSnapshotCmd string
+	// A job command, which fails, is retried up to maxWriteRetries times and for up to maxWriteRetryTime,
+	// whichever comes first. Zero means no limit.
+	maxWriteRetries   int
+	maxWriteRetryTime time.Duration
+	// If resumeOnReset is true, a job continues after the connection is lost and restored, like after a brief USB glitch.
+	// The unconfirmed command is sent again. It's only safe for the printers, which don't reset, when the port is opened.
+	resumeOnReset bool
+	// If lenientGcode is true, the job lines which can't be parsed are skipped with a warning.
+	lenientGcode bool
+	// gpio and gpioPins are used to read the door switch and the UV LED state. Jobs don't start while the door is open.
+	gpio     GPIO
+	gpioPins GPIOPins
+	// snapSem serializes snapshots, because the cameras can't take two at once. See acquireSnapshot.
+	snapSem chan bool
+	// wd is the liveness watchdog, if it's enabled. ExecuteGcode beats it as "executor" for every command.
+	wd *LivenessWatchdog
+	// policy restricts the commands of jobs, like the ones taken from ts.gcode. Nil allows any command.
+	policy *CommandPolicy
+
 	stateMu sync.Mutex
 	state   string
 	idleCh  chan bool
+	// The number of lines skipped in the last job. See lenientGcode.
+	skippedLines int
+	// The name and the parsed commands of the last job loaded by ExecuteGcode. See DumpJob.
+	loadedJobName string
+	loadedCmds    []*Cmd
+	// The commands sent around every job. See SetJobGcode.
+	gcode jobGcode
+	// maxTemps are the temperature limits of jobs. A job is aborted, if one is exceeded.
+	maxTemps TempLimits
+	// If snapshotMaxDim is positive, snapshot images are downscaled to fit it before they are sent to the server.
+	// The files passed to the post-snapshot hook stay in full resolution.
+	snapshotMaxDim int
+	// queuedSnaps are the camera sets (see snapshotKey) with a snapshot waiting for the current one to complete.
+	queuedSnaps map[string]bool
 }
 
+// jobGcode are the machine-specific commands, which are not a part of job files. start is sent after homing,
+// before the first command of a job, like setting the acceleration or a prime line. end is sent after a job succeeds.
+// abort is sent after a job fails or is canceled, like turning off the UV LED.
+type jobGcode struct {
+	start, end, abort []*Cmd
+}
+
+const abortTimeout = 70 * time.Second
+
 // NB: the caller MUST set downlink before using the executor.
 func NewExecutor(up *Uplink, virtual bool, rss Snapshotter) *Executor {
-	return &Executor{up: up, virtual: virtual, rss: rss, idleCh: make(chan bool)}
+	return &Executor{
+		up:                  up,
+		virtual:             virtual,
+		rss:                 rss,
+		baseDir:             defaultBaseDir,
+		createTemp:          ioutil.TempFile,
+		maxDownloadSize:     defaultMaxDownloadSize,
+		httpClient:          newDownloadClient(defaultDownloadConnectTimeout, defaultDownloadReadTimeout),
+		downloadReadTimeout: defaultDownloadReadTimeout,
+		maxWriteRetries:     defaultMaxWriteRetries,
+		maxWriteRetryTime:   defaultMaxWriteRetryTime,
+		activities:          NewActivityTracker(),
+		framePatterns:       parseFramePatterns(defaultFramePatterns),
+		display:             FbiDisplay{},
+		idleCh:              make(chan bool),
+		snapSem:             make(chan bool, 1),
+	}
+}
+
+// jobsDir is where the downloaded jobs are extracted.
+func (exe *Executor) jobsDir() string {
+	return path.Join(exe.baseDir, "jobs")
+}
+
+// CheckWritable makes sure that the base dir is writable, so that we fail early
+// instead of in the middle of a job.
+func (exe *Executor) CheckWritable() error {
+	if err := checkWritable(exe.baseDir, exe.createTemp); err != nil {
+		return fmt.Errorf("%v. Is the filesystem read-only? Use -base_dir to point the agent to a writable directory", err)
+	}
+	return nil
+}
+
+func checkWritable(dir string, createTemp func(dir, pattern string) (*os.File, error)) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("directory %s can't be created: %v", dir, err)
+	}
+	f, err := createTemp(dir, ".write-probe-")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 func isCanceled(ctx context.Context) bool {
@@ -69,7 +231,11 @@ func (exe *Executor) ExecuteFewCommands(ctx context.Context, cmds ...string) (er
 			return context.Canceled
 		}
 		// TODO: support host commands this way.
-		err := exe.down.WriteAndWaitForOK(ctx, cmds[i])
+		text, err := sanitizeCommand(cmds[i])
+		if err != nil {
+			return fmt.Errorf("invalid command %q: %v", cmds[i], err)
+		}
+		err = exe.down.WriteAndWaitForOK(ctx, text)
 		if err != nil {
 			return fmt.Errorf("failed to write a command: %v", err)
 		}
@@ -81,29 +247,69 @@ func (exe *Executor) ExecuteGcode(ctx context.Context, jobName, gcodePath string
 	if !exe.down.Connected() {
 		return errors.New("can't execute gcode: printer not connected")
 	}
-	autoupdate.DisableUpdates()
-	defer autoupdate.EnableUpdates()
+	if err := exe.checkDoor(); err != nil {
+		return fmt.Errorf("job rejected: %v", err)
+	}
+	defer exe.activities.Begin("job " + jobName)()
 	exe.up.SetJobName(jobName)
 	defer exe.up.SetJobName("")
+	// Between jobs, there's nothing to watch.
+	defer exe.wd.Forget("executor")
 
 	exe.up.NotifyJobProgress(jobName, 0.01 /*progress*/, 0 /*elapsed*/, 0 /*remaining*/)
 
-	// Home the printer before the download is completed. This will save us some time later.
-	// Note: this is incompatible with other devices, like robotic arms. We will care about that later.
-	// It will likely have different executors for each device kind.
-	//var wg sync.WaitGroup
-	//wg.Add(1)
-	//go func() {
-	//	defer wg.Done()
-	//	if err := exe.down.WriteAndWaitForOK(ctx, "G28 Z0"); err != nil {
-	//		exe.up.logf("Failed to home the printer. Error: %v", err)
-	//	}
-	//}()
-
-	cmds, numFrames, err := loadGcode(gcodePath)
+	// Stale replies, like the ones left in the OS buffer from a previous session, could be taken for the acks
+	// of the first commands. Discard them before anything is sent.
+	if fl, ok := exe.down.(inputFlusher); ok {
+		if err := fl.Flush(ctx); err != nil {
+			return fmt.Errorf("failed to flush the input from the device: %v", err)
+		}
+	}
+
+	// Home the printer while the job is being loaded. This will save us some time later.
+	// Note: homing is incompatible with other devices, like robotic arms or CNC, so it's configurable.
+	// If the job fails before the homing is complete, like when it's rejected, the homing is canceled,
+	// and the job waits for it, so that nothing is sent to the printer after the job has ended.
+	homeCtx, cancelHoming := context.WithCancel(ctx)
+	homed := make(chan bool)
+	defer func() {
+		cancelHoming()
+		<-homed
+	}()
+	if exe.homeCmd != "" && exe.homeCmd != "none" {
+		go func() {
+			defer close(homed)
+			if err := exe.down.WriteAndWaitForOK(homeCtx, exe.homeCmd); err != nil {
+				exe.up.logf("Failed to home the printer. Error: %v", err)
+			}
+		}()
+	} else {
+		close(homed)
+	}
+
+	cmds, numFrames, skipped, err := loadGcode(gcodePath, exe.lenientGcode)
 	if err != nil {
 		return fmt.Errorf("could not load gcode from %s: %v", gcodePath, err)
 	}
+	for _, warning := range skipped {
+		exe.up.logf("WARNING: %s", warning)
+	}
+	exe.setSkippedLines(len(skipped))
+	exe.setLoadedJob(jobName, cmds)
+
+	if exe.maxZ > 0 {
+		if err := checkMaxZ(cmds, exe.maxZ); err != nil {
+			return fmt.Errorf("job rejected: %v", err)
+		}
+	}
+	for _, cmd := range cmds {
+		if err := checkTarget(exe.down, cmd.Text); err != nil {
+			return fmt.Errorf("job rejected: %v", err)
+		}
+		if err := exe.policy.Check(cmd.Text); err != nil {
+			return fmt.Errorf("job rejected: %v", err)
+		}
+	}
 
 	exe.up.NotifyJobProgress(jobName, 0.02 /*progress*/, 0 /*elapsed*/, 0 /*remaining*/)
 	exe.up.NotifyFrameIndex(jobName, 0, numFrames)
@@ -111,8 +317,13 @@ func (exe *Executor) ExecuteGcode(ctx context.Context, jobName, gcodePath string
 		return context.Canceled
 	}
 	exe.up.logf("Loaded %d gcode commands from %s.", len(cmds), gcodePath)
-	// Wait until it's homed.
-	//wg.Wait()
+	// Wait until it's homed. The printer may not abort the homing on cancel, so the wait is canceled separately.
+	select {
+	case <-homed:
+	case <-ctx.Done():
+		exe.up.logf("The job %s is canceled while homing", jobName)
+		return context.Canceled
+	}
 
 	if !exe.down.WaitForConnection(time.Minute) {
 		return ErrNoDownlinkConnection
@@ -120,39 +331,60 @@ func (exe *Executor) ExecuteGcode(ctx context.Context, jobName, gcodePath string
 	// Wait to allow the downlink to read all pending messages.
 	time.Sleep(time.Second)
 
-	// No matter what, if this function returns an error, we will try to turn off UV LED.
-	//defer func() {
-	//	if err == nil {
-	//		return
-	//	}
-	//	exe.up.NotifyJobProgress(jobName, 0, 0, 0)
-	//	// Don't block it for more than 70*3 seconds.
-	//	ctx, _ := context.WithTimeout(context.Background(), 70*time.Second)
-	//	// Best effort.
-	//	for _, cmd := range []string{"M107", "G1 Z170 F200", "M84"} {
-	//		if err := exe.down.WriteAndWaitForOK(ctx, cmd); err != nil {
-	//			exe.up.logf("Failed to run abort procedures. Error: %v", err)
-	//		}
-	//	}
-	//}()
+	gcode := exe.jobGcode()
+	maxTemps := exe.MaxTemps()
+	// No matter what, if this function returns an error, we will try to bring the device into a safe state,
+	// like turning off the UV LED.
+	defer func() {
+		if err == nil || len(gcode.abort) == 0 {
+			return
+		}
+		// The job context is likely canceled. Don't block it for more than abortTimeout.
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		// Best effort.
+		if abortErr := exe.runInjectedCommands(ctx, jobName, gcode.abort); abortErr != nil {
+			exe.up.logf("Failed to run the abort commands. Error: %v", abortErr)
+		}
+	}()
+	if err := exe.runInjectedCommands(ctx, jobName, gcode.start); err != nil {
+		return fmt.Errorf("failed to run the start commands: %v", err)
+	}
 
+	// If the job has M73 (set print progress), we use it instead of guessing the progress from the command index.
+	useM73 := hasProgressCommands(cmds)
+	useFrames := !useM73 && exe.frameProgress && numFrames > 0
 	var lastProgress float64
+	var lastCurrentCommandNotify time.Time
 	start := time.Now()
 	var profileStart time.Time
 	skipN := 10
+	// If the job displays frames, the layer times give a better estimate than the command index.
+	eta := newLayerETA(numFrames)
 	for i := 0; i < len(cmds); i++ {
+		exe.wd.Beat("executor")
 		if isCanceled(ctx) {
 			return context.Canceled
 		}
+		if err := exe.checkTemps(maxTemps); err != nil {
+			return fmt.Errorf("job aborted: %v", err)
+		}
 		// Skip first skipN commands for to make estimates closer to the reality.
 		if i >= skipN && profileStart.IsZero() {
 			profileStart = time.Now()
 		}
-		progress := float64(int(float64(i*1000)/float64(len(cmds)))) / 10
-		if progress == 0 {
-			progress = 0.05
-		}
-		if progress > lastProgress {
+		if useM73 {
+			// The slicer knows better, how long the job will take. Report its estimates as is.
+			if cmds[i].Type == "M" && cmds[i].Idx == 73 {
+				if progress, ok := cmds[i].Dict['P']; ok && progress > lastProgress {
+					remaining := time.Duration(cmds[i].Dict['R'] * float64(time.Minute))
+					exe.up.NotifyJobProgress(jobName, progress, time.Now().Sub(start), remaining)
+					lastProgress = progress
+				}
+			}
+		} else if useFrames {
+			// The progress is reported, when a frame is displayed. See below.
+		} else if progress := commandProgress(i, len(cmds)); progress > lastProgress {
 			now := time.Now()
 			elapsed := now.Sub(start)
 			var remaining time.Duration
@@ -163,10 +395,17 @@ func (exe *Executor) ExecuteGcode(ctx context.Context, jobName, gcodePath string
 					remaining = time.Duration(float64(profileElapsed) * (100 - profileProgress) / profileProgress)
 				}
 			}
+			if layerRemaining, ok := eta.Remaining(); ok {
+				remaining = layerRemaining
+			}
 
 			exe.up.NotifyJobProgress(jobName, progress, elapsed, remaining)
 			lastProgress = progress
 		}
+		if now := time.Now(); now.Sub(lastCurrentCommandNotify) >= currentCommandNotifyPeriod {
+			exe.up.NotifyCurrentCommand(jobName, i, cmds[i])
+			lastCurrentCommandNotify = now
+		}
 		if cmds[i].IsHost() {
 			// We should handle host command failures gracefully. At the very least,
 			// we'll need to turn off the UV light.
@@ -174,42 +413,197 @@ func (exe *Executor) ExecuteGcode(ctx context.Context, jobName, gcodePath string
 			if err := cmds[i].Run(ctx, jobName, numFrames, exe.up, exe, exe.virtual); err != nil {
 				return fmt.Errorf("failed to execute command %+v: %v", cmds[i], err)
 			}
+			if cmds[i].Idx == MDisplayFrame {
+				frameIdx := int(cmds[i].Dict['S'])
+				eta.Frame(frameIdx, time.Now())
+				if useFrames {
+					if progress := frameProgress(frameIdx, numFrames); progress > lastProgress {
+						remaining, _ := eta.Remaining()
+						exe.up.NotifyJobProgress(jobName, progress, time.Now().Sub(start), remaining)
+						lastProgress = progress
+					}
+				}
+			}
 			continue
 		}
-		for {
-			err := exe.down.WriteAndWaitForOK(ctx, cmds[i].Text)
-			if err == nil {
-				break
-			}
-			if err == ErrConnectionReset {
-				exe.up.logf("Connection reset while printing. Sorry. There's nothing we can do about it.")
-				return err
+		exe.paceForBuffers(ctx)
+		if err := exe.writeWithRetries(ctx, cmds[i].Text); err != nil {
+			return err
+		}
+	}
+	if err := exe.runInjectedCommands(ctx, jobName, gcode.end); err != nil {
+		return fmt.Errorf("failed to run the end commands: %v", err)
+	}
+	return nil
+}
+
+// writeWithRetries writes a job command and retries it with a backoff, if it fails.
+// It gives up after maxWriteRetries retries or maxWriteRetryTime, whichever comes first.
+func (exe *Executor) writeWithRetries(ctx context.Context, text string) error {
+	start := time.Now()
+	backoff := minRetryBackoff
+	// A command is not retried or resumed, if the device has reset meanwhile, like a printer, which reboots when the port is opened.
+	sr, hasStats := exe.down.(statsReporter)
+	var resets int64
+	if hasStats {
+		resets = sr.Stats().Resets
+	}
+	for retries := 0; ; retries++ {
+		if hasStats && sr.Stats().Resets != resets {
+			exe.up.logf("The printer has reset, while %q was retried. Sorry. There's nothing we can do about it.", text)
+			return ErrDeviceReset
+		}
+		err := exe.writeAndBeat(ctx, text)
+		if err == nil {
+			return nil
+		}
+		if err == ErrConnectionReset && exe.resumeOnReset {
+			// The downlink resynchronizes the line numbers after the reconnect, and the command is retried below.
+			exe.up.logf("Connection reset while printing. Will resume from %q after the reconnect.", text)
+		} else if err == ErrConnectionReset || err == ErrDeviceReset {
+			exe.up.logf("Connection reset while printing: %v. Sorry. There's nothing we can do about it.", err)
+			return err
+		}
+		if err == ErrPrinterHalted {
+			return err
+		}
+		if _, ok := err.(*SafetyStopError); ok {
+			return err
+		}
+		if _, ok := err.(*TempCutoffError); ok {
+			return err
+		}
+		if isCanceled(ctx) {
+			return context.Canceled
+		}
+		if exe.maxWriteRetries > 0 && retries >= exe.maxWriteRetries {
+			return fmt.Errorf("failed to write %q after %d retries: %v", text, retries, err)
+		}
+		if elapsed := time.Now().Sub(start); exe.maxWriteRetryTime > 0 && elapsed >= exe.maxWriteRetryTime {
+			return fmt.Errorf("failed to write %q for %v: %v", text, elapsed, err)
+		}
+		exe.up.logf("WriteAndWaitForOK failed: %v. Retrying in %v...", err, backoff)
+		select {
+		case <-ctx.Done():
+			return context.Canceled
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		if !exe.down.WaitForConnection(time.Minute) {
+			return ErrNoDownlinkConnection
+		}
+	}
+}
+
+// runInjectedCommands runs the start, end or abort commands of a job. See jobGcode.
+func (exe *Executor) runInjectedCommands(ctx context.Context, jobName string, cmds []*Cmd) error {
+	for _, cmd := range cmds {
+		if isCanceled(ctx) {
+			return context.Canceled
+		}
+		if cmd.IsHost() {
+			if err := cmd.Run(ctx, jobName, 0 /*numFrames*/, exe.up, exe, exe.virtual); err != nil {
+				return fmt.Errorf("failed to execute command %+v: %v", cmd, err)
 			}
-			exe.up.logf("WriteAndWaitForOK failed: %v. Retrying...", err)
-			if isCanceled(ctx) {
-				return context.Canceled
+			continue
+		}
+		if err := exe.writeAndBeat(ctx, cmd.Text); err != nil {
+			return fmt.Errorf("failed to write %q: %v", cmd.Text, err)
+		}
+	}
+	return nil
+}
+
+// writeAndBeat is WriteAndWaitForOK, which beats the liveness watchdog, while the downlink keeps receiving something,
+// like the temperatures during M109 or the busy lines during G28, so that a long command is not taken for a wedge.
+// A downlink without the link stats is trusted: it's probed by the watchdog on its own.
+func (exe *Executor) writeAndBeat(ctx context.Context, text string) error {
+	if exe.wd == nil {
+		return exe.down.WriteAndWaitForOK(ctx, text)
+	}
+	done, exited := make(chan bool), make(chan bool)
+	defer func() {
+		// No beat must come after the job has ended and the executor is forgotten.
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		sr, hasStats := exe.down.(statsReporter)
+		var bytesIn int64
+		if hasStats {
+			bytesIn = sr.Stats().BytesIn
+		}
+		tick := time.NewTicker(exe.wd.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
 			}
-			if !exe.down.WaitForConnection(time.Minute) {
-				return ErrNoDownlinkConnection
+			if !hasStats {
+				exe.wd.Beat("executor")
+			} else if n := sr.Stats().BytesIn; n != bytesIn {
+				bytesIn = n
+				exe.wd.Beat("executor")
 			}
 		}
+	}()
+	return exe.down.WriteAndWaitForOK(ctx, text)
+}
+
+// bufferReporter is implemented by downlinks, which know the free space in the firmware buffers.
+type bufferReporter interface {
+	FreeBuffers() (buf BufferInfo, ok bool)
+}
+
+// paceForBuffers pauses, while the firmware buffers are almost full. That allows to avoid
+// unnecessary resends under load. It returns true, if it has paused.
+func (exe *Executor) paceForBuffers(ctx context.Context) bool {
+	br, ok := exe.down.(bufferReporter)
+	if !exe.bufferFlowControl || !ok {
+		return false
+	}
+	for pauses := 0; ; pauses++ {
+		buf, ok := br.FreeBuffers()
+		if !ok || (buf.Planner > lowFreeBuffers && buf.Block > lowFreeBuffers) {
+			return pauses > 0
+		}
+		if pauses >= maxBufferPauses {
+			exe.up.logf("The firmware buffers are still full after %d pauses. Sending the next command anyway.", pauses)
+			return true
+		}
+		select {
+		case <-time.After(bufferPacingDelay):
+		case <-ctx.Done():
+			return true
+		}
+		if err := exe.down.WriteAndWaitForOK(ctx, bufferQueryCmd); err != nil {
+			// The next job command will fail the same way, if the link is broken.
+			return true
+		}
 	}
-	return nil
 }
 
 func (exe *Executor) FetchJob(ctx context.Context, jobURL string) (gcodePath string, err error) {
+	if err := exe.CheckWritable(); err != nil {
+		return "", err
+	}
 	exe.up.logf("Downloading a job from %s", jobURL)
 	data, err := exe.getURL(ctx, jobURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch a job from %q: %v", jobURL, err)
 	}
 	// Make a best effort to create the dir for jobs.
-	os.MkdirAll("/opt/robodone/jobs", 0755)
+	os.MkdirAll(exe.jobsDir(), 0755)
 	// Make a best effort to delete old jobs.
-	if err := tryToRemoveOldJobs("/opt/robodone/jobs"); err != nil {
+	if err := tryToRemoveOldJobs(exe.jobsDir()); err != nil {
 		exe.up.logf("Failed to remove old jobs: %v. Proceeding, like it didn't happen.", err)
 	}
-	dir, err := ioutil.TempDir("/opt/robodone/jobs", "job")
+	dir, err := ioutil.TempDir(exe.jobsDir(), "job")
 	if err != nil {
 		return "", fmt.Errorf("failed to create a directory for a job: %v", err)
 	}
@@ -229,11 +623,18 @@ func (exe *Executor) FetchJob(ctx context.Context, jobURL string) (gcodePath str
 	return
 }
 
-func loadGcode(fname string) (cmds []*Cmd, numFrames int, err error) {
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// loadGcode loads and parses a job. If lenient is true, the lines which can't be parsed are skipped
+// and returned as warnings instead of failing the whole job.
+func loadGcode(fname string, lenient bool) (cmds []*Cmd, numFrames int, skipped []string, err error) {
 	data, err := ioutil.ReadFile(fname)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, nil, err
 	}
+	// Some slicers prepend a UTF-8 byte order mark, which would stick to the first command. Other bytes outside
+	// of ASCII, like Windows-1252 or UTF-8 in comments, need no care: comments are cut at the ASCII ';'.
+	data = bytes.TrimPrefix(data, utf8BOM)
 	baseDir := path.Dir(fname)
 	for i, line := range strings.Split(string(data), "\n") {
 		lineno := i + 1
@@ -248,8 +649,12 @@ func loadGcode(fname string) (cmds []*Cmd, numFrames int, err error) {
 			continue
 		}
 		cmd, err := parseGcodeCommand(baseDir, line)
+		if err != nil && lenient {
+			skipped = append(skipped, fmt.Sprintf("%s:%d: skipped unsupported gcode: %v", fname, lineno, err))
+			continue
+		}
 		if err != nil {
-			return nil, 0, fmt.Errorf("%s:%d: invalid gcode: %v", fname, lineno, err)
+			return nil, 0, nil, fmt.Errorf("%s:%d: invalid gcode: %v", fname, lineno, err)
 		}
 		if cmd.Type == "M" && cmd.Idx == MDisplayFrame {
 			frameIdx := int(cmd.Dict['S'])
@@ -262,6 +667,48 @@ func loadGcode(fname string) (cmds []*Cmd, numFrames int, err error) {
 	return
 }
 
+// commandProgress estimates job progress in percent from the index of the current command.
+func commandProgress(i, numCmds int) float64 {
+	progress := float64(int(float64(i*1000)/float64(numCmds))) / 10
+	if progress == 0 {
+		progress = 0.05
+	}
+	return progress
+}
+
+// frameProgress is the progress in percent of an SLA job, when the frame with the given index is displayed.
+func frameProgress(frameIdx, numFrames int) float64 {
+	progress := float64(int(float64(frameIdx*1000)/float64(numFrames))) / 10
+	if progress == 0 {
+		progress = 0.05
+	}
+	return progress
+}
+
+func hasProgressCommands(cmds []*Cmd) bool {
+	for _, cmd := range cmds {
+		if cmd.Type == "M" && cmd.Idx == 73 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMaxZ makes sure that no move in the job goes above maxZ.
+// Only absolute positioning is supported by the parser, so the commanded Z values are the actual ones.
+func checkMaxZ(cmds []*Cmd, maxZ float64) error {
+	for i, cmd := range cmds {
+		if cmd.Type != "G" || cmd.Idx > 3 {
+			continue
+		}
+		if z, ok := cmd.Dict['Z']; ok && z > maxZ {
+			return fmt.Errorf("command #%d (%q) moves to Z=%.3f, which exceeds the machine height of %.3f",
+				i+1, cmd.Text, z, maxZ)
+		}
+	}
+	return nil
+}
+
 func (exe *Executor) getURL(ctx context.Context, srcURL string) (res []byte, err error) {
 	// Validate url to make sure no malware is downloaded this way.
 	// Theoretically, we are dealing with secure connections, but
@@ -276,21 +723,38 @@ func (exe *Executor) getURL(ctx context.Context, srcURL string) (res []byte, err
 		return nil, errors.New("downloading arbitrary urls is disabled for security reasons. " +
 			"Let us know if you need this functionality by writing at beta@robodone.com")
 	}
-	cleanURL := purl.String()
+	return exe.download(ctx, purl.String())
+}
 
+// download gets the url with exe.httpClient. Unlike getURL, it does not validate the url.
+func (exe *Executor) download(ctx context.Context, srcURL string) (res []byte, err error) {
 	start := time.Now()
 	defer func() {
 		if err == nil {
 			exe.up.logf("Download took %.1f seconds", time.Now().Sub(start).Seconds())
 		}
 	}()
-	resp, err := http.Get(cleanURL)
+	req, err := http.NewRequest("GET", srcURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request for %q: %v", srcURL, err)
+	}
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := exe.httpClient.Do(req.WithContext(reqCtx))
 	if err != nil {
-		return nil, fmt.Errorf("http.Get(%q): %v", cleanURL, err)
+		return nil, fmt.Errorf("GET %q: %v", srcURL, err)
 	}
 	defer resp.Body.Close()
-	body, err := readAll(ctx, resp.Body)
+	if exe.maxDownloadSize > 0 && resp.ContentLength > exe.maxDownloadSize {
+		return nil, fmt.Errorf("the download is too large: %d bytes, the limit is %d bytes", resp.ContentLength, exe.maxDownloadSize)
+	}
+	sr := newStallReader(resp.Body, exe.downloadReadTimeout, cancel)
+	body, err := readAll(ctx, sr, exe.maxDownloadSize)
+	stalled := !sr.Stop()
 	if err != nil {
+		if stalled && ctx.Err() == nil {
+			return nil, fmt.Errorf("the download has stalled: no data received for %v", exe.downloadReadTimeout)
+		}
 		return nil, fmt.Errorf("failed to read HTTP response: %v", err)
 	}
 	if resp.StatusCode != 200 {
@@ -299,7 +763,8 @@ func (exe *Executor) getURL(ctx context.Context, srcURL string) (res []byte, err
 	return body, nil
 }
 
-func readAll(ctx context.Context, r io.Reader) ([]byte, error) {
+// readAll reads everything from r, but not more than maxSize bytes. Zero maxSize means no limit.
+func readAll(ctx context.Context, r io.Reader, maxSize int64) ([]byte, error) {
 	var buf bytes.Buffer
 	b := make([]byte, 128<<10)
 	for {
@@ -307,6 +772,9 @@ func readAll(ctx context.Context, r io.Reader) ([]byte, error) {
 			return nil, context.Canceled
 		}
 		n, err := r.Read(b)
+		if maxSize > 0 && int64(buf.Len()+n) > maxSize {
+			return nil, fmt.Errorf("the download is too large: more than %d bytes", maxSize)
+		}
 		if n > 0 {
 			buf.Write(b[:n])
 		}
@@ -321,6 +789,16 @@ func readAll(ctx context.Context, r io.Reader) ([]byte, error) {
 }
 
 func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
+	// A command could be addressed to a particular device, like "arm:movej(...)". The prefix is kept in the text,
+	// so that MultiDownlink routes it. Other downlinks reject it, see checkTarget.
+	if target, rest, ok := splitTarget(line); ok {
+		cmd, err := parseGcodeCommand(baseDir, rest)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Text = target + ":" + cmd.Text
+		return cmd, nil
+	}
 	// Canonical representation of gcode commands is uppercase.
 	// There are firmwares sensitive to that. It also helps to parse gcode,
 	// if the case is known.
@@ -328,6 +806,21 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 	if strings.Index(line, "movej") >= 0 || strings.Index(line, "movel") >= 0 {
 		return &Cmd{Text: line, Type: "-", Idx: 0, Dict: make(map[byte]float64), BaseDir: baseDir}, nil
 	}
+	// Some M-codes take free text, like the message of M117. It's passed verbatim.
+	if word, rest := splitFirstWord(line); len(word) > 1 && (word[0] == 'M' || word[0] == 'm') {
+		if num, err := strconv.ParseUint(word[1:], 10, 64); err == nil && rawTextMCodes[int(num)] {
+			// The line gets a line number and a checksum before it's sent, so the text must not end it early
+			// or start a comment or a checksum.
+			if i := strings.IndexFunc(rest, func(r rune) bool { return r == '*' || r == ';' || unicode.IsControl(r) }); i >= 0 {
+				return nil, fmt.Errorf("the argument of M%d contains a forbidden character %q", num, rest[i])
+			}
+			text := fmt.Sprintf("M%d", num)
+			if rest != "" {
+				text += " " + rest
+			}
+			return &Cmd{Text: text, Type: "M", Idx: int(num), Dict: map[byte]float64{'M': float64(num)}, Arg: rest, BaseDir: baseDir}, nil
+		}
+	}
 	line = strings.ToUpper(line)
 
 	// Below is a trivial gcode parser. It splits everything into the words,
@@ -338,11 +831,22 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 	words := strings.Split(line, " ")
 
 	m := make(map[byte]float64)
+	// M18 and M84 take the axes without values, like M84 E to release the extruder motor only.
+	bareAxes := words[0] == "M18" || words[0] == "M84"
+	bare := make(map[byte]bool)
 
 	for i, word := range words {
 		if word == "" {
 			continue
 		}
+		if len(word) == 1 && bareAxes && i > 0 && strings.Contains("XYZE", word) {
+			if _, ok := m[word[0]]; ok {
+				return nil, fmt.Errorf("words with duplicate letter %q", word[0])
+			}
+			m[word[0]] = 0
+			bare[word[0]] = true
+			continue
+		}
 		if len(word) == 1 {
 			return nil, fmt.Errorf("a single letter word %q is not acceptable", word)
 		}
@@ -354,8 +858,8 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 			return nil, fmt.Errorf("command has a 'G' or 'M' word %q in the middle of a command", word)
 		}
 		if letter == 'G' || letter == 'M' {
-			// Require a positive integer value
-			if _, err := strconv.ParseUint(word[1:], 10, 64); err != nil {
+			// Require a positive integer value. The only exception is G38.2, probe toward a surface.
+			if _, err := strconv.ParseUint(word[1:], 10, 64); err != nil && word != "G38.2" {
 				return nil, fmt.Errorf("invalid index to a 'G' or 'M' word %q. Must be positive integer.", word)
 			}
 		}
@@ -376,14 +880,16 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 	asm := func(letters ...byte) {
 		var tok []string
 		if val, ok := m['G']; ok {
-			tok = append(tok, fmt.Sprintf("G%d", int(val+0.5)))
+			tok = append(tok, "G"+strconv.FormatFloat(val, 'f', -1, 64))
 		}
 		if val, ok := m['M']; ok {
 			tok = append(tok, fmt.Sprintf("M%d", int(val+0.5)))
 		}
 		for _, letter := range letters {
-			if val, ok := m[letter]; ok {
-				tok = append(tok, fmt.Sprintf("%c%.6f", letter, val))
+			if bare[letter] {
+				tok = append(tok, string(letter))
+			} else if val, ok := m[letter]; ok {
+				tok = append(tok, fmt.Sprintf("%c%s", letter, formatGcodeNumber(val)))
 			}
 		}
 		text = strings.Join(tok, " ")
@@ -405,6 +911,17 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 			// G1. Linear move.
 			// Only allow Z movements for now.
 			asm('Z', 'F')
+		case 2, 3:
+			// G2/G3. Clockwise/counter-clockwise arc. The center is given with the I, J, K offsets or the radius with R.
+			// The firmware executes the arc, so it's passed as is.
+			_, hasR := m['R']
+			_, hasI := m['I']
+			_, hasJ := m['J']
+			_, hasK := m['K']
+			if hasR == (hasI || hasJ || hasK) {
+				return nil, fmt.Errorf("G%d needs either the center (I, J, K) or the radius (R)", num)
+			}
+			asm('X', 'Y', 'Z', 'I', 'J', 'K', 'R', 'F')
 		case 4:
 			// G4. Dwell. P value is the delay in ms.
 			asm('P')
@@ -415,6 +932,16 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 			// G28. Homing. Only support Z homing for now.
 			// F is a feed rate in units per minute.
 			asm('Z', 'F')
+		case 29:
+			// G29. Auto bed leveling. It may take tens of seconds and print many lines before ok.
+			asm('S', 'P', 'V', 'T')
+		case 38:
+			// G38.2. Probe toward a surface, stop on contact. The triggered position is reported
+			// by the firmware, like [PRB:0.000,0.000,-1.234:1].
+			if m['G'] != 38.2 {
+				return nil, fmt.Errorf("unsupported command G%s", formatGcodeNumber(m['G']))
+			}
+			asm('X', 'Y', 'Z', 'F')
 		case 90:
 			// G90. Set to absolute positioning.
 			asm()
@@ -429,13 +956,45 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 		typ = "M"
 		idx = num
 		switch num {
-		case 84:
-			// Release motors
+		case 3, 4:
+			// Spindle on, clockwise (M3) or counter-clockwise (M4). S is the speed or the power.
+			// Spindle-style grippers use S as the grip force.
+			asm('S')
+		case 5:
+			// Spindle off.
+			asm()
+		case 24:
+			// Start or resume SD print. S is the file position, T is the elapsed time in seconds.
+			asm('S', 'T')
+		case 25:
+			// Pause SD print.
+			asm()
+		case 27:
+			// Report SD print status. S is the auto-report interval in seconds.
+			asm('S')
+		case 73:
+			// Set print progress. P is progress in percent, R is remaining time in minutes.
+			asm('P', 'R')
+		case 18, 84:
+			// Release motors. With axis letters, only those motors are released, like M84 E for the extruder.
+			// S is the idle timeout in seconds, after which the motors are released.
+			asm('X', 'Y', 'Z', 'E', 'S')
+		case 204:
+			// Set the default acceleration. P is for printing moves, R is for retracts, T is for travel moves.
+			asm('P', 'R', 'T', 'S')
+		case 105:
+			// Report temperatures.
 			asm()
 		case 106:
 			asm('P', 'S')
 		case 107:
 			asm('P', 'S')
+		case 155:
+			// Auto-report temperatures. S is the interval in seconds, zero disables it.
+			asm('S')
+		case 115:
+			// Report firmware version and capabilities.
+			asm()
 		case MDisplayFrame:
 			asm('S')
 		case MHostDwell:
@@ -445,6 +1004,10 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 			asm()
 		case MWaitForIdle:
 			asm()
+		case MFanRamp:
+			// Fan ramp. P is the fan index, R is the start speed (0 by default), S is the target speed (0-255),
+			// T is the duration in ms.
+			asm('P', 'R', 'S', 'T')
 		default:
 			return nil, fmt.Errorf("unsupported command M%d", num)
 		}
@@ -455,36 +1018,242 @@ func parseGcodeCommand(baseDir, line string) (*Cmd, error) {
 	return &Cmd{Text: text, Type: typ, Idx: idx, Dict: m, BaseDir: baseDir}, nil
 }
 
+// rawTextMCodes are the M-codes, whose arguments are passed through unparsed. See -raw_text_mcodes.
+var rawTextMCodes = mustParseMCodeSet(defaultRawTextMCodes)
+
+// parseMCodeSet parses a comma-separated list of M-code numbers, like "117,118".
+func parseMCodeSet(str string) (map[int]bool, error) {
+	res := make(map[int]bool)
+	for _, tok := range strings.Split(str, ",") {
+		tok = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(tok)), "M")
+		if tok == "" {
+			continue
+		}
+		num, err := strconv.ParseUint(tok, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid M-code %q: %v", tok, err)
+		}
+		res[int(num)] = true
+	}
+	return res, nil
+}
+
+func mustParseMCodeSet(str string) map[int]bool {
+	res, err := parseMCodeSet(str)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// splitFirstWord returns the first word of the line and the rest of it with the surrounding spaces trimmed.
+func splitFirstWord(line string) (word, rest string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i:])
+	}
+	return line, ""
+}
+
+// sanitizeCommand checks a command, which does not come from a job file, like a manual one from the console.
+// Any firmware command, including M112, M999 or M503, is passed through, but nothing can be injected into
+// the line: control characters are stripped, and several lines, a comment or a checksum are rejected.
+// If the job parser accepts the command without dropping words, the normalized text is sent.
+func sanitizeCommand(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if strings.ContainsAny(line, "\r\n") {
+		return "", errors.New("a single command is expected, got several lines")
+	}
+	line = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, line))
+	if line == "" {
+		return "", errors.New("empty command")
+	}
+	if len(line) > maxCommandLen {
+		return "", fmt.Errorf("command is too long: %d bytes, max: %d", len(line), maxCommandLen)
+	}
+	cmd, err := parseGcodeCommand("" /*baseDir*/, line)
+	if err == nil && cmd.Type == "-" {
+		// UR3 script. See parseGcodeCommand. It's sent without a line number and a checksum.
+		return cmd.Text, nil
+	}
+	if strings.ContainsAny(line, "*;") {
+		// The firmware would take them for the checksum or a comment, and the rest of the line would be lost.
+		return "", errors.New("'*' and ';' are not allowed in a command")
+	}
+	if err != nil {
+		// Not a job command, like M112 or M503. It's sent as is.
+		return line, nil
+	}
+	if cmd.IsHost() {
+		return "", fmt.Errorf("host command %s can't be sent to the device", cmd.Text)
+	}
+	text := cmd.Text
+	if _, rest, ok := splitTarget(text); ok {
+		text = rest
+	}
+	kept := make(map[byte]bool)
+	for _, word := range strings.Fields(text) {
+		kept[word[0]] = true
+	}
+	for letter := range cmd.Dict {
+		if !kept[letter] {
+			// The parser would drop the word. The command is sent as typed instead.
+			return line, nil
+		}
+	}
+	return cmd.Text, nil
+}
+
+// formatGcodeNumber formats integral values without a fractional part, like P1000,
+// because some older firmwares mishandle P1000.000000. Other values keep six decimals.
+func formatGcodeNumber(val float64) string {
+	if r := math.Round(val); math.Abs(val-r) < 1e-9 {
+		return strconv.FormatInt(int64(r), 10)
+	}
+	return fmt.Sprintf("%.6f", val)
+}
+
+func parseFramePatterns(str string) []string {
+	var res []string
+	for _, pattern := range strings.Split(str, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			res = append(res, pattern)
+		}
+	}
+	return res
+}
+
+// resolveFrame returns the path to the frame with the given index. Patterns are tried in order.
+func resolveFrame(baseDir string, patterns []string, frameIdx int) (string, error) {
+	var tried []string
+	for _, pattern := range patterns {
+		fname := path.Join(baseDir, fmt.Sprintf(pattern, frameIdx))
+		if _, err := os.Stat(fname); err == nil {
+			return fname, nil
+		}
+		tried = append(tried, path.Base(fname))
+	}
+	return "", fmt.Errorf("frame %d not found in %s (tried: %s)", frameIdx, baseDir, strings.Join(tried, ", "))
+}
+
 type Cmd struct {
 	Text string
 	Type string
 	Idx  int
 	Dict map[byte]float64
+	// Arg is a free text argument, like the message of M117.
+	Arg string
 
 	// BaseDir is useful for locating frames. It's the directory where the job gcode file is located.
 	BaseDir string
 }
 
+// CmdParams are the decoded words of a command, for the command inspector in the UI.
+// The fields describe the words sent to the device. The words dropped by the parser are listed in Dropped.
+type CmdParams struct {
+	// Axis targets in mm.
+	X *float64 `json:"x_mm,omitempty"`
+	Y *float64 `json:"y_mm,omitempty"`
+	Z *float64 `json:"z_mm,omitempty"`
+	E *float64 `json:"e_mm,omitempty"`
+	// Feedrate is F in mm/min.
+	Feedrate *float64 `json:"feedrate_mm_min,omitempty"`
+	// DwellMS is P of G4 and M7821.
+	DwellMS *float64 `json:"dwell_ms,omitempty"`
+	// Other are the words without a known unit by letter, like S of M106 (the fan speed, 0-255).
+	Other map[string]float64 `json:"other,omitempty"`
+	// Dropped are the words, which are parsed, but not sent to the device, like X and Y of G1:
+	// only Z moves are supported for now.
+	Dropped map[string]float64 `json:"dropped,omitempty"`
+}
+
+// Params decodes the words of the command.
+// It returns nil for the commands without words, like UR3 scripts and raw text M-codes.
+func (cmd *Cmd) Params() *CmdParams {
+	if cmd.Type != "G" && cmd.Type != "M" || cmd.Arg != "" {
+		return nil
+	}
+	words := strings.Fields(cmd.Text)
+	if len(words) < 2 {
+		return nil
+	}
+	dwell := cmd.Type == "G" && cmd.Idx == 4 || cmd.Type == "M" && cmd.Idx == MHostDwell
+	p := new(CmdParams)
+	sent := make(map[byte]bool)
+	for _, word := range words[1:] {
+		letter := word[0]
+		sent[letter] = true
+		val, ok := cmd.Dict[letter]
+		if !ok || len(word) == 1 {
+			// A bare axis letter, like E of M84 E, has no value.
+			continue
+		}
+		switch {
+		case letter == 'X':
+			p.X = &val
+		case letter == 'Y':
+			p.Y = &val
+		case letter == 'Z':
+			p.Z = &val
+		case letter == 'E':
+			p.E = &val
+		case letter == 'F':
+			p.Feedrate = &val
+		case letter == 'P' && dwell:
+			p.DwellMS = &val
+		default:
+			if p.Other == nil {
+				p.Other = make(map[string]float64)
+			}
+			p.Other[string(letter)] = val
+		}
+	}
+	for letter, val := range cmd.Dict {
+		if letter == 'G' || letter == 'M' || sent[letter] {
+			continue
+		}
+		if p.Dropped == nil {
+			p.Dropped = make(map[string]float64)
+		}
+		p.Dropped[string(letter)] = val
+	}
+	return p
+}
+
 func (cmd *Cmd) IsHost() bool {
-	return cmd.Type == "M" && (cmd.Idx == MDisplayFrame || cmd.Idx == MHostDwell || cmd.Idx == MSnapshot || cmd.Idx == MWaitForIdle)
+	return cmd.Type == "M" && (cmd.Idx == MDisplayFrame || cmd.Idx == MHostDwell || cmd.Idx == MSnapshot || cmd.Idx == MWaitForIdle ||
+		cmd.Idx == MFanRamp)
 }
 
 func (cmd *Cmd) Run(ctx context.Context, jobName string, numFrames int, up *Uplink, exe *Executor, virtual bool) error {
-	if cmd.Type != "M" || (cmd.Idx != MDisplayFrame && cmd.Idx != MHostDwell && cmd.Idx != MSnapshot && cmd.Idx != MWaitForIdle) {
+	if !cmd.IsHost() {
 		return fmt.Errorf("unsupported host command %s%d", cmd.Type, cmd.Idx)
 	}
 	if cmd.Idx == MDisplayFrame {
 		// Show a new frame on the LCD.
 		frameIdx := int(cmd.Dict['S'])
-		fname := path.Join(cmd.BaseDir, fmt.Sprintf("frame-%06d.png", frameIdx))
 		if !virtual {
-			data, err := exec.Command("killall", "fbi").CombinedOutput()
+			fname, err := resolveFrame(cmd.BaseDir, exe.framePatterns, frameIdx)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "killall fbi: %v, %v\n", string(data), err)
+				return err
 			}
-			data, err = exec.Command("fbi", "-noverbose", "-a", "-T", "1", fname).CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to display a frame: %v, %v", string(data), err)
+			if err := exe.display.Show(fname); err != nil {
+				return err
+			}
+			if exe.frameSettleDelay > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(exe.frameSettleDelay):
+				}
 			}
 		}
 		up.NotifyFrameIndex(jobName, frameIdx, numFrames)
@@ -496,7 +1265,13 @@ func (cmd *Cmd) Run(ctx context.Context, jobName string, numFrames int, up *Upli
 		return nil
 	}
 	if cmd.Idx == MSnapshot {
-		if err := exe.Snapshot(ctx); err != nil {
+		err := exe.Snapshot(ctx)
+		if err == ErrSnapshotSkipped {
+			// The queued snapshot is taken after this command anyway.
+			exe.up.logf("Skipped a snapshot: %v", err)
+			return nil
+		}
+		if err != nil {
 			return fmt.Errorf("failed to take a snapshot: %v", err)
 		}
 		return nil
@@ -507,9 +1282,54 @@ func (cmd *Cmd) Run(ctx context.Context, jobName string, numFrames int, up *Upli
 		time.Sleep(time.Second)
 		return exe.WaitForIdle()
 	}
+	if cmd.Idx == MFanRamp {
+		return exe.fanRamp(ctx, cmd)
+	}
 	panic("unreachable")
 }
 
+// fanRampSpeeds returns the speeds of a linear ramp from from to to in the given number of steps.
+// The start speed is not included, the last one is to.
+func fanRampSpeeds(from, to float64, steps int) []int {
+	if steps < 1 {
+		steps = 1
+	}
+	res := make([]int, steps)
+	for i := range res {
+		res[i] = int(math.Round(from + (to-from)*float64(i+1)/float64(steps)))
+	}
+	return res
+}
+
+// fanRamp changes the fan speed gradually with a series of M106 commands. See MFanRamp.
+func (exe *Executor) fanRamp(ctx context.Context, cmd *Cmd) error {
+	from, to, dur := cmd.Dict['R'], cmd.Dict['S'], time.Duration(cmd.Dict['T'])*time.Millisecond
+	if from < 0 || from > 255 || to < 0 || to > 255 {
+		return fmt.Errorf("invalid fan ramp %s: the speeds must be in [0, 255]", cmd.Text)
+	}
+	if dur < 0 {
+		return fmt.Errorf("invalid fan ramp %s: negative duration", cmd.Text)
+	}
+	prefix := "M106 "
+	if p, ok := cmd.Dict['P']; ok {
+		prefix += "P" + formatGcodeNumber(p) + " "
+	}
+	speeds := fanRampSpeeds(from, to, int(dur/fanRampStep))
+	// The target speed is set at the end of the ramp.
+	interval := dur / time.Duration(len(speeds))
+	for _, speed := range speeds {
+		select {
+		case <-ctx.Done():
+			return context.Canceled
+		case <-time.After(interval):
+		}
+		if err := exe.down.WriteAndWaitForOK(ctx, prefix+"S"+strconv.Itoa(speed)); err != nil {
+			return fmt.Errorf("fan ramp: %v", err)
+		}
+	}
+	return nil
+}
+
 func tryToRemoveOldJobs(dir string) error {
 	f, err := os.Open(dir)
 	if err != nil {
@@ -535,7 +1355,7 @@ func tryToRemoveOldJobs(dir string) error {
 }
 
 func (exe *Executor) RealSenseTrainPack(ctx context.Context, packID, graspID string,
-	x, y, z, roll, pitch, yaw float64) error {
+	x, y, z, roll, pitch, yaw float64, numFrames int) error {
 	if exe.rss == nil {
 		return errors.New("RealSense functionality is not enabled")
 	}
@@ -551,15 +1371,30 @@ func (exe *Executor) RealSenseTrainPack(ctx context.Context, packID, graspID str
 	if !isHexID(graspID) {
 		return errors.New("graspID is not a valid hex ID")
 	}
-	packDir := path.Join("/opt/robodone/realsense/", graspID, packID)
+	if numFrames < 1 {
+		return fmt.Errorf("invalid number of frames: %d, want at least 1", numFrames)
+	}
+	if err := exe.CheckWritable(); err != nil {
+		return err
+	}
+	release, err := exe.acquireSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer exe.activities.Begin("realsense-train-pack")()
+	packDir := path.Join(exe.baseDir, "realsense", graspID, packID)
 	if err := os.MkdirAll(packDir, 0777); err != nil {
 		return fmt.Errorf("failed to create a directory for a pack of snapshots")
 	}
 	exe.up.logf("Pack dir %s created", packDir)
 	prefix := path.Join(packDir, packID) + "-"
 
-	numFrames := 5
 	if err := exe.rss.TakeSnapshot(ctx, prefix, numFrames); err != nil {
+		// A partial pack without parameters.json is useless for training. Don't leave it behind.
+		if rmErr := os.RemoveAll(packDir); rmErr != nil {
+			exe.up.logf("Failed to remove the incomplete pack dir %s: %v", packDir, rmErr)
+		}
 		return fmt.Errorf("failed to take a RealSense snapshot (%d frames): %v", numFrames, err)
 	}
 	// Now, it's time to write parameters.json with the pose and possibly other values.
@@ -581,13 +1416,49 @@ func (exe *Executor) RealSenseTrainPack(ctx context.Context, packID, graspID str
 	if err := ioutil.WriteFile(path.Join(packDir, "parameters.json"), data, 0644); err != nil {
 		return fmt.Errorf("failed to write RealSense Train Pack params to the disk: %v", err)
 	}
+	exe.runPostSnapshotHook(ctx, prefix)
 	return nil
 }
 
-func (exe *Executor) Snapshot(ctx context.Context) error {
+// Snapshot takes a snapshot from the cameras and sends it to the server. If no cameras are named, all of them are used.
+func (exe *Executor) Snapshot(ctx context.Context, names ...string) error {
 	if exe.rss == nil {
 		return errors.New("no means to take a snapshot are configured (RealSense, RGB camera, radar, etc)")
 	}
+	take := exe.rss.TakeSnapshot
+	if len(names) > 0 {
+		ss, ok := exe.rss.(subsetSnapshotter)
+		if !ok {
+			return errors.New("only one camera is configured, so it can't be selected by name")
+		}
+		take = func(ctx context.Context, prefix string, numFrames int) error {
+			return ss.TakeSnapshotOf(ctx, prefix, numFrames, names)
+		}
+	}
+	// Snapshots can be requested faster than they are taken, like on every idle transition of the arm.
+	// If a snapshot of the same cameras is already waiting for the current one, it's taken after this request
+	// anyway, so this one is skipped.
+	key := snapshotKey(names)
+	exe.stateMu.Lock()
+	if exe.queuedSnaps[key] {
+		exe.stateMu.Unlock()
+		return ErrSnapshotSkipped
+	}
+	if exe.queuedSnaps == nil {
+		exe.queuedSnaps = make(map[string]bool)
+	}
+	exe.queuedSnaps[key] = true
+	exe.stateMu.Unlock()
+	release, err := exe.acquireSnapshot(ctx)
+	exe.stateMu.Lock()
+	delete(exe.queuedSnaps, key)
+	exe.stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	defer exe.activities.Begin("snapshot")()
 	dirName, err := ioutil.TempDir("", "robosla-shell-snapshot-")
 	if err != nil {
 		return fmt.Errorf("failed to create a temp directory")
@@ -596,9 +1467,14 @@ func (exe *Executor) Snapshot(ctx context.Context) error {
 	defer os.RemoveAll(dirName)
 
 	prefix := path.Join(dirName, "realsense-")
-	if err := exe.rss.TakeSnapshot(ctx, prefix, 1 /*numFrames*/); err != nil {
+	if err := take(ctx, prefix, 1 /*numFrames*/); err != nil {
 		return fmt.Errorf("failed to take a RealSense snapshot: %v", err)
 	}
+	// The pose right after the frame is taken. The arm is expected to stand still.
+	var pose []float64
+	if pr, ok := exe.down.(poseReporter); ok {
+		pose, _ = pr.Pose()
+	}
 
 	// Scan the directory and load all images into a map.
 	fnames, err := getImageNames(dirName)
@@ -612,13 +1488,162 @@ func (exe *Executor) Snapshot(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to load a camera frame from %s: %v", fname, err)
 		}
-		cameras[fname[:len(fname)-len(path.Ext(fname))]] = dataurl.EncodeBytes(data)
+		mimeType := snapshotMimeType(exe.rss, fname)
+		if data, err = convertImage(data, exe.SnapshotMaxDim(), mimeType); err != nil {
+			return fmt.Errorf("failed to convert a camera frame from %s: %v", fname, err)
+		}
+		url := dataurl.EncodeBytes(data)
+		if mimeType != "" {
+			url = dataurl.New(data, mimeType).String()
+		}
+		cameras[fname[:len(fname)-len(path.Ext(fname))]] = url
+	}
+	exe.up.NotifySnapshot(cameras, pose)
+	exe.runPostSnapshotHook(ctx, prefix)
+
+	return nil
+}
+
+// ErrSnapshotSkipped is returned by Snapshot, if a snapshot of the same cameras is already waiting
+// for the current one. No snapshot is taken for this request.
+var ErrSnapshotSkipped = errors.New("busy: a snapshot of the same cameras is already queued")
+
+// snapshotKey names a set of cameras for logs and for coalescing snapshots. No names mean all cameras.
+func snapshotKey(names []string) string {
+	if len(names) == 0 {
+		return "all cameras"
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// acquireSnapshot waits until no other snapshot is being taken. release must be called after the snapshot.
+func (exe *Executor) acquireSnapshot(ctx context.Context) (release func(), err error) {
+	select {
+	case exe.snapSem <- true:
+		return func() { <-exe.snapSem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("canceled while waiting for another snapshot: %v", ctx.Err())
 	}
-	exe.up.NotifySnapshot(cameras)
+}
+
+func (exe *Executor) jobGcode() jobGcode {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	return exe.gcode
+}
+
+// SetJobGcode sets the commands sent around every job. They take effect with the next job.
+func (exe *Executor) SetJobGcode(start, end, abort []*Cmd) {
+	exe.stateMu.Lock()
+	exe.gcode = jobGcode{start: start, end: end, abort: abort}
+	exe.stateMu.Unlock()
+}
+
+// MaxTemps returns the temperature limits of jobs. See maxTemps.
+func (exe *Executor) MaxTemps() TempLimits {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	return exe.maxTemps
+}
 
+func (exe *Executor) SetMaxTemps(maxTemps TempLimits) {
+	exe.stateMu.Lock()
+	exe.maxTemps = maxTemps
+	exe.stateMu.Unlock()
+}
+
+// checkTemps returns an error, if any of the last reported temperatures exceeds its limit.
+func (exe *Executor) checkTemps(maxTemps TempLimits) error {
+	temps := exe.up.Temperatures()
+	if heater, limit := maxTemps.Exceeded(temps); heater != "" {
+		return fmt.Errorf("%s is %.1f°C, above the limit of %.1f°C", heater, temps[heater].Actual, limit)
+	}
 	return nil
 }
 
+// SnapshotMaxDim returns the maximum width and height of snapshot images sent to the server. Zero means no limit.
+func (exe *Executor) SnapshotMaxDim() int {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	return exe.snapshotMaxDim
+}
+
+func (exe *Executor) SetSnapshotMaxDim(maxDim int) {
+	exe.stateMu.Lock()
+	exe.snapshotMaxDim = maxDim
+	exe.stateMu.Unlock()
+}
+
+// runPostSnapshotHook runs the post-snapshot command, if configured. Its failures are logged, but don't fail the snapshot.
+func (exe *Executor) runPostSnapshotHook(ctx context.Context, prefix string) {
+	args := strings.Fields(exe.postSnapshotCmd)
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, postSnapshotTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], prefix)...)
+	data, err := cmd.CombinedOutput()
+	if len(data) > 0 {
+		if len(data) > maxHookOutput {
+			data = data[:maxHookOutput]
+		}
+		exe.up.logf("Post-snapshot hook output: %s", string(data))
+	}
+	if err != nil {
+		exe.up.logf("Post-snapshot hook %q failed: %v", exe.postSnapshotCmd, err)
+	}
+}
+
+func (exe *Executor) setSkippedLines(n int) {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	exe.skippedLines = n
+}
+
+func (exe *Executor) setLoadedJob(jobName string, cmds []*Cmd) {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	exe.loadedJobName, exe.loadedCmds = jobName, cmds
+}
+
+// LoadedJob returns the name and the parsed commands of the last loaded job. cmds is nil, if no job is loaded yet.
+// The job may be already done.
+func (exe *Executor) LoadedJob() (jobName string, cmds []*Cmd) {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	return exe.loadedJobName, exe.loadedCmds
+}
+
+// DumpJob sends the parsed commands of a job with notify-job-dump for debugging. The commands are sent in chunks
+// of jobDumpChunk with a pause of jobDumpInterval between them, so that a large job does not flood the uplink.
+func (exe *Executor) DumpJob(jobName string, cmds []*Cmd) {
+	for offset := 0; offset < len(cmds); offset += jobDumpChunk {
+		if offset > 0 {
+			time.Sleep(jobDumpInterval)
+		}
+		end := offset + jobDumpChunk
+		if end > len(cmds) {
+			end = len(cmds)
+		}
+		dump := &JobDump{Offset: offset, Total: len(cmds)}
+		for i, cmd := range cmds[offset:end] {
+			dump.Commands = append(dump.Commands, DumpedCommand{Index: offset + i, Text: cmd.Text, Host: cmd.IsHost(), Params: cmd.Params()})
+		}
+		exe.up.NotifyJobDump(jobName, dump)
+	}
+	exe.up.logf("Dumped %d commands of the job %s", len(cmds), jobName)
+}
+
+// SkippedLines returns the number of unsupported lines skipped in the last job.
+func (exe *Executor) SkippedLines() int {
+	exe.stateMu.Lock()
+	defer exe.stateMu.Unlock()
+	return exe.skippedLines
+}
+
 func (exe *Executor) NotifyMovingState(state string) {
 	exe.stateMu.Lock()
 	was := exe.state
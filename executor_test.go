@@ -0,0 +1,928 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+type notifyRecorder struct {
+	mu   sync.Mutex
+	ch   <-chan *device_api.UplinkMessage
+	msgs []*device_api.UplinkMessage
+}
+
+func (r *notifyRecorder) ByType(typ string) []*device_api.UplinkMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for drained := false; !drained; {
+		select {
+		case msg := <-r.ch:
+			r.msgs = append(r.msgs, msg)
+		default:
+			drained = true
+		}
+	}
+	var res []*device_api.UplinkMessage
+	for _, msg := range r.msgs {
+		if msg.Type == typ {
+			res = append(res, msg)
+		}
+	}
+	return res
+}
+
+// newTestUplink returns an uplink which is never connected to the API server,
+// and records all notifications sent through it.
+func newTestUplink() (*Uplink, *notifyRecorder) {
+	up := NewUplink("")
+	ch := make(chan *device_api.UplinkMessage, 10000)
+	up.notifyCh = ch
+	return up, &notifyRecorder{ch: ch}
+}
+
+func TestExecuteGcodeDryRun(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+
+	if err := exe.ExecuteGcode(context.Background(), "dry", "testdata/simple.gcode"); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	want := []string{"G90", "G21", "M107", "G28 Z0 F150", "G0 Z10",
+		"G1 Z0.050000 F100", "M106", "G4 P10000", "M107", "G1 Z4 F100"}
+	got := down.Written()
+	if len(got) != len(want) {
+		t.Fatalf("Written: want %d commands, got %d: %q", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Written[%d]: want %q, got %q", i, want[i], got[i])
+		}
+	}
+	if len(rec.ByType("notify-job-progress")) == 0 {
+		t.Errorf("no job progress notifications sent")
+	}
+}
+
+func TestExecuteGcodeStartEndCommands(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	start, _, _, err := loadGcode(writeTestJob(t, "M204 S500 ; acceleration\nG1 Z1 F100\n"), false)
+	if err != nil {
+		t.Fatalf("loadGcode(start): %v", err)
+	}
+	end, _, _, err := loadGcode(writeTestJob(t, "M84\n"), false)
+	if err != nil {
+		t.Fatalf("loadGcode(end): %v", err)
+	}
+	exe.SetJobGcode(start, end, nil)
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+
+	if err := exe.ExecuteGcode(context.Background(), "bracketed", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	want := "M204 S500; G1 Z1 F100; G90; G1 Z4 F100; M84"
+	if got := strings.Join(down.Written(), "; "); got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+}
+
+func TestExecuteGcodeLenient(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	job := writeTestJob(t, "G90\nQ42 X1 ; exotic\nG1 Z4 F100\n")
+
+	if err := exe.ExecuteGcode(context.Background(), "strict", job); err == nil {
+		t.Fatalf("ExecuteGcode: want an error for an unsupported command in the strict mode")
+	}
+	exe.lenientGcode = true
+	if err := exe.ExecuteGcode(context.Background(), "lenient", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	if n := exe.SkippedLines(); n != 1 {
+		t.Errorf("SkippedLines: want 1, got %d", n)
+	}
+	want := "G90; G1 Z4 F100"
+	if got := strings.Join(down.Written(), "; "); got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+}
+
+func TestLoadGcodeEncodings(t *testing.T) {
+	// A UTF-8 BOM, UTF-8 and Windows-1252 (0x96 is an en dash) in comments, CRLF line endings.
+	job := writeTestJob(t, "\xEF\xBB\xBFG90 ; Größe\r\n; \x96 layer 1\r\nG1 Z5 F100 ;\xB0C\r\n")
+	cmds, _, _, err := loadGcode(job, false)
+	if err != nil {
+		t.Fatalf("loadGcode: %v", err)
+	}
+	var got []string
+	for _, cmd := range cmds {
+		got = append(got, cmd.Text)
+	}
+	if want := "G90; G1 Z5 F100"; strings.Join(got, "; ") != want {
+		t.Errorf("want %q, got %q", want, strings.Join(got, "; "))
+	}
+}
+
+// writeTestJob writes gcode into a temporary directory and returns the path to it.
+func writeTestJob(t *testing.T, gcode string) string {
+	dir, err := ioutil.TempDir("", "robosla-test-job")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fname := path.Join(dir, "job.gcode")
+	if err := ioutil.WriteFile(fname, []byte(gcode), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return fname
+}
+
+func TestExecuteGcodeMaxZ(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	exe.maxZ = 150
+
+	job := writeTestJob(t, "G28 Z0 F150\nG1 Z10 F100\nG1 Z200 F100\n")
+	err := exe.ExecuteGcode(context.Background(), "tall", job)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the machine height") {
+		t.Fatalf("ExecuteGcode: want max_z rejection, got: %v", err)
+	}
+	if got := down.Written(); len(got) != 0 {
+		t.Errorf("rejected job has sent commands to the device: %q", got)
+	}
+}
+
+func TestExecuteGcodeNotifyCurrentCommand(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	exe.down = NewDryRunDownlink(up)
+
+	job := writeTestJob(t, "G90\nM7821 P1500\nG1 Z4 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "cur", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	want := []CurrentCommand{{Index: 0, Text: "G90"}, {Index: 2, Text: "G1 Z4 F100"}}
+	msgs := rec.ByType("notify-current-command")
+	if len(msgs) != len(want) {
+		t.Fatalf("want %d current command notifications, got %d", len(want), len(msgs))
+	}
+	for i, msg := range msgs {
+		var got CurrentCommand
+		if err := json.Unmarshal([]byte(msg.Comment), &got); err != nil {
+			t.Fatalf("failed to parse %q: %v", msg.Comment, err)
+		}
+		if got.Index != want[i].Index || got.Text != want[i].Text {
+			t.Errorf("notification #%d: want %+v, got %+v", i, want[i], got)
+		}
+	}
+	var last CurrentCommand
+	if err := json.Unmarshal([]byte(msgs[1].Comment), &last); err != nil {
+		t.Fatalf("failed to parse %q: %v", msgs[1].Comment, err)
+	}
+	if p := last.Params; p == nil || p.Z == nil || *p.Z != 4 || p.Feedrate == nil || *p.Feedrate != 100 {
+		t.Errorf("want the params of G1 Z4 F100 in the notification, got %+v", p)
+	}
+}
+
+func TestCmdParams(t *testing.T) {
+	cmd, err := parseGcodeCommand("", "G38.2 X10 F600")
+	if err != nil {
+		t.Fatalf("parseGcodeCommand: %v", err)
+	}
+	data, err := json.Marshal(cmd.Params())
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if got, want := string(data), `{"x_mm":10,"feedrate_mm_min":600}`; got != want {
+		t.Errorf("G38.2 X10 F600: want %s, got %s", want, got)
+	}
+
+	for _, tc := range []struct {
+		line string
+		want string
+	}{
+		// Only Z moves are sent for now, so X is dropped.
+		{"G1 X10 F600", `{"feedrate_mm_min":600,"dropped":{"X":10}}`},
+		{"G0 X1 Y2 Z3", `{"z_mm":3,"dropped":{"X":1,"Y":2}}`},
+		{"G1 Z0 F100", `{"z_mm":0,"feedrate_mm_min":100}`},
+		{"G4 P400", `{"dwell_ms":400}`},
+		{"M7821 P1500", `{"dwell_ms":1500}`},
+		{"M106 P1 S255", `{"other":{"P":1,"S":255}}`},
+		{"M84 E S30", `{"other":{"S":30}}`},
+		{"G90", `null`},
+		{"M117 Hello", `null`},
+	} {
+		cmd, err := parseGcodeCommand("", tc.line)
+		if err != nil {
+			t.Fatalf("parseGcodeCommand(%q): %v", tc.line, err)
+		}
+		data, err := json.Marshal(cmd.Params())
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		if string(data) != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.line, tc.want, data)
+		}
+	}
+}
+
+func TestFetchJobReadOnlyBaseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-test-readonly")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	exe.baseDir = dir
+	// Permissions don't stop root, so the read-only file system is faked.
+	exe.createTemp = func(dir, pattern string) (*os.File, error) {
+		return nil, &os.PathError{Op: "open", Path: path.Join(dir, pattern), Err: syscall.EROFS}
+	}
+	_, err = exe.FetchJob(context.Background(), "https://storage.googleapis.com/robosla-data/job.zip")
+	if err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Fatalf("FetchJob: want a clear error about read-only base dir, got: %v", err)
+	}
+}
+
+func TestFanRampSpeeds(t *testing.T) {
+	for _, tc := range []struct {
+		from, to float64
+		steps    int
+		want     string
+	}{
+		{0, 255, 5, "[51 102 153 204 255]"},
+		{200, 100, 4, "[175 150 125 100]"},
+		{0, 100, 3, "[33 67 100]"},
+		{0, 255, 0, "[255]"},
+	} {
+		if got := fmt.Sprint(fanRampSpeeds(tc.from, tc.to, tc.steps)); got != tc.want {
+			t.Errorf("fanRampSpeeds(%v, %v, %d): want %s, got %s", tc.from, tc.to, tc.steps, tc.want, got)
+		}
+	}
+}
+
+func TestExecuteGcodeFanRamp(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	job := writeTestJob(t, "M7824 P1 R100 S200 T1000\nG1 Z4 F100\n")
+
+	start := time.Now()
+	if err := exe.ExecuteGcode(context.Background(), "ramp", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < time.Second {
+		t.Errorf("the ramp took %v, want at least 1s", elapsed)
+	}
+	want := "M106 P1 S125; M106 P1 S150; M106 P1 S175; M106 P1 S200; G1 Z4 F100"
+	if got := strings.Join(down.Written(), "; "); got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+}
+
+// signalingDownlink is a dry-run downlink, which sends every command to written, once it's written.
+type signalingDownlink struct {
+	*DryRunDownlink
+	written chan string
+}
+
+func (dl *signalingDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	err := dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+	dl.written <- cmd
+	return err
+}
+
+func TestExecuteGcodeFanRampCanceled(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := &signalingDownlink{NewDryRunDownlink(up), make(chan string, 100)}
+	exe.down = down
+	job := writeTestJob(t, "M7824 S255 T60000\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- exe.ExecuteGcode(ctx, "ramp", job) }()
+	select {
+	case cmd := <-down.written:
+		if cmd != "M106 S1" {
+			t.Errorf("want the first ramp step without P, got %q", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the first ramp step is not written")
+	}
+	cancel()
+	if err := <-errCh; err == nil {
+		t.Fatalf("ExecuteGcode: want an error after cancel")
+	}
+	var steps []string
+	for _, cmd := range down.Written() {
+		if strings.HasPrefix(cmd, "M106 S") {
+			steps = append(steps, cmd)
+		}
+	}
+	if len(steps) != 1 {
+		t.Errorf("want the ramp stopped after the first step, got %q", steps)
+	}
+}
+
+func TestParseGcodeCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"G28 Z0 F150", "G28 Z0 F150"},
+		{"G4 P1000", "G4 P1000"},
+		{"G1 Z0.2", "G1 Z0.200000"},
+		{"G1 Z-1.5 F100.0", "G1 Z-1.500000 F100"},
+		{"M106 S255", "M106 S255"},
+		{"M73 P25 R10", "M73 P25 R10"},
+		{"G29", "G29"},
+		{"g29 s1 v4", "G29 S1 V4"},
+		{"M117 Printing layer 5", "M117 Printing layer 5"},
+		{"m117  Don't   touch the vat ", "M117 Don't   touch the vat"},
+		{"M117", "M117"},
+		{"M84", "M84"},
+		{"M84 E0", "M84 E0"},
+		{"M84 E", "M84 E"},
+		{"M84 X Y", "M84 X Y"},
+		{"m18 z s30", "M18 Z S30"},
+		{"m18 x0 y0", "M18 X0 Y0"},
+		{"M84 S60", "M84 S60"},
+		{"M118 E1 Hello, host!", "M118 E1 Hello, host!"},
+		{"M23 /Models/Benchy~1.GCO", "M23 /Models/Benchy~1.GCO"},
+		{"M24", "M24"},
+		{"M25", "M25"},
+		{"M27 S5", "M27 S5"},
+		{"M105", "M105"},
+		{"M155 S2", "M155 S2"},
+		{"M204 P500 T1000", "M204 P500 T1000"},
+		{"G38.2 Z-10 F100", "G38.2 Z-10 F100"},
+		{"g38.2 x1.5 y2 z-5", "G38.2 X1.500000 Y2 Z-5"},
+		{"M7824 P1 S255 T2000", "M7824 P1 S255 T2000"},
+		{"M3 S40", "M3 S40"},
+		{"m4 s12.5", "M4 S12.500000"},
+		{"M5", "M5"},
+		{"G2 X10 Y10 I5 J0 F600", "G2 X10 Y10 I5 J0 F600"},
+		{"G3 X0 Y0 R5 F600", "G3 X0 Y0 R5 F600"},
+		{"g3 x1.5 z2 k-1", "G3 X1.500000 Z2 K-1"},
+	}
+	for _, tt := range tests {
+		cmd, err := parseGcodeCommand("", tt.line)
+		if err != nil {
+			t.Errorf("parseGcodeCommand(%q): %v", tt.line, err)
+			continue
+		}
+		if cmd.Text != tt.want {
+			t.Errorf("parseGcodeCommand(%q): want %q, got %q", tt.line, tt.want, cmd.Text)
+		}
+	}
+	// Only the motor release takes the axes without values.
+	for _, line := range []string{"G28 Z", "M84 E E", "M84 S", "M106 S"} {
+		if cmd, err := parseGcodeCommand("", line); err == nil {
+			t.Errorf("parseGcodeCommand(%q): want an error, got %q", line, cmd.Text)
+		}
+	}
+}
+
+func TestParseRawTextMCodes(t *testing.T) {
+	if _, err := parseGcodeCommand("", "M812 sd:/file.gcode"); err == nil {
+		t.Errorf("M812 must not be a raw text M-code by default")
+	}
+	old := rawTextMCodes
+	defer func() { rawTextMCodes = old }()
+	codes, err := parseMCodeSet(defaultRawTextMCodes + ", M812")
+	if err != nil {
+		t.Fatalf("parseMCodeSet: %v", err)
+	}
+	rawTextMCodes = codes
+	cmd, err := parseGcodeCommand("", "m812 sd:/File.gcode")
+	if err != nil {
+		t.Fatalf("parseGcodeCommand: %v", err)
+	}
+	if cmd.Text != "M812 sd:/File.gcode" || cmd.Arg != "sd:/File.gcode" || cmd.Idx != 812 {
+		t.Errorf("parseGcodeCommand: want M812 with the file name preserved, got %+v", cmd)
+	}
+	// The text must not break the line numbering and the checksum.
+	for _, line := range []string{"M117 50%*12", "M117 Hi;M112", "M117 Hi\nM112", "M117 Hi\rM112", "M23 a\x00b", "M118 a\tb"} {
+		if cmd, err := parseGcodeCommand("", line); err == nil {
+			t.Errorf("parseGcodeCommand(%q): want an error, got %q", line, cmd.Text)
+		}
+	}
+	if _, err := parseMCodeSet("117,x"); err == nil {
+		t.Errorf("parseMCodeSet(117,x): want an error")
+	}
+}
+
+func TestSanitizeCommand(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{line: "g28 z0\r", want: "G28 Z0"},
+		{line: "G4\tP100", want: "G4 P100"},
+		{line: "M106 P1\x00", want: "M106 P1"},
+		{line: "arm:movej([0,0,0,0,0,0])", want: "arm:movej([0,0,0,0,0,0])"},
+		// The commands, which jobs may not use, are sent as typed.
+		{line: "M112", want: "M112"},
+		{line: "M999\r\n", want: "M999"},
+		{line: "M503", want: "M503"},
+		{line: "G1 X10 Z1", want: "G1 X10 Z1"},
+		{line: "G38 Z-10", want: "G38 Z-10"},
+		{line: "G2 X10 Y10 F600", want: "G2 X10 Y10 F600"},
+		{line: "M7821 P100", wantErr: true},
+		{line: "G28 Z0\nM112", wantErr: true},
+		{line: "G28 Z0\rM112", wantErr: true},
+		{line: "M117 Hi;M112", wantErr: true},
+		{line: "G28 Z0*12", wantErr: true},
+		{line: "\x00\r", wantErr: true},
+		{line: "G4 P" + strings.Repeat("1", maxCommandLen), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeCommand(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("sanitizeCommand(%q): want an error, got %q", tt.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sanitizeCommand(%q): %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeCommand(%q): want %q, got %q", tt.line, tt.want, got)
+		}
+	}
+}
+
+func TestExecuteGcodeM73Progress(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	exe.down = NewDryRunDownlink(up)
+
+	job := writeTestJob(t, "M73 P0 R30\nG1 Z1 F100\nM73 P50 R15\nG1 Z2 F100\nM73 P90 R3\nG1 Z3 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "m73", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	var got []string
+	for _, msg := range rec.ByType("notify-job-progress") {
+		if msg.Progress < 1 {
+			// Skip the initial notifications, which are sent before the job is started.
+			continue
+		}
+		got = append(got, fmt.Sprintf("%.0f%%/%v", msg.Progress, msg.Remaining))
+	}
+	want := "50%/15m0s 90%/3m0s"
+	if strings.Join(got, " ") != want {
+		t.Errorf("progress notifications: want %q, got %q", want, got)
+	}
+}
+
+func TestExecuteGcodeFrameProgress(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	exe.down = NewDryRunDownlink(up)
+	exe.frameProgress = true
+
+	// Many commands per layer: the command index would report 20% at the first frame already.
+	gcode := "G90\nG1 Z5 F100\nG1 Z0.05 F100\n"
+	for i := 1; i <= 4; i++ {
+		gcode += fmt.Sprintf("M7820 S%d\nG4 P1\nG1 Z5 F100\nG1 Z%.2f F100\n", i, 0.05*float64(i+1))
+	}
+	job := writeTestJob(t, gcode)
+	if err := exe.ExecuteGcode(context.Background(), "sla", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	var got []string
+	for _, msg := range rec.ByType("notify-job-progress") {
+		if msg.Progress < 1 {
+			// Skip the initial notifications, which are sent before the job is started.
+			continue
+		}
+		got = append(got, fmt.Sprintf("%.0f%%", msg.Progress))
+	}
+	if want := "25% 50% 75% 100%"; strings.Join(got, " ") != want {
+		t.Errorf("progress notifications: want %q, got %q", want, got)
+	}
+
+	// Without frames, the command index is used.
+	job = writeTestJob(t, "G90\nG1 Z1 F100\nG1 Z2 F100\nG1 Z3 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "cnc", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	got = nil
+	for _, msg := range rec.ByType("notify-job-progress") {
+		if msg.JobName == "cnc" && msg.Progress >= 1 {
+			got = append(got, fmt.Sprintf("%.0f%%", msg.Progress))
+		}
+	}
+	if want := "25% 50% 75%"; strings.Join(got, " ") != want {
+		t.Errorf("progress notifications without frames: want %q, got %q", want, got)
+	}
+}
+
+func TestExecuteGcodeHomeCmd(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	exe.homeCmd = "G28"
+
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "home", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	want := "G28; G90; G1 Z4 F100"
+	if got := strings.Join(down.Written(), "; "); got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+}
+
+// slowHomingDownlink is a dry-run downlink, which homes until home is closed. Like the real downlink, it stops
+// waiting for the ok, when the context is canceled. done is closed, when the homing command returns.
+type slowHomingDownlink struct {
+	*DryRunDownlink
+	homing chan bool
+	home   chan bool
+	done   chan bool
+}
+
+func newSlowHomingDownlink(up *Uplink) *slowHomingDownlink {
+	return &slowHomingDownlink{DryRunDownlink: NewDryRunDownlink(up), homing: make(chan bool), home: make(chan bool), done: make(chan bool)}
+}
+
+func (dl *slowHomingDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	if strings.HasPrefix(cmd, "G28") {
+		defer close(dl.done)
+		close(dl.homing)
+		select {
+		case <-dl.home:
+		case <-ctx.Done():
+			return context.Canceled
+		}
+	}
+	return dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+}
+
+func TestExecuteGcodeCancelWhileHoming(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := newSlowHomingDownlink(up)
+	defer close(down.home)
+	exe.down = down
+	exe.homeCmd = "G28"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+	errCh := make(chan error, 1)
+	go func() { errCh <- exe.ExecuteGcode(ctx, "home", job) }()
+	<-down.homing
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("ExecuteGcode: want context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ExecuteGcode is still waiting for the homing after cancel")
+	}
+	if written := down.Written(); len(written) != 0 {
+		t.Errorf("want no job commands after cancel, got %q", written)
+	}
+}
+
+func TestExecuteGcodeRejectedWhileHoming(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := newSlowHomingDownlink(up)
+	defer close(down.home)
+	exe.down = down
+	exe.homeCmd = "G28"
+	exe.maxZ = 1
+
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+	errCh := make(chan error, 1)
+	go func() { errCh <- exe.ExecuteGcode(context.Background(), "home", job) }()
+	<-down.homing
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "job rejected") {
+			t.Errorf("ExecuteGcode: want max_z rejection, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ExecuteGcode is still waiting for the homing after the job is rejected")
+	}
+	// The homing has not outlived the job.
+	select {
+	case <-down.done:
+	default:
+		t.Errorf("the homing is still running after the job has failed")
+	}
+}
+
+// failingDownlink is a dry-run downlink, which fails every command starting with prefix.
+type failingDownlink struct {
+	*DryRunDownlink
+	prefix string
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func (dl *failingDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	if strings.HasPrefix(cmd, dl.prefix) {
+		dl.mu.Lock()
+		dl.attempts++
+		dl.mu.Unlock()
+		return errors.New("checksum mismatch")
+	}
+	return dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+}
+
+func (dl *failingDownlink) Attempts() int {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.attempts
+}
+
+func TestExecuteGcodeRetryCap(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := &failingDownlink{DryRunDownlink: NewDryRunDownlink(up), prefix: "G1"}
+	exe.down = down
+	exe.maxWriteRetries = 3
+	job := writeTestJob(t, "G90\nG1 Z4 F100\nG1 Z5 F100\n")
+
+	start := time.Now()
+	err := exe.ExecuteGcode(context.Background(), "retry", job)
+	if err == nil || !strings.Contains(err.Error(), "after 3 retries") {
+		t.Fatalf("ExecuteGcode: want an error after 3 retries, got %v", err)
+	}
+	if got := down.Attempts(); got != 4 {
+		t.Errorf("want 4 attempts (1 + 3 retries), got %d", got)
+	}
+	// 1 second before the first command and the backoff of 100ms + 200ms + 400ms.
+	if elapsed := time.Now().Sub(start); elapsed < time.Second+700*time.Millisecond {
+		t.Errorf("the retries took %v, want a backoff between them", elapsed)
+	}
+	if got, want := strings.Join(down.Written(), "; "), "G90"; got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+
+	// The same with the time limit.
+	exe.maxWriteRetries = 0
+	exe.maxWriteRetryTime = 250 * time.Millisecond
+	err = exe.ExecuteGcode(context.Background(), "retry", job)
+	if err == nil || !strings.Contains(err.Error(), "failed to write \"G1 Z4 F100\" for") {
+		t.Fatalf("ExecuteGcode: want an error after the retry time, got %v", err)
+	}
+	if got := down.Attempts(); got != 4+3 {
+		t.Errorf("want 3 more attempts within 250ms (at 0, 100ms and 300ms), got %d", got-4)
+	}
+}
+
+func TestSnapshotPostHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-hook")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The hook saves its arguments.
+	hook := path.Join(dir, "hook.sh")
+	out := path.Join(dir, "args.txt")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	up, _ := newTestUplink()
+	rss := newFakeRealSense(t, up, func(n int) {})
+	defer rss.stdin.Close()
+	exe := NewExecutor(up, true /*virtual*/, rss)
+	exe.postSnapshotCmd = hook + " --flag"
+
+	if err := exe.Snapshot(context.Background()); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("the hook has not been run: %v", err)
+	}
+	args := strings.Fields(string(data))
+	if len(args) != 2 || args[0] != "--flag" || !strings.HasSuffix(args[1], "/realsense-") {
+		t.Errorf("want the hook run with --flag and the snapshot prefix, got %q", args)
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func TestReadAllMaxSize(t *testing.T) {
+	const total = 4 << 20
+	r := &countingReader{r: io.LimitReader(zeroReader{}, total)}
+	_, err := readAll(context.Background(), r, 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("readAll: want a too-large error, got: %v", err)
+	}
+	if r.n >= total {
+		t.Errorf("readAll has consumed the whole body (%d bytes) before rejecting it", r.n)
+	}
+
+	data, err := readAll(context.Background(), io.LimitReader(zeroReader{}, 1000), 1000)
+	if err != nil {
+		t.Fatalf("readAll: %v", err)
+	}
+	if len(data) != 1000 {
+		t.Errorf("readAll: want 1000 bytes, got %d", len(data))
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// bufferReportingDownlink is a dry-run downlink, which reports the given free space in the firmware buffers.
+// After freeAfter commands, the buffers are reported as free, like when the firmware has caught up.
+type bufferReportingDownlink struct {
+	*DryRunDownlink
+	freeAfter int
+
+	mu  sync.Mutex
+	buf BufferInfo
+}
+
+func (dl *bufferReportingDownlink) FreeBuffers() (BufferInfo, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.buf, true
+}
+
+func (dl *bufferReportingDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	err := dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.freeAfter > 0 && len(dl.Written()) >= dl.freeAfter {
+		dl.buf = BufferInfo{Planner: 15, Block: 4}
+	}
+	return err
+}
+
+func TestPaceForBuffers(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := &bufferReportingDownlink{DryRunDownlink: NewDryRunDownlink(up), freeAfter: 3, buf: BufferInfo{Planner: 0, Block: 4}}
+	exe.down = down
+
+	if exe.paceForBuffers(context.Background()) {
+		t.Errorf("paceForBuffers: pacing engaged, although buffer flow control is disabled")
+	}
+	exe.bufferFlowControl = true
+	start := time.Now()
+	if !exe.paceForBuffers(context.Background()) {
+		t.Errorf("paceForBuffers: pacing has not engaged, although the planner buffer is full")
+	}
+	if elapsed := time.Now().Sub(start); elapsed < bufferPacingDelay {
+		t.Errorf("paceForBuffers: paused for %v, want at least %v", elapsed, bufferPacingDelay)
+	}
+	// The buffers are only reported as free after the third query.
+	if got := strings.Join(down.Written(), "; "); got != "G4 P0; G4 P0; G4 P0" {
+		t.Errorf("Written: want the buffers queried until there's room, got %q", got)
+	}
+	if exe.paceForBuffers(context.Background()) {
+		t.Errorf("paceForBuffers: pacing engaged, although there's plenty of free space")
+	}
+
+	// The buffers stay full, until the job is canceled.
+	down.freeAfter = 0
+	down.buf = BufferInfo{Planner: 0, Block: 4}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*bufferPacingDelay)
+	defer cancel()
+	if !exe.paceForBuffers(ctx) {
+		t.Errorf("paceForBuffers: pacing has not engaged, although the planner buffer is full")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("paceForBuffers has returned before the buffers are free or the job is canceled")
+	}
+
+	// The buffers stay full, but the pacing gives up after maxBufferPauses.
+	written := len(down.Written())
+	if !exe.paceForBuffers(context.Background()) {
+		t.Errorf("paceForBuffers: pacing has not engaged, although the planner buffer is full")
+	}
+	if queries := len(down.Written()) - written; queries != maxBufferPauses {
+		t.Errorf("want the buffers queried %d times, before giving up, got %d", maxBufferPauses, queries)
+	}
+}
+
+func TestResolveFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-frames")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"frame-000003.png", "layer_0004.jpg"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	patterns := parseFramePatterns(defaultFramePatterns + ",layer_%04d.png, layer_%04d.jpg")
+	tests := []struct {
+		idx  int
+		want string
+	}{
+		{3, "frame-000003.png"},
+		{4, "layer_0004.jpg"},
+	}
+	for _, tt := range tests {
+		fname, err := resolveFrame(dir, patterns, tt.idx)
+		if err != nil {
+			t.Errorf("resolveFrame(%d): %v", tt.idx, err)
+			continue
+		}
+		if fname != path.Join(dir, tt.want) {
+			t.Errorf("resolveFrame(%d): want %s, got %s", tt.idx, tt.want, fname)
+		}
+	}
+	if _, err := resolveFrame(dir, patterns, 5); err == nil || !strings.Contains(err.Error(), "frame 5 not found") {
+		t.Errorf("resolveFrame(5): want a frame not found error, got: %v", err)
+	}
+}
+
+func TestExecuteGcodeChattyCommand(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, false /*virtual*/, nil)
+	conn := newFakeSerial()
+	dl := NewDFADownlink(up, 115200)
+	dl.acceptOnReplyAfter = 10 * time.Millisecond
+	dl.conn = conn
+	go dl.run(Connected)
+	exe.down = dl
+
+	waitForWrites := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); len(conn.Written()) < n && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go func() {
+		// G29 probes the bed for a while, reporting every point, and only then sends ok.
+		waitForWrites(1)
+		for i := 0; i < 5; i++ {
+			conn.Reply(fmt.Sprintf("Bed X: %d.000 Y: 0.000 Z: 0.125", i))
+			time.Sleep(20 * time.Millisecond)
+		}
+		if written := conn.Written(); len(written) != 1 {
+			t.Errorf("the next command is sent before G29 is complete: %q", written)
+		}
+		conn.Reply("ok")
+		waitForWrites(2)
+		conn.Reply("ok")
+	}()
+	job := writeTestJob(t, "G29\nG1 Z1 F100\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := exe.ExecuteGcode(ctx, "g29", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	if written := conn.Written(); len(written) != 2 || !strings.Contains(written[0], "G29") {
+		t.Errorf("want G29 and G1 written, got %q", written)
+	}
+	conn.Close()
+}
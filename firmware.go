@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long to wait for the M115 response at connect.
+	firmwareCapsTimeout = 10 * time.Second
+	// Auto-reported temperatures are requested with that interval, if the firmware supports it.
+	tempAutoReportCmd = "M155 S2"
+)
+
+// FirmwareCaps are the firmware name and capabilities reported in response to M115, like:
+//
+//	FIRMWARE_NAME:Marlin 2.0.9 (Github) SOURCE_CODE_URL:github.com/MarlinFirmware/Marlin PROTOCOL_VERSION:1.0
+//	Cap:AUTOREPORT_TEMP:1
+//	Cap:EEPROM:0
+//
+// GRBL does not know M115. Its name comes from the banner it prints at boot, like "Grbl 1.1h ['$' for help]".
+type FirmwareCaps struct {
+	Name string
+	Caps map[string]bool
+}
+
+// parseFirmwareLine adds the information from a line of the M115 response to caps.
+// It returns false, if the line is not a part of the M115 response or the GRBL banner.
+func (caps *FirmwareCaps) parseFirmwareLine(txt string) bool {
+	if strings.HasPrefix(txt, "Grbl ") {
+		caps.Name = strings.Join(strings.Fields(txt)[:2], " ")
+		return true
+	}
+	if strings.HasPrefix(txt, "FIRMWARE_NAME:") {
+		// The name could contain spaces. It lasts until the next KEY: field.
+		var name []string
+		for _, word := range strings.Fields(txt[len("FIRMWARE_NAME:"):]) {
+			if i := strings.Index(word, ":"); i > 0 && isFieldKey(word[:i]) {
+				break
+			}
+			name = append(name, word)
+		}
+		caps.Name = strings.Join(name, " ")
+		return true
+	}
+	if strings.HasPrefix(txt, "Cap:") {
+		parts := strings.Split(txt[len("Cap:"):], ":")
+		if len(parts) != 2 {
+			return false
+		}
+		if caps.Caps == nil {
+			caps.Caps = make(map[string]bool)
+		}
+		caps.Caps[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1]) == "1"
+		return true
+	}
+	return false
+}
+
+// isFieldKey returns true for the keys of M115 fields, like SOURCE_CODE_URL.
+func isFieldKey(key string) bool {
+	for _, c := range key {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Known returns true, if the firmware has responded to M115 or printed the GRBL banner.
+func (caps FirmwareCaps) Known() bool {
+	return caps.Name != ""
+}
+
+// AutoReportTemp returns true, if the firmware reports temperatures on its own (M155),
+// so polling them with M105 is not needed.
+func (caps FirmwareCaps) AutoReportTemp() bool {
+	return caps.Caps["AUTOREPORT_TEMP"]
+}
+
+// LineNumbers returns true, if commands should be sent with line numbers and checksums.
+// Most firmwares accept them. Unknown firmwares get them as well, because that was always the case.
+func (caps FirmwareCaps) LineNumbers() bool {
+	return !strings.HasPrefix(strings.ToLower(caps.Name), "grbl")
+}
+
+// firmwareCapsReporter is implemented by downlinks which query the firmware capabilities.
+type firmwareCapsReporter interface {
+	FirmwareCaps() FirmwareCaps
+}
+
+func (dl *DFADownlink) FirmwareCaps() FirmwareCaps {
+	dl.capsMu.Lock()
+	defer dl.capsMu.Unlock()
+	return dl.caps
+}
+
+func (dl *DFADownlink) parseFirmwareLine(txt string) bool {
+	dl.capsMu.Lock()
+	defer dl.capsMu.Unlock()
+	return dl.caps.parseFirmwareLine(txt)
+}
+
+// queryFirmwareCaps sends M115 to the newly connected device. The response is parsed in readFromDevice.
+// The line numbers are not known to be supported yet, so M115 is sent without them.
+// It's not sent at all, if the GRBL banner has already been received.
+// If the banner is missed, GRBL rejects M115 with "error:20", which ends the query. See handleWaitingForOK.
+func (dl *DFADownlink) queryFirmwareCaps() {
+	ctx, cancel := context.WithTimeout(context.Background(), firmwareCapsTimeout)
+	defer cancel()
+	if !dl.FirmwareCaps().Known() {
+		if err := dl.writeRawAndWaitForOK(ctx, "M115"); err != nil {
+			dl.up.logf("Failed to query firmware capabilities: %v", err)
+			return
+		}
+	}
+	caps := dl.FirmwareCaps()
+	if !caps.Known() {
+		dl.up.logf("The firmware has not reported its name and capabilities. Using the defaults.")
+		return
+	}
+	dl.up.logf("Firmware: %s, auto-report temperature: %v, line numbers: %v", caps.Name, caps.AutoReportTemp(), caps.LineNumbers())
+	if caps.AutoReportTemp() {
+		// Temperature lines are parsed in readFromDevice, so there's no need to poll them with M105.
+		if err := dl.WriteAndWaitForOK(ctx, tempAutoReportCmd); err != nil {
+			dl.up.logf("Failed to enable auto-reported temperatures: %v", err)
+		}
+	}
+}
+
+// tempRe matches a heater in the temperature report, like T:210.00, T1:200.0 or B:60.00.
+var tempRe = regexp.MustCompile(`^([TBC][0-9]?):(-?[0-9.]+)$`)
+
+// parseTemperatures parses the temperature report, which is the response to M105 or
+// an unsolicited auto-report (see M155), like:
+//
+//	T:210.00 /210.00 B:60.00 /60.00 @:127 B@:0
+//
+// It returns false, if there are no temperatures in the line.
+func parseTemperatures(txt string) (temps map[string]Temperature, ok bool) {
+	var last string
+	for _, word := range strings.Fields(txt) {
+		if m := tempRe.FindStringSubmatch(word); m != nil {
+			val, err := strconv.ParseFloat(m[2], 64)
+			if err != nil {
+				return nil, false
+			}
+			if temps == nil {
+				temps = make(map[string]Temperature)
+			}
+			temps[m[1]] = Temperature{Actual: val}
+			last = m[1]
+			continue
+		}
+		if strings.HasPrefix(word, "/") && last != "" {
+			val, err := strconv.ParseFloat(word[1:], 64)
+			if err != nil {
+				return nil, false
+			}
+			temp := temps[last]
+			temp.Target = val
+			temps[last] = temp
+		}
+		last = ""
+	}
+	return temps, temps != nil
+}
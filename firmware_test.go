@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-agent/gcode"
+)
+
+const marlinM115 = `FIRMWARE_NAME:Marlin 2.0.9.3 (Feb 10 2022 12:00:00) SOURCE_CODE_URL:github.com/MarlinFirmware/Marlin PROTOCOL_VERSION:1.0 MACHINE_TYPE:Ender-3 EXTRUDER_COUNT:1
+Cap:SERIAL_XON_XOFF:0
+Cap:EEPROM:1
+Cap:AUTOREPORT_TEMP:1
+Cap:PROGRESS:0`
+
+func TestParseFirmwareCaps(t *testing.T) {
+	var caps FirmwareCaps
+	for _, line := range strings.Split(marlinM115, "\n") {
+		if !caps.parseFirmwareLine(line) {
+			t.Errorf("parseFirmwareLine(%q): want true", line)
+		}
+	}
+	if caps.parseFirmwareLine("echo:busy: processing") {
+		t.Errorf("parseFirmwareLine: want false for an unrelated line")
+	}
+	if want := "Marlin 2.0.9.3 (Feb 10 2022 12:00:00)"; caps.Name != want {
+		t.Errorf("Name: want %q, got %q", want, caps.Name)
+	}
+	if !caps.Known() || !caps.AutoReportTemp() || !caps.LineNumbers() {
+		t.Errorf("want known firmware with auto-report temperature and line numbers, got %+v", caps)
+	}
+	if caps.Caps["PROGRESS"] || !caps.Caps["EEPROM"] {
+		t.Errorf("want PROGRESS:0 and EEPROM:1, got %+v", caps.Caps)
+	}
+
+	// GRBL does not answer M115. It's detected by its banner.
+	var grbl FirmwareCaps
+	if !grbl.parseFirmwareLine("Grbl 1.1h ['$' for help]") || grbl.Name != "Grbl 1.1h" {
+		t.Errorf("want Grbl 1.1h detected by its banner, got %+v", grbl)
+	}
+	if grbl.LineNumbers() || grbl.AutoReportTemp() {
+		t.Errorf("want no line numbers and no auto-report temperature for grbl, got %+v", grbl)
+	}
+	if unknown := (FirmwareCaps{}); unknown.Known() || !unknown.LineNumbers() {
+		t.Errorf("want line numbers for an unknown firmware")
+	}
+}
+
+func TestDFADownlinkQueriesFirmwareCaps(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	go dl.Run()
+
+	conn := waitForOpen(t, opens)
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The firmware is not known yet, so M115 is sent without a line number.
+	if written := strings.TrimSpace(conn.Written()[0]); written != "M115" {
+		t.Fatalf("want M115 sent at connect without a line number, got %q", written)
+	}
+	for _, line := range strings.Split(marlinM115, "\n") {
+		conn.Reply(line)
+	}
+	conn.Reply("ok")
+	// The firmware supports auto-reported temperatures, so they are enabled.
+	for deadline := time.Now().Add(5 * time.Second); len(conn.Written()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("M155 is not sent. Firmware capabilities: %+v", dl.FirmwareCaps())
+		}
+	}
+	// M115 has not used up a line number.
+	if written, want := conn.Written()[1], gcode.AddLineAndHash(1, tempAutoReportCmd); !strings.Contains(written, want) {
+		t.Errorf("want %s sent after M115, got %q", want, written)
+	}
+	conn.Reply("ok")
+}
+
+func TestDFADownlinkFirmwareCapsProbeError(t *testing.T) {
+	dl, opens, _ := newFakeDFADownlink()
+	// The probe must not wait to be accepted on a reply.
+	dl.acceptOnReplyAfter = time.Hour
+	go dl.Run()
+
+	conn := waitForOpen(t, opens)
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// GRBL, which banner is missed, rejects M115 without an ok.
+	conn.Reply("error:20")
+	errCh := make(chan error, 1)
+	go func() { errCh <- dl.WriteAndWaitForOK(context.Background(), "G0 X1") }()
+	for deadline := time.Now().Add(5 * time.Second); len(conn.Written()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the command queued behind the failed M115 is not sent")
+		}
+	}
+	if written := conn.Written()[1]; !strings.Contains(written, "G0 X1") {
+		t.Errorf("want G0 X1 sent after M115, got %q", written)
+	}
+	conn.Reply("ok")
+	if err := <-errCh; err != nil {
+		t.Errorf("WriteAndWaitForOK: %v", err)
+	}
+	conn.Close()
+}
+
+func TestParseTemperatures(t *testing.T) {
+	temps, ok := parseTemperatures("T:210.00 /215.00 B:60.10 /60.00 @:127 B@:0")
+	if !ok {
+		t.Fatalf("parseTemperatures: want ok")
+	}
+	want := map[string]Temperature{"T": {210, 215}, "B": {60.1, 60}}
+	if len(temps) != len(want) || temps["T"] != want["T"] || temps["B"] != want["B"] {
+		t.Errorf("parseTemperatures: want %+v, got %+v", want, temps)
+	}
+	if temps, _ := parseTemperatures("T0:200.5 /0.0 T1:25.0 /0.0"); temps["T1"].Actual != 25 {
+		t.Errorf("parseTemperatures: want T1 at 25, got %+v", temps)
+	}
+	if _, ok := parseTemperatures("echo:busy: processing"); ok {
+		t.Errorf("parseTemperatures: want no temperatures in an unrelated line")
+	}
+}
+
+func TestDFADownlinkAutoReportedTemperatures(t *testing.T) {
+	up, rec := newTestUplink()
+	dl := NewDFADownlink(up, 115200)
+	conn := newFakeSerial()
+	go dl.readFromDevice(conn, false)
+
+	// Nobody has asked for them.
+	go func() {
+		conn.Reply(" T:200.00 /200.00 B:55.00 /60.00 @:64 B@:127")
+		conn.Reply(" T:201.00 /200.00 B:56.00 /60.00 @:64 B@:127")
+		conn.Reply("echo:done")
+	}()
+	// Temperatures are not replies to a command, so the first message is for echo:done.
+	if msg := <-dl.reqCh; msg.Type != MsgSomeReply {
+		t.Errorf("want MsgSomeReply, got %+v", msg)
+	}
+	msgs := rec.ByType("notify-temperature")
+	if len(msgs) != 2 {
+		t.Fatalf("want 2 notify-temperature messages, got %d", len(msgs))
+	}
+	var temps map[string]Temperature
+	if err := json.Unmarshal([]byte(msgs[1].Comment), &temps); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", msgs[1].Comment, err)
+	}
+	if temps["T"] != (Temperature{201, 200}) || temps["B"] != (Temperature{56, 60}) {
+		t.Errorf("want T 201/200 and B 56/60, got %+v", temps)
+	}
+	conn.Close()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSysfsGPIORoot = "/sys/class/gpio"
+	gpioPollInterval     = time.Second
+)
+
+// GPIO reads digital pins. Many SLA rigs wire the door switch and the UV LED relay to GPIO.
+// It's an interface, so that other backends (and fakes in tests) can be plugged in.
+type GPIO interface {
+	Read(pin int) (bool, error)
+}
+
+// SysfsGPIO reads pins via /sys/class/gpio. A pin is exported on the first read, if needed.
+// The direction is left as is, so the state of outputs, like the UV LED relay, can be read too.
+type SysfsGPIO struct {
+	root string
+}
+
+func NewSysfsGPIO() *SysfsGPIO {
+	return &SysfsGPIO{root: defaultSysfsGPIORoot}
+}
+
+func (g *SysfsGPIO) Read(pin int) (bool, error) {
+	valuePath := path.Join(g.root, fmt.Sprintf("gpio%d", pin), "value")
+	if _, err := os.Stat(valuePath); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(path.Join(g.root, "export"), []byte(strconv.Itoa(pin)), 0200); err != nil {
+			return false, fmt.Errorf("failed to export GPIO %d: %v", pin, err)
+		}
+	}
+	data, err := ioutil.ReadFile(valuePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read GPIO %d: %v", pin, err)
+	}
+	switch strings.TrimSpace(string(data)) {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, fmt.Errorf("unexpected value of GPIO %d: %q", pin, data)
+}
+
+// GPIOPin is a pin number. If ActiveLow is true, the low level means open door or UV on.
+type GPIOPin struct {
+	Num       int
+	ActiveLow bool
+}
+
+// GPIOPins maps the known inputs (door and uv) to the pins they are wired to.
+type GPIOPins map[string]GPIOPin
+
+// ParseGPIOPins parses a list like "door=!17,uv=27". The ! prefix marks an active low pin.
+func ParseGPIOPins(str string) (GPIOPins, error) {
+	res := make(GPIOPins)
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.Split(part, "=")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid GPIO input %q, want <name>=<pin> or <name>=!<pin>", part)
+		}
+		if kv[0] != "door" && kv[0] != "uv" {
+			return nil, fmt.Errorf("unknown GPIO input %q, want door or uv", kv[0])
+		}
+		var pin GPIOPin
+		num := kv[1]
+		if strings.HasPrefix(num, "!") {
+			pin.ActiveLow = true
+			num = num[1:]
+		}
+		n, err := strconv.ParseUint(num, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin of GPIO input %q: %v", kv[0], err)
+		}
+		pin.Num = int(n)
+		if _, ok := res[kv[0]]; ok {
+			return nil, fmt.Errorf("GPIO input %q is defined twice", kv[0])
+		}
+		res[kv[0]] = pin
+	}
+	return res, nil
+}
+
+// GPIOState is the state of the door and the UV LED. It's sent as JSON in the comment of notify-gpio-state.
+// The inputs, which are not configured, are omitted.
+type GPIOState struct {
+	Door string `json:"door,omitempty"`
+	UV   string `json:"uv,omitempty"`
+}
+
+func (pins GPIOPins) read(g GPIO, name string) (active, ok bool, err error) {
+	pin, ok := pins[name]
+	if !ok {
+		return false, false, nil
+	}
+	val, err := g.Read(pin.Num)
+	if err != nil {
+		return false, false, err
+	}
+	return val != pin.ActiveLow, true, nil
+}
+
+// ReadState reads all configured inputs.
+func (pins GPIOPins) ReadState(g GPIO) (st GPIOState, err error) {
+	open, ok, err := pins.read(g, "door")
+	if err != nil {
+		return st, err
+	}
+	if ok {
+		st.Door = "closed"
+		if open {
+			st.Door = "open"
+		}
+	}
+	on, ok, err := pins.read(g, "uv")
+	if err != nil {
+		return st, err
+	}
+	if ok {
+		st.UV = "off"
+		if on {
+			st.UV = "on"
+		}
+	}
+	return st, nil
+}
+
+// checkDoor reports the GPIO state and refuses to start a job while the door is open.
+func (exe *Executor) checkDoor() error {
+	if exe.gpio == nil || len(exe.gpioPins) == 0 {
+		return nil
+	}
+	st, err := exe.gpioPins.ReadState(exe.gpio)
+	if err != nil {
+		return fmt.Errorf("failed to read the door state: %v", err)
+	}
+	exe.up.NotifyGPIOState(st)
+	if st.Door == "open" {
+		return errors.New("the door is open")
+	}
+	return nil
+}
+
+// MonitorGPIO polls the GPIO inputs and notifies the server, when their state changes.
+func (exe *Executor) MonitorGPIO(ctx context.Context, interval time.Duration) {
+	var last GPIOState
+	var lastErr string
+	for {
+		st, err := exe.gpioPins.ReadState(exe.gpio)
+		if err != nil {
+			// Log the error once, not every poll.
+			if err.Error() != lastErr {
+				exe.up.logf("GPIO: %v", err)
+				lastErr = err.Error()
+			}
+		} else {
+			lastErr = ""
+			if st != last {
+				exe.up.NotifyGPIOState(st)
+				last = st
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type fakeGPIO map[int]bool
+
+func (g fakeGPIO) Read(pin int) (bool, error) { return g[pin], nil }
+
+func TestParseGPIOPins(t *testing.T) {
+	pins, err := ParseGPIOPins("door=!17, uv=27")
+	if err != nil {
+		t.Fatalf("ParseGPIOPins: %v", err)
+	}
+	if want := (GPIOPin{Num: 17, ActiveLow: true}); pins["door"] != want {
+		t.Errorf("door: want %+v, got %+v", want, pins["door"])
+	}
+	if want := (GPIOPin{Num: 27}); pins["uv"] != want {
+		t.Errorf("uv: want %+v, got %+v", want, pins["uv"])
+	}
+	for _, str := range []string{"door", "door=x", "lid=17", "door=1,door=2"} {
+		if _, err := ParseGPIOPins(str); err == nil {
+			t.Errorf("ParseGPIOPins(%q): want an error", str)
+		}
+	}
+}
+
+func TestExecuteGcodeDoorOpen(t *testing.T) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	// The door switch is active low: the pin reads 0, when the door is open.
+	exe.gpio = fakeGPIO{17: false, 27: true}
+	exe.gpioPins = GPIOPins{"door": {Num: 17, ActiveLow: true}, "uv": {Num: 27}}
+	job := writeTestJob(t, "G90\nG1 Z4 F100\n")
+
+	err := exe.ExecuteGcode(context.Background(), "door", job)
+	if err == nil || !strings.Contains(err.Error(), "door is open") {
+		t.Fatalf("ExecuteGcode: want an error about the open door, got %v", err)
+	}
+	if written := down.Written(); len(written) > 0 {
+		t.Errorf("want no commands sent, got %q", written)
+	}
+	msgs := rec.ByType("notify-gpio-state")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-gpio-state message, got %d", len(msgs))
+	}
+	var st GPIOState
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &st); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", msgs[0].Comment, err)
+	}
+	if want := (GPIOState{Door: "open", UV: "on"}); st != want {
+		t.Errorf("want %+v, got %+v", want, st)
+	}
+
+	exe.gpio = fakeGPIO{17: true}
+	if err := exe.ExecuteGcode(context.Background(), "door", job); err != nil {
+		t.Fatalf("ExecuteGcode with the door closed: %v", err)
+	}
+}
+
+func TestSysfsGPIORead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-gpio")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "gpio17"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "gpio17", "value"), []byte("1\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g := &SysfsGPIO{root: dir}
+	val, err := g.Read(17)
+	if err != nil {
+		t.Fatalf("Read(17): %v", err)
+	}
+	if !val {
+		t.Errorf("Read(17): want true, got false")
+	}
+	// The pin is not exported and the fake export file does not create it.
+	if _, err := g.Read(27); err == nil {
+		t.Errorf("Read(27): want an error")
+	}
+	if data, err := ioutil.ReadFile(path.Join(dir, "export")); err != nil || string(data) != "27" {
+		t.Errorf("want pin 27 to be exported, got %q, %v", data, err)
+	}
+}
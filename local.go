@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ListenLocal serves the shell verbs on a Unix domain socket, so that the device can be controlled
+// over SSH, when the cloud is unreachable. Only the owner of the agent process can connect to it.
+// Every line is a command, like in the cloud shell. The log lines it produces are sent back with
+// the "log: " prefix, followed by "ok" or "error". The prefix keeps a device echoing "ok" from
+// being taken for the result.
+func (sh *Shell) ListenLocal(socketPath string) error {
+	// A stale socket from the previous run.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the stale socket %s: %v", socketPath, err)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to restrict the permissions of %s: %v", socketPath, err)
+	}
+	go sh.serveLocal(l)
+	return nil
+}
+
+func (sh *Shell) serveLocal(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			sh.up.logf("Local shell: %v", err)
+			return
+		}
+		go sh.serveLocalConn(conn)
+	}
+}
+
+// localLogPrefix precedes the log lines in the responses of the local shell.
+const localLogPrefix = "log: "
+
+func (sh *Shell) serveLocalConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewScanner(conn)
+	for in.Scan() {
+		cmd := strings.TrimSpace(in.Text())
+		if cmd == "" {
+			continue
+		}
+		var mu sync.Mutex
+		var out []string
+		remove := sh.up.addLogTap(func(line string) {
+			mu.Lock()
+			defer mu.Unlock()
+			// A log line may span several lines, like the status JSON. Each of them is prefixed.
+			for _, l := range strings.Split(line, "\n") {
+				out = append(out, localLogPrefix+l)
+			}
+		})
+		sh.up.logf("Local shell: %s", cmd)
+		ok := sh.handleCommand(cmd)
+		remove()
+		res := "error"
+		if ok {
+			res = "ok"
+		}
+		mu.Lock()
+		out = append(out, res)
+		_, err := fmt.Fprintf(conn, "%s\n", strings.Join(out, "\n"))
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// localCommand sends a command to the local shell and returns the output lines before the ok/error line.
+func localCommand(t *testing.T, conn net.Conn, in *bufio.Scanner, cmd string) (out []string, ok bool) {
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		t.Fatalf("failed to send %q: %v", cmd, err)
+	}
+	for in.Scan() {
+		switch line := in.Text(); {
+		case line == "ok" || line == "error":
+			return out, line == "ok"
+		case strings.HasPrefix(line, localLogPrefix):
+			out = append(out, strings.TrimPrefix(line, localLogPrefix))
+		default:
+			t.Fatalf("%q: unexpected line in the response: %q", cmd, line)
+		}
+	}
+	t.Fatalf("no response to %q: %v", cmd, in.Err())
+	return nil, false
+}
+
+func TestLocalShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-local")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sh, _, _ := newTestShell()
+	socketPath := path.Join(dir, "agent.sock")
+	if err := sh.ListenLocal(socketPath); err != nil {
+		t.Fatalf("ListenLocal: %v", err)
+	}
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the socket must be only accessible by the owner, got %v (err: %v)", fi.Mode(), err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	in := bufio.NewScanner(conn)
+
+	out, ok := localCommand(t, conn, in, "version")
+	if !ok || !strings.Contains(strings.Join(out, "\n"), "RoboSLA agent version "+Version) {
+		t.Errorf("version: want the agent version and ok, got %q (ok: %v)", out, ok)
+	}
+	out, ok = localCommand(t, conn, in, "status")
+	if !ok || !strings.Contains(strings.Join(out, "\n"), `"version":"`+Version+`"`) {
+		t.Errorf("status: want the status JSON and ok, got %q (ok: %v)", out, ok)
+	}
+	if _, ok = localCommand(t, conn, in, "M999999"); ok {
+		t.Errorf("want an error for an invalid command")
+	}
+}
+
+// echoingDownlink is a dry-run downlink, which logs the "ok" of the device for every command.
+type echoingDownlink struct {
+	*DryRunDownlink
+	up *Uplink
+}
+
+func (dl *echoingDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	dl.up.logf("ok")
+	return dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+}
+
+func TestLocalShellDeviceEcho(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-local")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := &echoingDownlink{NewDryRunDownlink(up), up}
+	exe.down = down
+	sh := NewShell(up, down, exe)
+	socketPath := path.Join(dir, "agent.sock")
+	if err := sh.ListenLocal(socketPath); err != nil {
+		t.Fatalf("ListenLocal: %v", err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	in := bufio.NewScanner(conn)
+
+	// The echoed ok is a log line, not the result of the command.
+	out, ok := localCommand(t, conn, in, "G28 Z0")
+	echoed := false
+	for _, line := range out {
+		echoed = echoed || line == "ok"
+	}
+	if !ok || !echoed {
+		t.Errorf("G28 Z0: want the echoed ok among the log lines and ok, got %q (ok: %v)", out, ok)
+	}
+	// The responses are still in sync.
+	out, ok = localCommand(t, conn, in, "version")
+	if !ok || !strings.Contains(strings.Join(out, "\n"), "RoboSLA agent version "+Version) {
+		t.Errorf("version: want the agent version and ok, got %q (ok: %v)", out, ok)
+	}
+}
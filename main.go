@@ -9,7 +9,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/robodone/robosla-common/pkg/autoupdate"
+	"github.com/robodone/robosla-agent/pkg/mmwave"
+	"github.com/robodone/robosla-agent/pkg/ur"
 	"github.com/robodone/robosla-common/pkg/device_api"
 )
 
@@ -17,14 +18,63 @@ var (
 	Version     = "dev"
 	showVersion = flag.Bool("version", false, "If specified, the binary will show its version and exit")
 	baudRate    = flag.Int("rate", 115200, "Baud rate")
+	serialDev   = flag.String("serial_device", "", "Serial device of the printer, like /dev/ttyUSB0. By default, the first of /dev/ttyACM0-2 and /dev/ttyUSB0-2, which exists.")
 	apiServer   = flag.String("api_server", "", "Address of the API server")
+	apiPins     = flag.String("api_server_pins", "", "Comma-separated list of pinned API server certificates, like sha256/<base64 of the SPKI hash>. If specified, the agent does not connect to a server, unless its certificate chain matches one of them.")
+	updChannels = flag.String("update_channels", "", "Comma-separated list of the update channels with their manifest URLs, like beta=https://example.com/robosla-agent-beta.json. The prod channel is always available. The channel is switched with the update-channel shell command.")
+	fatalDelay  = flag.Duration("fatal_delay", defaultFatalDelay, "Pause before and after a fatal error is logged, so that it reaches the server. It's skipped, if the agent is not connected to the server.")
 	virtual     = flag.Bool("virtual", false, "If specified, the printer will simulate a connection to a printer.")
+	dryRun      = flag.Bool("dry_run", false, "If specified, the commands are validated and logged, but never sent to the device. Unlike --virtual, no timing is simulated.")
 	realSense   = flag.Bool("realsense", false, "If specified, RealSense features will be enabled")
 	speedup     = flag.Float64("speedup", 10, "Speedup for --virtual mode")
-	deviceType  = flag.String("device_type", "usb-gcode", "Device type. Default value (usb-gcode) covers most common 3d printers / CNC machines based on g-code. Another possible value: ur3 for Universal Robots UR3.")
-	ur3Host     = flag.String("ur3_host", "", "UR3 robot host (only used if -device_type=ur3)")
-	ur3Port     = flag.Int("ur3_port", 30002, "UR3 port (only used if -device_type=ur3)")
-	ur3RTDEPort = flag.Int("ur3_rtde_port", 30004, "UR3 RTDE port (only used if -device_type=ur3)")
+	radarCubes  = flag.Bool("mmwave_raw_cubes", false, "If specified, mmwave radar snapshots also save the raw little-endian data cube (<prefix>00-cube.bin) next to the image, for later reprocessing")
+	radarWarmup = flag.Int("mmwave_warmup_frames", mmwave.DefaultWarmupFrames, "Number of frames discarded after the mmwave radar is started for a snapshot, because the first frames are often noisy")
+	virtMoves   = flag.Bool("virtual_moves", false, "If specified, moves in --virtual mode take as long as the distance at the current feedrate requires (divided by --speedup), so that progress and ETA are realistic")
+	configDir   = flag.String("config_dir", "", "Directory with user.json and device.json. By default, $XDG_CONFIG_HOME/robosla or the first writable one of /etc/robosla, $HOME/.config/robosla and the directory with the binary. The cookies of legacy installs are copied from the directory with the binary.")
+	baseDir     = flag.String("base_dir", defaultBaseDir, "Directory for jobs and snapshot packs. Must be writable.")
+	maxDownload = flag.Int64("max_download_size", defaultMaxDownloadSize, "Maximum size of a downloaded job in bytes. Zero means no limit.")
+	dlConnectTO = flag.Duration("download_connect_timeout", defaultDownloadConnectTimeout, "Timeout to connect to the download server (or the proxy set by HTTP_PROXY / HTTPS_PROXY) and to complete the TLS handshake")
+	dlReadTO    = flag.Duration("download_read_timeout", defaultDownloadReadTimeout, "A job download fails, if no data is received for that long. The whole download may take longer. Zero disables the timeout.")
+	maxRetries  = flag.Int("max_write_retries", defaultMaxWriteRetries, "A job fails, if a command still fails after that many retries. Zero means no limit.")
+	maxRetryFor = flag.Duration("max_write_retry_time", defaultMaxWriteRetryTime, "A job fails, if a command still fails after being retried for that long. Zero means no limit.")
+	resumeReset = flag.Bool("resume_on_reset", false, "If specified, a job continues after the printer connection is lost and restored, like after a brief USB glitch: the line numbers are resynchronized with M110, and the unconfirmed command is sent again (it may run twice). If the printer resets, when the serial port is opened, the job fails instead.")
+	bufferFlow  = flag.Bool("buffer_flow_control", false, "If specified, commands are paced using the free buffer space reported by the firmware in ok responses (Marlin's ADVANCED_OK)")
+	homeCmd     = flag.String("home_cmd", "none", "Command to home the device at the start of every job, like 'G28 Z0' for SLA or 'G28' for delta printers. 'none' disables homing at the job start, which is the right thing for CNC.")
+	framePats   = flag.String("frame_patterns", defaultFramePatterns, "Comma-separated list of frame file name patterns in a job, like frame-%06d.png,layer_%04d.png,layer_%04d.jpg. The first existing file is displayed.")
+	frameDisp   = flag.String("frame_display", defaultFrameDisplay, "How SLA frames are displayed on the LCD: fbi runs the fbi image viewer, framebuffer draws them to /dev/fb0 directly, none shows nothing (for headless rigs).")
+	frameProg   = flag.Bool("frame_progress", false, "If specified, the progress of SLA jobs is the index of the displayed frame out of the number of frames, which is smoother than the default guess from the command index. Jobs without frames still use the command index.")
+	frameSettle = flag.Duration("frame_settle_delay", 0, "Pause after an SLA frame is shown and before the exposure starts, like 20ms, for LCDs which take a while to update. Zero means no pause.")
+	rawTextM    = flag.String("raw_text_mcodes", defaultRawTextMCodes, "Comma-separated list of M-codes, which take free text arguments (like the message of M117). Their arguments are passed to the device unparsed.")
+	snapMaxDim  = flag.Int("snapshot_max_dim", 0, "If positive, snapshot images are downscaled to fit this width and height before they are sent to the server. The server can change it with the snapshot-max-dim command. The files passed to -post_snapshot_cmd stay in full resolution.")
+	snapHook    = flag.String("post_snapshot_cmd", "", "Command to run after every snapshot, like copying the images to a NAS. The snapshot prefix (the directory and the file name prefix) is appended as the last argument. It's killed after a minute.")
+	startGcode  = flag.String("start_gcode", "", "If specified, the gcode file with the commands, which are sent after homing and before the first command of every job, like setting the acceleration or a prime line")
+	endGcode    = flag.String("end_gcode", "", "If specified, the gcode file with the commands, which are sent after every job, which succeeded")
+	lenient     = flag.Bool("lenient_gcode", false, "If specified, job lines which can't be parsed are skipped with a warning instead of failing the job. The number of skipped lines is reported when the job is done.")
+	maxZ        = flag.Float64("max_z", 0, "If positive, jobs which move Z above this value are rejected before they start")
+	deviceType  = flag.String("device_type", "usb-gcode", "Device type. Default value (usb-gcode) covers most common 3d printers / CNC machines based on g-code. Other possible values: ur3 for Universal Robots UR3, usb-gcode+ur3 for a g-code device and UR3 controlled together, where the commands for UR3 are prefixed with arm:, like arm:movej(...).")
+	outputs     = flag.String("outputs", defaultOutputs, "Comma-separated list of on/off outputs and the fan index (M106 P) they are wired to, like gripper=0,vent=1")
+	gripForce   = flag.Int("grip_force", 0, "If positive, the gripper is driven like a spindle: grip sends M3 S<grip_force> and drop sends M5. The server can override the force with grip <force>. Otherwise, the gripper and vent outputs are toggled.")
+	hotendLimit = flag.Float64("hotend_temp_cutoff", 0, "If positive, the agent sends M112 (emergency stop) and fails the job, as soon as a hotend reports a temperature above it, in °C. It does not depend on the setpoints and the max_temps of the config, to catch a thermal runaway, which the firmware misses.")
+	bedLimit    = flag.Float64("bed_temp_cutoff", 0, "If positive, the agent sends M112 (emergency stop) and fails the job, as soon as the bed reports a temperature above it, in °C. See -hotend_temp_cutoff.")
+	dfaWatchdog = flag.Duration("dfa_watchdog", defaultDFAWatchdogTimeout, "If the printer connection makes no progress for that long while a command is pending, it's forcibly reconnected. Zero disables the watchdog.")
+	livenessTO  = flag.Duration("liveness_timeout", defaultLivenessTimeout, "If the uplink, the shell, the running job or the downlink does not respond for that long, like after a deadlock, the agent dumps the stacks of all goroutines to the log and exits, so that the service manager restarts it. A long command, like M109 or G28, counts as progress, as long as the printer keeps sending something, like the temperatures or busy lines. Zero disables the watchdog.")
+	noAckDelay  = flag.Duration("no_ack_delay", defaultNoAckDelay, "Pause after every command, if the firmware does not acknowledge commands. Longer values reduce the throughput, shorter ones may overrun the firmware buffer, if it has no flow control.")
+	minCmdIntvl = flag.Duration("min_cmd_interval", 0, "Pause between the end of a command and the next command. Some cheap boards drop commands sent back-to-back, even though they acknowledge them. Unlike -no_ack_delay, it applies to every command.")
+	httpAddr    = flag.String("http_addr", "", "If specified, the agent serves its status as JSON at http://<http_addr>/status and Prometheus metrics at /metrics, like :8080. If the host is omitted, it binds to localhost.")
+	bashAllow   = flag.String("bash_allow", "", "Comma-separated list of programs, which the bash and shutdown commands may run, like ls,df,shutdown. By default, any program is allowed.")
+	cmdAllow    = flag.String("command_allow", "", "Comma-separated list of the commands, which the server may send, like G,M105,M114,status. Entries are G/M-codes, all codes of a letter (like G) or shell verbs. By default, any command is allowed. Every command of a job is checked as well, and the job is rejected, if one is not allowed. The commands from the local socket are not restricted, but the jobs they start are.")
+	cmdDeny     = flag.String("command_deny", "", "Comma-separated list of the commands, which the server may not send, like M112,bash. See -command_allow. It takes precedence over the allow-list.")
+	localSocket = flag.String("local_socket", "", "If specified, the shell commands are also accepted on this Unix domain socket (one per line), for local control when the cloud is unreachable. Only the agent user can connect to it.")
+	maxLineLen  = flag.Int("max_line_len", defaultMaxLineLen, "The longest line accepted from the printer, in bytes. Firmwares may dump very long settings lines in M503 and EEPROM reports.")
+	gpioInputs  = flag.String("gpio", "", "Comma-separated list of GPIO inputs (via /sys/class/gpio), like door=17,uv=27. A ! before the pin means active low, like door=!17. Jobs don't start while the door is open. The state is reported to the server.")
+	startMarker = flag.String("start_marker", "", "If specified, no commands are sent to the printer after connect, until it prints a line with this text, like 'start' for Marlin. Up to 10 seconds.")
+	ur3Host     = flag.String("ur3_host", "", "UR3 robot host (only used if -device_type is ur3 or usb-gcode+ur3)")
+	ur3Port     = flag.Int("ur3_port", 30002, "UR3 port (only used if -device_type is ur3 or usb-gcode+ur3)")
+	ur3RTDEPort = flag.Int("ur3_rtde_port", 30004, "UR3 RTDE port (only used if -device_type is ur3 or usb-gcode+ur3)")
+	ur3Accel    = flag.Float64("ur3_accel", defaultArmAccel, "Acceleration of the moves made with the arm-move (rad/s^2) and arm-jog (m/s^2) commands, unless overridden with a=<accel>")
+	ur3Vel      = flag.Float64("ur3_vel", defaultArmVel, "Velocity of the moves made with the arm-move (rad/s) and arm-jog (m/s) commands, unless overridden with v=<vel>")
+	ur3Home     = flag.String("ur3_home", "", "Comma-separated joint angles of the safe home of the arm in radians, like 0,-1.57,1.57,-1.57,-1.57,0. The arm-home command moves the arm there. With actual_q in -ur3_rtde_outputs, the arrival is confirmed.")
+	ur3RTDEOuts = flag.String("ur3_rtde_outputs", ur.DefaultOutputs, "Comma-separated list of RTDE outputs to subscribe to (only used if -device_type is ur3 or usb-gcode+ur3). actual_TCP_speed, actual_TCP_pose and safety_status_bits are required. With actual_q, the joint angles are reported.")
 )
 
 func failf(format string, args ...interface{}) {
@@ -46,7 +96,26 @@ func main() {
 		fmt.Printf("%s\n", Version)
 		os.Exit(0)
 	}
-	go autoupdate.Run(autoupdate.ProdManifestURL, Version, time.Minute, 1*time.Minute)
+	if err := migrateLegacyCookies(); err != nil {
+		logf("WARNING: failed to move the cookies to %s: %v", getConfigDir(), err)
+	}
+	// The config bundle pushed by the server. It must be applied before anything reads the flags.
+	cmdlineFlags = explicitFlags()
+	agentCfg, err := readAgentConfig()
+	if err != nil && !os.IsNotExist(err) {
+		logf("WARNING: the config bundle is ignored: %v", err)
+	}
+	if agentCfg != nil {
+		if err := agentCfg.applyFlags(cmdlineFlags); err != nil {
+			failf("Failed to apply %s: %v", getAgentConfigPath(), err)
+		}
+	}
+	channels, err := parseUpdateChannels(*updChannels)
+	if err != nil {
+		failf("Invalid -update_channels: %v", err)
+	}
+	updater := NewUpdater(Version, channels)
+	go updater.Run()
 
 	fmt.Fprintf(os.Stderr, "RoboSLA agent version: %s\n", Version)
 
@@ -54,6 +123,22 @@ func main() {
 		*apiServer = device_api.ChooseServer(Version)
 	}
 	up := NewUplink(*apiServer)
+	up.fatalDelay = *fatalDelay
+	if *apiPins != "" {
+		pins, err := parseCertPins(*apiPins)
+		if err != nil {
+			failf("Invalid -api_server_pins: %v", err)
+		}
+		if _, err := pinnedHostPort(*apiServer); err != nil {
+			failf("Invalid -api_server_pins: %v", err)
+		}
+		up.certPins = pins
+	}
+	var wd *LivenessWatchdog
+	if *livenessTO > 0 {
+		wd = NewLivenessWatchdog(up, *livenessTO)
+		up.wd = wd
+	}
 	go up.Run()
 	// Note: this may potentially block it forever. Only an autoupdate could resolve it.
 	// But it's not that we have other option, because the agent has to behave differently for
@@ -70,66 +155,221 @@ func main() {
 	if deviceName == "7f51037e15b4c836" /* Samovar-01 */ {
 		rss = &CombinedSnapshotter{
 			Snaps: map[string]Snapshotter{
-				"radar": &MmwaveSnapshotter{up: up},
+				"radar": &MmwaveSnapshotter{up: up, saveRawCubes: *radarCubes, warmupFrames: *radarWarmup},
 				"rgb":   &RaspistillSnapshotter{up: up},
 			},
 		}
 	}
-	exe := NewExecutor(up, *virtual, rss)
+	codes, err := parseMCodeSet(*rawTextM)
+	if err != nil {
+		up.Fatalf("Invalid -raw_text_mcodes: %v", err)
+	}
+	rawTextMCodes = codes
+	exe := NewExecutor(up, *virtual || *dryRun, rss)
+	exe.wd = wd
+	exe.maxZ = *maxZ
+	if *homeCmd != "none" {
+		if _, err := parseGcodeCommand("", *homeCmd); err != nil {
+			up.Fatalf("Invalid -home_cmd: %v", err)
+		}
+	}
+	exe.homeCmd = *homeCmd
+	exe.baseDir = *baseDir
+	exe.maxDownloadSize = *maxDownload
+	if *dlReadTO < 0 {
+		up.Fatalf("-download_read_timeout must not be negative, got %v", *dlReadTO)
+	}
+	exe.httpClient = newDownloadClient(*dlConnectTO, *dlReadTO)
+	exe.downloadReadTimeout = *dlReadTO
+	exe.maxWriteRetries = *maxRetries
+	exe.maxWriteRetryTime = *maxRetryFor
+	exe.resumeOnReset = *resumeReset
+	exe.bufferFlowControl = *bufferFlow
+	exe.framePatterns = parseFramePatterns(*framePats)
+	if exe.display, err = NewFrameDisplay(*frameDisp); err != nil {
+		up.Fatalf("Invalid -frame_display: %v", err)
+	}
+	exe.frameSettleDelay = *frameSettle
+	exe.frameProgress = *frameProg
+	exe.postSnapshotCmd = *snapHook
+	exe.snapshotMaxDim = *snapMaxDim
+	exe.lenientGcode = *lenient
+	var startCmds, endCmds []*Cmd
+	if *startGcode != "" {
+		if startCmds, _, _, err = loadGcode(*startGcode, false); err != nil {
+			up.Fatalf("Invalid -start_gcode: %v", err)
+		}
+	}
+	if *endGcode != "" {
+		if endCmds, _, _, err = loadGcode(*endGcode, false); err != nil {
+			up.Fatalf("Invalid -end_gcode: %v", err)
+		}
+	}
+	exe.SetJobGcode(startCmds, endCmds, nil)
+	if agentCfg != nil {
+		agentCfg.applyExecutor(exe, cmdlineFlags)
+	}
+	pins, err := ParseGPIOPins(*gpioInputs)
+	if err != nil {
+		up.Fatalf("Invalid -gpio: %v", err)
+	}
+	if len(pins) > 0 {
+		exe.gpio = NewSysfsGPIO()
+		exe.gpioPins = pins
+		go exe.MonitorGPIO(context.Background(), gpioPollInterval)
+	}
+	for _, pattern := range exe.framePatterns {
+		if strings.Contains(fmt.Sprintf(pattern, 1), "%!") {
+			up.Fatalf("Invalid -frame_patterns: %q must have exactly one integer verb, like %%06d", pattern)
+		}
+	}
+	if err := exe.CheckWritable(); err != nil {
+		// Not fatal: the device can still be controlled manually. Jobs will fail early with the same error.
+		up.logf("WARNING: %v", err)
+	}
 
+	if *maxLineLen <= 0 {
+		up.Fatalf("-max_line_len must be positive, got %d", *maxLineLen)
+	}
 	var down Downlink
 	switch *deviceType {
 	case "usb-gcode":
-		if *virtual || deviceName == "7f51037e15b4c836" /* Samovar-01 */ {
-			down = NewVirtualDownlink(up, *speedup)
-		} else {
-			/*realDown := NewRealDownlink(up, *baudRate)
-			go realDown.Run()
-			down = realDown*/
-			// TODO(krasin): get settings from the server instead of hardcoding them.
-			if deviceName == "60d7ef1765337d23" /*Delta-01*/ {
-				up.logf("Forcing baud rate = 57600")
-				*baudRate = 57600
-			}
-			dfaDown := NewDFADownlink(up, *baudRate)
-			go dfaDown.Run()
-			down = dfaDown
-		}
+		down = startGcodeDownlink(up, deviceName)
 	case "ur3":
-		if *ur3Host == "" {
-			up.Fatalf("-ur3_host not specified")
-		}
-		if *ur3Port == 0 {
-			up.Fatalf("-ur3_port not specified")
-		}
-		if *virtual {
-			up.Fatalf("virtual UR3 is not supported")
-		}
-		notifyMovingState := func(state string, pose []float64) {
-			up.NotifyMovingState(state, pose)
-			exe.NotifyMovingState(state)
-			// We try to take snapshot, if we are not moving.
-			if state != "moving" && rss != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-				err := exe.Snapshot(ctx)
-				cancel()
-				if err != nil {
-					up.logf("Failed to make a snapshot on idle transition: %v", err)
-					return
-				}
-			}
-		}
-		ur3Down := NewUR3Downlink(up, *ur3Host, *ur3Port, *ur3RTDEPort, notifyMovingState)
-		go ur3Down.Run()
-		down = ur3Down
+		down = startUR3Downlink(up, exe, rss)
+	case "usb-gcode+ur3":
+		// A printer and a robotic arm controlled by the same agent. Arm commands are prefixed with "arm:".
+		down = NewMultiDownlink(map[string]Downlink{
+			"printer": startGcodeDownlink(up, deviceName),
+			"arm":     startUR3Downlink(up, exe, rss),
+		}, "printer")
 	default:
 		up.Fatalf("Unsupported -device_type value: %q", *deviceType)
 	}
 	// TODO(krasin): remove this initialization dependency loop between executor, shell and downlink.
 	exe.down = down
 	sh := NewShell(up, down, exe)
+	sh.wd = wd
+	outs, err := ParseOutputs(*outputs)
+	if err != nil {
+		up.Fatalf("Invalid -outputs: %v", err)
+	}
+	sh.outputs = outs
+	sh.gripForce = *gripForce
+	if *ur3Accel <= 0 || *ur3Vel <= 0 {
+		up.Fatalf("-ur3_accel and -ur3_vel must be positive, got %v and %v", *ur3Accel, *ur3Vel)
+	}
+	sh.armAccel, sh.armVel = *ur3Accel, *ur3Vel
+	if sh.armHome, err = parseArmHome(*ur3Home); err != nil {
+		up.Fatalf("Invalid -ur3_home: %v", err)
+	}
+	sh.updater = updater
+	sh.tsPath = getGcodeTSPath()
+	sh.bashAllow = parseBashAllow(*bashAllow)
+	if *cmdAllow != "" || *cmdDeny != "" {
+		if sh.policy, err = parseCommandPolicy(*cmdAllow, *cmdDeny); err != nil {
+			up.Fatalf("Invalid -command_allow or -command_deny: %v", err)
+		}
+		exe.policy = sh.policy
+	}
 	go sh.Run()
+	if *localSocket != "" {
+		if err := sh.ListenLocal(*localSocket); err != nil {
+			up.logf("Local shell is not available: %v", err)
+		}
+	}
+
+	if *httpAddr != "" {
+		ss := NewStatusServer(up, down, Version)
+		go func() {
+			if err := ss.ListenAndServe(*httpAddr); err != nil {
+				up.logf("Status endpoint failed: %v", err)
+			}
+		}()
+	}
+
+	if wd != nil {
+		// The uplink, the shell and the executor beat on their own. The downlink is probed through its request channel.
+		wd.Probe("downlink", livenessProbeInterval, func() { down.Connected() })
+		go wd.Run(livenessProbeInterval)
+	}
 
 	// Never exit
 	select {}
 }
+
+func startGcodeDownlink(up *Uplink, deviceName string) Downlink {
+	if *dryRun {
+		return NewDryRunDownlink(up)
+	}
+	if *virtual || deviceName == "7f51037e15b4c836" /* Samovar-01 */ {
+		virtDown := NewVirtualDownlink(up, *speedup)
+		virtDown.modelMoves = *virtMoves
+		return virtDown
+	}
+	/*realDown := NewRealDownlink(up, *baudRate)
+	go realDown.Run()
+	down = realDown*/
+	// TODO(krasin): get settings from the server instead of hardcoding them.
+	if deviceName == "60d7ef1765337d23" /*Delta-01*/ {
+		up.logf("Forcing baud rate = 57600")
+		*baudRate = 57600
+	}
+	dfaDown := NewDFADownlink(up, *baudRate)
+	dfaDown.watchdogTimeout = *dfaWatchdog
+	dfaDown.noAckDelay = *noAckDelay
+	dfaDown.minCmdInterval = *minCmdIntvl
+	dfaDown.maxLineLen = *maxLineLen
+	dfaDown.startMarker = *startMarker
+	dfaDown.cutoffs = TempLimits{"T": *hotendLimit, "B": *bedLimit}
+	if *serialDev != "" {
+		ttyDev := *serialDev
+		dfaDown.findDev = func() (string, error) { return ttyDev, nil }
+	}
+	go dfaDown.Run()
+	return dfaDown
+}
+
+func startUR3Downlink(up *Uplink, exe *Executor, rss Snapshotter) Downlink {
+	if *ur3Host == "" {
+		up.Fatalf("-ur3_host not specified")
+	}
+	if *ur3Port == 0 {
+		up.Fatalf("-ur3_port not specified")
+	}
+	if *virtual || *dryRun {
+		up.Fatalf("virtual UR3 is not supported")
+	}
+	notifyMovingState := func(state string, pose []float64) {
+		up.NotifyMovingState(state, pose)
+		exe.NotifyMovingState(state)
+		// We try to take snapshot, if we are not moving.
+		if state != "moving" && rss != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err := exe.Snapshot(ctx)
+			cancel()
+			if err == ErrSnapshotSkipped {
+				up.logf("Skipped a snapshot on idle transition: %v", err)
+				return
+			}
+			if err != nil {
+				up.logf("Failed to make a snapshot on idle transition: %v", err)
+				return
+			}
+		}
+	}
+	ur3Down := NewUR3Downlink(up, *ur3Host, *ur3Port, *ur3RTDEPort, notifyMovingState)
+	outputs, err := ur.ParseOutputs(*ur3RTDEOuts)
+	if err != nil {
+		up.Fatalf("Invalid -ur3_rtde_outputs: %v", err)
+	}
+	for _, name := range []string{"actual_TCP_speed", "actual_TCP_pose", "safety_status_bits"} {
+		if !containsString(outputs, name) {
+			up.Fatalf("Invalid -ur3_rtde_outputs: %s is required", name)
+		}
+	}
+	ur3Down.rtdeOutputs = outputs
+	ur3Down.posePath = getUR3PosePath()
+	go ur3Down.Run()
+	return ur3Down
+}
@@ -3,23 +3,38 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/robodone/robosla-agent/pkg/mmwave"
 )
 
+// Dimensions of a radar data cube rendered as a 16-bit grayscale image.
+const (
+	mmwaveCubeWidth  = 384
+	mmwaveCubeHeight = 128
+)
+
 type MmwaveSnapshotter struct {
 	mu    sync.Mutex
 	up    *Uplink
 	radar *mmwave.Conn
+
+	// If true, the raw little-endian cube bytes are saved next to the image, for later reprocessing.
+	saveRawCubes bool
+	// Number of frames discarded after the sensor is started, see mmwave.DefaultWarmupFrames.
+	warmupFrames int
 }
 
-func cubeToJPEG(cube []byte, width, height int) ([]byte, error) {
+// cubeToPNG renders the data cube as a 16-bit grayscale PNG. PNG is lossless, so every value of the cube is kept.
+func cubeToPNG(cube []byte, width, height int) ([]byte, error) {
 	if width*height*2 != len(cube) {
 		return nil, fmt.Errorf("unexpected length of cube, want w*h*2 = %d*%d*2 = %d, got %d",
 			width, height, width*height*2, len(cube))
@@ -31,12 +46,17 @@ func cubeToJPEG(cube []byte, width, height int) ([]byte, error) {
 		img.Pix[i*2], img.Pix[i*2+1] = img.Pix[i*2+1], img.Pix[i*2]
 	}
 	var res bytes.Buffer
-	if err := jpeg.Encode(&res, img, nil); err != nil {
-		return nil, fmt.Errorf("failed to encode JPEG: %v", err)
+	if err := png.Encode(&res, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
 	}
 	return res.Bytes(), nil
 }
 
+// MimeType returns PNG, so that the radar frames are uploaded losslessly, as they are saved. See cubeToPNG.
+func (rss *MmwaveSnapshotter) MimeType() string {
+	return "image/png"
+}
+
 func (rss *MmwaveSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
 	if numFrames != 1 {
 		return fmt.Errorf("mmwave snapshot does not support taking multiple frames, but %d frames were requested", numFrames)
@@ -50,23 +70,74 @@ func (rss *MmwaveSnapshotter) TakeSnapshot(ctx context.Context, prefix string, n
 		if err != nil {
 			return fmt.Errorf("failed to connect to mmwave radar: %v", err)
 		}
+		rss.radar.SetWarmupFrames(rss.warmupFrames)
 		if err := rss.radar.Configure(); err != nil {
 			return fmt.Errorf("failed to configure the radar device: %v", err)
 		}
 	}
-	fname := fmt.Sprintf("%s%02d-camera0.jpg", prefix, 0)
 	start := time.Now()
-	cube, err := rss.radar.TakeSnapshot()
+	frame, err := rss.radar.TakeSnapshot()
 	if err != nil {
 		return fmt.Errorf("failed to read radar data: %v", err)
 	}
 	rss.up.logf("TakeSnapshot took %v", time.Now().Sub(start))
-	jpegData, err := cubeToJPEG(cube, 384, 128)
+	return saveMmwaveFrame(prefix, frame, rss.saveRawCubes)
+}
+
+// MmwaveFrameInfo is the frame header saved as a JSON sidecar next to the radar image.
+type MmwaveFrameInfo struct {
+	FrameNumber    uint32 `json:"frame_number"`
+	NumDetectedObj uint32 `json:"num_detected_obj"`
+	NumTLVs        uint32 `json:"num_tlvs"`
+	TimeCPUCycles  uint32 `json:"time_cpu_cycles"`
+	TotalPacketLen uint32 `json:"total_packet_len"`
+	Version        uint32 `json:"version"`
+	Platform       uint32 `json:"platform"`
+
+	// The cube is width x height little-endian uint16 values.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Name of the file with the raw cube bytes, if they are saved.
+	CubeFile string `json:"cube_file,omitempty"`
+}
+
+// saveMmwaveFrame saves the data cube as an image and its header as a JSON sidecar with the same name,
+// so that every radar frame is self-describing. If saveRaw is true, the raw cube bytes are saved too.
+func saveMmwaveFrame(prefix string, frame *mmwave.Frame, saveRaw bool) error {
+	fname := fmt.Sprintf("%s%02d-camera0.png", prefix, 0)
+	pngData, err := cubeToPNG(frame.Cube, mmwaveCubeWidth, mmwaveCubeHeight)
 	if err != nil {
-		return fmt.Errorf("cubeToImage: %v", err)
+		return fmt.Errorf("cubeToPNG: %v", err)
 	}
-	if err := ioutil.WriteFile(fname, jpegData, 0644); err != nil {
+	if err := ioutil.WriteFile(fname, pngData, 0644); err != nil {
 		return fmt.Errorf("Error: can't save %s: %v", fname, err)
 	}
+	hdr := frame.Header
+	info := &MmwaveFrameInfo{
+		FrameNumber:    hdr.FrameNumber,
+		NumDetectedObj: hdr.NumDetectedObj,
+		NumTLVs:        hdr.NumTLVs,
+		TimeCPUCycles:  hdr.TimeCPUCycles,
+		TotalPacketLen: hdr.TotalPacketLen,
+		Version:        hdr.Version,
+		Platform:       hdr.Platform,
+		Width:          mmwaveCubeWidth,
+		Height:         mmwaveCubeHeight,
+	}
+	if saveRaw {
+		cubeName := fmt.Sprintf("%s%02d-cube.bin", prefix, 0)
+		if err := ioutil.WriteFile(cubeName, frame.Cube, 0644); err != nil {
+			return fmt.Errorf("Error: can't save %s: %v", cubeName, err)
+		}
+		info.CubeFile = path.Base(cubeName)
+	}
+	infoData, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize the radar frame header: %v", err)
+	}
+	infoName := strings.TrimSuffix(fname, path.Ext(fname)) + ".json"
+	if err := ioutil.WriteFile(infoName, infoData, 0644); err != nil {
+		return fmt.Errorf("Error: can't save %s: %v", infoName, err)
+	}
 	return nil
 }
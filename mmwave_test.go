@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/robodone/robosla-agent/pkg/mmwave"
+)
+
+func TestSaveMmwaveFrameSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-mmwave")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	frame := &mmwave.Frame{
+		Header: mmwave.Header{FrameNumber: 1234, NumDetectedObj: 5, NumTLVs: 2, TotalPacketLen: 512},
+		Cube:   make([]byte, mmwaveCubeWidth*mmwaveCubeHeight*2),
+	}
+	if err := saveMmwaveFrame(path.Join(dir, "radar"), frame, false); err != nil {
+		t.Fatalf("saveMmwaveFrame: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "radar00-camera0.png")); err != nil {
+		t.Errorf("the image is not saved: %v", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "radar00-camera0.json"))
+	if err != nil {
+		t.Fatalf("the sidecar is not saved: %v", err)
+	}
+	var info MmwaveFrameInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", data, err)
+	}
+	if info.FrameNumber != 1234 || info.NumDetectedObj != 5 {
+		t.Errorf("want frame 1234 with 5 detected objects, got %+v", info)
+	}
+	if _, err := os.Stat(path.Join(dir, "radar00-cube.bin")); err == nil {
+		t.Errorf("the raw cube is saved, but it was not requested")
+	}
+}
+
+func TestCubeToPNG(t *testing.T) {
+	cube := make([]byte, mmwaveCubeWidth*mmwaveCubeHeight*2)
+	for i := range cube {
+		cube[i] = byte(i * 7)
+	}
+	data, err := cubeToPNG(cube, mmwaveCubeWidth, mmwaveCubeHeight)
+	if err != nil {
+		t.Fatalf("cubeToPNG: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	gray, ok := img.(*image.Gray16)
+	if !ok {
+		t.Fatalf("want a 16-bit grayscale image, got %T", img)
+	}
+	// Lossless: every little-endian value of the cube is in the image.
+	for i := 0; i < len(cube); i += 2 {
+		x, y := (i/2)%mmwaveCubeWidth, (i/2)/mmwaveCubeWidth
+		if got, want := gray.Gray16At(x, y).Y, uint16(cube[i])|uint16(cube[i+1])<<8; got != want {
+			t.Fatalf("pixel (%d, %d): want %d, got %d", x, y, want, got)
+		}
+	}
+	if _, err := cubeToPNG(cube[1:], mmwaveCubeWidth, mmwaveCubeHeight); err == nil {
+		t.Errorf("cubeToPNG: want an error for a truncated cube")
+	}
+}
+
+func TestSaveMmwaveFrameRawCube(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-mmwave")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cube := make([]byte, mmwaveCubeWidth*mmwaveCubeHeight*2)
+	for i := range cube {
+		cube[i] = byte(i * 7)
+	}
+	if err := saveMmwaveFrame(path.Join(dir, "radar"), &mmwave.Frame{Cube: cube}, true); err != nil {
+		t.Fatalf("saveMmwaveFrame: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path.Join(dir, "radar00-cube.bin"))
+	if err != nil {
+		t.Fatalf("the raw cube is not saved: %v", err)
+	}
+	if len(raw) != mmwave.CubeSize {
+		t.Errorf("raw cube length: want %d, got %d", mmwave.CubeSize, len(raw))
+	}
+	if !bytes.Equal(raw, cube) {
+		t.Errorf("the raw cube differs from the input")
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "radar00-camera0.json"))
+	if err != nil {
+		t.Fatalf("the sidecar is not saved: %v", err)
+	}
+	var info MmwaveFrameInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", data, err)
+	}
+	if info.CubeFile != "radar00-cube.bin" || info.Width != mmwaveCubeWidth || info.Height != mmwaveCubeHeight {
+		t.Errorf("want radar00-cube.bin with %dx%d values, got %+v", mmwaveCubeWidth, mmwaveCubeHeight, info)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MultiDownlink allows to control several devices at once, like a printer and a robotic arm moving a camera.
+// A command is routed to the downlink named by its prefix, like "arm:movej(...)". Commands without
+// a prefix go to the default downlink. Each downlink maintains its own connection.
+type MultiDownlink struct {
+	downs map[string]Downlink
+	def   string
+}
+
+func NewMultiDownlink(downs map[string]Downlink, def string) *MultiDownlink {
+	if _, ok := downs[def]; !ok {
+		panic(fmt.Sprintf("NewMultiDownlink: default downlink %q is not in the list", def))
+	}
+	return &MultiDownlink{downs: downs, def: def}
+}
+
+// splitTarget splits "arm:movej(...)" into "arm" and "movej(...)".
+// ok is false, if the command is not addressed to a particular downlink.
+func splitTarget(cmd string) (target, rest string, ok bool) {
+	idx := strings.Index(cmd, ":")
+	if idx <= 0 {
+		return "", cmd, false
+	}
+	for _, c := range cmd[:idx] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", cmd, false
+		}
+	}
+	return cmd[:idx], strings.TrimSpace(cmd[idx+1:]), true
+}
+
+// targetRouter is implemented by downlinks which route commands by their target prefix, like MultiDownlink.
+type targetRouter interface {
+	HasTarget(name string) bool
+}
+
+func (dl *MultiDownlink) HasTarget(name string) bool {
+	_, ok := dl.downs[name]
+	return ok
+}
+
+// checkTarget returns an error, if cmd is addressed to a device, like "arm:movej(...)", and down can't route it there.
+// Other downlinks would send the prefix to the device as is.
+func checkTarget(down Downlink, cmd string) error {
+	target, _, ok := splitTarget(cmd)
+	if !ok {
+		return nil
+	}
+	if tr, isTR := down.(targetRouter); isTR && tr.HasTarget(target) {
+		return nil
+	}
+	return fmt.Errorf("unknown target %q in command %q", target, cmd)
+}
+
+func (dl *MultiDownlink) route(cmd string) (Downlink, string, error) {
+	target, rest, ok := splitTarget(cmd)
+	if !ok {
+		return dl.downs[dl.def], cmd, nil
+	}
+	down, ok := dl.downs[target]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown target %q in command %q", target, cmd)
+	}
+	return down, rest, nil
+}
+
+// names returns the names of the downlinks in order, so that they are always visited in the same order.
+func (dl *MultiDownlink) names() []string {
+	var names []string
+	for name := range dl.downs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (dl *MultiDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	down, rest, err := dl.route(cmd)
+	if err != nil {
+		return err
+	}
+	return down.WriteAndWaitForOK(ctx, rest)
+}
+
+// Connected returns true only if all the devices are connected.
+func (dl *MultiDownlink) Connected() bool {
+	for _, down := range dl.downs {
+		if !down.Connected() {
+			return false
+		}
+	}
+	return true
+}
+
+func (dl *MultiDownlink) WaitForConnection(wait time.Duration) bool {
+	until := time.Now().Add(wait)
+	for _, down := range dl.downs {
+		left := until.Sub(time.Now())
+		if left < 0 {
+			left = 0
+		}
+		if !down.WaitForConnection(left) {
+			return false
+		}
+	}
+	return true
+}
+
+func (dl *MultiDownlink) Disconnect() error {
+	for _, name := range dl.names() {
+		if err := dl.downs[name].Disconnect(); err != nil {
+			return fmt.Errorf("failed to disconnect %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (dl *MultiDownlink) Reconnect() error {
+	for _, name := range dl.names() {
+		if err := dl.downs[name].Reconnect(); err != nil {
+			return fmt.Errorf("failed to reconnect %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Flush discards the stale input from the downlinks, which support it. See DFADownlink.Flush.
+func (dl *MultiDownlink) Flush(ctx context.Context) error {
+	for _, name := range dl.names() {
+		if fl, ok := dl.downs[name].(inputFlusher); ok {
+			if err := fl.Flush(ctx); err != nil {
+				return fmt.Errorf("failed to flush %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Pose returns the pose of the first downlink, in the order of names, which knows it.
+func (dl *MultiDownlink) Pose() (pose []float64, ok bool) {
+	for _, name := range dl.names() {
+		if pr, isPR := dl.downs[name].(poseReporter); isPR {
+			if pose, ok = pr.Pose(); ok {
+				return
+			}
+		}
+	}
+	return nil, false
+}
+
+// PreRestartPose returns the pose before the restart of the first downlink, in the order of names, which knows it.
+func (dl *MultiDownlink) PreRestartPose() (saved *SavedPose, ok bool) {
+	for _, name := range dl.names() {
+		if pr, isPR := dl.downs[name].(preRestartPoseReporter); isPR {
+			if saved, ok = pr.PreRestartPose(); ok {
+				return
+			}
+		}
+	}
+	return nil, false
+}
+
+// Joints returns the joint angles of the first downlink, in the order of names, which knows them.
+func (dl *MultiDownlink) Joints() (joints []float64, ok bool) {
+	for _, name := range dl.names() {
+		if jr, isJR := dl.downs[name].(jointReporter); isJR {
+			if joints, ok = jr.Joints(); ok {
+				return
+			}
+		}
+	}
+	return nil, false
+}
+
+// Stats returns the link stats of the default downlink, if it collects them.
+func (dl *MultiDownlink) Stats() LinkStats {
+	if sr, ok := dl.downs[dl.def].(statsReporter); ok {
+		return sr.Stats()
+	}
+	return LinkStats{}
+}
+
+// FreeBuffers returns the free firmware buffers of the default downlink. See bufferReporter.
+func (dl *MultiDownlink) FreeBuffers() (buf BufferInfo, ok bool) {
+	if br, isBR := dl.downs[dl.def].(bufferReporter); isBR {
+		return br.FreeBuffers()
+	}
+	return BufferInfo{}, false
+}
+
+// FirmwareCaps returns the firmware capabilities of the default downlink, if it knows them.
+func (dl *MultiDownlink) FirmwareCaps() FirmwareCaps {
+	if fr, ok := dl.downs[dl.def].(firmwareCapsReporter); ok {
+		return fr.FirmwareCaps()
+	}
+	return FirmwareCaps{}
+}
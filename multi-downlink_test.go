@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMultiDownlinkRouting(t *testing.T) {
+	up, _ := newTestUplink()
+	printer := NewDryRunDownlink(up)
+	arm := NewDryRunDownlink(up)
+	dl := NewMultiDownlink(map[string]Downlink{"printer": printer, "arm": arm}, "printer")
+
+	for _, cmd := range []string{"G28 Z0", "arm:movej([0, 0, 0, 0, 0, 0], a=0.1, v=0.01)", "printer:G1 Z10"} {
+		if err := dl.WriteAndWaitForOK(context.Background(), cmd); err != nil {
+			t.Fatalf("WriteAndWaitForOK(%q): %v", cmd, err)
+		}
+	}
+	if got, want := strings.Join(printer.Written(), "; "), "G28 Z0; G1 Z10"; got != want {
+		t.Errorf("printer: want %q, got %q", want, got)
+	}
+	if got, want := strings.Join(arm.Written(), "; "), "movej([0, 0, 0, 0, 0, 0], a=0.1, v=0.01)"; got != want {
+		t.Errorf("arm: want %q, got %q", want, got)
+	}
+	if err := dl.WriteAndWaitForOK(context.Background(), "camera:G1 Z10"); err == nil {
+		t.Errorf("WriteAndWaitForOK: want an error for an unknown target")
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	up, _ := newTestUplink()
+	printer := NewDryRunDownlink(up)
+	multi := NewMultiDownlink(map[string]Downlink{"printer": printer, "arm": NewDryRunDownlink(up)}, "printer")
+	for _, tc := range []struct {
+		down Downlink
+		cmd  string
+		ok   bool
+	}{
+		{printer, "G1 Z10", true},
+		{printer, "arm:G1 Z10", false},
+		{multi, "G1 Z10", true},
+		{multi, "arm:G1 Z10", true},
+		{multi, "camera:G1 Z10", false},
+	} {
+		if err := checkTarget(tc.down, tc.cmd); (err == nil) != tc.ok {
+			t.Errorf("checkTarget(%T, %q): want ok: %v, got %v", tc.down, tc.cmd, tc.ok, err)
+		}
+	}
+
+	// The prefix is not sent to a single device.
+	sh, down, _ := newTestShell()
+	if err := sh.SendCommand(context.Background(), "arm:G1 Z10"); err == nil {
+		t.Errorf("SendCommand: want an error for a target without a multi-downlink")
+	}
+	if written := down.Written(); len(written) != 0 {
+		t.Errorf("want nothing written, got %q", written)
+	}
+}
+
+func TestMultiDownlinkForwards(t *testing.T) {
+	up, _ := newTestUplink()
+	printer := &statsDryRunDownlink{NewDryRunDownlink(up), LinkStats{Resends: 7}}
+	dl := NewMultiDownlink(map[string]Downlink{"printer": printer, "arm": NewDryRunDownlink(up)}, "printer")
+	var down Downlink = dl
+	sr, ok := down.(statsReporter)
+	if !ok {
+		t.Fatalf("MultiDownlink does not report link stats")
+	}
+	if got := sr.Stats().Resends; got != 7 {
+		t.Errorf("Stats: want the printer stats with 7 resends, got %d", got)
+	}
+	if _, ok := down.(bufferReporter); !ok {
+		t.Errorf("MultiDownlink does not report the firmware buffers")
+	}
+	if _, ok := down.(firmwareCapsReporter); !ok {
+		t.Errorf("MultiDownlink does not report the firmware capabilities")
+	}
+	if _, ok := dl.Joints(); ok {
+		t.Errorf("Joints: want none without an arm, which knows them")
+	}
+}
+
+// orderedDownlink is a dry-run downlink, which records the order, in which the downlinks are reconnected.
+type orderedDownlink struct {
+	*DryRunDownlink
+	name  string
+	order *[]string
+}
+
+func (dl *orderedDownlink) Reconnect() error {
+	*dl.order = append(*dl.order, dl.name)
+	return nil
+}
+
+func TestMultiDownlinkOrder(t *testing.T) {
+	up, _ := newTestUplink()
+	var order []string
+	downs := make(map[string]Downlink)
+	for _, name := range []string{"printer", "arm", "camera", "gantry"} {
+		downs[name] = &orderedDownlink{NewDryRunDownlink(up), name, &order}
+	}
+	dl := NewMultiDownlink(downs, "printer")
+	for i := 0; i < 10; i++ {
+		order = nil
+		if err := dl.Reconnect(); err != nil {
+			t.Fatalf("Reconnect: %v", err)
+		}
+		if got, want := strings.Join(order, ", "), "arm, camera, gantry, printer"; got != want {
+			t.Fatalf("want the downlinks reconnected in the order of names: %q, got %q", want, got)
+		}
+	}
+}
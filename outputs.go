@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Default routing of the on/off outputs: the gripper valve is wired to the first fan header,
+// and the vent valve is wired to the second one.
+const defaultOutputs = "gripper=0,vent=1"
+
+// Outputs maps names of on/off outputs (valves, fans, etc) to the fan index (P in M106/M107),
+// they are wired to. That allows to control them without knowing, how exactly the board is wired.
+type Outputs map[string]int
+
+func ParseOutputs(str string) (Outputs, error) {
+	res := make(Outputs)
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.Split(part, "=")
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid output %q, want <name>=<index>", part)
+		}
+		idx, err := strconv.ParseUint(kv[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index of output %q: %v", kv[0], err)
+		}
+		if _, ok := res[kv[0]]; ok {
+			return nil, fmt.Errorf("output %q is defined twice", kv[0])
+		}
+		res[kv[0]] = int(idx)
+	}
+	return res, nil
+}
+
+func (o Outputs) command(name string, on bool) (string, error) {
+	idx, ok := o[name]
+	if !ok {
+		return "", fmt.Errorf("output %q is not configured", name)
+	}
+	if on {
+		return fmt.Sprintf("M106 P%d", idx), nil
+	}
+	return fmt.Sprintf("M107 P%d", idx), nil
+}
+
+// On returns a command which turns on the named output.
+func (o Outputs) On(name string) (string, error) { return o.command(name, true) }
+
+// Off returns a command which turns off the named output.
+func (o Outputs) Off(name string) (string, error) { return o.command(name, false) }
+
+// Sequence translates steps like "gripper=on" or "vent=off" into gcode commands.
+// Steps which don't refer to outputs, like "G4 P400", are passed as is.
+func (o Outputs) Sequence(steps ...string) ([]string, error) {
+	var res []string
+	for _, step := range steps {
+		cmd := step
+		var err error
+		switch {
+		case strings.HasSuffix(step, "=on"):
+			cmd, err = o.On(strings.TrimSuffix(step, "=on"))
+		case strings.HasSuffix(step, "=off"):
+			cmd, err = o.Off(strings.TrimSuffix(step, "=off"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cmd)
+	}
+	return res, nil
+}
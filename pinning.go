@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+const pinDialTimeout = 30 * time.Second
+
+// parseCertPins parses a comma-separated list of SPKI pins, like "sha256/AAAA...=,sha256/BBBB...=".
+// A pin is the base64 of the SHA-256 hash of the certificate's SubjectPublicKeyInfo, as in HPKP.
+func parseCertPins(str string) ([][]byte, error) {
+	var pins [][]byte
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "sha256/") {
+			return nil, fmt.Errorf("pin %q: want sha256/<base64 of the SPKI hash>", s)
+		}
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256/"))
+		if err != nil {
+			return nil, fmt.Errorf("pin %q: %v", s, err)
+		}
+		if len(pin) != sha256.Size {
+			return nil, fmt.Errorf("pin %q: want %d bytes, got %d", s, sha256.Size, len(pin))
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func spkiHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// pinnedHostPort returns host:port to check the pin of for the API server address, like wss://example.com/ws.
+func pinnedHostPort(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "wss", "https":
+	default:
+		return "", fmt.Errorf("certificate pinning requires a wss:// or https:// address, got %q", addr)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	return net.JoinHostPort(u.Hostname(), "443"), nil
+}
+
+// checkPins returns an error, unless one of the certificates in the verified chains matches one of the pins.
+func checkPins(verifiedChains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			hash := spkiHash(cert)
+			for _, pin := range pins {
+				if bytes.Equal(hash, pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("the certificate of the API server does not match any of the pins. Possible MITM attack")
+}
+
+// pinnedTLSConfig returns the TLS config, with which the handshake fails, unless the certificate of the server
+// matches one of the pins. If roots is nil, the system roots are used.
+func pinnedTLSConfig(serverName string, pins [][]byte, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkPins(verifiedChains, pins)
+		},
+	}
+}
+
+// pinnedTLSDialer returns the dialer of the TLS connections to the API server, on which the handshake fails,
+// unless the certificate matches one of the pins. It's passed to the WebSocket dial, so the pins are enforced
+// on the connection, which is actually used. If roots is nil, the system roots are used.
+func pinnedTLSDialer(pins [][]byte, roots *x509.CertPool) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: pinDialTimeout}
+		conn, err := tls.DialWithDialer(dialer, network, addr, pinnedTLSConfig(host, pins, roots))
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake with %s failed: %v", addr, err)
+		}
+		return conn, nil
+	}
+}
+
+// connectWS connects to the API server. If the certificate pins are configured, the TLS connection
+// is dialed with the pins checked. See pinnedTLSDialer.
+func (up *Uplink) connectWS() (device_api.Conn, error) {
+	if len(up.certPins) > 0 {
+		return device_api.ConnectWSWithDialer(up.apiServerAddr, pinnedTLSDialer(up.certPins, nil))
+	}
+	return device_api.ConnectWS(up.apiServerAddr)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPinnedTLSDialer(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from "+r.URL.Path)
+	}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	good, err := parseCertPins("sha256/" + base64.StdEncoding.EncodeToString(spkiHash(srv.Certificate())))
+	if err != nil {
+		t.Fatalf("parseCertPins: %v", err)
+	}
+	// The dialer is used, like the WebSocket dial uses it.
+	client := &http.Client{Transport: &http.Transport{DialTLS: pinnedTLSDialer(good, roots), DisableKeepAlives: true}}
+	resp, err := client.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatalf("Get with the matching pin: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello from /ws" {
+		t.Errorf("want the response of the server, got %q, err: %v", body, err)
+	}
+
+	bad := sha256.Sum256([]byte("some other key"))
+	if conn, err := pinnedTLSDialer([][]byte{bad[:]}, roots)("tcp", srv.Listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("pinnedTLSDialer: want an error for a mismatched pin")
+	}
+	if _, err := pinnedHostPort("ws://example.com/ws"); err == nil {
+		t.Errorf("pinnedHostPort: want an error for a non-TLS address")
+	}
+}
+
+func TestParseCertPins(t *testing.T) {
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	pins, err := parseCertPins(pin + ", " + pin)
+	if err != nil || len(pins) != 2 {
+		t.Errorf("parseCertPins: want 2 pins, got %d, err: %v", len(pins), err)
+	}
+	for _, s := range []string{"md5/AAAA", "sha256/not-base64!", "sha256/AAAA"} {
+		if _, err := parseCertPins(s); err == nil {
+			t.Errorf("parseCertPins(%q): want an error", s)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package mmwave
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/samofly/serial"
@@ -19,6 +22,17 @@ const (
 	BufferSize  = 1 << 10
 	PreviewSize = 1 << 9
 	HeaderSize  = 36
+	// numRangeBins * numDopplerBins * numTxAntennas * numRxAntennas * 4 bytes
+	CubeSize = 128 * 16 * 3 * 4 * 4
+	// Packets longer than that are considered corrupted.
+	MaxPacketLen = HeaderSize + CubeSize + 64<<10
+	// If the cfg port does not confirm a command for that long, the command is assumed to be done.
+	DefaultConfirmTimeout = 2 * time.Second
+	// Number of frames buffered by Stream. When the reader falls behind, the oldest frames are dropped.
+	StreamBufferSize = 4
+	// Number of frames discarded by TakeSnapshot after sensorStart. The first frames are often noisy,
+	// because the radar has not stabilized yet.
+	DefaultWarmupFrames = 2
 )
 
 var (
@@ -36,6 +50,14 @@ type Header struct {
 	NumTLVs        uint32
 }
 
+// Frame is a data cube together with the header of the frame it was received with
+// and the points detected in that frame.
+type Frame struct {
+	Header Header
+	Points []Point
+	Cube   []byte
+}
+
 type Logger interface {
 	Logf(format string, args ...interface{})
 }
@@ -46,7 +68,19 @@ type Conn struct {
 	dataDev string
 	cfg     serial.Port
 	data    serial.Port
-	cubeCh  <-chan []byte
+	frameCh <-chan *Frame
+	// Closed, when the data port reader exits.
+	closed chan bool
+
+	mu     sync.Mutex
+	stream chan Frame // Non-nil while streaming.
+	// Frames to discard after sensorStart in TakeSnapshot, and how many of them are still to be discarded.
+	warmupFrames int
+	warmupLeft   int
+
+	// Command confirmations from the cfg port: nil for "Done", an error for "Error ...".
+	confirmCh      chan error
+	confirmTimeout time.Duration
 }
 
 // Open assumes that the radar is on /dev/ttyACM0 and /dev/ttyACM1 ports.
@@ -56,8 +90,17 @@ func Open(logger Logger) (*Conn, error) {
 }
 
 func OpenDev(logger Logger, cfgDev string, cfgBaud int, dataDev string, dataBaud int) (res *Conn, err error) {
-	cubeCh := make(chan []byte, 1)
-	res = &Conn{log: logger, cfgDev: cfgDev, dataDev: dataDev, cubeCh: cubeCh}
+	frameCh := make(chan *Frame, 1)
+	res = &Conn{
+		log:            logger,
+		cfgDev:         cfgDev,
+		dataDev:        dataDev,
+		frameCh:        frameCh,
+		closed:         make(chan bool),
+		confirmCh:      make(chan error, 1),
+		confirmTimeout: DefaultConfirmTimeout,
+		warmupFrames:   DefaultWarmupFrames,
+	}
 	res.cfg, err = serial.Open(cfgDev, cfgBaud)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open cfg port: %v", err)
@@ -71,7 +114,7 @@ func OpenDev(logger Logger, cfgDev string, cfgBaud int, dataDev string, dataBaud
 	if err != nil {
 		return nil, fmt.Errorf("failed to open data port: %v", err)
 	}
-	go res.readFromData(cubeCh)
+	go res.readFromData(frameCh)
 	go res.readFromCfg()
 	return res, nil
 }
@@ -107,17 +150,52 @@ func sendSerial(logger Logger, conn serial.Port, cmd string) error {
 	return err
 }
 
+// sendAndConfirm sends a command to the cfg port and waits until the radar confirms it.
+// If there's no confirmation within confirmTimeout, it logs that and assumes the command is done,
+// because the confirmation line could be lost or garbled.
+func (c *Conn) sendAndConfirm(cmd string) error {
+	// Forget confirmations of the previous commands.
+	for cleared := false; !cleared; {
+		select {
+		case <-c.confirmCh:
+		default:
+			cleared = true
+		}
+	}
+	if err := sendSerial(c.log, c.cfg, cmd); err != nil {
+		return err
+	}
+	select {
+	case err := <-c.confirmCh:
+		if err != nil {
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+		return nil
+	case <-time.After(c.confirmTimeout):
+		c.log.Logf("%s has not been confirmed in %v. Assuming it's done.", cmd, c.confirmTimeout)
+		return nil
+	}
+}
+
+// sendComment sends a comment line to the cfg port. The radar does not confirm comments.
+func (c *Conn) sendComment(comment string) error {
+	return sendSerial(c.log, c.cfg, "% "+comment)
+}
+
 // Configure stops the radar sensor and configures it and leaves the sensor stopped.
 // It must be called at least once after opening the connection.
+// Every command is confirmed, so that no stale confirmation is left for the following commands.
 func (c *Conn) Configure() (err error) {
 	send := func(cmd string) {
 		if err != nil {
 			return
 		}
-		err = sendSerial(c.log, c.cfg, cmd)
+		err = c.sendAndConfirm(cmd)
 	}
 
-	send("% mmwave-reader")
+	if err = c.sendComment("mmwave-reader"); err != nil {
+		return
+	}
 	send("sensorStop")
 	send("flushCfg")
 	send("dfeDataOutputMode 1")
@@ -151,10 +229,12 @@ func (c *Conn) MiniConfigure() (err error) {
 		if err != nil {
 			return
 		}
-		err = sendSerial(c.log, c.cfg, cmd)
+		err = c.sendAndConfirm(cmd)
 	}
 
-	send("% mmwave-reader")
+	if err = c.sendComment("mmwave-reader"); err != nil {
+		return
+	}
 	send("sensorStop")
 	send("flushCfg")
 	send("dfeDataOutputMode 1")
@@ -168,12 +248,31 @@ func (c *Conn) MiniConfigure() (err error) {
 	return
 }
 
-func (c *Conn) TakeSnapshot() ([]byte, error) {
+// SetWarmupFrames sets the number of frames discarded by TakeSnapshot after sensorStart. See DefaultWarmupFrames.
+func (c *Conn) SetWarmupFrames(n int) {
+	c.mu.Lock()
+	c.warmupFrames = n
+	c.mu.Unlock()
+}
+
+// discardWarmup returns true, if the frame is one of the first frames after sensorStart, which are discarded.
+func (c *Conn) discardWarmup(frame *Frame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.warmupLeft <= 0 {
+		return false
+	}
+	c.warmupLeft--
+	c.log.Logf("Discarding warmup frame %d, %d more to go", frame.Header.FrameNumber, c.warmupLeft)
+	return true
+}
+
+func (c *Conn) TakeSnapshot() (*Frame, error) {
 	// Receive all stale data and forget it.
 	var cleared bool
 	for !cleared {
 		select {
-		case <-c.cubeCh:
+		case <-c.frameCh:
 		default:
 			cleared = true
 		}
@@ -183,72 +282,197 @@ func (c *Conn) TakeSnapshot() ([]byte, error) {
 		if err := c.MiniConfigure(); err != nil {
 			return nil, fmt.Errorf("failed to configure before taking a snapshot: %v", err)
 		}
+		c.mu.Lock()
+		c.warmupLeft = c.warmupFrames
+		c.mu.Unlock()
 		// Start the sensor
-		sendSerial(c.log, c.cfg, "sensorStart")
+		if err := c.sendAndConfirm("sensorStart"); err != nil {
+			c.log.Logf("Failed to start the sensor: %v", err)
+			continue
+		}
 		select {
-		case cube, ok := <-c.cubeCh:
+		case frame, ok := <-c.frameCh:
 			if !ok {
 				// The connection was closed.
 				return nil, io.EOF
 			}
-			return cube, nil
+			// The sensor is stopped here, not in the data port reader, which must not wait for the confirmation.
+			// The frames received meanwhile are stale. They are discarded by the next snapshot.
+			if err := c.sendAndConfirm("sensorStop"); err != nil {
+				c.log.Logf("Failed to stop the sensor: %v", err)
+			}
+			return frame, nil
 		case <-time.After(20 * time.Second):
 		}
 	}
 	return nil, fmt.Errorf("taking a snapshot timed out (even after retries)")
 }
 
-func (c *Conn) readFromData(cubeCh chan<- []byte) {
-	defer close(cubeCh)
-	r := bufio.NewReaderSize(c.data, BufferSize)
-	cube := make([]byte, 128*16*3*4*4) // numRangeBins * numDopplerBins * numTxAntennas * numRxAntennas * 4 bytes
+// Stream starts the sensor and delivers frames continuously, until ctx is canceled or the connection is closed.
+// Then the sensor is stopped and the channel is closed. If the reader falls behind, the oldest frames are dropped.
+// TakeSnapshot must not be used while streaming.
+func (c *Conn) Stream(ctx context.Context) <-chan Frame {
+	ch := make(chan Frame, StreamBufferSize)
+	c.mu.Lock()
+	c.stream = ch
+	c.mu.Unlock()
+	go func() {
+		if err := c.MiniConfigure(); err != nil {
+			c.log.Logf("Failed to configure before streaming: %v", err)
+		} else if err := c.sendAndConfirm("sensorStart"); err != nil {
+			c.log.Logf("Failed to start the sensor: %v", err)
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-c.closed:
+			}
+		}
+		c.mu.Lock()
+		c.stream = nil
+		c.mu.Unlock()
+		if err := c.sendAndConfirm("sensorStop"); err != nil {
+			c.log.Logf("Failed to stop the sensor: %v", err)
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// sendToStream sends the frame to the active stream, if any, and reports whether the stream was active.
+func (c *Conn) sendToStream(frame *Frame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream == nil {
+		return false
+	}
 	for {
-		data, err := r.Peek(PreviewSize)
+		select {
+		case c.stream <- *frame:
+			return true
+		default:
+		}
+		// The channel is full. Drop the oldest frame to make room for the new one.
+		select {
+		case <-c.stream:
+		default:
+		}
+	}
+}
+
+func (c *Conn) readFromData(frameCh chan<- *Frame) {
+	defer close(c.closed)
+	defer close(frameCh)
+	c.readFrames(c.data, func(frame *Frame) {
+		if c.sendToStream(frame) || c.discardWarmup(frame) {
+			// Keep the sensor running.
+			return
+		}
+		// TakeSnapshot stops the sensor, once it has got the frame.
+		select {
+		case frameCh <- frame:
+		default:
+		}
+	})
+}
+
+// readFrames reads frames from the data port and calls onFrame for every one of them.
+// The serial port returns io.EOF, if there's no data yet, so io.EOF is never fatal here.
+// It returns on any other error.
+func (c *Conn) readFrames(data io.Reader, onFrame func(frame *Frame)) {
+	r := bufio.NewReaderSize(data, BufferSize)
+	for {
+		preview, err := r.Peek(PreviewSize)
 		if err != nil && err != io.EOF {
 			c.log.Logf("readFromData, peek failed: %v", err)
 			return
 		}
-		if len(data) < HeaderSize {
-			// Not enough data, let's wait a bit.
-			time.Sleep(20 * time.Millisecond)
-			continue
-		}
-		pos := bytes.Index(data, MagicWord)
+		pos := bytes.Index(preview, MagicWord)
 		if pos < 0 {
-			// No magic word in the preview window. Discarding the data.
-			c.log.Logf("Discard %d bytes", len(data))
-			r.Discard(len(data))
+			// No magic word in the preview window. Discarding the data, except for the tail,
+			// which could be the beginning of a magic word.
+			if n := len(preview) - len(MagicWord) + 1; n > 0 {
+				c.log.Logf("Discard %d bytes", n)
+				r.Discard(n)
+			} else {
+				// Not enough data, let's wait a bit.
+				time.Sleep(20 * time.Millisecond)
+			}
 			continue
 		}
 		if pos > 0 {
 			// Discard the remainings of the previous frame.
 			c.log.Logf("Discard %d bytes", pos)
 			r.Discard(pos)
+			continue
 		}
-		_, err = r.Peek(HeaderSize)
+		// The magic word is at the start. Nothing is consumed, until the full header is available.
+		hdrData, err := r.Peek(HeaderSize)
 		if err == io.EOF {
-			// Not enough data
+			// Not enough data, let's wait a bit.
+			time.Sleep(20 * time.Millisecond)
 			continue
 		}
+		if err != nil {
+			c.log.Logf("readFromData, peek failed: %v", err)
+			return
+		}
 		var hdr Header
-		if err = binary.Read(r, binary.LittleEndian, &hdr); err != nil {
-			c.log.Logf("failed to read radar message header: %v", err)
+		if err = binary.Read(bytes.NewReader(hdrData), binary.LittleEndian, &hdr); err != nil {
+			c.log.Logf("failed to parse radar message header: %v", err)
 			return
 		}
 		c.log.Logf("hdr: %+v", hdr)
-		r.Discard(int(hdr.TotalPacketLen) - HeaderSize)
-		if _, err = io.ReadFull(r, cube); err != nil {
+		if hdr.TotalPacketLen < HeaderSize || hdr.TotalPacketLen > MaxPacketLen {
+			// A corrupted header, or the magic word is a part of the data. Resync to the next magic word.
+			c.log.Logf("Invalid TotalPacketLen: %d, want [%d, %d]. Skipping the frame.", hdr.TotalPacketLen, HeaderSize, MaxPacketLen)
+			r.Discard(len(MagicWord))
+			continue
+		}
+		r.Discard(HeaderSize)
+		packet := make([]byte, int(hdr.TotalPacketLen)-HeaderSize)
+		if err = readFull(r, packet, len(packet)); err != nil {
+			c.log.Logf("failed to read the radar packet (size: %d): %v", hdr.TotalPacketLen, err)
+			return
+		}
+		var points []Point
+		tlvs, err := ParseTLVs(packet, int(hdr.NumTLVs))
+		if err == nil {
+			points, err = ParsePoints(tlvs)
+		}
+		if err != nil {
+			// The cube is still useful without the points.
+			c.log.Logf("failed to parse the radar packet: %v", err)
+		}
+		cube := make([]byte, CubeSize)
+		if err = readFull(r, cube, len(cube)); err != nil {
 			c.log.Logf("failed to read radar data cube (size: %d): %v", len(cube), err)
 			return
 		}
-		sendSerial(c.log, c.cfg, "sensorStop")
-		// TODO(krasin): properly wait for sensorStop confirmation.
-		time.Sleep(500 * time.Millisecond)
-		select {
-		case cubeCh <- cube:
-		default:
+		onFrame(&Frame{Header: hdr, Points: points, Cube: cube})
+	}
+}
+
+// readFull reads exactly n bytes into buf, or skips them, if buf is nil. Unlike io.ReadFull,
+// it waits for more data on io.EOF, because that's how the serial port reports a timeout.
+func readFull(r *bufio.Reader, buf []byte, n int) error {
+	for done := 0; done < n; {
+		var got int
+		var err error
+		if buf == nil {
+			got, err = r.Discard(n - done)
+		} else {
+			got, err = r.Read(buf[done:n])
+		}
+		done += got
+		if err == io.EOF {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func (c *Conn) readFromCfg() error {
@@ -256,6 +480,19 @@ func (c *Conn) readFromCfg() error {
 	for in.Scan() {
 		txt := strings.TrimSpace(in.Text())
 		c.log.Logf("%s\n", txt)
+		// The radar echoes every command after the prompt and then reports "Done" or "Error <code>".
+		var res error
+		switch {
+		case txt == "Done":
+		case strings.HasPrefix(txt, "Error"):
+			res = errors.New(txt)
+		default:
+			continue
+		}
+		select {
+		case c.confirmCh <- res:
+		default:
+		}
 	}
 	if err := in.Err(); err != nil {
 		c.log.Logf("readFromCfg: %v", err)
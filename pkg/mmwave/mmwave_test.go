@@ -0,0 +1,307 @@
+package mmwave
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Logf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+
+var errDone = errors.New("no more data")
+
+// chunkReader returns the chunks one by one with io.EOF in between, like a serial port, when
+// the data is not there yet. When all chunks are read, it returns errDone.
+type chunkReader struct {
+	chunks [][]byte
+	eof    bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, errDone
+	}
+	if r.eof {
+		r.eof = false
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+		r.eof = true
+	}
+	return n, nil
+}
+
+// testHeader returns a header with the given TotalPacketLen.
+func testHeader(t *testing.T, totalPacketLen uint32) []byte {
+	var buf bytes.Buffer
+	hdr := Header{Version: 1, TotalPacketLen: totalPacketLen, FrameNumber: 7}
+	copy(hdr.Magic[:], MagicWord)
+	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// testFrame returns a frame with a packet of packetLen bytes after the header and a data cube filled with fill.
+func testFrame(t *testing.T, packetLen int, fill byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(testHeader(t, uint32(HeaderSize+packetLen)))
+	buf.Write(make([]byte, packetLen))
+	buf.Write(bytes.Repeat([]byte{fill}, CubeSize))
+	return buf.Bytes()
+}
+
+func readTestCubes(t *testing.T, chunks ...[]byte) [][]byte {
+	var cubes [][]byte
+	c := &Conn{log: testLogger{t}}
+	c.readFrames(&chunkReader{chunks: chunks}, func(frame *Frame) {
+		if frame.Header.FrameNumber != 7 {
+			t.Errorf("FrameNumber: want 7, got %d", frame.Header.FrameNumber)
+		}
+		cubes = append(cubes, frame.Cube)
+	})
+	return cubes
+}
+
+func TestReadCubesSplitHeader(t *testing.T) {
+	frame := testFrame(t, 100, 0xAB)
+	// Some garbage before the frame, and the header is split in the middle.
+	first := append([]byte{1, 2, 3}, frame[:HeaderSize/2]...)
+	cubes := readTestCubes(t, first, frame[HeaderSize/2:HeaderSize+50], frame[HeaderSize+50:])
+	if len(cubes) != 1 {
+		t.Fatalf("want 1 cube, got %d", len(cubes))
+	}
+	if !bytes.Equal(cubes[0], bytes.Repeat([]byte{0xAB}, CubeSize)) {
+		t.Errorf("the cube is misaligned")
+	}
+}
+
+func TestReadCubesSplitMagicWord(t *testing.T) {
+	frame := testFrame(t, 0, 0xCD)
+	garbage := bytes.Repeat([]byte{0xFF}, 2*PreviewSize)
+	first := append(garbage, frame[:3]...)
+	cubes := readTestCubes(t, first, frame[3:])
+	if len(cubes) != 1 || cubes[0][0] != 0xCD {
+		t.Fatalf("want 1 cube after the magic word split across reads, got %d", len(cubes))
+	}
+}
+
+func TestReadCubesInvalidPacketLen(t *testing.T) {
+	for _, totalPacketLen := range []uint32{0xFFFFFFF0, 4} {
+		data := append(testHeader(t, totalPacketLen), testFrame(t, 10, 0xEF)...)
+		cubes := readTestCubes(t, data)
+		if len(cubes) != 1 || cubes[0][0] != 0xEF {
+			t.Errorf("TotalPacketLen %d: want to resync to the next frame and read 1 cube, got %d", totalPacketLen, len(cubes))
+		}
+	}
+}
+
+// fakeCfgPort plays the radar cfg port: it echoes every command after the prompt and then
+// sends the reply, which is returned by the reply func. Empty reply means no confirmation.
+type fakeCfgPort struct {
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+	reply func(cmd string) string
+}
+
+func newFakeCfgPort(reply func(cmd string) string) *fakeCfgPort {
+	pr, pw := io.Pipe()
+	return &fakeCfgPort{pr: pr, pw: pw, reply: reply}
+}
+
+func (f *fakeCfgPort) Read(p []byte) (int, error) { return f.pr.Read(p) }
+
+func (f *fakeCfgPort) Write(p []byte) (int, error) {
+	cmd := strings.TrimSpace(string(p))
+	go func() {
+		out := "mmwDemo:/>" + cmd + "\n"
+		if reply := f.reply(cmd); reply != "" {
+			out += reply + "\n"
+		}
+		f.pw.Write([]byte(out))
+	}()
+	return len(p), nil
+}
+
+func (f *fakeCfgPort) Close() error { return f.pw.Close() }
+
+func newTestCfgConn(t *testing.T, reply func(cmd string) string) *Conn {
+	cfg := newFakeCfgPort(reply)
+	c := &Conn{log: testLogger{t}, cfg: cfg, closed: make(chan bool), confirmCh: make(chan error, 1), confirmTimeout: 5 * time.Second}
+	go c.readFromCfg()
+	return c
+}
+
+func TestSendAndConfirm(t *testing.T) {
+	c := newTestCfgConn(t, func(cmd string) string { return "Done" })
+	defer c.cfg.Close()
+	start := time.Now()
+	if err := c.sendAndConfirm("sensorStop"); err != nil {
+		t.Fatalf("sendAndConfirm(sensorStop): %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed >= c.confirmTimeout {
+		t.Errorf("sendAndConfirm waited for %v, which is the timeout, instead of the confirmation", elapsed)
+	}
+}
+
+func TestSendAndConfirmError(t *testing.T) {
+	c := newTestCfgConn(t, func(cmd string) string { return "Error -1" })
+	defer c.cfg.Close()
+	if err := c.sendAndConfirm("sensorStart"); err == nil {
+		t.Errorf("sendAndConfirm(sensorStart): want an error, because the radar has replied with Error -1")
+	}
+}
+
+func TestSendAndConfirmTimeout(t *testing.T) {
+	c := newTestCfgConn(t, func(cmd string) string { return "" })
+	defer c.cfg.Close()
+	c.confirmTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := c.sendAndConfirm("sensorStop"); err != nil {
+		t.Fatalf("sendAndConfirm(sensorStop): want no error on timeout, got %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < c.confirmTimeout {
+		t.Errorf("sendAndConfirm returned after %v, want at least %v", elapsed, c.confirmTimeout)
+	}
+}
+
+func TestMiniConfigureConfirmsEveryCommand(t *testing.T) {
+	var mu sync.Mutex
+	var cmds []string
+	c := newTestCfgConn(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, cmd)
+		if strings.HasPrefix(cmd, "channelCfg") {
+			return "Error -1"
+		}
+		if strings.HasPrefix(cmd, "%") {
+			// Comments are not confirmed.
+			return ""
+		}
+		return "Done"
+	})
+	defer c.cfg.Close()
+	if err := c.MiniConfigure(); err == nil || !strings.Contains(err.Error(), "channelCfg") {
+		t.Fatalf("MiniConfigure: want the channelCfg error, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if last := cmds[len(cmds)-1]; !strings.HasPrefix(last, "channelCfg") {
+		t.Errorf("want no commands sent after the failed one, got %q", cmds)
+	}
+}
+
+// fakeDataPort plays the radar data port.
+type fakeDataPort struct{ chunkReader }
+
+func (f *fakeDataPort) Write(p []byte) (int, error) { return len(p), nil }
+func (f *fakeDataPort) Close() error                { return nil }
+
+func TestStream(t *testing.T) {
+	c := newTestCfgConn(t, func(cmd string) string { return "Done" })
+	defer c.cfg.Close()
+	var chunks [][]byte
+	for i := 1; i <= 3; i++ {
+		frame := testFrame(t, 16, byte(i))
+		// Header.FrameNumber is right after Magic, Version, TotalPacketLen and Platform.
+		binary.LittleEndian.PutUint32(frame[20:], uint32(i))
+		chunks = append(chunks, frame)
+	}
+	c.data = &fakeDataPort{chunkReader{chunks: chunks}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream := c.Stream(ctx)
+	go c.readFromData(make(chan *Frame, 1))
+
+	var got []uint32
+	for frame := range stream {
+		got = append(got, frame.Header.FrameNumber)
+		if frame.Cube[0] != byte(frame.Header.FrameNumber) {
+			t.Errorf("frame %d has the cube of frame %d", frame.Header.FrameNumber, frame.Cube[0])
+		}
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("the stream has not been closed after the data port reader has exited")
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("want frames [1 2 3], got %v", got)
+	}
+}
+
+func TestSendToStreamDropsOldest(t *testing.T) {
+	c := &Conn{stream: make(chan Frame, 2)}
+	for i := 1; i <= 3; i++ {
+		if !c.sendToStream(&Frame{Header: Header{FrameNumber: uint32(i)}}) {
+			t.Fatalf("sendToStream: want true while streaming")
+		}
+	}
+	if first := <-c.stream; first.Header.FrameNumber != 2 {
+		t.Errorf("want the oldest frame 1 dropped and frame 2 first, got frame %d", first.Header.FrameNumber)
+	}
+}
+
+// gatedDataPort plays the radar data port, which sends nothing until the sensor is started.
+type gatedDataPort struct {
+	fakeDataPort
+	started chan bool
+}
+
+func (f *gatedDataPort) Read(p []byte) (int, error) {
+	<-f.started
+	return f.fakeDataPort.Read(p)
+}
+
+func TestTakeSnapshotWarmup(t *testing.T) {
+	started := make(chan bool)
+	var once sync.Once
+	var mu sync.Mutex
+	var lastCmd string
+	c := newTestCfgConn(t, func(cmd string) string {
+		mu.Lock()
+		lastCmd = cmd
+		mu.Unlock()
+		if cmd == "sensorStart" {
+			once.Do(func() { close(started) })
+		}
+		return "Done"
+	})
+	defer c.cfg.Close()
+	var chunks [][]byte
+	for i := 1; i <= 4; i++ {
+		frame := testFrame(t, 16, byte(i))
+		binary.LittleEndian.PutUint32(frame[20:], uint32(i))
+		chunks = append(chunks, frame)
+	}
+	c.data = &gatedDataPort{fakeDataPort: fakeDataPort{chunkReader{chunks: chunks}}, started: started}
+	c.SetWarmupFrames(2)
+	frameCh := make(chan *Frame, 1)
+	c.frameCh = frameCh
+	go c.readFromData(frameCh)
+
+	frame, err := c.TakeSnapshot()
+	// Frame 4 is still read. Wait for the reader to exit, so that it does not log after the test.
+	<-c.closed
+	if err != nil {
+		t.Fatalf("TakeSnapshot: %v", err)
+	}
+	if frame.Header.FrameNumber != 3 || frame.Cube[0] != 3 {
+		t.Errorf("want frame 3 after 2 warmup frames, got frame %d with the cube of frame %d", frame.Header.FrameNumber, frame.Cube[0])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if lastCmd != "sensorStop" {
+		t.Errorf("want the sensor stopped after the snapshot, got %q as the last command", lastCmd)
+	}
+}
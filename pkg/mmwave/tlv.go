@@ -0,0 +1,91 @@
+package mmwave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// TLV types emitted by the mmWave demo firmware.
+const (
+	TLVDetectedPoints         = 1
+	TLVDetectedPointsSideInfo = 7
+)
+
+const (
+	tlvHeaderSize = 8
+	// x, y, z, velocity: float32 each.
+	pointSize = 16
+	// snr, noise: int16 each, in 0.1 dB.
+	sideInfoSize = 4
+)
+
+// TLV is a type-length-value record of a radar packet. Data is the value only.
+type TLV struct {
+	Type uint32
+	Data []byte
+}
+
+// Point is a detected object. SNR and Noise are in dB and are only set, if HasSideInfo is true.
+type Point struct {
+	X, Y, Z     float32
+	Velocity    float32
+	SNR         float32
+	Noise       float32
+	HasSideInfo bool
+}
+
+// ParseTLVs splits the packet, which follows the frame header, into numTLVs records.
+func ParseTLVs(packet []byte, numTLVs int) ([]TLV, error) {
+	var res []TLV
+	for i := 0; i < numTLVs; i++ {
+		if len(packet) < tlvHeaderSize {
+			return nil, fmt.Errorf("TLV #%d: truncated header, only %d bytes left", i, len(packet))
+		}
+		typ := binary.LittleEndian.Uint32(packet)
+		length := binary.LittleEndian.Uint32(packet[4:])
+		packet = packet[tlvHeaderSize:]
+		if uint64(length) > uint64(len(packet)) {
+			return nil, fmt.Errorf("TLV #%d (type %d): length %d exceeds the remaining %d bytes", i, typ, length, len(packet))
+		}
+		res = append(res, TLV{Type: typ, Data: packet[:length]})
+		packet = packet[length:]
+	}
+	return res, nil
+}
+
+// ParsePoints decodes the detected points and enriches them with SNR and noise from the side-info TLV
+// by index. If the side-info TLV is missing or has a different number of entries, the points without
+// a matching entry have HasSideInfo == false and the extra entries are ignored.
+func ParsePoints(tlvs []TLV) ([]Point, error) {
+	var points []Point
+	var sideInfo []byte
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case TLVDetectedPoints:
+			if len(tlv.Data)%pointSize != 0 {
+				return nil, fmt.Errorf("detected points TLV has length %d, which is not a multiple of %d", len(tlv.Data), pointSize)
+			}
+			var raw [4]float32
+			r := bytes.NewReader(tlv.Data)
+			for r.Len() > 0 {
+				if err := binary.Read(r, binary.LittleEndian, &raw); err != nil {
+					return nil, fmt.Errorf("failed to parse a detected point: %v", err)
+				}
+				points = append(points, Point{X: raw[0], Y: raw[1], Z: raw[2], Velocity: raw[3]})
+			}
+		case TLVDetectedPointsSideInfo:
+			sideInfo = tlv.Data
+		}
+	}
+	for i := range points {
+		off := i * sideInfoSize
+		if off+sideInfoSize > len(sideInfo) {
+			break
+		}
+		points[i].SNR = float32(int16(binary.LittleEndian.Uint16(sideInfo[off:]))) / 10
+		points[i].Noise = float32(int16(binary.LittleEndian.Uint16(sideInfo[off+2:]))) / 10
+		points[i].HasSideInfo = true
+	}
+	return points, nil
+}
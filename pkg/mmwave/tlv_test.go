@@ -0,0 +1,86 @@
+package mmwave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func writeTestTLV(t *testing.T, buf *bytes.Buffer, typ uint32, data interface{}) {
+	var val bytes.Buffer
+	if err := binary.Write(&val, binary.LittleEndian, data); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+	binary.Write(buf, binary.LittleEndian, [2]uint32{typ, uint32(val.Len())})
+	buf.Write(val.Bytes())
+}
+
+func TestParsePointsWithSideInfo(t *testing.T) {
+	var packet bytes.Buffer
+	writeTestTLV(t, &packet, TLVDetectedPoints, [][4]float32{{1, 2, 0.5, -0.25}, {3, 4, 0, 1}})
+	writeTestTLV(t, &packet, TLVDetectedPointsSideInfo, [][2]int16{{215, -42}, {100, 7}})
+	tlvs, err := ParseTLVs(packet.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("ParseTLVs: %v", err)
+	}
+	points, err := ParsePoints(tlvs)
+	if err != nil {
+		t.Fatalf("ParsePoints: %v", err)
+	}
+	want := []Point{
+		{X: 1, Y: 2, Z: 0.5, Velocity: -0.25, SNR: 21.5, Noise: -4.2, HasSideInfo: true},
+		{X: 3, Y: 4, Z: 0, Velocity: 1, SNR: 10, Noise: 0.7, HasSideInfo: true},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("want %d points, got %d: %+v", len(want), len(points), points)
+	}
+	for i := range want {
+		if points[i] != want[i] {
+			t.Errorf("point #%d: want %+v, got %+v", i, want[i], points[i])
+		}
+	}
+}
+
+func TestParsePointsMismatchedSideInfo(t *testing.T) {
+	var packet bytes.Buffer
+	writeTestTLV(t, &packet, TLVDetectedPoints, [][4]float32{{1, 0, 0, 0}, {2, 0, 0, 0}, {3, 0, 0, 0}})
+	writeTestTLV(t, &packet, TLVDetectedPointsSideInfo, [][2]int16{{10, 20}})
+	tlvs, err := ParseTLVs(packet.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("ParseTLVs: %v", err)
+	}
+	points, err := ParsePoints(tlvs)
+	if err != nil {
+		t.Fatalf("ParsePoints: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("want 3 points, got %d", len(points))
+	}
+	if !points[0].HasSideInfo || points[0].SNR != 1 {
+		t.Errorf("point #0: want SNR 1 dB, got %+v", points[0])
+	}
+	if points[1].HasSideInfo || points[2].HasSideInfo {
+		t.Errorf("points without side info entries: want HasSideInfo == false, got %+v", points[1:])
+	}
+
+	// More side info entries than points.
+	packet.Reset()
+	writeTestTLV(t, &packet, TLVDetectedPoints, [][4]float32{{1, 0, 0, 0}})
+	writeTestTLV(t, &packet, TLVDetectedPointsSideInfo, [][2]int16{{10, 20}, {30, 40}})
+	tlvs, _ = ParseTLVs(packet.Bytes(), 2)
+	if points, err = ParsePoints(tlvs); err != nil || len(points) != 1 || !points[0].HasSideInfo {
+		t.Errorf("want 1 point with side info, got %+v, err: %v", points, err)
+	}
+}
+
+func TestParseTLVsTruncated(t *testing.T) {
+	var packet bytes.Buffer
+	writeTestTLV(t, &packet, TLVDetectedPoints, [][4]float32{{1, 0, 0, 0}})
+	data := packet.Bytes()
+	if _, err := ParseTLVs(data[:len(data)-1], 1); err == nil {
+		t.Errorf("ParseTLVs: want an error for a truncated TLV")
+	}
+	if _, err := ParseTLVs(data, 2); err == nil {
+		t.Errorf("ParseTLVs: want an error, when there are fewer TLVs than the header says")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"math"
 	"net"
+	"strings"
 )
 
 type PacketType uint8
@@ -20,8 +21,78 @@ const (
 	RTDE_DATA_PACKAGE                  = PacketType(85)
 
 	RTDE_PROTOCOL_VERSION = 2
+
+	// DefaultOutputs are the RTDE outputs subscribed to by default: the TCP speed and pose, the joint angles
+	// and the safety status.
+	DefaultOutputs = "actual_TCP_speed,actual_TCP_pose,actual_q,safety_status_bits"
+)
+
+// outputSizes are the supported RTDE outputs and the sizes of their values in bytes.
+// All of them are VECTOR6D, except safety_status_bits, which is UINT32.
+var outputSizes = map[string]int{
+	"actual_TCP_speed":   48,
+	"actual_TCP_pose":    48,
+	"actual_TCP_force":   48,
+	"actual_q":           48,
+	"actual_qd":          48,
+	"actual_current":     48,
+	"target_q":           48,
+	"target_qd":          48,
+	"target_TCP_pose":    48,
+	"target_TCP_speed":   48,
+	"safety_status_bits": 4,
+}
+
+// SafetyStatus is the value of safety_status_bits.
+type SafetyStatus uint32
+
+const (
+	SafetyNormalMode SafetyStatus = 1 << iota
+	SafetyReducedMode
+	SafetyProtectiveStopped
+	SafetyRecoveryMode
+	SafetySafeguardStopped
+	SafetySystemEmergencyStopped
+	SafetyRobotEmergencyStopped
+	SafetyEmergencyStopped
+	SafetyViolation
+	SafetyFault
+	SafetyStoppedDueToSafety
+
+	safetyStopMask = SafetyProtectiveStopped | SafetyRecoveryMode | SafetySafeguardStopped | SafetySystemEmergencyStopped |
+		SafetyRobotEmergencyStopped | SafetyEmergencyStopped | SafetyViolation | SafetyFault | SafetyStoppedDueToSafety
 )
 
+// Safe returns true, if the robot is in the normal or reduced mode and is not stopped by the safety system.
+func (st SafetyStatus) Safe() bool {
+	return st&(SafetyNormalMode|SafetyReducedMode) != 0 && st&safetyStopMask == 0
+}
+
+// String returns the most severe condition, like "protective stop".
+func (st SafetyStatus) String() string {
+	switch {
+	case st&SafetyFault != 0:
+		return "fault"
+	case st&SafetyViolation != 0:
+		return "safety violation"
+	case st&(SafetySystemEmergencyStopped|SafetyRobotEmergencyStopped|SafetyEmergencyStopped) != 0:
+		return "emergency stop"
+	case st&SafetyProtectiveStopped != 0:
+		return "protective stop"
+	case st&SafetySafeguardStopped != 0:
+		return "safeguard stop"
+	case st&SafetyStoppedDueToSafety != 0:
+		return "safety stop"
+	case st&SafetyRecoveryMode != 0:
+		return "recovery mode"
+	case st&SafetyReducedMode != 0:
+		return "reduced mode"
+	case st&SafetyNormalMode != 0:
+		return "normal mode"
+	}
+	return "unknown"
+}
+
 func readHeader(r io.Reader) (size int, typ PacketType, err error) {
 	var buf [3]byte
 	if _, err = io.ReadFull(r, buf[:]); err != nil {
@@ -98,6 +169,13 @@ func parseU64(data []byte) uint64 {
 		uint64(data[4])<<24 + uint64(data[5])<<16 + uint64(data[6])<<8 + uint64(data[7])
 }
 
+func parseU32(data []byte) uint32 {
+	if len(data) != 4 {
+		panic(fmt.Sprintf("parseU32: invalid input len. Want: 4, got: %d", len(data)))
+	}
+	return uint32(data[0])<<24 + uint32(data[1])<<16 + uint32(data[2])<<8 + uint32(data[3])
+}
+
 func parseF64(data []byte) float64 {
 	u64 := parseU64(data)
 	f64 := math.Float64frombits(u64)
@@ -118,7 +196,53 @@ func ParseVector6D(data []byte) []float64 {
 	}
 }
 
-func ConnectRTDE(host string, port int, output string) (net.Conn, error) {
+// ParseOutputs parses a comma-separated list of RTDE outputs, like actual_TCP_speed,actual_q.
+func ParseOutputs(str string) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := outputSizes[name]; !ok {
+			return nil, fmt.Errorf("unsupported RTDE output %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("RTDE output %q is listed twice", name)
+		}
+		seen[name] = true
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// ParseDataPackage parses the body of RTDE_DATA_PACKAGE: the recipe id followed by the values of the outputs
+// in the order they were subscribed to. A UINT32 value is returned as a single element slice.
+func ParseDataPackage(body []byte, outputs []string) (map[string][]float64, error) {
+	want := 1
+	for _, name := range outputs {
+		want += outputSizes[name]
+	}
+	if len(body) != want {
+		return nil, fmt.Errorf("data package has %d bytes, want %d for %d outputs", len(body), want, len(outputs))
+	}
+	res := make(map[string][]float64, len(outputs))
+	pos := 1
+	for _, name := range outputs {
+		size := outputSizes[name]
+		if size == 4 {
+			res[name] = []float64{float64(parseU32(body[pos : pos+4]))}
+		} else {
+			res[name] = ParseVector6D(body[pos : pos+size])
+		}
+		pos += size
+	}
+	return res, nil
+}
+
+// ConnectRTDE connects to the RTDE interface of a UR robot and subscribes to the outputs, see ParseOutputs.
+func ConnectRTDE(host string, port int, outputs []string) (net.Conn, error) {
 	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
 		return nil, fmt.Errorf("could not open connection to a UR robot at %s:%d. Error: %v", host, port, err)
@@ -130,7 +254,7 @@ func ConnectRTDE(host string, port int, output string) (net.Conn, error) {
 		_, _, err = sendAndReceive(conn, typ, bodyParts...)
 	}
 	sr(RTDE_REQUEST_PROTOCOL_VERSION, u16Bytes(RTDE_PROTOCOL_VERSION))
-	sr(RTDE_CONTROL_PACKAGE_SETUP_OUTPUTS, f64Bytes(6 /* frequency */), []byte("actual_TCP_speed,actual_TCP_pose"))
+	sr(RTDE_CONTROL_PACKAGE_SETUP_OUTPUTS, f64Bytes(6 /* frequency */), []byte(strings.Join(outputs, ",")))
 	sr(RTDE_CONTROL_PACKAGE_START)
 	if err != nil {
 		return nil, fmt.Errorf("failed to establish RTDE connection to a UR robot: %v", err)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CommandPolicy restricts the commands, which the server may push with ts.gcode. Entries are G/M-codes, like M112,
+// all codes of a letter, like G, or shell verbs, like bash. A command is rejected, if it's denied, or if there is
+// an allow-list, and the command is not in it. The policy is set by the operator with flags only, so that the server
+// can't lift it.
+type CommandPolicy struct {
+	// Nil allows any command, which is not denied.
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// parseCommandPolicy parses comma-separated allow and deny lists, like "G,M105,status" and "M112,bash".
+func parseCommandPolicy(allow, deny string) (*CommandPolicy, error) {
+	p := new(CommandPolicy)
+	var err error
+	if p.allow, err = parsePolicyList(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow-list: %v", err)
+	}
+	if p.deny, err = parsePolicyList(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny-list: %v", err)
+	}
+	return p, nil
+}
+
+func parsePolicyList(str string) (map[string]bool, error) {
+	var res map[string]bool
+	for _, tok := range strings.Split(str, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		if strings.ContainsAny(tok, " \t:;") {
+			return nil, fmt.Errorf("invalid entry %q, want a G/M-code, like M112, or a shell verb, like bash", tok)
+		}
+		if res == nil {
+			res = make(map[string]bool)
+		}
+		res[policyKey(tok)] = true
+	}
+	return res, nil
+}
+
+// policyKey returns the code of a g-code command in its canonical form, like M112 for "m0112 ; stop", or the verb
+// of a shell command. A device prefix, like "arm:", is skipped.
+func policyKey(cmd string) string {
+	if _, rest, ok := splitTarget(strings.TrimSpace(cmd)); ok {
+		cmd = rest
+	}
+	word, _ := splitFirstWord(cmd)
+	if len(word) > 1 {
+		letter := strings.ToUpper(word[:1])
+		if num, err := strconv.ParseUint(word[1:], 10, 64); err == nil && letter >= "A" && letter <= "Z" {
+			return fmt.Sprintf("%s%d", letter, num)
+		}
+	}
+	if len(word) == 1 {
+		return strings.ToUpper(word)
+	}
+	return word
+}
+
+// Check returns an error, if the command is not allowed.
+func (p *CommandPolicy) Check(cmd string) error {
+	if p == nil {
+		return nil
+	}
+	key := policyKey(cmd)
+	// A bare letter matches all codes of the letter, like G for G1 and G28.
+	var letter string
+	if len(key) > 1 && key[0] >= 'A' && key[0] <= 'Z' && key[1] >= '0' && key[1] <= '9' {
+		letter = key[:1]
+	}
+	if p.deny[key] || letter != "" && p.deny[letter] {
+		return fmt.Errorf("%s is denied by -command_deny", key)
+	}
+	if p.allow != nil && !p.allow[key] && (letter == "" || !p.allow[letter]) {
+		return fmt.Errorf("%s is not in -command_allow", key)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+func TestCommandPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		allow, deny string
+		cmd         string
+		want        bool
+	}{
+		{"", "", "M112", true},
+		{"", "M112,bash", "M112", false},
+		{"", "M112,bash", "m0112 ; stop", false},
+		{"", "M112,bash", "arm:M112", false},
+		{"", "M112,bash", "bash ls", false},
+		{"", "M112,bash", "M114", true},
+		{"", "M112,bash", "status", true},
+		{"G,M105,status", "", "G1 Z5 F100", true},
+		{"G,M105,status", "", "g28", true},
+		{"G,M105,status", "", "M105", true},
+		{"G,M105,status", "", "M106 S255", false},
+		{"G,M105,status", "", "status", true},
+		{"G,M105,status", "", "reboot", false},
+		{"M", "M112", "M112", false},
+	} {
+		p, err := parseCommandPolicy(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("parseCommandPolicy(%q, %q): %v", tc.allow, tc.deny, err)
+		}
+		if err := p.Check(tc.cmd); (err == nil) != tc.want {
+			t.Errorf("allow %q, deny %q: Check(%q): want allowed: %v, got %v", tc.allow, tc.deny, tc.cmd, tc.want, err)
+		}
+	}
+	for _, list := range []string{"M112 S1", "arm:M112", "G1;"} {
+		if _, err := parseCommandPolicy("", list); err == nil {
+			t.Errorf("parseCommandPolicy(%q): want an error", list)
+		}
+	}
+}
+
+func TestShellCommandPolicy(t *testing.T) {
+	sh, down, rec := newTestShell()
+	var err error
+	if sh.policy, err = parseCommandPolicy("", "M84"); err != nil {
+		t.Fatalf("parseCommandPolicy: %v", err)
+	}
+	sh.processGcodeUpdates(gcodeUpdate(t,
+		device_api.TSValue{TS: 10, Value: "G28"},
+		device_api.TSValue{TS: 20, Value: "M84"},
+		device_api.TSValue{TS: 30, Value: "G1 Z5 F100"}), 0)
+	// The rest of the commands don't run after a rejected one, like after a failed one.
+	if got := strings.Join(down.Written(), "; "); got != "G28" {
+		t.Errorf("Written: want G28, got %q", got)
+	}
+	msgs := rec.ByType("notify-command-rejected")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-command-rejected message, got %d", len(msgs))
+	}
+	var rej RejectedCommand
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &rej); err != nil {
+		t.Fatalf("failed to parse the rejection: %v", err)
+	}
+	if rej.Command != "M84" || !strings.Contains(rej.Reason, "-command_deny") {
+		t.Errorf("want M84 rejected by -command_deny, got %+v", rej)
+	}
+
+	// The local socket is not restricted.
+	if !sh.handleCommand("M84") {
+		t.Errorf("M84 failed on the local socket")
+	}
+	if got := strings.Join(down.Written(), "; "); got != "G28; M84" {
+		t.Errorf("Written: want G28; M84, got %q", got)
+	}
+}
+
+func TestExecuteGcodeCommandPolicy(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	var err error
+	if exe.policy, err = parseCommandPolicy("G,M106,M107", ""); err != nil {
+		t.Fatalf("parseCommandPolicy: %v", err)
+	}
+	// A job is rejected as a whole, before any command is sent.
+	job := writeTestJob(t, "G90\nM106\nM84\nG1 Z4 F100\n")
+	if err := exe.ExecuteGcode(context.Background(), "denied", job); err == nil || !strings.Contains(err.Error(), "M84 is not in -command_allow") {
+		t.Errorf("ExecuteGcode: want the job rejected because of M84, got %v", err)
+	}
+	if written := down.Written(); len(written) != 0 {
+		t.Errorf("want nothing written for a rejected job, got %q", written)
+	}
+	job = writeTestJob(t, "G90\nM106\nG1 Z4 F100\nM107\n")
+	if err := exe.ExecuteGcode(context.Background(), "allowed", job); err != nil {
+		t.Errorf("ExecuteGcode: %v", err)
+	}
+}
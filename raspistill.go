@@ -18,6 +18,11 @@ type RaspistillSnapshotter struct {
 	cmd *exec.Cmd
 }
 
+// MimeType returns JPEG, which is good enough for RGB frames and much smaller.
+func (rss *RaspistillSnapshotter) MimeType() string {
+	return "image/jpeg"
+}
+
 func (rss *RaspistillSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
 	if numFrames != 1 {
 		return fmt.Errorf("raspistill snapshot does not support taking multiple frames, but %d frames were requested", numFrames)
@@ -19,6 +19,9 @@ type RealSenseSnapshotter struct {
 	stdoutScan *bufio.Scanner
 }
 
+// Number of frames in a RealSense train pack, unless specified in the realsense-train-pack command.
+const defaultTrainPackFrames = 5
+
 type RealSenseTrainPackParams struct {
 	PackID    string  `json:"packID"`
 	GraspID   string  `json:"graspID"`
@@ -68,10 +71,14 @@ func (rss *RealSenseSnapshotter) TakeSnapshot(ctx context.Context, prefix string
 		rss.stdoutScan = bufio.NewScanner(stdout)
 	}
 	for i := 0; i < numFrames; i++ {
+		// A frame in progress is always completed, so that the next request is not answered
+		// with the reply to this one. The cancellation is checked between frames.
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled after %d of %d frames: %v", i, numFrames, err)
+		}
 		if _, err := fmt.Fprintf(rss.stdin, "%s%02d-\n", prefix, i); err != nil {
 			return fmt.Errorf("failed to write to realsense-snapshot stdin: %v", err)
 		}
-		// TODO(krasin): obey context cancellation here.
 		if !rss.stdoutScan.Scan() {
 			err := rss.stdoutScan.Err()
 			if err != nil {
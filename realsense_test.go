@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newFakeRealSense returns a RealSense snapshotter connected to a fake realsense-snapshot,
+// which saves an empty frame for every request and then calls onFrame with the number of saved frames.
+func newFakeRealSense(t *testing.T, up *Uplink, onFrame func(n int)) *RealSenseSnapshotter {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	go func() {
+		defer stdoutW.Close()
+		s := bufio.NewScanner(stdinR)
+		for n := 1; s.Scan(); n++ {
+			fname := strings.TrimSpace(s.Text()) + "camera0.png"
+			if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+				t.Errorf("fake realsense-snapshot: %v", err)
+			}
+			onFrame(n)
+			io.WriteString(stdoutW, "OK\n")
+		}
+	}()
+	return &RealSenseSnapshotter{up: up, cmd: &exec.Cmd{}, stdin: stdinW, stdoutScan: bufio.NewScanner(stdoutR)}
+}
+
+func TestRealSenseTrainPackCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-realsense")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var frames int
+	up, _ := newTestUplink()
+	rss := newFakeRealSense(t, up, func(n int) {
+		frames = n
+		if n == 2 {
+			// Canceled while the second frame is being taken.
+			cancel()
+		}
+	})
+	defer rss.stdin.Close()
+	exe := NewExecutor(up, true /*virtual*/, rss)
+	exe.baseDir = dir
+
+	packID, graspID := "00000000000000a1", "00000000000000b2"
+	err = exe.RealSenseTrainPack(ctx, packID, graspID, 1, 2, 3, 0, 0, 0, defaultTrainPackFrames)
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("RealSenseTrainPack: want a cancellation error, got %v", err)
+	}
+	if frames != 2 {
+		t.Errorf("want the pack to stop after frame 2 of 5, got %d frames", frames)
+	}
+	packDir := path.Join(dir, "realsense", graspID, packID)
+	if _, err := os.Stat(packDir); !os.IsNotExist(err) {
+		t.Errorf("the incomplete pack dir %s is left behind (err: %v)", packDir, err)
+	}
+}
+
+func TestRealSenseTrainPackNumFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-realsense")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var frames int
+	up, _ := newTestUplink()
+	rss := newFakeRealSense(t, up, func(n int) { frames = n })
+	defer rss.stdin.Close()
+	exe := NewExecutor(up, true /*virtual*/, rss)
+	exe.baseDir = dir
+
+	p, err := parseTrainPackArgs(strings.Split("realsense-train-pack 00000000000000b2 00000000000000a1 1 2 3 0.1 0.2 0.3 3", " "))
+	if err != nil {
+		t.Fatalf("parseTrainPackArgs: %v", err)
+	}
+	if err := exe.RealSenseTrainPack(context.Background(), p.PackID, p.GraspID, p.X, p.Y, p.Z, p.Roll, p.Pitch, p.Yaw, p.NumFrames); err != nil {
+		t.Fatalf("RealSenseTrainPack: %v", err)
+	}
+	if frames != 3 {
+		t.Errorf("want 3 frames taken, got %d", frames)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "realsense", p.GraspID, p.PackID, "parameters.json"))
+	if err != nil {
+		t.Fatalf("parameters.json is not saved: %v", err)
+	}
+	var saved RealSenseTrainPackParams
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", data, err)
+	}
+	if saved.NumFrames != 3 || saved.Yaw != 0.3 {
+		t.Errorf("want 3 frames and yaw 0.3 in parameters.json, got %+v", saved)
+	}
+}
+
+func TestParseTrainPackArgsDefaultFrames(t *testing.T) {
+	p, err := parseTrainPackArgs(strings.Split("realsense-train-pack g p 1 2 3 0 0 0", " "))
+	if err != nil {
+		t.Fatalf("parseTrainPackArgs: %v", err)
+	}
+	if p.NumFrames != defaultTrainPackFrames {
+		t.Errorf("NumFrames: want %d by default, got %d", defaultTrainPackFrames, p.NumFrames)
+	}
+	if _, err := parseTrainPackArgs(strings.Split("realsense-train-pack g p 1 2 3 0 0 0 many", " ")); err == nil {
+		t.Errorf("parseTrainPackArgs: want an error for an invalid number of frames")
+	}
+	if _, err := parseTrainPackArgs(strings.Split("realsense-train-pack g p 1 2 3", " ")); err == nil {
+		t.Errorf("parseTrainPackArgs: want an error for missing roll, pitch and yaw")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+)
+
+// The disk check of selftest fails, if there is less free space than that in the jobs dir.
+const minFreeJobsDiskSpace = 100 << 20
+
+type SelfTestResult struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Details string `json:"details,omitempty"`
+}
+
+type selfTestProbe struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runSelfTest runs all probes one by one and returns their results.
+// ok is true only if all the probes have passed.
+func runSelfTest(ctx context.Context, probes []selfTestProbe) (results []SelfTestResult, ok bool) {
+	ok = true
+	for _, p := range probes {
+		res := SelfTestResult{Name: p.name, OK: true}
+		if err := p.run(ctx); err != nil {
+			res.OK = false
+			res.Details = err.Error()
+			ok = false
+		}
+		results = append(results, res)
+	}
+	return
+}
+
+func (sh *Shell) selfTestProbes() []selfTestProbe {
+	probes := []selfTestProbe{
+		{"uplink", func(ctx context.Context) error {
+			if sh.up.getClient() == nil {
+				return errors.New("not connected to the API server")
+			}
+			return nil
+		}},
+		{"downlink", func(ctx context.Context) error {
+			if !sh.exe.down.Connected() {
+				return errors.New("device not connected")
+			}
+			// Only a gcode device is known to answer M115. Other downlinks, like UR3, would take it
+			// for a command of their own, so being connected is enough for them.
+			down := sh.exe.down
+			if md, ok := down.(*MultiDownlink); ok {
+				down = md.downs[md.def]
+			}
+			if _, ok := down.(*DFADownlink); !ok {
+				return nil
+			}
+			return sh.exe.down.WriteAndWaitForOK(ctx, "M115")
+		}},
+		{"disk", func(ctx context.Context) error {
+			return checkFreeSpace(sh.exe.baseDir, minFreeJobsDiskSpace)
+		}},
+	}
+	snaps := map[string]Snapshotter{"camera": sh.exe.rss}
+	if cs, ok := sh.exe.rss.(*CombinedSnapshotter); ok {
+		snaps = cs.Snaps
+	}
+	var names []string
+	for name := range snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snap := snaps[name]
+		if snap == nil {
+			// No cameras configured; that's fine.
+			continue
+		}
+		probes = append(probes, selfTestProbe{"camera " + name, func(ctx context.Context) error {
+			return sh.exe.probeSnapshotter(ctx, snap)
+		}})
+	}
+	return probes
+}
+
+// probeSnapshotter takes a test snapshot with snap. Like any other snapshot, it waits for the one in progress.
+func (exe *Executor) probeSnapshotter(ctx context.Context, snap Snapshotter) error {
+	release, err := exe.acquireSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dirName, err := ioutil.TempDir("", "robosla-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create a temp directory: %v", err)
+	}
+	defer os.RemoveAll(dirName)
+	return snap.TakeSnapshot(ctx, path.Join(dirName, "selftest-"), 1 /*numFrames*/)
+}
+
+// checkFreeSpace checks the free space on the file system of dir. The jobs dir is only created by the first job,
+// so if dir does not exist yet, its nearest existing parent is checked.
+func checkFreeSpace(dir string, minFree uint64) error {
+	existing := dir
+	for {
+		if _, err := os.Stat(existing); !os.IsNotExist(err) {
+			break
+		}
+		parent := path.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(existing, &st); err != nil {
+		return fmt.Errorf("failed to check free space in %s: %v", dir, err)
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	if free < minFree {
+		return fmt.Errorf("only %d MB free in %s, want at least %d MB", free>>20, dir, minFree>>20)
+	}
+	return nil
+}
+
+// SelfTest checks the device, the cameras, the disk and the uplink, and reports the summary.
+func (sh *Shell) SelfTest(ctx context.Context) error {
+	results, ok := runSelfTest(ctx, sh.selfTestProbes())
+	for _, res := range results {
+		if res.OK {
+			sh.up.logf("selftest %s: PASS", res.Name)
+		} else {
+			sh.up.logf("selftest %s: FAIL (%s)", res.Name, res.Details)
+		}
+	}
+	sh.up.NotifySelfTest(ok, results)
+	if !ok {
+		return errors.New("some self-test checks have failed")
+	}
+	return nil
+}
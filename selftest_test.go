@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	pass := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("camera is unplugged") }
+
+	results, ok := runSelfTest(context.Background(), []selfTestProbe{
+		{"uplink", pass},
+		{"camera rgb", fail},
+		{"disk", pass},
+	})
+	if ok {
+		t.Errorf("runSelfTest: want failure, because one of the probes has failed")
+	}
+	want := []SelfTestResult{
+		{Name: "uplink", OK: true},
+		{Name: "camera rgb", OK: false, Details: "camera is unplugged"},
+		{Name: "disk", OK: true},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("want %d results, got %d: %+v", len(want), len(results), results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result #%d: want %+v, got %+v", i, want[i], results[i])
+		}
+	}
+
+	if _, ok := runSelfTest(context.Background(), []selfTestProbe{{"uplink", pass}, {"disk", pass}}); !ok {
+		t.Errorf("runSelfTest: want success, when all probes pass")
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-test-disk")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The jobs dir is not created yet, so its parent is checked.
+	jobsDir := path.Join(dir, "jobs", "new")
+	if err := checkFreeSpace(jobsDir, 1); err != nil {
+		t.Errorf("checkFreeSpace(%s): %v", jobsDir, err)
+	}
+	if err := checkFreeSpace(jobsDir, 1<<62); err == nil || !strings.Contains(err.Error(), "MB free in "+jobsDir) {
+		t.Errorf("checkFreeSpace(%s): want not enough free space, got %v", jobsDir, err)
+	}
+}
+
+func TestSelfTestDownlinkProbe(t *testing.T) {
+	sh, down, _ := newTestShell()
+	for _, p := range sh.selfTestProbes() {
+		if p.name != "downlink" {
+			continue
+		}
+		if err := p.run(context.Background()); err != nil {
+			t.Errorf("downlink probe: %v", err)
+		}
+	}
+	// M115 is only sent to a gcode device.
+	if got := down.Written(); len(got) != 0 {
+		t.Errorf("downlink probe: want nothing written to a non-gcode downlink, got %q", got)
+	}
+}
+
+func TestProbeSnapshotterWaitsForSnapshot(t *testing.T) {
+	up, _ := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	snap := &imageSnapshotter{data: []byte("jpeg")}
+	release, err := exe.acquireSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("acquireSnapshot: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := exe.probeSnapshotter(ctx, snap); err == nil {
+		t.Errorf("probeSnapshotter: want an error, while another snapshot is being taken")
+	}
+	release()
+	if err := exe.probeSnapshotter(context.Background(), snap); err != nil {
+		t.Errorf("probeSnapshotter: %v", err)
+	}
+}
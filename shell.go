@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,17 +19,81 @@ import (
 )
 
 type Shell struct {
-	up           *Uplink
-	exe          *Executor
+	up      *Uplink
+	exe     *Executor
+	outputs Outputs
+	updater *Updater // Optional
+	// If gripForce is positive, the gripper is driven like a spindle: grip sends M3 S<gripForce>
+	// and drop sends M5. Otherwise, the gripper and vent outputs are toggled.
+	gripForce int
+	// armAccel and armVel are the acceleration and the velocity of the arm-move and arm-jog moves,
+	// unless overridden with a= and v=. See -ur3_accel and -ur3_vel.
+	armAccel, armVel float64
+	// armHome are the joint angles of the home of the arm in radians. See arm-home.
+	armHome []float64
+	// restart restarts the agent to apply the new connection settings. See ApplyConfig.
+	restart func() error
+	// tsPath is the file with the timestamp of the last command taken from ts.gcode. Optional.
+	// It survives reconnects and restarts, so that the commands replayed by the server are not run twice.
+	tsPath string
+	// bashAllow is the set of programs, which the bash and shutdown commands may run. Nil allows any program.
+	bashAllow map[string]bool
+	// policy restricts the commands taken from ts.gcode. Nil allows any command. The local socket is not restricted.
+	policy *CommandPolicy
+	// execCommand runs a program and returns its combined output. It's replaced in tests.
+	execCommand func(ctx context.Context, name string, args ...string) ([]byte, error)
+	// wd is the liveness watchdog, if it's enabled. Run beats it as "shell".
+	wd           *LivenessWatchdog
 	mu           sync.Mutex
 	curJobCancel context.CancelFunc
+	// curJobDone is closed, when the goroutine of the last started job is over.
+	curJobDone chan bool
+
+	// Serializes the commands from the cloud and the local socket.
+	cmdMu sync.Mutex
 }
 
 func NewShell(up *Uplink, down Downlink, exe *Executor) *Shell {
+	outputs, err := ParseOutputs(defaultOutputs)
+	if err != nil {
+		panic(err)
+	}
 	return &Shell{
-		up:  up,
-		exe: exe,
+		up:          up,
+		exe:         exe,
+		outputs:     outputs,
+		armAccel:    defaultArmAccel,
+		armVel:      defaultArmVel,
+		restart:     restartAgent,
+		execCommand: runCommand,
+	}
+}
+
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// parseBashAllow parses a comma-separated list of programs, like ls,df,shutdown. An empty list allows any program.
+func parseBashAllow(str string) map[string]bool {
+	var res map[string]bool
+	for _, name := range strings.Split(str, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]bool)
+		}
+		res[name] = true
+	}
+	return res
+}
+
+// checkAllowed returns an error, if the program is not in -bash_allow.
+func (sh *Shell) checkAllowed(name string) error {
+	if sh.bashAllow != nil && !sh.bashAllow[name] {
+		return fmt.Errorf("%s is not in -bash_allow", name)
 	}
+	return nil
 }
 
 func (sh *Shell) Run() error {
@@ -34,11 +101,21 @@ func (sh *Shell) Run() error {
 	if err != nil {
 		return fmt.Errorf("Failed to subscribe to ts.gcode: %v", err)
 	}
-	var lastTS int64
-	for reqJson := range sub.C() {
-		lastTS = sh.processGcodeUpdates(reqJson, lastTS)
+	lastTS := sh.loadLastTS()
+	// The loop wakes up periodically to beat the liveness watchdog, even if there are no commands.
+	tick := time.NewTicker(livenessProbeInterval)
+	defer tick.Stop()
+	for {
+		sh.wd.Beat("shell")
+		select {
+		case reqJson, ok := <-sub.C():
+			if !ok {
+				return nil
+			}
+			lastTS = sh.processGcodeUpdates(reqJson, lastTS)
+		case <-tick.C:
+		}
 	}
-	return nil
 }
 
 func (sh *Shell) processGcodeUpdates(reqJson string, lastTS int64) int64 {
@@ -55,172 +132,549 @@ func (sh *Shell) processGcodeUpdates(reqJson string, lastTS int64) int64 {
 		cmds = append(cmds, v.Value)
 		lastTS = v.TS
 	}
+	if len(cmds) > 0 {
+		// Saved before the commands run: if the agent dies in the middle, it's safer to skip a command than to repeat a move.
+		sh.saveLastTS(lastTS)
+	}
 	for _, cmd := range cmds {
-		cmd = strings.TrimSpace(cmd)
-		parts := strings.Split(cmd, " ")
-		for i := range parts {
-			parts[i] = strings.TrimSpace(parts[i])
+		if err := sh.policy.Check(cmd); err != nil {
+			sh.rejectCommand(cmd, err)
+			// Don't run the rest of the commands after a failure.
+			return lastTS
 		}
-		verb := parts[0]
-		var arg1, arg2 string
-		if len(parts) > 1 {
-			arg1 = parts[1]
+		if !sh.handleCommand(cmd) {
+			// Don't run the rest of the commands after a failure.
+			return lastTS
 		}
-		if len(parts) > 2 {
-			arg2 = parts[2]
+	}
+	return lastTS
+}
+
+// rejectCommand reports a command, which is not allowed by the policy. A rejected job is also reported as failed,
+// so that the server does not wait for it.
+func (sh *Shell) rejectCommand(cmd string, err error) {
+	sh.up.logf("Rejected %q: %v", cmd, err)
+	sh.up.NotifyCommandRejected(cmd, err.Error())
+	if verb, rest := splitFirstWord(cmd); verb == "fetch-and-print" {
+		jobName, _ := splitFirstWord(rest)
+		sh.up.NotifyJobDone(jobName, false, fmt.Sprintf("rejected: %v", err))
+	}
+}
+
+func getGcodeTSPath() string {
+	return path.Join(getConfigDir(), "gcode-ts")
+}
+
+// loadLastTS returns the timestamp of the last command taken from ts.gcode before a reconnect or a restart.
+func (sh *Shell) loadLastTS() int64 {
+	if sh.tsPath == "" {
+		return 0
+	}
+	data, err := ioutil.ReadFile(sh.tsPath)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		sh.up.logf("Failed to read the last gcode timestamp: %v", err)
+		return 0
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		sh.up.logf("Invalid last gcode timestamp in %s: %v", sh.tsPath, err)
+		return 0
+	}
+	return ts
+}
+
+func (sh *Shell) saveLastTS(ts int64) {
+	if sh.tsPath == "" {
+		return
+	}
+	if err := writeFileAtomic(sh.tsPath, []byte(strconv.FormatInt(ts, 10)+"\n"), 0644, nil); err != nil {
+		sh.up.logf("Failed to save the last gcode timestamp: %v. The commands could run twice after a restart", err)
+	}
+}
+
+// handleCommand runs a shell verb or sends a g-code command to the device.
+// It returns false, if the command has failed and the following commands should not run.
+func (sh *Shell) handleCommand(cmd string) bool {
+	sh.cmdMu.Lock()
+	defer sh.cmdMu.Unlock()
+	cmd = strings.TrimSpace(cmd)
+	parts := strings.Split(cmd, " ")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	verb := parts[0]
+	var arg1, arg2 string
+	if len(parts) > 1 {
+		arg1 = parts[1]
+	}
+	if len(parts) > 2 {
+		arg2 = parts[2]
+	}
+	switch verb {
+	case "bash":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.Bash(ctx, parts[1:])
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to run %q: %v", parts[1:], err)
 		}
-		switch verb {
-		case "bash":
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			err := sh.Bash(ctx, parts[1:])
-			cancel()
-			if err != nil {
-				sh.up.logf("Failed to run %q: %v", parts[1:], err)
-			}
-			continue
-		case "cancel":
-			sh.cancelJob()
-			continue
-		case "drop":
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			sh.up.NotifyGripperState("opening")
-			err := sh.exe.ExecuteFewCommands(ctx, "M106", "M107 P1", "G4 P400")
-			if err != nil {
-				cancel()
-				sh.up.logf("Failed to drop: %v", err)
-				continue
-			}
-			sh.up.NotifyGripperState("venting")
-			err = sh.exe.ExecuteFewCommands(ctx, "G4 P600", "M106 P1")
-			cancel()
-			if err != nil {
-				sh.up.logf("Failed to complete drop: %v", err)
-				continue
-			}
-			sh.up.NotifyGripperState("open")
-			continue
-		case "grip":
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			err := sh.exe.ExecuteFewCommands(ctx, "M107")
-			cancel()
-			if err != nil {
-				sh.up.logf("Failed to grip: %v", err)
-			}
-			sh.up.NotifyGripperState("closed")
-			continue
-		case "cut":
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			err := sh.exe.ExecuteFewCommands(ctx, "M107", "G4 P400", "M106", "M107 P1", "G4 P400", "M106 P1")
-			cancel()
-			if err != nil {
-				sh.up.logf("Failed to grip: %v", err)
-			}
-			continue
-		case "fetch-and-print":
-			// print <jobName> <archiveURL>
-			ctx, err := sh.getNewJobContext()
-			if err != nil {
-				sh.up.NotifyJobDone(arg1, false, err.Error())
-				return lastTS
-			}
-			go func(ctx context.Context, jobName, jobURL string) {
-				var err error
-				defer func() {
-					var comment string
-					if err == nil {
-						comment = "OK"
-					} else {
-						comment = err.Error()
-					}
-					sh.clearCurrentJob()
-					sh.up.NotifyJobDone(jobName, err == nil, comment)
-				}()
-				localGcodePath, err := sh.exe.FetchJob(ctx, jobURL)
-				if err != nil {
-					sh.up.logf("Failed to fetch %q: %v", jobURL, err)
-					return
-				}
-				err = sh.exe.ExecuteGcode(ctx, jobName, localGcodePath)
-				if err != nil {
-					sh.up.logf("Failed to execute %q: %v", jobURL, err)
-					return
-				}
-			}(ctx, arg1, arg2)
-			continue
-		case "realsense-train-pack":
-			graspID := arg1
-			packID := arg2
+		return true
+	case "cancel":
+		sh.cancelJob()
+		return true
+	case "drop":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.Drop(ctx)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to drop: %v", err)
+		}
+		return true
+	case "grip":
+		// grip [force]. The force is only supported by spindle-style grippers. See gripForce.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.Grip(ctx, arg1)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to grip: %v", err)
+		}
+		return true
+	case "cut":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.Cut(ctx)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to cut: %v", err)
+		}
+		return true
+	case "probe":
+		// probe Z-10 F100
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.Probe(ctx, parts[1:])
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to probe: %v", err)
+			return false
+		}
+		return true
+	case "arm-move", "arm-jog":
+		// arm-move <x> <y> <z> <rx> <ry> <rz> [a=<accel>] [v=<vel>]. Move the arm to the pose.
+		// arm-jog <dx> <dy> <dz> [a=<accel>] [v=<vel>]. Move the tool by the offset in meters.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.MoveArm(ctx, verb == "arm-jog", parts[1:])
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to %s: %v", verb, err)
+			return false
+		}
+		return true
+	case "arm-home":
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.HomeArm(ctx)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to home the arm: %v", err)
+			return false
+		}
+		return true
+	case "fetch-and-print":
+		// print <jobName> <archiveURL>
+		ctx, done, err := sh.getNewJobContext()
+		if err != nil {
+			sh.up.NotifyJobDone(arg1, false, err.Error())
+			return false
+		}
+		// Downloading is a part of the job, so it's registered before the goroutine starts.
+		endActivity := sh.exe.activities.Begin("job " + arg1)
+		go func(ctx context.Context, jobName, jobURL string) {
 			var err error
-			f64 := func(name string, idx int) float64 {
-				if err != nil {
-					return math.NaN()
-				}
-				if idx >= len(parts) {
-					err = fmt.Errorf("realsense-train-pack: not enough parameters (%d). Want at least %d to parse %s",
-						len(parts), idx+1, name)
-					return math.NaN()
-				}
-				var res float64
-				res, err = strconv.ParseFloat(parts[idx], 64)
-				if err != nil {
-					return math.NaN()
+			defer close(done)
+			defer endActivity()
+			defer func() {
+				var comment string
+				switch {
+				case err == nil:
+					comment = "OK"
+					if n := sh.exe.SkippedLines(); n > 0 {
+						comment = fmt.Sprintf("OK, %d unsupported lines skipped", n)
+					}
+				case ctx.Err() == context.Canceled:
+					// Canceled with the cancel command. Whatever error it has caused, the job has not failed.
+					comment = jobCanceledComment
+				default:
+					comment = err.Error()
 				}
-				return res
-			}
-			x := f64("x", 3)
-			y := f64("y", 4)
-			z := f64("z", 5)
-			roll := f64("roll", 6)
-			pitch := f64("pitch", 7)
-			yaw := f64("yaw", 8)
+				sh.clearCurrentJob()
+				sh.up.NotifyJobDone(jobName, err == nil, comment)
+			}()
+			localGcodePath, err := sh.exe.FetchJob(ctx, jobURL)
 			if err != nil {
-				sh.up.logf("Failed to read RealSense Train Pack params: %v", err)
-				return lastTS
+				sh.up.logf("Failed to fetch %q: %v", jobURL, err)
+				return
 			}
-			start := time.Now()
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			err = sh.exe.RealSenseTrainPack(ctx, packID, graspID, x, y, z, roll, pitch, yaw)
-			cancel()
+			err = sh.exe.ExecuteGcode(ctx, jobName, localGcodePath)
 			if err != nil {
-				sh.up.logf("Failed to make a RealSense train pack: %v", err)
-				return lastTS
+				sh.up.logf("Failed to execute %q: %v", jobURL, err)
+				return
 			}
-			dur := time.Now().Sub(start)
-			sh.up.logf("RealSense train pack (packID=%s, graspID=%s) is successfully created. Took %.2f seconds.", packID, graspID, dur.Seconds())
-			continue
-		case "reboot", "restart":
-			err := sh.Reboot()
-			if err != nil {
-				sh.up.logf("Failed to reboot: %v", err)
-				return lastTS
+		}(ctx, arg1, arg2)
+		return true
+	case "realsense-train-pack":
+		p, err := parseTrainPackArgs(parts)
+		if err != nil {
+			sh.up.logf("Failed to read RealSense Train Pack params: %v", err)
+			return false
+		}
+		packID, graspID := p.PackID, p.GraspID
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = sh.exe.RealSenseTrainPack(ctx, packID, graspID, p.X, p.Y, p.Z, p.Roll, p.Pitch, p.Yaw, p.NumFrames)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to make a RealSense train pack: %v", err)
+			return false
+		}
+		dur := time.Now().Sub(start)
+		sh.up.logf("RealSense train pack (packID=%s, graspID=%s) is successfully created. Took %.2f seconds.", packID, graspID, dur.Seconds())
+		return true
+	case "update-channel":
+		if err := sh.UpdateChannel(arg1); err != nil {
+			sh.up.logf("Failed to switch the update channel: %v", err)
+		}
+		return true
+	case "check-update":
+		if err := sh.CheckUpdate(); err != nil {
+			sh.up.logf("Failed to check for updates: %v", err)
+		}
+		return true
+	case "flush":
+		// flush. Discard the stale input from the device. It's also done at the start of every job.
+		fl, ok := sh.exe.down.(inputFlusher)
+		if !ok {
+			sh.up.logf("Flushing the input is not supported by this device type")
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := fl.Flush(ctx)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to flush the input: %v", err)
+			return false
+		}
+		return true
+	case "dump-job":
+		// dump-job. Stream the parsed commands of the last loaded job with notify-job-dump. See Executor.DumpJob.
+		jobName, cmds := sh.exe.LoadedJob()
+		if cmds == nil {
+			sh.up.logf("Failed to dump the job: no job is loaded")
+			return false
+		}
+		go sh.exe.DumpJob(jobName, cmds)
+		return true
+	case "diag":
+		if sr, ok := sh.exe.down.(statsReporter); ok {
+			sh.up.logf("Serial link stats: %v", sr.Stats())
+		} else {
+			sh.up.logf("Link diagnostics are not supported by this device type")
+		}
+		if fr, ok := sh.exe.down.(firmwareCapsReporter); ok {
+			if caps := fr.FirmwareCaps(); caps.Known() {
+				sh.up.logf("Firmware: %s", caps.Name)
 			}
-			continue
-		case "snapshot":
-			// Take snapshot of all cameras attached.
-			// Note: currently, that only includes RealSense cameras (RGB + Depth).
-			start := time.Now()
+		}
+		return true
+	case "collect-diag":
+		// collect-diag. Send a zip archive with the logs, the config, the last job and more. See CollectDiag.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.CollectDiag(ctx)
+		cancel()
+		if err != nil {
+			sh.up.logf("Failed to collect the diagnostics: %v", err)
+			return false
+		}
+		return true
+	case "disconnect":
+		if err := sh.exe.down.Disconnect(); err != nil {
+			sh.up.logf("Failed to disconnect: %v", err)
+		}
+		return true
+	case "reconnect":
+		if err := sh.exe.down.Reconnect(); err != nil {
+			sh.up.logf("Failed to reconnect: %v", err)
+		}
+		return true
+	case "reboot", "restart":
+		err := sh.Reboot()
+		if err != nil {
+			sh.up.logf("Failed to reboot: %v", err)
+			return false
+		}
+		return true
+	case "shutdown":
+		err := sh.Shutdown()
+		if err != nil {
+			sh.up.logf("Failed to shut down: %v", err)
+			return false
+		}
+		return true
+	case "selftest":
+		// selftest. The camera probes may take a while, so it runs in the background, and the summary
+		// is sent with notify-selftest.
+		go func() {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			err := sh.exe.Snapshot(ctx)
-			cancel()
-			if err != nil {
-				sh.up.logf("Failed to make a snapshot of all cameras: %v", err)
-				return lastTS
+			defer cancel()
+			if err := sh.SelfTest(ctx); err != nil {
+				sh.up.logf("Self-test failed: %v", err)
 			}
-			dur := time.Now().Sub(start)
-			sh.up.logf("Took a snapshot from all (RealSense) cameras in %.2f seconds.", dur.Seconds())
-			continue
-		case "version":
-			sh.up.PrintVersion()
+		}()
+		return true
+	case "snapshot":
+		// snapshot [camera...]. Take snapshot of the named cameras or all cameras attached.
+		// Note: currently, that only includes RealSense cameras (RGB + Depth).
+		var cameras []string
+		for _, name := range parts[1:] {
+			if name != "" {
+				cameras = append(cameras, name)
+			}
+		}
+		what := "all cameras"
+		if len(cameras) > 0 {
+			what = strings.Join(cameras, ", ")
+		}
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := sh.exe.Snapshot(ctx, cameras...)
+		cancel()
+		if err == ErrSnapshotSkipped {
+			sh.up.logf("Skipped a snapshot of %s: %v", what, err)
+			return false
+		}
+		if err != nil {
+			sh.up.logf("Failed to make a snapshot of %s: %v", what, err)
+			return false
+		}
+		dur := time.Now().Sub(start)
+		sh.up.logf("Took a snapshot from %s in %.2f seconds.", what, dur.Seconds())
+		return true
+	case "config":
+		// config <json>. See AgentConfig.
+		if err := sh.ApplyConfig(strings.TrimPrefix(cmd, "config")); err != nil {
+			sh.up.logf("Failed to apply the config: %v", err)
+			return false
+		}
+		return true
+	case "snapshot-max-dim":
+		// snapshot-max-dim [pixels]. Without an argument, the current value is reported. Zero disables downscaling.
+		if err := sh.SnapshotMaxDim(arg1); err != nil {
+			sh.up.logf("Failed to set the snapshot size: %v", err)
+			return false
+		}
+		return true
+	case "status":
+		sh.up.logf("Status: %s", sh.up.bestJson(NewStatusServer(sh.up, sh.exe.down, Version).Status()))
+		return true
+	case "version":
+		sh.up.PrintVersion()
+		return true
+	}
+
+	if err := sh.SendCommand(context.TODO(), cmd); err != nil {
+		sh.up.logf("Error while sending gcode: %v", err)
+		return false
+	}
+	return true
+}
+
+// SendCommand sends just a single g-code command to the device. This is not cancelable yet.
+// Any firmware command can be sent, like M112, but nothing can be injected into the line. See sanitizeCommand.
+func (sh *Shell) SendCommand(ctx context.Context, cmd string) error {
+	text, err := sanitizeCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("rejected command %q: %v", cmd, err)
+	}
+	if err := checkTarget(sh.exe.down, text); err != nil {
+		return fmt.Errorf("rejected command %q: %v", cmd, err)
+	}
+	return sh.exe.down.WriteAndWaitForOK(ctx, text)
+}
+
+// executeOutputSequence runs a sequence of output toggles and gcode commands. See Outputs.Sequence.
+func (sh *Shell) executeOutputSequence(ctx context.Context, steps ...string) error {
+	cmds, err := sh.outputs.Sequence(steps...)
+	if err != nil {
+		return err
+	}
+	return sh.exe.ExecuteFewCommands(ctx, cmds...)
+}
+
+func (sh *Shell) Drop(ctx context.Context) error {
+	sh.up.NotifyGripperState("opening")
+	if sh.gripForce > 0 {
+		if err := sh.exe.ExecuteFewCommands(ctx, "M5"); err != nil {
+			return err
+		}
+		sh.up.NotifyGripperState("open")
+		return nil
+	}
+	if err := sh.executeOutputSequence(ctx, "gripper=on", "vent=off", "G4 P400"); err != nil {
+		return err
+	}
+	sh.up.NotifyGripperState("venting")
+	if err := sh.executeOutputSequence(ctx, "G4 P600", "vent=on"); err != nil {
+		return fmt.Errorf("failed to complete drop: %v", err)
+	}
+	sh.up.NotifyGripperState("open")
+	return nil
+}
+
+// Grip closes the gripper. force overrides gripForce for this grip, if not empty.
+func (sh *Shell) Grip(ctx context.Context, force string) error {
+	if sh.gripForce <= 0 {
+		if force != "" {
+			return errors.New("the grip force is only supported by spindle-style grippers, see -grip_force")
+		}
+		err := sh.executeOutputSequence(ctx, "gripper=off")
+		sh.up.NotifyGripperState("closed")
+		return err
+	}
+	s := sh.gripForce
+	if force != "" {
+		var err error
+		if s, err = strconv.Atoi(force); err != nil || s <= 0 {
+			return fmt.Errorf("invalid grip force %q, want a positive number", force)
+		}
+	}
+	err := sh.exe.ExecuteFewCommands(ctx, fmt.Sprintf("M3 S%d", s))
+	sh.up.NotifyGripperState("closed")
+	return err
+}
+
+func (sh *Shell) Cut(ctx context.Context) error {
+	return sh.executeOutputSequence(ctx, "gripper=off", "G4 P400", "gripper=on", "vent=off", "G4 P400", "vent=on")
+}
+
+// Probe moves toward a surface with G38.2 until the probe is triggered. The words are the target
+// and the feed rate, like Z-10 F100. The triggered position is reported by the firmware
+// and is sent to the server as notify-probe.
+func (sh *Shell) Probe(ctx context.Context, words []string) error {
+	if len(words) == 0 {
+		return errors.New("probe requires a target, like: probe Z-10 F100")
+	}
+	return sh.SendCommand(ctx, "G38.2 "+strings.Join(words, " "))
+}
+
+// MoveArm translates arm-move and arm-jog into a URScript move and sends it to the arm.
+func (sh *Shell) MoveArm(ctx context.Context, jog bool, args []string) error {
+	script, err := armMoveScript(jog, args, sh.armAccel, sh.armVel)
+	if err != nil {
+		return err
+	}
+	if _, ok := sh.exe.down.(*MultiDownlink); ok {
+		script = "arm:" + script
+	}
+	return sh.SendCommand(ctx, script)
+}
+
+// armMoveScript returns movej to the pose given by args: x, y, z in meters and the rotation vector in radians.
+// If jog is true, args are the x, y and z offsets of the tool in meters, and movel is returned.
+// a=<accel> and v=<vel> override the acceleration and the velocity of this move.
+func armMoveScript(jog bool, args []string, accel, vel float64) (string, error) {
+	want := 6
+	if jog {
+		want = 3
+	}
+	var coords []string
+	for _, arg := range args {
+		if arg == "" {
 			continue
 		}
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "a="):
+			accel, err = strconv.ParseFloat(arg[2:], 64)
+		case strings.HasPrefix(arg, "v="):
+			vel, err = strconv.ParseFloat(arg[2:], 64)
+		default:
+			var val float64
+			if val, err = strconv.ParseFloat(arg, 64); err == nil {
+				coords = append(coords, strconv.FormatFloat(val, 'f', 6, 64))
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid argument %q: %v", arg, err)
+		}
+	}
+	if len(coords) != want {
+		return "", fmt.Errorf("want %d coordinates, got %d", want, len(coords))
+	}
+	if accel <= 0 || vel <= 0 {
+		return "", fmt.Errorf("the acceleration and the velocity must be positive, got a=%v, v=%v", accel, vel)
+	}
+	av := urAccelVel(accel, vel)
+	if jog {
+		return fmt.Sprintf("movel(pose_add(get_actual_tcp_pose(), p[%s, 0, 0, 0]), %s)", strings.Join(coords, ", "), av), nil
+	}
+	return fmt.Sprintf("movej(get_inverse_kin(p[%s]), %s)", strings.Join(coords, ", "), av), nil
+}
 
-		// Sending just a single g-code command to the printer. This is not cancelable yet.
-		if err := sh.exe.down.WriteAndWaitForOK(context.TODO(), cmd); err != nil {
-			sh.up.logf("Error while sending gcode: %v", err)
-			return lastTS
+func urAccelVel(accel, vel float64) string {
+	return fmt.Sprintf("a=%s, v=%s", strconv.FormatFloat(accel, 'f', -1, 64), strconv.FormatFloat(vel, 'f', -1, 64))
+}
+
+// HomeArm moves the arm to the home joint configuration. The move is complete, when the arm has stopped.
+// If the joint angles are reported over RTDE, it also makes sure, that the arm has stopped at the home.
+func (sh *Shell) HomeArm(ctx context.Context) error {
+	if len(sh.armHome) == 0 {
+		return errors.New("the home of the arm is not configured, see -ur3_home")
+	}
+	var joints []string
+	for _, q := range sh.armHome {
+		joints = append(joints, strconv.FormatFloat(q, 'f', -1, 64))
+	}
+	script := fmt.Sprintf("movej([%s], %s)", strings.Join(joints, ", "), urAccelVel(sh.armAccel, sh.armVel))
+	down := sh.exe.down
+	if md, ok := down.(*MultiDownlink); ok {
+		script = "arm:" + script
+		down = md.downs["arm"]
+	}
+	if err := sh.SendCommand(ctx, script); err != nil {
+		return err
+	}
+	jr, ok := down.(jointReporter)
+	if !ok {
+		return nil
+	}
+	actual, ok := jr.Joints()
+	if !ok {
+		sh.up.logf("The joint angles are unknown (no actual_q in -ur3_rtde_outputs), so the arrival at the home is not confirmed")
+		return nil
+	}
+	for i, q := range sh.armHome {
+		if i >= len(actual) || math.Abs(actual[i]-q) > armHomeTolerance {
+			return fmt.Errorf("the arm has stopped at %v, not at the home %v", actual, sh.armHome)
 		}
 	}
-	return lastTS
+	sh.up.logf("The arm is at the home")
+	return nil
+}
+
+// SnapshotMaxDim reports the maximum dimension of snapshot images sent to the server, if str is empty.
+// Otherwise, it sets it.
+func (sh *Shell) SnapshotMaxDim(str string) error {
+	if str == "" {
+		sh.up.logf("Snapshot max dimension: %d", sh.exe.SnapshotMaxDim())
+		return nil
+	}
+	maxDim, err := strconv.Atoi(str)
+	if err != nil || maxDim < 0 {
+		return fmt.Errorf("invalid max dimension %q, want a non-negative number of pixels", str)
+	}
+	sh.exe.SetSnapshotMaxDim(maxDim)
+	sh.up.logf("Snapshot max dimension is set to %d", maxDim)
+	return nil
 }
 
 func (sh *Shell) Reboot() error {
@@ -234,15 +688,79 @@ func (sh *Shell) Reboot() error {
 	return nil
 }
 
-func (sh *Shell) getNewJobContext() (context.Context, error) {
+// Shutdown brings the device into a safe state with the abort commands and powers off Raspberry Pi.
+func (sh *Shell) Shutdown() error {
+	if err := sh.checkAllowed("shutdown"); err != nil {
+		return err
+	}
+	// Otherwise, the job would keep sending its commands after the abort ones.
+	sh.stopJob(abortTimeout)
+	if abort := sh.exe.jobGcode().abort; len(abort) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		err := sh.exe.runInjectedCommands(ctx, "shutdown", abort)
+		cancel()
+		if err != nil {
+			// Best effort: the device may be disconnected, which is no reason to keep Raspberry Pi running.
+			sh.up.logf("Failed to run the abort commands: %v", err)
+		}
+	}
+	sh.up.logf("Shutting down Raspberry Pi...")
+	// Allow the delivery of the message above.
+	time.Sleep(time.Second)
+	data, err := sh.execCommand(context.Background(), "shutdown", "-h", "now")
+	if err != nil {
+		return fmt.Errorf("failed to shut down: %v\nOutput:\n%s", err, string(data))
+	}
+	return nil
+}
+
+// UpdateChannel reports the current update channel, if channel is empty. Otherwise, it switches
+// to the specified channel and checks for updates there.
+func (sh *Shell) UpdateChannel(channel string) error {
+	if sh.updater == nil {
+		return errors.New("updates are not configured")
+	}
+	if channel == "" {
+		sh.up.logf("Agent version %s, update channel: %s, manifest: %s", Version, sh.updater.Channel(), sh.updater.ManifestURL())
+		return nil
+	}
+	if err := sh.checkIdle(); err != nil {
+		return err
+	}
+	sh.up.logf("Switching the update channel from %s to %s", sh.updater.Channel(), channel)
+	return sh.updater.SetChannel(channel)
+}
+
+func (sh *Shell) CheckUpdate() error {
+	if sh.updater == nil {
+		return errors.New("updates are not configured")
+	}
+	if err := sh.checkIdle(); err != nil {
+		return err
+	}
+	sh.up.logf("Checking for updates in the %s channel (current version: %s)", sh.updater.Channel(), Version)
+	sh.updater.CheckNow()
+	return nil
+}
+
+// checkIdle returns an error, if a restart or an update would interrupt a running activity.
+func (sh *Shell) checkIdle() error {
+	if active := sh.exe.activities.Active(); len(active) > 0 {
+		return fmt.Errorf("busy with %s, try again later", strings.Join(active, ", "))
+	}
+	return nil
+}
+
+// getNewJobContext returns the context of a new job. The job goroutine must close done, when it's over.
+func (sh *Shell) getNewJobContext() (ctx context.Context, done chan bool, err error) {
 	sh.mu.Lock()
 	defer sh.mu.Unlock()
 	if sh.curJobCancel != nil {
-		return nil, fmt.Errorf("job is already running")
+		return nil, nil, fmt.Errorf("job is already running")
 	}
-	var ctx context.Context
 	ctx, sh.curJobCancel = context.WithCancel(context.Background())
-	return ctx, nil
+	sh.curJobDone = make(chan bool)
+	return ctx, sh.curJobDone, nil
 }
 
 func (sh *Shell) clearCurrentJob() {
@@ -264,12 +782,35 @@ func (sh *Shell) cancelJob() {
 	sh.up.logf("Cancelation is requested.")
 }
 
+// stopJob cancels the current job, if any, and waits until its goroutine is over, but no longer than timeout.
+func (sh *Shell) stopJob(timeout time.Duration) {
+	sh.mu.Lock()
+	done := sh.curJobDone
+	sh.mu.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+		return
+	default:
+	}
+	sh.cancelJob()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		sh.up.logf("The job is still running %v after the cancelation.", timeout)
+	}
+}
+
 func (sh *Shell) Bash(ctx context.Context, args []string) error {
 	if len(args) == 0 {
 		return errors.New("empty command line")
 	}
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	data, err := cmd.CombinedOutput()
+	if err := sh.checkAllowed(args[0]); err != nil {
+		return err
+	}
+	data, err := sh.execCommand(ctx, args[0], args[1:]...)
 	if len(data) > 0 {
 		if len(data) > 8000 {
 			data = data[:8000]
@@ -278,3 +819,46 @@ func (sh *Shell) Bash(ctx context.Context, args []string) error {
 	}
 	return err
 }
+
+// parseTrainPackArgs parses "realsense-train-pack <graspID> <packID> x y z roll pitch yaw [numFrames]".
+func parseTrainPackArgs(parts []string) (*RealSenseTrainPackParams, error) {
+	p := &RealSenseTrainPackParams{NumFrames: defaultTrainPackFrames}
+	if len(parts) > 1 {
+		p.GraspID = parts[1]
+	}
+	if len(parts) > 2 {
+		p.PackID = parts[2]
+	}
+	var err error
+	f64 := func(name string, idx int) float64 {
+		if err != nil {
+			return math.NaN()
+		}
+		if idx >= len(parts) {
+			err = fmt.Errorf("realsense-train-pack: not enough parameters (%d). Want at least %d to parse %s",
+				len(parts), idx+1, name)
+			return math.NaN()
+		}
+		var res float64
+		res, err = strconv.ParseFloat(parts[idx], 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return res
+	}
+	p.X = f64("x", 3)
+	p.Y = f64("y", 4)
+	p.Z = f64("z", 5)
+	p.Roll = f64("roll", 6)
+	p.Pitch = f64("pitch", 7)
+	p.Yaw = f64("yaw", 8)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 9 {
+		if p.NumFrames, err = strconv.Atoi(parts[9]); err != nil {
+			return nil, fmt.Errorf("realsense-train-pack: invalid number of frames %q: %v", parts[9], err)
+		}
+	}
+	return p, nil
+}
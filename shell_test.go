@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+// newTestShell returns a shell with a dry-run downlink, which records all written commands.
+func newTestShell() (*Shell, *DryRunDownlink, *notifyRecorder) {
+	up, rec := newTestUplink()
+	exe := NewExecutor(up, true /*virtual*/, nil)
+	down := NewDryRunDownlink(up)
+	exe.down = down
+	return NewShell(up, down, exe), down, rec
+}
+
+// withoutDelays filters out G4 commands.
+func withoutDelays(cmds []string) []string {
+	var res []string
+	for _, cmd := range cmds {
+		if !strings.HasPrefix(cmd, "G4 ") {
+			res = append(res, cmd)
+		}
+	}
+	return res
+}
+
+func TestShellDrop(t *testing.T) {
+	sh, down, rec := newTestShell()
+	outs, err := ParseOutputs("gripper=2,vent=3")
+	if err != nil {
+		t.Fatalf("ParseOutputs: %v", err)
+	}
+	sh.outputs = outs
+	if err := sh.Drop(context.Background()); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	want := []string{"M106 P2", "M107 P3", "M106 P3"}
+	got := withoutDelays(down.Written())
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Drop: want %q, got %q", want, got)
+	}
+	var states []string
+	for _, msg := range rec.ByType("notify-gripper-state") {
+		states = append(states, msg.GripperState)
+	}
+	if strings.Join(states, ",") != "opening,venting,open" {
+		t.Errorf("gripper states: want opening,venting,open, got: %q", states)
+	}
+}
+
+func TestShellSpindleGripper(t *testing.T) {
+	sh, down, rec := newTestShell()
+	sh.gripForce = 40
+
+	for _, cmd := range []string{"grip", "drop", "grip 25"} {
+		if !sh.handleCommand(cmd) {
+			t.Fatalf("%s failed", cmd)
+		}
+	}
+	want := "M3 S40; M5; M3 S25"
+	if got := strings.Join(withoutDelays(down.Written()), "; "); got != want {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+	var states []string
+	for _, msg := range rec.ByType("notify-gripper-state") {
+		states = append(states, msg.GripperState)
+	}
+	if strings.Join(states, ",") != "closed,opening,open,closed" {
+		t.Errorf("gripper states: want closed,opening,open,closed, got: %q", states)
+	}
+
+	if err := sh.Grip(context.Background(), "-5"); err == nil {
+		t.Errorf("Grip: want an error for a negative force")
+	}
+	sh.gripForce = 0
+	if err := sh.Grip(context.Background(), "25"); err == nil {
+		t.Errorf("Grip: want an error for a force with a valve gripper")
+	}
+}
+
+func TestShellRejectsInvalidCommand(t *testing.T) {
+	sh, _, _ := newTestShell()
+	conn := newFakeSerial()
+	dl := NewDFADownlink(sh.up, 115200)
+	dl.conn = conn
+	go dl.run(Connected)
+	sh.exe.down = dl
+
+	if err := sh.SendCommand(context.Background(), "G1 X10 Y10 Z-50;M112"); err == nil {
+		t.Errorf("SendCommand: want an error for a command with a comment")
+	}
+	if err := sh.SendCommand(context.Background(), "G28\nM999"); err == nil {
+		t.Errorf("SendCommand: want an error for several commands")
+	}
+	if written := conn.Written(); len(written) > 0 {
+		t.Errorf("want no serial writes, got %q", written)
+	}
+	conn.Close()
+}
+
+func TestShellProbe(t *testing.T) {
+	sh, _, rec := newTestShell()
+	conn := newFakeSerial()
+	dl := NewDFADownlink(sh.up, 115200)
+	dl.conn = conn
+	go dl.run(Connected)
+	sh.exe.down = dl
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- sh.Probe(context.Background(), []string{"Z-10", "F100"}) }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := conn.Written()[0]; !strings.Contains(got, "G38.2 Z-10 F100") {
+		t.Errorf("want G38.2 Z-10 F100 to be sent, got %q", got)
+	}
+	conn.Reply("[PRB:1.000,2.000,-3.250:1]")
+	conn.Reply("ok")
+	if err := <-errCh; err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	msgs := rec.ByType("notify-probe")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-probe message, got %d", len(msgs))
+	}
+	var res ProbeResult
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &res); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", msgs[0].Comment, err)
+	}
+	if want := (ProbeResult{X: 1, Y: 2, Z: -3.25, Triggered: true}); res != want {
+		t.Errorf("want %+v, got %+v", want, res)
+	}
+	if err := sh.Probe(context.Background(), nil); err == nil {
+		t.Errorf("Probe: want an error without a target")
+	}
+	conn.Close()
+}
+
+func gcodeUpdate(t *testing.T, cmds ...device_api.TSValue) string {
+	var resp device_api.Response
+	resp.TS.Gcode = cmds
+	data, err := json.Marshal(&resp)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return string(data)
+}
+
+func TestShellGcodeReplayAfterReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robosla-shell")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tsPath := path.Join(dir, "gcode-ts")
+
+	sh, down, _ := newTestShell()
+	sh.tsPath = tsPath
+	lastTS := sh.loadLastTS()
+	lastTS = sh.processGcodeUpdates(gcodeUpdate(t, device_api.TSValue{TS: 10, Value: "G28"}, device_api.TSValue{TS: 20, Value: "G1 Z5 F100"}), lastTS)
+	if got := strings.Join(down.Written(), "; "); got != "G28; G1 Z5 F100" {
+		t.Errorf("Written: want G28; G1 Z5 F100, got %q", got)
+	}
+
+	// After a reconnect and a restart, the server replays the stream from an earlier point.
+	sh, down, _ = newTestShell()
+	sh.tsPath = tsPath
+	lastTS = sh.loadLastTS()
+	if lastTS != 20 {
+		t.Errorf("loadLastTS: want 20, got %d", lastTS)
+	}
+	sh.processGcodeUpdates(gcodeUpdate(t,
+		device_api.TSValue{TS: 10, Value: "G28"},
+		device_api.TSValue{TS: 20, Value: "G1 Z5 F100"},
+		device_api.TSValue{TS: 30, Value: "G1 Z10 F100"}), lastTS)
+	if got := strings.Join(down.Written(), "; "); got != "G1 Z10 F100" {
+		t.Errorf("Written: want only the new command G1 Z10 F100, got %q", got)
+	}
+}
+
+func TestShellShutdown(t *testing.T) {
+	sh, down, _ := newTestShell()
+	abort, err := parseGcodeLines("abort_gcode", []string{"M107", "M84"})
+	if err != nil {
+		t.Fatalf("parseGcodeLines: %v", err)
+	}
+	sh.exe.SetJobGcode(nil, nil, abort)
+	var ran []string
+	sh.execCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		ran = append(ran, strings.Join(append([]string{name}, args...), " "))
+		return nil, nil
+	}
+
+	sh.bashAllow = parseBashAllow("ls,df")
+	if sh.handleCommand("shutdown") {
+		t.Errorf("shutdown is run, but it's not in -bash_allow")
+	}
+	if len(ran) != 0 || len(down.Written()) != 0 {
+		t.Errorf("want nothing run, got commands %q and gcode %q", ran, down.Written())
+	}
+
+	sh.bashAllow = parseBashAllow("ls, shutdown")
+	if !sh.handleCommand("shutdown") {
+		t.Fatalf("shutdown failed")
+	}
+	if got, want := strings.Join(down.Written(), "; "), "M107; M84"; got != want {
+		t.Errorf("Written: want the abort commands %q, got %q", want, got)
+	}
+	if len(ran) != 1 || ran[0] != "shutdown -h now" {
+		t.Errorf("want shutdown -h now run, got %q", ran)
+	}
+}
+
+func TestShellShutdownStopsJob(t *testing.T) {
+	sh, _, _ := newTestShell()
+	dir, err := ioutil.TempDir("", "robosla-test-base")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sh.exe.baseDir = dir
+	tr := &stallingTransport{requested: make(chan bool, 1)}
+	sh.exe.httpClient = &http.Client{Transport: tr}
+	sh.execCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, nil
+	}
+
+	if !sh.handleCommand("fetch-and-print stalled https://storage.googleapis.com/robosla-data/job.zip") {
+		t.Fatalf("fetch-and-print failed")
+	}
+	<-tr.requested
+	if !sh.handleCommand("shutdown") {
+		t.Fatalf("shutdown failed")
+	}
+	if active := sh.exe.activities.Active(); len(active) != 0 {
+		t.Errorf("want the job stopped before the shutdown, got running: %q", active)
+	}
+}
+
+func TestShellMoveArm(t *testing.T) {
+	sh, down, _ := newTestShell()
+	sh.armAccel, sh.armVel = 0.3, 0.05
+
+	for _, cmd := range []string{
+		"arm-move 0.1 0.2 0.3 0 3.14 0",
+		"arm-move 0.1 0.2 0.3 0 3.14 0 v=0.2",
+		"arm-jog 0 0 -0.01 a=0.5",
+	} {
+		if !sh.handleCommand(cmd) {
+			t.Fatalf("%s failed", cmd)
+		}
+	}
+	want := []string{
+		"movej(get_inverse_kin(p[0.100000, 0.200000, 0.300000, 0.000000, 3.140000, 0.000000]), a=0.3, v=0.05)",
+		"movej(get_inverse_kin(p[0.100000, 0.200000, 0.300000, 0.000000, 3.140000, 0.000000]), a=0.3, v=0.2)",
+		"movel(pose_add(get_actual_tcp_pose(), p[0.000000, 0.000000, -0.010000, 0, 0, 0]), a=0.5, v=0.05)",
+	}
+	if got := down.Written(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Written: want %q, got %q", want, got)
+	}
+
+	for _, cmd := range []string{"arm-move 0.1 0.2 0.3", "arm-move 0.1 0.2 0.3 0 3.14 0 a=-1", "arm-jog 0 0 x"} {
+		if sh.handleCommand(cmd) {
+			t.Errorf("%s: want a failure", cmd)
+		}
+	}
+	if got := len(down.Written()); got != len(want) {
+		t.Errorf("want no more moves sent, got %d", got-len(want))
+	}
+}
+
+func TestShellDumpJob(t *testing.T) {
+	sh, _, rec := newTestShell()
+	if sh.handleCommand("dump-job") {
+		t.Errorf("dump-job succeeded without a loaded job")
+	}
+
+	gcode := "G90\nM7820 S0\nM7821 P1500\n"
+	for i := 1; i <= jobDumpChunk; i++ {
+		gcode += fmt.Sprintf("G1 Z%d F100\n", i)
+	}
+	job := writeTestJob(t, gcode)
+	if err := sh.exe.ExecuteGcode(context.Background(), "dumped", job); err != nil {
+		t.Fatalf("ExecuteGcode: %v", err)
+	}
+	if !sh.handleCommand("dump-job") {
+		t.Fatalf("dump-job failed")
+	}
+	var msgs []*device_api.UplinkMessage
+	for deadline := time.Now().Add(5 * time.Second); len(msgs) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		msgs = rec.ByType("notify-job-dump")
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("want the job dumped in 2 chunks, got %d", len(msgs))
+	}
+	var cmds []DumpedCommand
+	for i, msg := range msgs {
+		var dump JobDump
+		if err := json.Unmarshal([]byte(msg.Comment), &dump); err != nil {
+			t.Fatalf("failed to parse the dump: %v", err)
+		}
+		if msg.JobName != "dumped" || dump.Offset != i*jobDumpChunk || dump.Total != jobDumpChunk+3 {
+			t.Errorf("chunk %d: want job dumped at offset %d of %d, got %s at %d of %d",
+				i, i*jobDumpChunk, jobDumpChunk+3, msg.JobName, dump.Offset, dump.Total)
+		}
+		cmds = append(cmds, dump.Commands...)
+	}
+	if len(cmds) != jobDumpChunk+3 {
+		t.Fatalf("want %d commands, got %d", jobDumpChunk+3, len(cmds))
+	}
+	frame, dwell, last := cmds[1], cmds[2], cmds[len(cmds)-1]
+	if frame.Text != "M7820 S0" || !frame.Host || frame.Params == nil || frame.Params.Other["S"] != 0 {
+		t.Errorf("want the frame host command with S0, got %+v", frame)
+	}
+	if dwell.Text != "M7821 P1500" || !dwell.Host || dwell.Params == nil || dwell.Params.DwellMS == nil || *dwell.Params.DwellMS != 1500 {
+		t.Errorf("want the dwell host command with 1500 ms, got %+v", dwell)
+	}
+	if last.Index != jobDumpChunk+2 || last.Text != fmt.Sprintf("G1 Z%d F100", jobDumpChunk) || last.Host {
+		t.Errorf("want the last move, got %+v", last)
+	}
+}
+
+// stallingTransport never responds. It signals every request on requested.
+type stallingTransport struct {
+	requested chan bool
+}
+
+func (tr *stallingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.requested <- true
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestShellCancelJob(t *testing.T) {
+	sh, _, rec := newTestShell()
+	dir, err := ioutil.TempDir("", "robosla-test-base")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sh.exe.baseDir = dir
+	tr := &stallingTransport{requested: make(chan bool, 1)}
+	sh.exe.httpClient = &http.Client{Transport: tr}
+
+	jobDone := func(jobName string) *device_api.UplinkMessage {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, msg := range rec.ByType("notify-job-done") {
+				if msg.JobName == jobName {
+					return msg
+				}
+			}
+		}
+		t.Fatalf("%s is not reported as done", jobName)
+		return nil
+	}
+
+	// Only the jobs from our storage may be downloaded.
+	if !sh.handleCommand("fetch-and-print failed https://example.com/job.zip") {
+		t.Fatalf("fetch-and-print failed")
+	}
+	if msg := jobDone("failed"); msg.Success || msg.Comment == jobCanceledComment {
+		t.Errorf("want the job failed, got success: %v, comment: %q", msg.Success, msg.Comment)
+	}
+
+	if !sh.handleCommand("fetch-and-print canceled https://storage.googleapis.com/robosla-data/job.zip") {
+		t.Fatalf("fetch-and-print failed")
+	}
+	<-tr.requested
+	sh.handleCommand("cancel")
+	if msg := jobDone("canceled"); msg.Success || msg.Comment != jobCanceledComment {
+		t.Errorf("want the job canceled, got success: %v, comment: %q", msg.Success, msg.Comment)
+	}
+}
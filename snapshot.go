@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -11,11 +12,41 @@ type Snapshotter interface {
 	TakeSnapshot(ctx context.Context, prefix string, numFrames int) error
 }
 
+// subsetSnapshotter is implemented by snapshotters with several named cameras.
+type subsetSnapshotter interface {
+	TakeSnapshotOf(ctx context.Context, prefix string, numFrames int, names []string) error
+}
+
+// mimeTyper is implemented by snapshotters, which prefer a format of the uploaded frames,
+// like PNG for depth and radar frames, which must not be blurred by a lossy compression.
+type mimeTyper interface {
+	MimeType() string
+}
+
 type CombinedSnapshotter struct {
 	Snaps map[string]Snapshotter
 }
 
 func (cs *CombinedSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
+	var names []string
+	for name := range cs.Snaps {
+		names = append(names, name)
+	}
+	return cs.TakeSnapshotOf(ctx, prefix, numFrames, names)
+}
+
+// TakeSnapshotOf takes a snapshot from the named snapshotters only.
+func (cs *CombinedSnapshotter) TakeSnapshotOf(ctx context.Context, prefix string, numFrames int, names []string) error {
+	for _, name := range names {
+		if _, ok := cs.Snaps[name]; !ok {
+			var known []string
+			for name := range cs.Snaps {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown camera %q, want one of %s", name, strings.Join(known, ", "))
+		}
+	}
 	if numFrames != 1 {
 		return fmt.Errorf("only taking a single snapshot is supported by CombinedSnapshot, but %d was requested", numFrames)
 	}
@@ -23,18 +54,21 @@ func (cs *CombinedSnapshotter) TakeSnapshot(ctx context.Context, prefix string,
 	if strings.HasSuffix(prefix, "realsense-") {
 		prefix = prefix[:len(prefix)-len("realsense-")]
 	}
+	var mu sync.Mutex
 	errs := make(map[string]error)
 	var wg sync.WaitGroup
-	wg.Add(len(cs.Snaps))
-	for name, snap := range cs.Snaps {
+	wg.Add(len(names))
+	for _, name := range names {
 		go func(name string, snap Snapshotter) {
 			defer wg.Done()
 			snapPrefix := fmt.Sprintf("%s%s", prefix, name)
 			err := snap.TakeSnapshot(ctx, snapPrefix, numFrames)
 			if err != nil {
+				mu.Lock()
 				errs[name] = err
+				mu.Unlock()
 			}
-		}(name, snap)
+		}(name, cs.Snaps[name])
 	}
 	wg.Wait()
 	for name, err := range errs {
@@ -44,3 +78,31 @@ func (cs *CombinedSnapshotter) TakeSnapshot(ctx context.Context, prefix string,
 	}
 	return nil
 }
+
+// MimeTypeOf returns the preferred mime type of the frame saved as fname by one of the snapshotters,
+// or an empty string, if the snapshotter has no preference.
+func (cs *CombinedSnapshotter) MimeTypeOf(fname string) string {
+	// The longest name wins, so that rgb2 frames are not taken for rgb ones.
+	var snap Snapshotter
+	var best string
+	for name, s := range cs.Snaps {
+		if strings.HasPrefix(fname, name) && len(name) > len(best) {
+			snap, best = s, name
+		}
+	}
+	if mt, ok := snap.(mimeTyper); ok {
+		return mt.MimeType()
+	}
+	return ""
+}
+
+// snapshotMimeType returns the preferred mime type of the frame saved as fname by snap.
+func snapshotMimeType(snap Snapshotter, fname string) string {
+	switch snap := snap.(type) {
+	case *CombinedSnapshotter:
+		return snap.MimeTypeOf(fname)
+	case mimeTyper:
+		return snap.MimeType()
+	}
+	return ""
+}
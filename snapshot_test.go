@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingSnapshotter counts the snapshots taken and saves nothing.
+type countingSnapshotter struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *countingSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *countingSnapshotter) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestShellSnapshotSubset(t *testing.T) {
+	sh, _, _ := newTestShell()
+	radar, rgb := new(countingSnapshotter), new(countingSnapshotter)
+	sh.exe.rss = &CombinedSnapshotter{Snaps: map[string]Snapshotter{"radar": radar, "rgb": rgb}}
+
+	if !sh.handleCommand("snapshot rgb") {
+		t.Fatalf("snapshot rgb failed")
+	}
+	if radar.Calls() != 0 || rgb.Calls() != 1 {
+		t.Errorf("want only rgb invoked, got radar: %d, rgb: %d", radar.Calls(), rgb.Calls())
+	}
+
+	if !sh.handleCommand("snapshot") {
+		t.Fatalf("snapshot failed")
+	}
+	if radar.Calls() != 1 || rgb.Calls() != 2 {
+		t.Errorf("want all cameras invoked without a filter, got radar: %d, rgb: %d", radar.Calls(), rgb.Calls())
+	}
+
+	if sh.handleCommand("snapshot camera9") {
+		t.Errorf("a snapshot of an unknown camera is taken")
+	}
+	if radar.Calls() != 1 || rgb.Calls() != 2 {
+		t.Errorf("want no cameras invoked for an unknown camera, got radar: %d, rgb: %d", radar.Calls(), rgb.Calls())
+	}
+}
+
+// mimeSnapshotter saves the same JPEG for every snapshot and prefers mimeType for the upload.
+type mimeSnapshotter struct {
+	imageSnapshotter
+	mimeType string
+}
+
+func (s *mimeSnapshotter) MimeType() string { return s.mimeType }
+
+func TestSnapshotMimeType(t *testing.T) {
+	up, rec := newTestUplink()
+	data := encodeTestJPEG(t, 64, 48)
+	exe := NewExecutor(up, true /*virtual*/, &CombinedSnapshotter{Snaps: map[string]Snapshotter{
+		"radar": &mimeSnapshotter{imageSnapshotter{data}, "image/png"},
+		"rgb":   &mimeSnapshotter{imageSnapshotter{data}, "image/jpeg"},
+	}})
+
+	if err := exe.Snapshot(context.Background()); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	msgs := rec.ByType("notify-snapshot")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-snapshot message, got %d", len(msgs))
+	}
+	for name, want := range map[string]string{"radarcamera0": "png", "rgbcamera0": "jpeg"} {
+		url := msgs[0].Cameras[name]
+		if prefix := "data:image/" + want + ";base64,"; !strings.HasPrefix(url, prefix) {
+			t.Errorf("%s: want a data URL starting with %q, got %.40q", name, prefix, url)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(url[strings.Index(url, ",")+1:])
+		if err != nil {
+			t.Fatalf("%s: failed to decode the data URL: %v", name, err)
+		}
+		if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != want {
+			t.Errorf("%s: want a %s image, got %q, %v", name, want, format, err)
+		}
+	}
+}
+
+// slowSnapshotter blocks every snapshot until release is closed and records the highest number of snapshots
+// taken at once.
+type slowSnapshotter struct {
+	release chan bool
+
+	mu      sync.Mutex
+	calls   int
+	running int
+	maxRun  int
+}
+
+func (s *slowSnapshotter) TakeSnapshot(ctx context.Context, prefix string, numFrames int) error {
+	s.mu.Lock()
+	s.calls++
+	if s.running++; s.running > s.maxRun {
+		s.maxRun = s.running
+	}
+	s.mu.Unlock()
+	<-s.release
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *slowSnapshotter) Stats() (calls, running, maxRun int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, s.running, s.maxRun
+}
+
+func TestSnapshotSerialized(t *testing.T) {
+	up, _ := newTestUplink()
+	snap := &slowSnapshotter{release: make(chan bool)}
+	exe := NewExecutor(up, true /*virtual*/, snap)
+	errCh := make(chan error, 3)
+	snapshot := func() { errCh <- exe.Snapshot(context.Background()) }
+	go snapshot()
+	for _, running, _ := snap.Stats(); running == 0; _, running, _ = snap.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	// The second one waits for the first one. The third one is coalesced with the second one.
+	go snapshot()
+	for queued := false; !queued; time.Sleep(time.Millisecond) {
+		exe.stateMu.Lock()
+		queued = exe.queuedSnaps["all cameras"]
+		exe.stateMu.Unlock()
+	}
+	go snapshot()
+	select {
+	case err := <-errCh:
+		if err != ErrSnapshotSkipped {
+			t.Fatalf("Snapshot: want the third one skipped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the third snapshot is not skipped")
+	}
+	close(snap.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Errorf("Snapshot: %v", err)
+		}
+	}
+	if calls, _, maxRun := snap.Stats(); calls != 2 || maxRun != 1 {
+		t.Errorf("want 2 snapshots taken one at a time, got %d snapshots, up to %d at once", calls, maxRun)
+	}
+}
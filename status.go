@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// AgentStatus is served as JSON by the status endpoint.
+type AgentStatus struct {
+	Version         string                 `json:"version"`
+	DeviceName      string                 `json:"device_name"`
+	UplinkConnected bool                   `json:"uplink_connected"`
+	DeviceConnected bool                   `json:"device_connected"`
+	JobName         string                 `json:"job_name"`
+	Temperatures    map[string]Temperature `json:"temperatures"`
+	// Pose is the last known pose of a robotic arm, if there's one.
+	Pose []float64 `json:"pose,omitempty"`
+	// PreRestartPose is the last known pose before the agent has restarted. The arm may have moved since then.
+	PreRestartPose *SavedPose `json:"last_known_pose_pre_restart,omitempty"`
+}
+
+// StatusServer is a read-only HTTP endpoint for local monitoring, like a kiosk dashboard.
+type StatusServer struct {
+	up      *Uplink
+	down    Downlink
+	version string
+	started time.Time
+}
+
+func NewStatusServer(up *Uplink, down Downlink, version string) *StatusServer {
+	return &StatusServer{up: up, down: down, version: version, started: time.Now()}
+}
+
+func (ss *StatusServer) Status() *AgentStatus {
+	st := &AgentStatus{
+		Version:         ss.version,
+		DeviceName:      ss.up.DeviceName(),
+		UplinkConnected: ss.up.getClient() != nil,
+		DeviceConnected: ss.down != nil && ss.down.Connected(),
+		JobName:         ss.up.getJobName(),
+		Temperatures:    ss.up.Temperatures(),
+	}
+	if pr, ok := ss.down.(poseReporter); ok {
+		st.Pose, _ = pr.Pose()
+	}
+	if pr, ok := ss.down.(preRestartPoseReporter); ok {
+		st.PreRestartPose, _ = pr.PreRestartPose()
+	}
+	return st
+}
+
+func (ss *StatusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "the status endpoint is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.MarshalIndent(ss.Status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ServeMetrics exports the link stats, job progress, temperatures and uptime in Prometheus text format.
+func (ss *StatusServer) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("robosla_info", "gauge", "Agent version.")
+	fmt.Fprintf(&buf, "robosla_info{version=%q} 1\n", ss.version)
+	metric("robosla_uptime_seconds", "gauge", "Time since the agent has started.")
+	fmt.Fprintf(&buf, "robosla_uptime_seconds %g\n", time.Now().Sub(ss.started).Seconds())
+	metric("robosla_device_connected", "gauge", "1 if the device is connected, 0 otherwise.")
+	fmt.Fprintf(&buf, "robosla_device_connected %d\n", boolToInt(ss.down != nil && ss.down.Connected()))
+	if sr, ok := ss.down.(statsReporter); ok {
+		st := sr.Stats()
+		for _, c := range []struct {
+			name, help string
+			val        int64
+		}{
+			{"robosla_commands_sent_total", "Commands sent to the device.", st.CommandsSent},
+			{"robosla_oks_total", "Commands acknowledged by the device.", st.OKs},
+			{"robosla_resends_total", "Resend requests from the device.", st.Resends},
+			{"robosla_reconnects_total", "Reconnects to the device.", st.Reconnects},
+			{"robosla_resets_total", "Unexpected resets of the device.", st.Resets},
+			{"robosla_bytes_in_total", "Bytes received from the device.", st.BytesIn},
+			{"robosla_bytes_out_total", "Bytes sent to the device.", st.BytesOut},
+		} {
+			metric(c.name, "counter", c.help)
+			fmt.Fprintf(&buf, "%s %d\n", c.name, c.val)
+		}
+	}
+	metric("robosla_job_progress_percent", "gauge", "Progress of the current job.")
+	fmt.Fprintf(&buf, "robosla_job_progress_percent{job=%q} %g\n", ss.up.getJobName(), ss.up.JobProgress())
+	temps := ss.up.Temperatures()
+	if len(temps) > 0 {
+		var heaters []string
+		for heater := range temps {
+			heaters = append(heaters, heater)
+		}
+		sort.Strings(heaters)
+		metric("robosla_temperature_celsius", "gauge", "Heater temperatures.")
+		for _, heater := range heaters {
+			fmt.Fprintf(&buf, "robosla_temperature_celsius{heater=%q,kind=\"actual\"} %g\n", heater, temps[heater].Actual)
+			fmt.Fprintf(&buf, "robosla_temperature_celsius{heater=%q,kind=\"target\"} %g\n", heater, temps[heater].Target)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ListenAndServe serves the status at /status and the metrics at /metrics. If addr has no host, like ":8080",
+// it binds to localhost, so that the endpoint is not exposed to the network by accident.
+func (ss *StatusServer) ListenAndServe(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/status", ss)
+	mux.HandleFunc("/metrics", ss.ServeMetrics)
+	return http.ListenAndServe(net.JoinHostPort(host, port), mux)
+}
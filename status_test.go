@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+func TestStatusServer(t *testing.T) {
+	up, _ := newTestUplink()
+	up.setClientAndDeviceName(&device_api.Client{}, "test-device")
+	up.SetJobName("benchy")
+	up.NotifyTemperature(map[string]Temperature{"T": {Actual: 201.5, Target: 210}})
+	ss := NewStatusServer(up, NewDryRunDownlink(up), "1.2.3")
+
+	w := httptest.NewRecorder()
+	ss.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /status: want 200, got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type: want application/json, got %q", ct)
+	}
+	var st map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", w.Body, err)
+	}
+	for _, key := range []string{"version", "device_name", "uplink_connected", "device_connected", "job_name", "temperatures"} {
+		if _, ok := st[key]; !ok {
+			t.Errorf("the status has no %q field: %s", key, w.Body)
+		}
+	}
+	var status AgentStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Version != "1.2.3" || status.JobName != "benchy" || !status.UplinkConnected {
+		t.Errorf("want version 1.2.3, job benchy and a connected uplink, got %+v", status)
+	}
+	if status.Temperatures["T"] != (Temperature{Actual: 201.5, Target: 210}) {
+		t.Errorf("want T 201.5/210, got %+v", status.Temperatures)
+	}
+
+	w = httptest.NewRecorder()
+	ss.ServeHTTP(w, httptest.NewRequest("POST", "/status", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status: want 405, got %d", w.Code)
+	}
+}
+
+func TestStatusServerMetrics(t *testing.T) {
+	up, _ := newTestUplink()
+	up.SetJobName("benchy")
+	up.NotifyJobProgress("benchy", 42.5, time.Minute, time.Minute)
+	up.NotifyTemperature(map[string]Temperature{"B": {Actual: 60, Target: 60}})
+	dl := NewDFADownlink(up, 115200)
+	go dl.run(Connecting)
+	dl.updateStats(func(st *LinkStats) {
+		st.CommandsSent = 17
+		st.Resends = 2
+	})
+	ss := NewStatusServer(up, dl, "1.2.3")
+
+	w := httptest.NewRecorder()
+	ss.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE robosla_commands_sent_total counter",
+		"robosla_commands_sent_total 17",
+		"robosla_resends_total 2",
+		`robosla_job_progress_percent{job="benchy"} 42.5`,
+		`robosla_temperature_celsius{heater="B",kind="actual"} 60`,
+		`robosla_info{version="1.2.3"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("the metrics have no line %q:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, "robosla_uptime_seconds ") {
+		t.Errorf("the metrics have no uptime:\n%s", body)
+	}
+}
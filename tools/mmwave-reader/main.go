@@ -73,11 +73,11 @@ func main() {
 		failf("Failed to configure the radar device: %v", err)
 	}
 	for i := 0; ; i++ {
-		cube, err := conn.TakeSnapshot()
+		frame, err := conn.TakeSnapshot()
 		if err != nil {
 			failf("Failed to read radar data: %v", err)
 		}
-		pngData, err := cubeToPNG(cube, 384, 128)
+		pngData, err := cubeToPNG(frame.Cube, 384, 128)
 		if err != nil {
 			failf("cubeToPNG: %v", err)
 		}
@@ -9,6 +9,8 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -27,7 +29,9 @@ const (
 )
 
 var (
-	steps = flag.Int("steps", 20000, "Number of steps")
+	steps    = flag.Int("steps", 20000, "Number of steps")
+	homePose = flag.String("home_pose", "-0.32, -0.112468, 0.22599999999999998, 2.2193304157225078, 2.2215519673201243, 0.0000011102208116102493",
+		"Comma-separated pose, which the robot is moved to first: x, y, z in meters and the rotation vector in radians")
 )
 
 // Matrix multiply for 3x3 matrices.
@@ -128,8 +132,19 @@ func goodRandPoint() (x, y, z, roll, pitch, yaw float64) {
 func main() {
 	flag.Parse()
 
+	home := strings.Split(*homePose, ",")
+	if len(home) != 6 {
+		log.Fatalf("-home_pose: want 6 values, got %d", len(home))
+	}
+	for i := range home {
+		home[i] = strings.TrimSpace(home[i])
+		if _, err := strconv.ParseFloat(home[i], 64); err != nil {
+			log.Fatalf("-home_pose: %v", err)
+		}
+	}
+
 	fmt.Println("; Home it first")
-	fmt.Println("movej(get_inverse_kin(p[-0.32, -0.112468, 0.22599999999999998, 2.2193304157225078, 2.2215519673201243, 0.0000011102208116102493]), a=0.4, v=0.3)")
+	fmt.Printf("movej(get_inverse_kin(p[%s]), a=0.4, v=0.3)\n", strings.Join(home, ", "))
 	fmt.Println("; wait for idle")
 	fmt.Println("M7823")
 
@@ -36,7 +36,8 @@ func main() {
 	if *ur3Host == "" {
 		log.Fatal("--ur3_host is not specified")
 	}
-	conn, err := ur.ConnectRTDE(*ur3Host, *ur3RTDEPort, "actual_TCP_speed")
+	outputs := []string{"actual_TCP_speed"}
+	conn, err := ur.ConnectRTDE(*ur3Host, *ur3RTDEPort, outputs)
 	if err != nil {
 		log.Fatalf("ConnectRTDE: %v", err)
 	}
@@ -50,7 +51,11 @@ func main() {
 			log.Fatalf("Failed to read from the socket: %v", err)
 		}
 		if typ == ur.RTDE_DATA_PACKAGE {
-			vec := ur.ParseVector6D(body[1:])
+			values, err := ur.ParseDataPackage(body, outputs)
+			if err != nil {
+				log.Fatalf("ParseDataPackage: %v", err)
+			}
+			vec := values["actual_TCP_speed"]
 			linSpeed := l2(vec[:3])
 			rotSpeed := l2(vec[3:])
 			if linSpeed < 2E-5 {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/autoupdate"
+)
+
+const (
+	defaultUpdateChannel = "prod"
+	// How often the update channel is checked for a new version.
+	updateCheckInterval = time.Minute
+)
+
+// parseUpdateChannels parses a comma-separated list of update channels with their manifest URLs,
+// like beta=https://example.com/robosla-agent-beta.json. The prod channel is always known:
+// it's autoupdate.ProdManifestURL, unless overridden.
+func parseUpdateChannels(str string) (map[string]string, error) {
+	channels := map[string]string{defaultUpdateChannel: autoupdate.ProdManifestURL}
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("channel %q: want <name>=<manifest URL>", s)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("channel %q: invalid manifest URL %q", parts[0], parts[1])
+		}
+		channels[parts[0]] = parts[1]
+	}
+	return channels, nil
+}
+
+// Updater keeps track of the update channel and checks it for a new version. The channel is stored
+// in the config dir, so that it survives restarts and autoupdates.
+type Updater struct {
+	version string
+	// channels maps the update channel names to their manifest URLs. See parseUpdateChannels.
+	channels map[string]string
+	mu       sync.Mutex
+	channel  string
+	// checkCh requests a check right away. See CheckNow.
+	checkCh chan bool
+	// check checks the manifest for a new version once and installs it, unless the updates are disabled
+	// by a running activity. It's overridden in tests.
+	check func(manifestURL, version string) error
+}
+
+func NewUpdater(version string, channels map[string]string) *Updater {
+	upd := &Updater{
+		version:  version,
+		channels: channels,
+		channel:  defaultUpdateChannel,
+		checkCh:  make(chan bool, 1),
+		check:    autoupdate.Check,
+	}
+	if channel, err := upd.readChannel(); err == nil {
+		upd.channel = channel
+	} else if !os.IsNotExist(err) {
+		logf("Failed to read the update channel, falling back to %s: %v", defaultUpdateChannel, err)
+	}
+	return upd
+}
+
+func getUpdateChannelPath() string {
+	return path.Join(getConfigDir(), "update-channel")
+}
+
+func (upd *Updater) readChannel() (string, error) {
+	data, err := ioutil.ReadFile(getUpdateChannelPath())
+	if err != nil {
+		return "", err
+	}
+	channel := strings.TrimSpace(string(data))
+	if _, ok := upd.channels[channel]; !ok {
+		return "", fmt.Errorf("unknown update channel %q in %s, want one of: %s", channel, getUpdateChannelPath(), upd.channelNames())
+	}
+	return channel, nil
+}
+
+func (upd *Updater) channelNames() string {
+	var names []string
+	for name := range upd.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (upd *Updater) Channel() string {
+	upd.mu.Lock()
+	defer upd.mu.Unlock()
+	return upd.channel
+}
+
+// ManifestURL returns the manifest URL used by the next update check.
+func (upd *Updater) ManifestURL() string {
+	return upd.channels[upd.Channel()]
+}
+
+// Run checks the current channel every updateCheckInterval and whenever CheckNow is called.
+func (upd *Updater) Run() {
+	for {
+		select {
+		case <-time.After(updateCheckInterval):
+		case <-upd.checkCh:
+		}
+		if err := upd.check(upd.ManifestURL(), upd.version); err != nil {
+			logf("Update check in the %s channel failed: %v", upd.Channel(), err)
+		}
+	}
+}
+
+// SetChannel switches to another update channel and checks for updates in that channel.
+func (upd *Updater) SetChannel(channel string) error {
+	if _, ok := upd.channels[channel]; !ok {
+		return fmt.Errorf("unknown update channel %q, want one of: %s. See -update_channels", channel, upd.channelNames())
+	}
+	if err := os.MkdirAll(getConfigDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create config dir: %v", err)
+	}
+	if err := writeFileAtomic(getUpdateChannelPath(), []byte(channel+"\n"), 0644, nil); err != nil {
+		return fmt.Errorf("failed to save the update channel: %v", err)
+	}
+	upd.mu.Lock()
+	upd.channel = channel
+	upd.mu.Unlock()
+	upd.CheckNow()
+	return nil
+}
+
+// CheckNow makes Run check the current channel right away. If a check is already requested, it does nothing.
+func (upd *Updater) CheckNow() {
+	select {
+	case upd.checkCh <- true:
+	default:
+	}
+}
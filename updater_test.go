@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUpdateChannels(t *testing.T) {
+	channels, err := parseUpdateChannels("beta=https://example.com/beta.json, nightly=https://example.com/nightly.json")
+	if err != nil {
+		t.Fatalf("parseUpdateChannels: %v", err)
+	}
+	if len(channels) != 3 || channels["beta"] != "https://example.com/beta.json" || channels["prod"] == "" {
+		t.Errorf("parseUpdateChannels: want prod, beta and nightly, got %v", channels)
+	}
+	for _, s := range []string{"beta", "=https://example.com/beta.json", "beta=example.com/beta.json"} {
+		if _, err := parseUpdateChannels(s); err == nil {
+			t.Errorf("parseUpdateChannels(%q): want an error", s)
+		}
+	}
+}
+
+func TestUpdaterSetChannel(t *testing.T) {
+	setTestConfigDir(t)
+	channels, err := parseUpdateChannels("beta=https://example.com/beta.json")
+	if err != nil {
+		t.Fatalf("parseUpdateChannels: %v", err)
+	}
+	upd := NewUpdater("test", channels)
+	if got := upd.ManifestURL(); got != channels["prod"] {
+		t.Errorf("ManifestURL: want prod manifest %s by default, got %s", channels["prod"], got)
+	}
+	checked := make(chan string, 10)
+	upd.check = func(manifestURL, version string) error {
+		checked <- manifestURL
+		return nil
+	}
+	go upd.Run()
+	if err := upd.SetChannel("beta"); err != nil {
+		t.Fatalf("SetChannel: %v", err)
+	}
+	select {
+	case got := <-checked:
+		if got != channels["beta"] {
+			t.Errorf("want the beta manifest %s checked, got %s", channels["beta"], got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetChannel: want an immediate update check")
+	}
+	// The channel must survive a restart.
+	if got := NewUpdater("test", channels).ManifestURL(); got != channels["beta"] {
+		t.Errorf("ManifestURL after restart: want beta manifest %s, got %s", channels["beta"], got)
+	}
+	if err := upd.SetChannel("nightly"); err == nil {
+		t.Errorf("SetChannel(nightly): want an error for an unknown channel, got nil")
+	}
+	// Without the beta channel configured, the saved one is not used.
+	if got := NewUpdater("test", map[string]string{"prod": channels["prod"]}).Channel(); got != "prod" {
+		t.Errorf("Channel: want prod, if the saved channel is not configured, got %s", got)
+	}
+}
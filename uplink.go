@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
@@ -23,15 +25,65 @@ type Uplink struct {
 	// This is likely not an appropriate place, but I don't have good ideas right now.
 	jobName  string
 	notifyCh chan *device_api.UplinkMessage
+	// The last reported temperatures and job progress, for the status endpoint.
+	temps       map[string]Temperature
+	jobProgress float64
 
 	// Pending logs
 	pendingLogsMu    sync.Mutex
 	pendingLogs      []string
 	pendingLogsStart time.Time
+	// The last maxRecentLogs lines, for diagnostic bundles. Unlike pendingLogs, they are kept after a flush.
+	recentLogs []string
+	// Local listeners of the logs, like the local shell socket.
+	logTaps   map[int]func(line string)
+	nextTapID int
+
+	// Backoff between handshake attempts.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// SPKI hashes of the API server certificates. If not empty, one of them must match.
+	certPins [][]byte
+
+	// fatalDelay is the pause before and after the fatal error is logged by Fatalf, so that it reaches
+	// the server. It's skipped, if the uplink is not connected.
+	fatalDelay time.Duration
+	// exit is os.Exit. It's overridden in tests.
+	exit func(code int)
+
+	// wd is the liveness watchdog, if it's enabled. Run beats it as "uplink", while it connects.
+	wd *LivenessWatchdog
+}
+
+const (
+	defaultMinBackoff = 5 * time.Second
+	defaultMaxBackoff = 5 * time.Minute
+	defaultFatalDelay = 5 * time.Second
+	// After that many failed handshake attempts on the same connection, the connection is reestablished.
+	maxHandshakeAttempts = 5
+	maxRecentLogs        = 1000
+)
+
+// unrecoverableError is a handshake failure which retries can't fix, like a missing user.json.
+type unrecoverableError struct {
+	error
+}
+
+func unrecoverablef(format string, args ...interface{}) error {
+	return &unrecoverableError{fmt.Errorf(format, args...)}
 }
 
 func NewUplink(apiServerAddr string) *Uplink {
-	return &Uplink{apiServerAddr: apiServerAddr, nd: pubsub.NewNode(), notifyCh: make(chan *device_api.UplinkMessage, 20)}
+	return &Uplink{
+		apiServerAddr: apiServerAddr,
+		nd:            pubsub.NewNode(),
+		notifyCh:      make(chan *device_api.UplinkMessage, 20),
+		minBackoff:    defaultMinBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		fatalDelay:    defaultFatalDelay,
+		exit:          os.Exit,
+	}
 }
 
 func (up *Uplink) getClient() *device_api.Client {
@@ -70,10 +122,18 @@ func (up *Uplink) getJobName() string {
 	return up.jobName
 }
 
+// JobProgress returns the last reported progress of the current job, in percent.
+func (up *Uplink) JobProgress() float64 {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.jobProgress
+}
+
 func (up *Uplink) SetJobName(jobName string) {
 	up.mu.Lock()
 	defer up.mu.Unlock()
 	up.jobName = jobName
+	up.jobProgress = 0
 }
 
 func (up *Uplink) Run() {
@@ -81,6 +141,7 @@ func (up *Uplink) Run() {
 	go up.runKeepAlive()
 	go up.runFlushLogs(time.Second)
 	for {
+		up.wd.Beat("uplink")
 		if up.getClient() != nil {
 			up.setClientAndDeviceName(nil, "")
 			// Avoid immediate reconnects.
@@ -90,47 +151,126 @@ func (up *Uplink) Run() {
 		var conn device_api.Conn
 		var err error
 		for {
-			conn, err = device_api.ConnectWS(up.apiServerAddr)
+			conn, err = up.connectWS()
 			if err == nil {
 				break
 			}
 			log.Printf("Failed to connect to the API server: %v. Will try again in a minute.", err)
-			time.Sleep(time.Minute)
+			up.wd.Sleep("uplink", time.Minute)
 		}
 		log.Printf("Connected to %s", up.apiServerAddr)
 		client := device_api.NewClient(conn, up.nd)
-		firstRun, err := isFirstRun()
-		if err != nil {
-			log.Fatalf("isFirstRun: %v", err)
-		}
-		if firstRun {
-			userCookie, err := readUserCookie()
-			if err != nil {
-				log.Fatalf("Unable to read user cookie: %v", err)
-			}
-			deviceCookie, err := client.RegisterDevice(userCookie)
-			if err != nil {
-				log.Fatalf("Failed to register the current device: %v", err)
-			}
-			if err := saveDeviceCookie(deviceCookie); err != nil {
-				log.Fatalf("Failed to save device.json: %v", err)
-			}
+		deviceName, err := up.handshakeWithRetries(client)
+		if _, ok := err.(*unrecoverableError); ok {
+			log.Fatalf("%v", err)
 		}
-		deviceCookie, err := readDeviceCookie()
 		if err != nil {
-			log.Fatalf("Failed to read device.json: %v", err)
-		}
-		deviceName, err := client.Hello(deviceCookie, up.getJobName())
-		if err != nil {
-			log.Fatalf("Hello: %v", err)
+			up.logf("Handshake with the API server failed: %v. Will reconnect in %v.", err, up.maxBackoff)
+			// The client stops with its connection, so nothing is left from the failed attempt.
+			closeConn(conn)
+			up.wd.Sleep("uplink", up.maxBackoff)
+			continue
 		}
 		up.setClientAndDeviceName(client, deviceName)
 		up.PrintVersion()
-		// It will return when an underlying connection is closed.
+		// It will return when an underlying connection is closed. Meanwhile, the loop only waits, so it's not watched.
+		up.wd.Forget("uplink")
 		<-client.Stopped()
 	}
 }
 
+// closeConn closes the connection to the API server, if it can be closed.
+func closeConn(conn device_api.Conn) {
+	if c, ok := interface{}(conn).(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Failed to close the connection to the API server: %v", err)
+		}
+	}
+}
+
+// deviceClient is the part of device_api.Client used for the handshake with the API server.
+type deviceClient interface {
+	RegisterDevice(userCookie string) (deviceCookie string, err error)
+	Hello(deviceCookie, jobName string) (deviceName string, err error)
+}
+
+// isAuthError returns true, if the API server has rejected the device cookie.
+func isAuthError(err error) bool {
+	return errors.Is(err, device_api.ErrUnauthorized)
+}
+
+func (up *Uplink) registerDevice(client deviceClient) (deviceCookie string, err error) {
+	userCookie, err := readUserCookie()
+	if err != nil {
+		return "", unrecoverablef("unable to read user cookie: %v", err)
+	}
+	deviceCookie, err = client.RegisterDevice(userCookie)
+	if err != nil {
+		return "", fmt.Errorf("failed to register the current device: %v", err)
+	}
+	if err := saveDeviceCookie(deviceCookie); err != nil {
+		// Not retried: another registration would create yet another device.
+		return "", unrecoverablef("failed to save device.json: %v", err)
+	}
+	return deviceCookie, nil
+}
+
+// handshake registers the device, if it's the first run, and introduces it to the API server.
+// If the server rejects the device cookie (for example, the device was deleted), and the user cookie
+// is still available, the device is registered again.
+func (up *Uplink) handshake(client deviceClient) (deviceName string, err error) {
+	firstRun, err := isFirstRun()
+	if err != nil {
+		return "", unrecoverablef("isFirstRun: %v", err)
+	}
+	if firstRun {
+		if _, err := up.registerDevice(client); err != nil {
+			return "", err
+		}
+	}
+	deviceCookie, err := readDeviceCookie()
+	if err != nil {
+		return "", unrecoverablef("failed to read device.json: %v", err)
+	}
+	deviceName, err = client.Hello(deviceCookie, up.getJobName())
+	if err == nil {
+		return deviceName, nil
+	}
+	if !isAuthError(err) {
+		return "", fmt.Errorf("Hello: %v", err)
+	}
+	up.logf("The API server has rejected the device cookie: %v. Trying to register the device again...", err)
+	if deviceCookie, err = up.registerDevice(client); err != nil {
+		return "", err
+	}
+	deviceName, err = client.Hello(deviceCookie, up.getJobName())
+	if err != nil {
+		return "", fmt.Errorf("Hello after re-registration: %v", err)
+	}
+	return deviceName, nil
+}
+
+// handshakeWithRetries retries the handshake with exponential backoff, until it succeeds,
+// fails with an unrecoverable error or runs out of attempts.
+func (up *Uplink) handshakeWithRetries(client deviceClient) (deviceName string, err error) {
+	backoff := up.minBackoff
+	for attempt := 1; ; attempt++ {
+		deviceName, err = up.handshake(client)
+		if err == nil {
+			return deviceName, nil
+		}
+		if _, ok := err.(*unrecoverableError); ok || attempt >= maxHandshakeAttempts {
+			return "", err
+		}
+		up.logf("Handshake attempt %d failed: %v. Will try again in %v.", attempt, err, backoff)
+		up.wd.Sleep("uplink", backoff)
+		backoff *= 2
+		if backoff > up.maxBackoff {
+			backoff = up.maxBackoff
+		}
+	}
+}
+
 func (up *Uplink) PrintVersion() {
 	up.logf("RoboSLA agent version %s running on printer %s", Version, up.deviceName)
 }
@@ -200,6 +340,10 @@ func (up *Uplink) WaitForConnection() {
 	}
 }
 
+// jobCanceledComment is the comment of notify-job-done for a job canceled with the cancel command, so that
+// the UI can tell it from a failure. A canceled job is not successful.
+const jobCanceledComment = "canceled"
+
 func (up *Uplink) NotifyJobDone(jobName string, success bool, comment string) {
 	up.Notify(&device_api.UplinkMessage{
 		Type:    "notify-job-done",
@@ -210,6 +354,9 @@ func (up *Uplink) NotifyJobDone(jobName string, success bool, comment string) {
 }
 
 func (up *Uplink) NotifyJobProgress(jobName string, progress float64, elapsed, remaining time.Duration) {
+	up.mu.Lock()
+	up.jobProgress = progress
+	up.mu.Unlock()
 	up.Notify(&device_api.UplinkMessage{
 		Type:      "notify-job-progress",
 		JobName:   jobName,
@@ -228,10 +375,139 @@ func (up *Uplink) NotifyFrameIndex(jobName string, frameIndex, numFrames int) {
 	})
 }
 
-func (up *Uplink) NotifySnapshot(cameras map[string]string) {
+// CurrentCommand describes the command being executed. It's sent as JSON in the comment of notify-current-command.
+type CurrentCommand struct {
+	Index  int        `json:"index"`
+	Text   string     `json:"text"`
+	Params *CmdParams `json:"params,omitempty"`
+}
+
+func (up *Uplink) NotifyCurrentCommand(jobName string, index int, cmd *Cmd) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-current-command",
+		JobName: jobName,
+		Comment: up.bestJson(&CurrentCommand{Index: index, Text: cmd.Text, Params: cmd.Params()}),
+	})
+}
+
+// JobDump is a chunk of the parsed commands of a job. It's sent as JSON in the comment of notify-job-dump.
+type JobDump struct {
+	// Offset is the index of the first command of the chunk. Total is the number of commands in the job.
+	Offset   int             `json:"offset"`
+	Total    int             `json:"total"`
+	Commands []DumpedCommand `json:"commands"`
+}
+
+// DumpedCommand is a parsed command of a job. Host commands, like M7820 (display a frame), are run by the agent itself.
+type DumpedCommand struct {
+	Index  int        `json:"index"`
+	Text   string     `json:"text"`
+	Host   bool       `json:"host,omitempty"`
+	Params *CmdParams `json:"params,omitempty"`
+}
+
+func (up *Uplink) NotifyJobDump(jobName string, dump *JobDump) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-job-dump",
+		JobName: jobName,
+		Comment: up.bestJson(dump),
+	})
+}
+
+// NotifyDiag sends a diagnostic bundle, a zip archive as a data URL in the comment. See Shell.CollectDiag.
+func (up *Uplink) NotifyDiag(bundle string) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-diag",
+		Comment: bundle,
+	})
+}
+
+// RejectedCommand is a command from the server, which is not allowed by the command policy of the device.
+// It's sent as JSON in the comment of notify-command-rejected.
+type RejectedCommand struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+}
+
+func (up *Uplink) NotifyCommandRejected(cmd, reason string) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-command-rejected",
+		Comment: up.bestJson(&RejectedCommand{Command: cmd, Reason: reason}),
+	})
+}
+
+// SerialPort describes the serial connection to the device. It's sent as JSON in the comment of notify-serial-port.
+type SerialPort struct {
+	Device   string `json:"device"`
+	BaudRate int    `json:"baud_rate"`
+}
+
+func (up *Uplink) NotifySerialPort(device string, baudRate int) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-serial-port",
+		Comment: up.bestJson(&SerialPort{Device: device, BaudRate: baudRate}),
+	})
+}
+
+// ProbeResult is the position, where the probe was triggered by G38.2. It's sent as JSON in the comment of notify-probe.
+type ProbeResult struct {
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Z         float64 `json:"z"`
+	Triggered bool    `json:"triggered"`
+}
+
+func (up *Uplink) NotifyProbe(res ProbeResult) {
+	up.logf("Probe result: X%s Y%s Z%s, triggered: %v",
+		formatGcodeNumber(res.X), formatGcodeNumber(res.Y), formatGcodeNumber(res.Z), res.Triggered)
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-probe",
+		Comment: up.bestJson(&res),
+	})
+}
+
+// Temperature of a heater. Temperatures are sent as JSON in the comment of notify-temperature,
+// keyed by the heater name: T (hotend), B (bed), C (chamber), T0, T1, etc.
+type Temperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+func (up *Uplink) NotifyTemperature(temps map[string]Temperature) {
+	up.mu.Lock()
+	up.temps = temps
+	up.mu.Unlock()
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-temperature",
+		Comment: up.bestJson(temps),
+	})
+}
+
+// Temperatures returns the last reported temperatures.
+func (up *Uplink) Temperatures() map[string]Temperature {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	res := make(map[string]Temperature, len(up.temps))
+	for k, v := range up.temps {
+		res[k] = v
+	}
+	return res
+}
+
+func (up *Uplink) NotifySelfTest(success bool, results []SelfTestResult) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-selftest",
+		Success: success,
+		Comment: up.bestJson(results),
+	})
+}
+
+// NotifySnapshot sends the camera frames. pose is the pose of the robotic arm, which moves the camera, if any.
+func (up *Uplink) NotifySnapshot(cameras map[string]string, pose []float64) {
 	up.Notify(&device_api.UplinkMessage{
 		Type:    "notify-snapshot",
 		Cameras: cameras,
+		Pose:    pose,
 	})
 }
 
@@ -243,6 +519,40 @@ func (up *Uplink) NotifyMovingState(state string, pose []float64) {
 	})
 }
 
+func (up *Uplink) NotifyGPIOState(st GPIOState) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-gpio-state",
+		Comment: up.bestJson(&st),
+	})
+}
+
+// JointState has the joint angles of a robotic arm in radians, from the base to the last wrist joint.
+// It's sent as JSON in the comment of notify-joint-state.
+type JointState struct {
+	Joints []float64 `json:"joints"`
+}
+
+func (up *Uplink) NotifyJointState(joints []float64) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-joint-state",
+		Comment: up.bestJson(&JointState{Joints: joints}),
+	})
+}
+
+// SafetyState is the safety status of a robotic arm, like "protective stop". It's sent as JSON
+// in the comment of notify-safety-status.
+type SafetyState struct {
+	Status string `json:"status"`
+	Safe   bool   `json:"safe"`
+}
+
+func (up *Uplink) NotifySafetyStatus(st SafetyState) {
+	up.Notify(&device_api.UplinkMessage{
+		Type:    "notify-safety-status",
+		Comment: up.bestJson(&st),
+	})
+}
+
 func (up *Uplink) NotifyGripperState(state string) {
 	up.Notify(&device_api.UplinkMessage{
 		Type:         "notify-gripper-state",
@@ -261,10 +571,41 @@ func (up *Uplink) logf(format string, args ...interface{}) {
 	if len(up.pendingLogs) == 0 {
 		up.pendingLogsStart = time.Now()
 	}
-	up.pendingLogs = append(up.pendingLogs, fmt.Sprintf(format, args...))
+	line := fmt.Sprintf(format, args...)
+	up.pendingLogs = append(up.pendingLogs, line)
+	if up.recentLogs = append(up.recentLogs, line); len(up.recentLogs) > maxRecentLogs {
+		up.recentLogs = up.recentLogs[len(up.recentLogs)-maxRecentLogs:]
+	}
+	for _, tap := range up.logTaps {
+		tap(line)
+	}
 	logf(format, args...)
 }
 
+// RecentLogs returns up to maxRecentLogs last log lines, oldest first.
+func (up *Uplink) RecentLogs() []string {
+	up.pendingLogsMu.Lock()
+	defer up.pendingLogsMu.Unlock()
+	return append([]string(nil), up.recentLogs...)
+}
+
+// addLogTap calls tap for every log line, until remove is called. tap must not block.
+func (up *Uplink) addLogTap(tap func(line string)) (remove func()) {
+	up.pendingLogsMu.Lock()
+	defer up.pendingLogsMu.Unlock()
+	if up.logTaps == nil {
+		up.logTaps = make(map[int]func(line string))
+	}
+	id := up.nextTapID
+	up.nextTapID++
+	up.logTaps[id] = tap
+	return func() {
+		up.pendingLogsMu.Lock()
+		defer up.pendingLogsMu.Unlock()
+		delete(up.logTaps, id)
+	}
+}
+
 func (up *Uplink) runFlushLogs(delay time.Duration) {
 	for {
 		time.Sleep(delay)
@@ -292,13 +633,20 @@ func (up *Uplink) flushLogs(delay time.Duration) {
 	up.pendingLogs = nil
 }
 
+// Fatalf logs the error and exits. If the uplink is connected, it waits for the error to be sent to the server.
+// Otherwise, the error is only printed locally, and it exits right away.
 func (up *Uplink) Fatalf(format string, args ...interface{}) {
-	// Allow robosla agent to setup (useful for the Fatalf calls happening in the very beginning of the program)
-	time.Sleep(5 * time.Second)
+	connected := up.getClient() != nil
+	if connected {
+		// Allow robosla agent to send what's pending.
+		time.Sleep(up.fatalDelay)
+	}
 	up.logf("FATAL: "+format, args...)
-	// Allow uplink to write to websocket.
-	time.Sleep(5 * time.Second)
-	os.Exit(1)
+	if connected {
+		// Allow uplink to write to websocket.
+		time.Sleep(up.fatalDelay)
+	}
+	up.exit(1)
 }
 
 func (up *Uplink) bestJson(v interface{}) string {
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+// fakeDeviceClient only accepts device cookies it has issued itself.
+// The first failRegister registrations fail with a transient error.
+type fakeDeviceClient struct {
+	issued       string
+	numRegister  int
+	failRegister int
+}
+
+func (c *fakeDeviceClient) RegisterDevice(userCookie string) (string, error) {
+	if c.failRegister > 0 {
+		c.failRegister--
+		return "", errors.New("503 Service Unavailable")
+	}
+	if userCookie != "user" {
+		return "", errors.New("unauthorized")
+	}
+	c.numRegister++
+	c.issued = "fresh-device"
+	return c.issued, nil
+}
+
+func (c *fakeDeviceClient) Hello(deviceCookie, jobName string) (string, error) {
+	if deviceCookie != c.issued {
+		return "", fmt.Errorf("hello: %w", device_api.ErrUnauthorized)
+	}
+	return "test-device", nil
+}
+
+func writeTestUserCookie(t *testing.T, dir string) {
+	if err := ioutil.WriteFile(path.Join(dir, "user.json"), []byte(`{"cookie": "user"}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestHandshakeReregistersRejectedDevice(t *testing.T) {
+	dir := setTestConfigDir(t)
+	writeTestUserCookie(t, dir)
+	if err := saveDeviceCookie("deleted-device"); err != nil {
+		t.Fatalf("saveDeviceCookie: %v", err)
+	}
+	up, _ := newTestUplink()
+	client := new(fakeDeviceClient)
+	deviceName, err := up.handshake(client)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if deviceName != "test-device" {
+		t.Errorf("handshake: want device name test-device, got %q", deviceName)
+	}
+	if client.numRegister != 1 {
+		t.Errorf("want the device to be registered once, got %d registrations", client.numRegister)
+	}
+	if cookie, err := readDeviceCookie(); err != nil || cookie != "fresh-device" {
+		t.Errorf("readDeviceCookie: want the fresh cookie, got %q, err: %v", cookie, err)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	if !isAuthError(fmt.Errorf("hello: %w", device_api.ErrUnauthorized)) {
+		t.Errorf("isAuthError: want true for a wrapped ErrUnauthorized")
+	}
+	// Only the typed error counts, not a message, which happens to look like one.
+	if isAuthError(errors.New("proxy: permission denied")) {
+		t.Errorf("isAuthError: want false for an unrelated error")
+	}
+}
+
+func TestHandshakeRetriesTransientErrors(t *testing.T) {
+	writeTestUserCookie(t, setTestConfigDir(t))
+	up, _ := newTestUplink()
+	up.minBackoff = time.Millisecond
+	up.maxBackoff = time.Millisecond
+	client := &fakeDeviceClient{failRegister: 2}
+	deviceName, err := up.handshakeWithRetries(client)
+	if err != nil {
+		t.Fatalf("handshakeWithRetries: %v", err)
+	}
+	if deviceName != "test-device" {
+		t.Errorf("handshakeWithRetries: want device name test-device, got %q", deviceName)
+	}
+}
+
+func TestHandshakeMissingUserCookieIsUnrecoverable(t *testing.T) {
+	setTestConfigDir(t)
+	up, _ := newTestUplink()
+	up.minBackoff = time.Millisecond
+	up.maxBackoff = time.Millisecond
+	client := new(fakeDeviceClient)
+	_, err := up.handshakeWithRetries(client)
+	if _, ok := err.(*unrecoverableError); !ok {
+		t.Fatalf("handshakeWithRetries: want an unrecoverable error, got: %v", err)
+	}
+	if client.numRegister != 0 {
+		t.Errorf("want no registrations, got %d", client.numRegister)
+	}
+}
+
+func TestFatalfNotConnected(t *testing.T) {
+	up, _ := newTestUplink()
+	code := -1
+	up.exit = func(c int) { code = c }
+
+	start := time.Now()
+	up.Fatalf("can't start: %s", "no printer")
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Errorf("Fatalf took %v without a connected client, want it to exit promptly", elapsed)
+	}
+	if code != 1 {
+		t.Errorf("want exit code 1, got %d", code)
+	}
+}
+
+func TestFatalfConnected(t *testing.T) {
+	up, _ := newTestUplink()
+	up.setClientAndDeviceName(&device_api.Client{}, "test-device")
+	up.fatalDelay = 50 * time.Millisecond
+	exited := false
+	up.exit = func(c int) { exited = true }
+
+	start := time.Now()
+	up.Fatalf("lost the printer")
+	if elapsed := time.Now().Sub(start); elapsed < 2*up.fatalDelay {
+		t.Errorf("Fatalf took %v with a connected client, want at least %v to send the error", elapsed, 2*up.fatalDelay)
+	}
+	if !exited {
+		t.Errorf("Fatalf has not exited")
+	}
+}
+
+type fakeConn struct {
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCloseConn(t *testing.T) {
+	conn := &fakeConn{}
+	closeConn(conn)
+	if !conn.closed {
+		t.Errorf("closeConn: the connection is not closed")
+	}
+	// Connections, which can't be closed, are left alone.
+	closeConn(struct{}{})
+}
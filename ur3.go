@@ -2,22 +2,40 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robodone/robosla-agent/pkg/ur"
 )
 
+// SafetyStopError is returned by UR3Downlink.WriteAndWaitForOK, while the robot is stopped by its safety system.
+type SafetyStopError struct {
+	Status ur.SafetyStatus
+}
+
+func (e *SafetyStopError) Error() string {
+	return fmt.Sprintf("the robot is in %s (safety_status_bits: %#x). Commands are refused until it's cleared on the teach pendant", e.Status, uint32(e.Status))
+}
+
 type UR3Downlink struct {
 	up                   *Uplink
 	host                 string
 	port                 int
 	rtdePort             int
+	rtdeOutputs          []string // See -ur3_rtde_outputs for what's required.
+	moveStartTimeout     time.Duration
 	onMovingStateChanged func(state string, pose []float64)
 	reqCh                chan *DFAMsg
 	conn                 io.ReadWriteCloser
@@ -25,6 +43,135 @@ type UR3Downlink struct {
 	pendingOKAck         chan<- bool
 	// These are pending writes which we have not yet processed at all.
 	pendingWrites []*DFAMsg
+	// moveMu serializes moves: the next move is sent only after the previous one is complete, unless it's blended.
+	moveMu sync.Mutex
+
+	// posePath is the file, where the latest pose is saved every poseSaveInterval. Optional.
+	// After a restart, it tells where the arm was, see PreRestartPose.
+	posePath         string
+	poseSaveInterval time.Duration
+
+	// stateMu guards the latest data received over RTDE. It's written by readFromRTDE and read by the status endpoint,
+	// snapshots and WriteAndWaitForOK.
+	stateMu sync.Mutex
+	// safety is the last safety status reported over RTDE. Zero means it's not known yet.
+	safety ur.SafetyStatus
+	// latest has the values of the last data package, see ur.ParseDataPackage. The map is replaced, never modified.
+	latest   map[string][]float64
+	latestAt time.Time
+	// motion is the last moving state: idle, slow or moving. It's empty, while there's no RTDE data.
+	// movesStarted counts the transitions from idle to slow or moving. motionChanged is closed on every change.
+	motion        string
+	movesStarted  int
+	motionChanged chan bool
+	// preRestartPose is the pose saved before the restart. See PreRestartPose.
+	preRestartPose *SavedPose
+}
+
+// URScript commands are fire-and-forget, so a move is considered complete, when the robot stops.
+// If it does not start moving for defaultMoveStartTimeout, it's assumed to be at the target already.
+const defaultMoveStartTimeout = 2 * time.Second
+
+// The acceleration and the velocity of the moves made with the arm-move and arm-jog commands: rad/s^2 and rad/s
+// for movej, m/s^2 and m/s for movel. Slow enough to stop the arm by hand.
+const (
+	defaultArmAccel = 0.1
+	defaultArmVel   = 0.01
+)
+
+// The latest pose is saved not more often than that. See posePath.
+const defaultPoseSaveInterval = 5 * time.Second
+
+// SavedPose is the pose of the arm saved to survive restarts.
+type SavedPose struct {
+	Pose []float64 `json:"pose"`
+	Time time.Time `json:"time"`
+}
+
+func getUR3PosePath() string {
+	return path.Join(getConfigDir(), "ur3-pose.json")
+}
+
+// loadPreRestartPose loads the pose saved before the restart. See PreRestartPose.
+func (dl *UR3Downlink) loadPreRestartPose() {
+	if dl.posePath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(dl.posePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		dl.up.logf("Failed to read the pose saved before the restart: %v", err)
+		return
+	}
+	saved := new(SavedPose)
+	if err := json.Unmarshal(data, saved); err != nil || len(saved.Pose) != 6 {
+		dl.up.logf("Invalid pose saved before the restart in %s: %v", dl.posePath, err)
+		return
+	}
+	dl.up.logf("The last known pose before the restart: %v at %v", saved.Pose, saved.Time)
+	dl.stateMu.Lock()
+	dl.preRestartPose = saved
+	dl.stateMu.Unlock()
+}
+
+// PreRestartPose returns the last pose saved before the agent has restarted. ok is false, if there's none.
+// It's not updated, so it's not necessarily the current pose.
+func (dl *UR3Downlink) PreRestartPose() (saved *SavedPose, ok bool) {
+	dl.stateMu.Lock()
+	defer dl.stateMu.Unlock()
+	return dl.preRestartPose, dl.preRestartPose != nil
+}
+
+func (dl *UR3Downlink) savePose(pose []float64, updated time.Time) {
+	data, err := json.Marshal(&SavedPose{Pose: pose, Time: updated})
+	if err == nil {
+		err = os.MkdirAll(path.Dir(dl.posePath), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(dl.posePath, data, 0644, nil)
+	}
+	if err != nil {
+		dl.up.logf("Failed to save the pose of the arm: %v", err)
+	}
+}
+
+// After arm-home, every joint must be that close to the home, in radians.
+const armHomeTolerance = 0.01
+
+// parseArmHome parses the comma-separated joint angles of the home in radians. See -ur3_home.
+func parseArmHome(str string) ([]float64, error) {
+	if strings.TrimSpace(str) == "" {
+		return nil, nil
+	}
+	var res []float64
+	for _, tok := range strings.Split(str, ",") {
+		val, err := strconv.ParseFloat(strings.TrimSpace(tok), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid joint angle %q: %v", tok, err)
+		}
+		res = append(res, val)
+	}
+	if len(res) != 6 {
+		return nil, fmt.Errorf("want 6 joint angles, got %d", len(res))
+	}
+	return res, nil
+}
+
+// poseReporter is implemented by downlinks which know the pose of a robotic arm.
+type poseReporter interface {
+	Pose() (pose []float64, ok bool)
+}
+
+// preRestartPoseReporter is implemented by downlinks which know the pose of a robotic arm before the agent has restarted.
+type preRestartPoseReporter interface {
+	PreRestartPose() (saved *SavedPose, ok bool)
+}
+
+// jointReporter is implemented by downlinks which know the joint angles of a robotic arm.
+type jointReporter interface {
+	Joints() (joints []float64, ok bool)
 }
 
 func NewUR3Downlink(up *Uplink, host string, port, rtdePort int, onMovingStateChanged func(state string, pose []float64)) *UR3Downlink {
@@ -36,8 +183,12 @@ func NewUR3Downlink(up *Uplink, host string, port, rtdePort int, onMovingStateCh
 		host:                 host,
 		port:                 port,
 		rtdePort:             rtdePort,
+		rtdeOutputs:          strings.Split(ur.DefaultOutputs, ","),
+		moveStartTimeout:     defaultMoveStartTimeout,
+		poseSaveInterval:     defaultPoseSaveInterval,
 		onMovingStateChanged: onMovingStateChanged,
 		reqCh:                make(chan *DFAMsg),
+		motionChanged:        make(chan bool),
 	}
 }
 
@@ -61,6 +212,15 @@ func (dl *UR3Downlink) WaitForConnection(wait time.Duration) bool {
 }
 
 func (dl *UR3Downlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	if st := dl.SafetyStatus(); st != 0 && !st.Safe() {
+		return &SafetyStopError{Status: st}
+	}
+	move := isURMove(cmd)
+	if move {
+		dl.moveMu.Lock()
+		defer dl.moveMu.Unlock()
+	}
+	started := dl.movesSeen()
 	respCh := make(chan bool, 1)
 	dl.reqCh <- &DFAMsg{Type: MsgWriteAndWaitForOK, Cmd: cmd, RespCh: respCh}
 	select {
@@ -68,17 +228,161 @@ func (dl *UR3Downlink) WriteAndWaitForOK(ctx context.Context, cmd string) error
 		if !ok {
 			return errors.New("OK not received")
 		}
+		if move && !isURBlended(cmd) {
+			return dl.waitForMove(ctx, started)
+		}
 		return nil
 	case <-ctx.Done():
 		return context.Canceled
 	}
 }
 
+// isURMove returns true for URScript move commands, like movel(...).
+func isURMove(cmd string) bool {
+	cmd = strings.TrimSpace(cmd)
+	for _, fn := range []string{"movej(", "movel(", "movep(", "movec("} {
+		if strings.HasPrefix(cmd, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+var urBlendRadiusRE = regexp.MustCompile(`\br\s*=\s*([0-9.eE+-]+)`)
+
+// isURBlended returns true for the moves with a blend radius, like movel(p[...], r=0.01). The next move must be sent
+// before they are complete, so that the robot blends them instead of stopping in between.
+func isURBlended(cmd string) bool {
+	m := urBlendRadiusRE.FindStringSubmatch(cmd)
+	if m == nil {
+		return false
+	}
+	r, err := strconv.ParseFloat(m[1], 64)
+	return err == nil && r > 0
+}
+
+// movesSeen returns the number of the moves started so far. If the robot is still moving, like after a blended move,
+// the current motion is not counted: the next move continues it instead of starting a new one, so it's complete,
+// when the robot stops.
+func (dl *UR3Downlink) movesSeen() int {
+	dl.stateMu.Lock()
+	defer dl.stateMu.Unlock()
+	if dl.motion != "" && dl.motion != "idle" {
+		return dl.movesStarted - 1
+	}
+	return dl.movesStarted
+}
+
+func (dl *UR3Downlink) setMotion(state string) {
+	dl.stateMu.Lock()
+	defer dl.stateMu.Unlock()
+	if state == dl.motion {
+		return
+	}
+	if state != "" && state != "idle" && (dl.motion == "" || dl.motion == "idle") {
+		dl.movesStarted++
+	}
+	dl.motion = state
+	close(dl.motionChanged)
+	dl.motionChanged = make(chan bool)
+}
+
+// waitForMove waits, until the robot starts moving after started moves and stops again.
+// If it does not start moving for moveStartTimeout, the move is considered complete.
+func (dl *UR3Downlink) waitForMove(ctx context.Context, started int) error {
+	startTimeout := time.After(dl.moveStartTimeout)
+	for {
+		dl.stateMu.Lock()
+		motion, n, changed := dl.motion, dl.movesStarted, dl.motionChanged
+		dl.stateMu.Unlock()
+		if motion == "" {
+			return errors.New("no RTDE data, so the completion of the move is unknown")
+		}
+		if n > started && motion == "idle" {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-startTimeout:
+			if n == started {
+				dl.up.logf("UR3 has not started moving in %v. Already at the target?", dl.moveStartTimeout)
+				return nil
+			}
+		case <-ctx.Done():
+			return context.Canceled
+		}
+	}
+}
+
+// SafetyStatus returns the last safety status of the robot or zero, if it's not known yet.
+func (dl *UR3Downlink) SafetyStatus() ur.SafetyStatus {
+	dl.stateMu.Lock()
+	defer dl.stateMu.Unlock()
+	return dl.safety
+}
+
+func (dl *UR3Downlink) setSafetyStatus(st ur.SafetyStatus) {
+	dl.stateMu.Lock()
+	dl.safety = st
+	dl.stateMu.Unlock()
+}
+
+// Latest returns a copy of the values of the last RTDE data package and the time it was received.
+// It's safe to call from any goroutine.
+func (dl *UR3Downlink) Latest() (values map[string][]float64, updated time.Time) {
+	dl.stateMu.Lock()
+	defer dl.stateMu.Unlock()
+	if dl.latest == nil {
+		return nil, time.Time{}
+	}
+	values = make(map[string][]float64, len(dl.latest))
+	for name, val := range dl.latest {
+		values[name] = append([]float64(nil), val...)
+	}
+	return values, dl.latestAt
+}
+
+// Pose returns the last TCP pose: x, y, z in meters and the rotation vector in radians.
+// ok is false, if no pose has been received yet.
+func (dl *UR3Downlink) Pose() (pose []float64, ok bool) {
+	values, _ := dl.Latest()
+	pose, ok = values["actual_TCP_pose"]
+	return
+}
+
+// Joints returns the last joint angles in radians. ok is false, if actual_q is not in the RTDE outputs
+// or no data has been received yet.
+func (dl *UR3Downlink) Joints() (joints []float64, ok bool) {
+	values, _ := dl.Latest()
+	joints, ok = values["actual_q"]
+	return
+}
+
+func (dl *UR3Downlink) setLatest(values map[string][]float64, updated time.Time) {
+	dl.stateMu.Lock()
+	dl.latest = values
+	dl.latestAt = updated
+	dl.stateMu.Unlock()
+}
+
+func (dl *UR3Downlink) Disconnect() error {
+	return errors.New("disconnecting UR3 is not supported yet. Use reconnect")
+}
+
+func (dl *UR3Downlink) Reconnect() error {
+	dl.reqCh <- &DFAMsg{Type: MsgReconnect}
+	return nil
+}
+
 func (dl *UR3Downlink) Run() (err error) {
 	defer func() {
 		dl.up.logf("UR3Downlink.Run failed, err: %v", err)
 	}()
-	st := Disconnected
+	dl.loadPreRestartPose()
+	return dl.run(Disconnected)
+}
+
+func (dl *UR3Downlink) run(st State) error {
 	for {
 		switch st {
 		case Disconnected:
@@ -116,6 +420,7 @@ func (dl *UR3Downlink) connect() {
 		dl.rtdeConn.Close()
 		dl.rtdeConn = nil
 	}
+	dl.setSafetyStatus(0)
 
 	first := true
 	for {
@@ -132,7 +437,7 @@ func (dl *UR3Downlink) connect() {
 			continue
 		}
 		dl.up.logf("Opened URScript robot connection to %s:%d.", dl.host, dl.port)
-		rtdeConn, err := ur.ConnectRTDE(dl.host, dl.rtdePort, "actual_TCP_speed")
+		rtdeConn, err := ur.ConnectRTDE(dl.host, dl.rtdePort, dl.rtdeOutputs)
 		if err != nil {
 			conn.Close()
 			dl.up.logf("Could not open RTDE connection to UR3 at %s:%d. Error: %v", dl.host, dl.rtdePort, err)
@@ -146,6 +451,18 @@ func (dl *UR3Downlink) connect() {
 	}
 }
 
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func l2(vec []float64) float64 {
 	var sum2 float64
 	for _, v := range vec {
@@ -156,18 +473,44 @@ func l2(vec []float64) float64 {
 
 func (dl *UR3Downlink) readFromRTDE(conn net.Conn) {
 	prevState := "unknown"
-	var lastPoseSent time.Time
+	var prevSafety ur.SafetyStatus
+	var lastPoseSent, lastPoseSaved time.Time
+	var savedPose []float64
 	for {
 		// Read incoming packages, decode them and generate events we are interested in.
 		typ, body, err := ur.ReceiveRTDEPacket(conn)
 		if err != nil {
 			// TODO(krasin): make sure we see this disconnect and act on it.
 			dl.up.logf("UR3Downlink.readFromRTDE, read error: %v", err)
+			dl.setMotion("")
 			return
 		}
 		if typ == ur.RTDE_DATA_PACKAGE {
-			// actual_TCP_speed
-			vec := ur.ParseVector6D(body[1:49])
+			values, err := ur.ParseDataPackage(body, dl.rtdeOutputs)
+			if err != nil {
+				dl.up.logf("UR3Downlink.readFromRTDE: %v", err)
+				continue
+			}
+			now := time.Now()
+			dl.setLatest(values, now)
+			if pose := values["actual_TCP_pose"]; dl.posePath != "" && now.Sub(lastPoseSaved) >= dl.poseSaveInterval && !equalFloats(pose, savedPose) {
+				lastPoseSaved, savedPose = now, pose
+				// Avoid blocking the real-time thread.
+				go dl.savePose(pose, now)
+			}
+			if bits, ok := values["safety_status_bits"]; ok {
+				if st := ur.SafetyStatus(bits[0]); st != prevSafety {
+					dl.setSafetyStatus(st)
+					if !st.Safe() {
+						dl.up.logf("UR3 is in %s (safety_status_bits: %#x). Refusing all commands until it's cleared.", st, uint32(st))
+					} else if prevSafety != 0 && !prevSafety.Safe() {
+						dl.up.logf("UR3 %s is cleared, now in %s", prevSafety, st)
+					}
+					go dl.up.NotifySafetyStatus(SafetyState{Status: st.String(), Safe: st.Safe()})
+					prevSafety = st
+				}
+			}
+			vec := values["actual_TCP_speed"]
 			linSpeed := l2(vec[:3])
 			rotSpeed := l2(vec[3:])
 			// Constants for regular moves
@@ -193,13 +536,15 @@ func (dl *UR3Downlink) readFromRTDE(conn net.Conn) {
 			default:
 				state = "moving"
 			}
-			// actual_TCP_pose
-			pose := ur.ParseVector6D(body[49:97])
-			now := time.Now()
+			dl.setMotion(state)
+			pose := values["actual_TCP_pose"]
 			if state != prevState || now.Sub(lastPoseSent) > time.Second {
 				lastPoseSent = now
 				// Avoid blocking the real-time thread.
 				go dl.onMovingStateChanged(state, pose)
+				if joints, ok := values["actual_q"]; ok {
+					go dl.up.NotifyJointState(joints)
+				}
 			}
 			prevState = state
 		}
@@ -218,6 +563,8 @@ func (dl *UR3Downlink) handleConnecting() State {
 			msg.RespCh <- false
 		case MsgDisconnected:
 			dl.up.Fatalf("handleConnecting: received MsgDisconnected. Inconceivable!")
+		case MsgReconnect:
+			// We are connecting anyway.
 		//case MsgOK:
 		//	dl.up.Fatalf("handleConnecting: received MsgOK. Inconceivable!")
 		case MsgWriteAndWaitForOK:
@@ -293,6 +640,10 @@ func (dl *UR3Downlink) handleNormal() State {
 		case MsgDisconnected:
 			dl.up.logf("handleNormal: received MsgDisconnected")
 			return Disconnected
+		case MsgReconnect:
+			// Closing the connection makes readFromDevice to exit and send MsgDisconnected.
+			dl.up.logf("handleNormal: dropping the connection by request")
+			dl.conn.Close()
 		case MsgOK:
 			dl.up.logf("handleNormal: received MsgOK. Could be a leftover since previous connection. Ignore (mildly dangerous)")
 		case MsgWriteAndWaitForOK:
@@ -346,6 +697,9 @@ func (dl *UR3Downlink) handleWaitingForOK() State {
 			dl.pendingOKAck = nil
 			// We need to wait until our write is complete (most likely, as a failed one)
 			return WaitingForWritten
+		case MsgReconnect:
+			dl.up.logf("handleWaitingForOK: dropping the connection by request")
+			dl.conn.Close()
 		case MsgWriteAndWaitForOK:
 			// It's expected that new commands could arrive while we wait for OK. Adding them to the |pendingWrites| queue.
 			dl.pendingWrites = append(dl.pendingWrites, msg)
@@ -383,6 +737,8 @@ func (dl *UR3Downlink) handleWaitingForWritten() State {
 			msg.RespCh <- false
 		case MsgDisconnected:
 			dl.up.Fatalf("handleWaitingForWritten: MsgDisconnected received. Inconceivable!")
+		case MsgReconnect:
+			// We are disconnected anyway.
 		case MsgOK:
 			dl.up.Fatalf("handleWaitingForWritten: MsgOK received. Inconceivable!")
 		case MsgWriteAndWaitForOK:
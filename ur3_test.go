@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-agent/pkg/ur"
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+// writeRTDEDataPackage writes RTDE_DATA_PACKAGE with the given VECTOR6D ([]float64) and UINT32 values.
+func writeRTDEDataPackage(t *testing.T, conn net.Conn, values ...interface{}) {
+	body := []byte{1} // recipe id
+	for _, val := range values {
+		switch val := val.(type) {
+		case []float64:
+			for _, v := range val {
+				var buf [8]byte
+				binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+				body = append(body, buf[:]...)
+			}
+		case uint32:
+			var buf [4]byte
+			binary.BigEndian.PutUint32(buf[:], val)
+			body = append(body, buf[:]...)
+		default:
+			t.Fatalf("unsupported RTDE value type %T", val)
+		}
+	}
+	size := len(body) + 3
+	if _, err := conn.Write(append([]byte{byte(size >> 8), byte(size), byte(ur.RTDE_DATA_PACKAGE)}, body...)); err != nil {
+		t.Fatalf("failed to write the data package: %v", err)
+	}
+}
+
+// waitForNotify waits for the notifications, which are sent asynchronously to not block the real-time thread.
+func waitForNotify(rec *notifyRecorder, typ string) []*device_api.UplinkMessage {
+	msgs := rec.ByType(typ)
+	for deadline := time.Now().Add(5 * time.Second); len(msgs) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		msgs = rec.ByType(typ)
+	}
+	return msgs
+}
+
+func TestUR3DownlinkJointState(t *testing.T) {
+	up, rec := newTestUplink()
+	dl := NewUR3Downlink(up, "", 0, 0, nil)
+	dl.rtdeOutputs = []string{"actual_TCP_speed", "actual_TCP_pose", "actual_q"}
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		dl.readFromRTDE(client)
+		close(done)
+	}()
+
+	speed := []float64{0, 0, 0, 0, 0, 0}
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	q := []float64{0, -1.57, 1.57, -1.57, -1.57, 0.5}
+	writeRTDEDataPackage(t, server, speed, pose, q)
+	server.Close()
+	<-done
+
+	msgs := waitForNotify(rec, "notify-joint-state")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-joint-state message, got %d", len(msgs))
+	}
+	var js JointState
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &js); err != nil {
+		t.Fatalf("failed to parse the joint state: %v", err)
+	}
+	if len(js.Joints) != len(q) {
+		t.Fatalf("want %d joints, got %v", len(q), js.Joints)
+	}
+	for i := range q {
+		if js.Joints[i] != q[i] {
+			t.Errorf("joint %d: want %v, got %v", i, q[i], js.Joints[i])
+		}
+	}
+}
+
+func TestUR3DownlinkProtectiveStop(t *testing.T) {
+	up, rec := newTestUplink()
+	dl := NewUR3Downlink(up, "", 0, 0, nil)
+	dl.rtdeOutputs = []string{"actual_TCP_speed", "actual_TCP_pose", "safety_status_bits"}
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		dl.readFromRTDE(client)
+		close(done)
+	}()
+
+	speed := []float64{0, 0, 0, 0, 0, 0}
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	writeRTDEDataPackage(t, server, speed, pose, uint32(ur.SafetyNormalMode|ur.SafetyProtectiveStopped))
+	server.Close()
+	<-done
+
+	// The DFA is not running, so the command would block, if it was not rejected right away.
+	err := dl.WriteAndWaitForOK(context.Background(), "movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05)")
+	if _, ok := err.(*SafetyStopError); !ok || !strings.Contains(err.Error(), "protective stop") {
+		t.Errorf("WriteAndWaitForOK: want a protective stop error, got %v", err)
+	}
+	msgs := waitForNotify(rec, "notify-safety-status")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 notify-safety-status message, got %d", len(msgs))
+	}
+	var st SafetyState
+	if err := json.Unmarshal([]byte(msgs[0].Comment), &st); err != nil {
+		t.Fatalf("failed to parse the safety state: %v", err)
+	}
+	if st.Safe || st.Status != "protective stop" {
+		t.Errorf("want an unsafe protective stop, got %+v", st)
+	}
+}
+
+func TestSafetyStatus(t *testing.T) {
+	for _, tc := range []struct {
+		st   ur.SafetyStatus
+		safe bool
+		str  string
+	}{
+		{ur.SafetyNormalMode, true, "normal mode"},
+		{ur.SafetyReducedMode, true, "reduced mode"},
+		{ur.SafetyNormalMode | ur.SafetyProtectiveStopped, false, "protective stop"},
+		{ur.SafetyNormalMode | ur.SafetyRobotEmergencyStopped | ur.SafetyEmergencyStopped, false, "emergency stop"},
+		{ur.SafetyRecoveryMode, false, "recovery mode"},
+		{0, false, "unknown"},
+	} {
+		if got := tc.st.Safe(); got != tc.safe {
+			t.Errorf("%#x.Safe(): want %v, got %v", uint32(tc.st), tc.safe, got)
+		}
+		if got := tc.st.String(); got != tc.str {
+			t.Errorf("%#x.String(): want %q, got %q", uint32(tc.st), tc.str, got)
+		}
+	}
+}
+
+func TestUR3DownlinkConcurrentReaders(t *testing.T) {
+	up, _ := newTestUplink()
+	dl := NewUR3Downlink(up, "", 0, 0, nil)
+	dl.rtdeOutputs = []string{"actual_TCP_speed", "actual_TCP_pose"}
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		dl.readFromRTDE(client)
+		close(done)
+	}()
+
+	// Two readers, like the status endpoint and snapshots, poll the pose while it's updated.
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if pose, ok := dl.Pose(); ok {
+					// A pose is never torn: x, y and z are updated together.
+					if pose[0] != pose[1] || pose[1] != pose[2] {
+						t.Errorf("inconsistent pose: %v", pose)
+						return
+					}
+					// Modifying the returned pose must not affect other readers.
+					pose[0] = -1
+				}
+			}
+		}()
+	}
+	speed := []float64{0, 0, 0, 0, 0, 0}
+	for i := 1; i <= 20; i++ {
+		v := float64(i) / 100
+		writeRTDEDataPackage(t, server, speed, []float64{v, v, v, 0, 3.14, 0})
+	}
+	server.Close()
+	<-done
+	close(stop)
+	wg.Wait()
+
+	if pose, ok := dl.Pose(); !ok || pose[0] != 0.2 {
+		t.Errorf("Pose: want the latest pose with x = 0.2, got %v, %v", pose, ok)
+	}
+	if _, updated := dl.Latest(); updated.IsZero() {
+		t.Errorf("Latest: the time of the update is not set")
+	}
+}
+
+// newTestUR3Downlink returns a connected UR3 downlink. The RTDE data packages with the given outputs
+// are written to server. The URScript commands are written to conn.
+func newTestUR3Downlink(t *testing.T, outputs ...string) (dl *UR3Downlink, server net.Conn, conn *fakeSerial) {
+	up, _ := newTestUplink()
+	dl = NewUR3Downlink(up, "", 0, 0, nil)
+	dl.rtdeOutputs = outputs
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go dl.readFromRTDE(client)
+	conn = newFakeSerial()
+	dl.conn = conn
+	go dl.run(Connected)
+	return dl, server, conn
+}
+
+// waitForMotionState waits until the downlink has processed an RTDE data package, so that the moves know the motion state.
+func waitForMotionState(t *testing.T, dl *UR3Downlink) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		dl.stateMu.Lock()
+		motion := dl.motion
+		dl.stateMu.Unlock()
+		if motion != "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no motion state after the RTDE data package")
+		}
+	}
+}
+
+func TestUR3DownlinkWaitsForMove(t *testing.T) {
+	dl, server, conn := newTestUR3Downlink(t, "actual_TCP_speed", "actual_TCP_pose")
+	dl.moveStartTimeout = 200 * time.Millisecond
+
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	idle := []float64{0, 0, 0, 0, 0, 0}
+	moving := []float64{0.05, 0, 0, 0, 0, 0}
+	writeRTDEDataPackage(t, server, idle, pose)
+	waitForMotionState(t, dl)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dl.WriteAndWaitForOK(context.Background(), "movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05)")
+	}()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Longer than moveStartTimeout: once the move has started, only the stop completes it.
+	writeRTDEDataPackage(t, server, moving, pose)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		writeRTDEDataPackage(t, server, moving, pose)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("WriteAndWaitForOK has returned before the move is complete: %v", err)
+	default:
+	}
+	writeRTDEDataPackage(t, server, idle, pose)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("WriteAndWaitForOK: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteAndWaitForOK is still waiting after the robot has stopped")
+	}
+
+	// A move to the current pose never starts. It's complete after moveStartTimeout.
+	start := time.Now()
+	if err := dl.WriteAndWaitForOK(context.Background(), "movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05)"); err != nil {
+		t.Fatalf("WriteAndWaitForOK: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < dl.moveStartTimeout {
+		t.Errorf("WriteAndWaitForOK returned after %v, want at least %v", elapsed, dl.moveStartTimeout)
+	}
+	// Other commands don't wait for a move.
+	start = time.Now()
+	if err := dl.WriteAndWaitForOK(context.Background(), "set_digital_out(0, True)"); err != nil {
+		t.Fatalf("WriteAndWaitForOK: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed >= dl.moveStartTimeout {
+		t.Errorf("set_digital_out has waited for %v", elapsed)
+	}
+}
+
+func TestUR3DownlinkSerializesMoves(t *testing.T) {
+	dl, server, conn := newTestUR3Downlink(t, "actual_TCP_speed", "actual_TCP_pose")
+	dl.moveStartTimeout = 5 * time.Second
+
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	idle := []float64{0, 0, 0, 0, 0, 0}
+	moving := []float64{0.05, 0, 0, 0, 0, 0}
+	writeRTDEDataPackage(t, server, idle, pose)
+	waitForMotionState(t, dl)
+
+	// Three moves from different goroutines, like a job and a manual command.
+	errCh := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			errCh <- dl.WriteAndWaitForOK(context.Background(), fmt.Sprintf("movel(p[0.1, 0.2, 0.%d, 0, 3.14, 0], a=0.1, v=0.05)", i+4))
+		}(i)
+	}
+	for i := 1; i <= 3; i++ {
+		for len(conn.Written()) < i {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if got := len(conn.Written()); got != i {
+			t.Fatalf("want %d moves sent before the move #%d is complete, got %d: %q", i, i, got, conn.Written())
+		}
+		writeRTDEDataPackage(t, server, moving, pose)
+		writeRTDEDataPackage(t, server, idle, pose)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Errorf("WriteAndWaitForOK: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WriteAndWaitForOK is still waiting after all moves are complete")
+		}
+	}
+
+	// A blended move does not wait, so that the next move is sent while the robot is still moving.
+	if err := dl.WriteAndWaitForOK(context.Background(), "movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05, r=0.01)"); err != nil {
+		t.Fatalf("WriteAndWaitForOK: %v", err)
+	}
+	if got := len(conn.Written()); got != 4 {
+		t.Errorf("want the blended move sent, got %d writes", got)
+	}
+
+	// The next move continues the motion of the blended one without another start. It's complete, when the robot stops.
+	writeRTDEDataPackage(t, server, moving, pose)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		dl.stateMu.Lock()
+		motion := dl.motion
+		dl.stateMu.Unlock()
+		if motion != "idle" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the robot is not moving after the RTDE data package")
+		}
+	}
+	go func() {
+		errCh <- dl.WriteAndWaitForOK(context.Background(), "movel(p[0.1, 0.2, 0.5, 0, 3.14, 0], a=0.1, v=0.05)")
+	}()
+	for len(conn.Written()) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-errCh:
+		t.Fatalf("WriteAndWaitForOK has returned, while the robot is moving: %v", err)
+	default:
+	}
+	start := time.Now()
+	writeRTDEDataPackage(t, server, idle, pose)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("WriteAndWaitForOK: %v", err)
+		}
+		if elapsed := time.Now().Sub(start); elapsed >= dl.moveStartTimeout {
+			t.Errorf("WriteAndWaitForOK has waited for the start timeout instead of the stop")
+		}
+	case <-time.After(dl.moveStartTimeout / 2):
+		t.Fatalf("WriteAndWaitForOK is still waiting after the robot has stopped")
+	}
+}
+
+func TestIsURBlended(t *testing.T) {
+	for cmd, want := range map[string]bool{
+		"movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05)":          false,
+		"movel(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05, r=0)":     false,
+		"movej([0, 0, 0, 0, 0, 0], a=1.4, v=1.05, t=0, r=0.01)":       true,
+		"movep(p[0.1, 0.2, 0.4, 0, 3.14, 0], a=0.1, v=0.05, r =2e-3)": true,
+	} {
+		if got := isURBlended(cmd); got != want {
+			t.Errorf("isURBlended(%q): want %v, got %v", cmd, want, got)
+		}
+	}
+}
+
+func TestShellArmHome(t *testing.T) {
+	dl, server, conn := newTestUR3Downlink(t, "actual_TCP_speed", "actual_TCP_pose", "actual_q")
+	sh, _, _ := newTestShell()
+	sh.exe.down = dl
+	sh.armAccel, sh.armVel = 0.4, 0.3
+	sh.armHome = []float64{0, -1.57, 1.57, -1.57, -1.57, 0}
+
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	idle := []float64{0, 0, 0, 0, 0, 0}
+	moving := []float64{0.05, 0, 0, 0, 0, 0}
+	away := []float64{0.5, -1, 1, -1, -1, 0.5}
+	writeRTDEDataPackage(t, server, idle, pose, away)
+	waitForMotionState(t, dl)
+
+	done := make(chan bool, 1)
+	go func() { done <- sh.handleCommand("arm-home") }()
+	for len(conn.Written()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := conn.Written()[0], "movej([0, -1.57, 1.57, -1.57, -1.57, 0], a=0.4, v=0.3)\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	writeRTDEDataPackage(t, server, moving, pose, away)
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("arm-home has returned, while the arm is moving")
+	default:
+	}
+	writeRTDEDataPackage(t, server, idle, pose, []float64{0, -1.5701, 1.5699, -1.57, -1.57, 0})
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("arm-home failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("arm-home is still waiting after the arm has stopped")
+	}
+
+	// The arm stops somewhere else, like after hitting an obstacle.
+	go func() { done <- sh.handleCommand("arm-home") }()
+	for len(conn.Written()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	writeRTDEDataPackage(t, server, moving, pose, away)
+	writeRTDEDataPackage(t, server, idle, pose, away)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("arm-home has succeeded, although the arm is not at the home")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("arm-home is still waiting after the arm has stopped")
+	}
+}
+
+func TestParseArmHome(t *testing.T) {
+	if home, err := parseArmHome("0, -1.57, 1.57, -1.57, -1.57, 0"); err != nil || len(home) != 6 || home[1] != -1.57 {
+		t.Errorf("parseArmHome: want 6 joint angles, got %v, %v", home, err)
+	}
+	if home, err := parseArmHome(""); err != nil || home != nil {
+		t.Errorf("parseArmHome(\"\"): want no home, got %v, %v", home, err)
+	}
+	for _, str := range []string{"0,0,0", "0,0,0,0,0,x"} {
+		if _, err := parseArmHome(str); err == nil {
+			t.Errorf("parseArmHome(%q): want an error", str)
+		}
+	}
+}
+
+func TestUR3DownlinkPoseSurvivesRestart(t *testing.T) {
+	dir := withConfigDir(t)
+	dl, server, _ := newTestUR3Downlink(t, "actual_TCP_speed", "actual_TCP_pose")
+	dl.posePath = getUR3PosePath()
+	if _, ok := dl.PreRestartPose(); ok {
+		t.Errorf("PreRestartPose: want none before the first start")
+	}
+	pose := []float64{0.1, 0.2, 0.3, 0, 3.14, 0}
+	writeRTDEDataPackage(t, server, []float64{0, 0, 0, 0, 0, 0}, pose)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path.Join(dir, "ur3-pose.json")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the pose has not been saved")
+		}
+	}
+
+	// The agent restarts. No RTDE data is received yet.
+	up, _ := newTestUplink()
+	restarted := NewUR3Downlink(up, "", 0, 0, nil)
+	restarted.posePath = getUR3PosePath()
+	restarted.loadPreRestartPose()
+	go restarted.run(Connecting)
+	st := NewStatusServer(up, restarted, "test").Status()
+	if st.Pose != nil {
+		t.Errorf("Status: want no current pose, got %v", st.Pose)
+	}
+	if st.PreRestartPose == nil || !equalFloats(st.PreRestartPose.Pose, pose) || st.PreRestartPose.Time.IsZero() {
+		t.Errorf("Status: want the pre-restart pose %v, got %+v", pose, st.PreRestartPose)
+	}
+}
@@ -4,12 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 )
 
 type VirtualDownlink struct {
 	up      *Uplink
 	speedup float64
+	// If modelMoves is true, G0/G1 take as long as the distance at the current feedrate requires
+	// (scaled by speedup). Otherwise, moves complete instantly.
+	modelMoves bool
+
+	mu       sync.Mutex
+	pos      [3]float64 // X, Y, Z in mm
+	feedrate float64    // mm/min
 }
 
 func NewVirtualDownlink(up *Uplink, speedup float64) *VirtualDownlink {
@@ -20,12 +29,28 @@ func (dl *VirtualDownlink) Connected() bool { return true }
 
 func (dl *VirtualDownlink) WaitForConnection(wait time.Duration) bool { return true }
 
+func (dl *VirtualDownlink) Disconnect() error {
+	dl.up.logf("Virtual printer can't be disconnected")
+	return nil
+}
+
+func (dl *VirtualDownlink) Reconnect() error {
+	dl.up.logf("Virtual printer is reconnected")
+	return nil
+}
+
 func (dl *VirtualDownlink) WriteAndWaitForOK(ctx context.Context, line string) error {
 	dl.up.logf(">%s", line)
 	cmd, err := parseGcodeCommand("" /*baseDir*/, line)
 	if err != nil {
 		return fmt.Errorf("failed to parse gcode %q: %v", line, err)
 	}
+	if cmd.Type == "G" && (cmd.Idx == 0 || cmd.Idx == 1) {
+		if d := dl.move(cmd); d > 0 {
+			time.Sleep(d)
+		}
+		return nil
+	}
 	if cmd.Type != "G" || cmd.Idx != 4 {
 		// If it's a non-delay command, return immediately
 		return nil
@@ -38,3 +63,25 @@ func (dl *VirtualDownlink) WriteAndWaitForOK(ctx context.Context, line string) e
 	time.Sleep(time.Duration(delay) * time.Millisecond)
 	return nil
 }
+
+// move updates the virtual position and returns how long the move would take.
+// The positioning is assumed to be absolute (G90), because that's the only mode we support.
+func (dl *VirtualDownlink) move(cmd *Cmd) time.Duration {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if f, ok := cmd.Dict['F']; ok && f > 0 {
+		dl.feedrate = f
+	}
+	var dist2 float64
+	for i, axis := range []byte{'X', 'Y', 'Z'} {
+		if v, ok := cmd.Dict[axis]; ok {
+			dist2 += (v - dl.pos[i]) * (v - dl.pos[i])
+			dl.pos[i] = v
+		}
+	}
+	if !dl.modelMoves || dl.feedrate <= 0 {
+		return 0
+	}
+	secs := math.Sqrt(dist2) / (dl.feedrate / 60) / dl.speedup
+	return time.Duration(secs * float64(time.Second))
+}
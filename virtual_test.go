@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVirtualDownlinkModelMoves(t *testing.T) {
+	up, _ := newTestUplink()
+	dl := NewVirtualDownlink(up, 10 /*speedup*/)
+	dl.modelMoves = true
+
+	// 20 mm in total at 10 mm/s is 2 seconds, or 200 ms with the speedup.
+	start := time.Now()
+	for _, cmd := range []string{"G1 Z10 F600", "G1 Z0", "M84"} {
+		if err := dl.WriteAndWaitForOK(context.Background(), cmd); err != nil {
+			t.Fatalf("WriteAndWaitForOK(%q): %v", cmd, err)
+		}
+	}
+	elapsed := time.Now().Sub(start)
+	if want := 200 * time.Millisecond; elapsed < want || elapsed > 2*want {
+		t.Errorf("want the job to take about %v, took %v", want, elapsed)
+	}
+
+	// Without modelling, moves are instant.
+	dl = NewVirtualDownlink(up, 10 /*speedup*/)
+	start = time.Now()
+	if err := dl.WriteAndWaitForOK(context.Background(), "G1 Z10 F600"); err != nil {
+		t.Fatalf("WriteAndWaitForOK: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 50*time.Millisecond {
+		t.Errorf("want an instant move, took %v", elapsed)
+	}
+}
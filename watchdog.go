@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLivenessTimeout = 5 * time.Minute
+	livenessProbeInterval  = 10 * time.Second
+)
+
+// LivenessWatchdog restarts the agent, if one of its main loops wedges, like after a deadlock. Otherwise, the agent
+// would become a zombie, which still holds the device. Every loop beats from its own goroutine, at least every
+// livenessProbeInterval, or is probed periodically through its request channel, and the heartbeat is updated,
+// when the probe returns. If a heartbeat is older than timeout, the stacks of all goroutines are dumped
+// to the log, and the agent exits, so that the service manager restarts it.
+type LivenessWatchdog struct {
+	up      *Uplink
+	timeout time.Duration
+
+	mu    sync.Mutex
+	beats map[string]time.Time
+
+	// interval is how often a loop, which waits for the device, checks, whether to beat. It's overridden in tests.
+	interval time.Duration
+	// exit is os.Exit. It's overridden in tests.
+	exit func(code int)
+}
+
+func NewLivenessWatchdog(up *Uplink, timeout time.Duration) *LivenessWatchdog {
+	return &LivenessWatchdog{
+		up:       up,
+		timeout:  timeout,
+		beats:    make(map[string]time.Time),
+		interval: livenessProbeInterval,
+		exit:     os.Exit,
+	}
+}
+
+// Beat marks the loop as alive. It does nothing, if the watchdog is nil, so the loops don't check, whether it's enabled.
+func (w *LivenessWatchdog) Beat(name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.beats[name] = time.Now()
+}
+
+// Forget stops watching the loop until its next beat, like the executor between jobs.
+func (w *LivenessWatchdog) Forget(name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.beats, name)
+}
+
+// Sleep pauses the loop for d and beats meanwhile, so that a long backoff is not taken for a wedge.
+func (w *LivenessWatchdog) Sleep(name string, d time.Duration) {
+	for deadline := time.Now().Add(d); ; {
+		w.Beat(name)
+		left := time.Until(deadline)
+		if left <= 0 {
+			return
+		}
+		if left > livenessProbeInterval {
+			left = livenessProbeInterval
+		}
+		time.Sleep(left)
+	}
+}
+
+// Probe calls probe every interval and beats after it returns. probe must block, while the loop is wedged,
+// like sending a request to the loop and waiting for the reply.
+func (w *LivenessWatchdog) Probe(name string, interval time.Duration, probe func()) {
+	w.Beat(name)
+	go func() {
+		for {
+			probe()
+			w.Beat(name)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// stalled returns the name of a loop, which has not beaten for longer than the timeout, or "", if all are alive.
+func (w *LivenessWatchdog) stalled() (name string, since time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var names []string
+	for name := range w.beats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if since := time.Now().Sub(w.beats[name]); since > w.timeout {
+			return name, since
+		}
+	}
+	return "", 0
+}
+
+// Run checks the heartbeats every interval. It only returns after the exit, which is only possible in tests.
+func (w *LivenessWatchdog) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		name, since := w.stalled()
+		if name == "" {
+			continue
+		}
+		// The uplink may be the one, which is wedged, so the stacks go to the local log only, and the server
+		// is notified without waiting for it.
+		logf("Liveness watchdog: %s has not responded for %v. Goroutines:\n%s", name, since, allStacks())
+		go w.up.logf("FATAL: %s has not responded for %v. Restarting the agent", name, since)
+		time.Sleep(w.up.fatalDelay)
+		w.exit(1)
+		return
+	}
+}
+
+// allStacks returns the stack traces of all goroutines.
+func allStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
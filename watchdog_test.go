@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLivenessWatchdogStalled(t *testing.T) {
+	up, _ := newTestUplink()
+	up.fatalDelay = 10 * time.Millisecond
+	fatal := make(chan string, 10)
+	defer up.addLogTap(func(line string) {
+		if strings.HasPrefix(line, "FATAL") {
+			fatal <- line
+		}
+	})()
+	w := NewLivenessWatchdog(up, 200*time.Millisecond)
+	exited := make(chan int, 1)
+	w.exit = func(code int) { exited <- code }
+
+	if !strings.Contains(string(allStacks()), "TestLivenessWatchdogStalled") {
+		t.Errorf("the stack dump has no test goroutine")
+	}
+
+	// The stuck probe never returns, like a request to a deadlocked loop.
+	w.Probe("alive", 10*time.Millisecond, func() {})
+	w.Probe("stuck", 10*time.Millisecond, func() { select {} })
+	done := make(chan bool)
+	go func() {
+		w.Run(10 * time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("want exit code 1, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the agent has not exited with a stalled heartbeat")
+	}
+	<-done
+	select {
+	case line := <-fatal:
+		if !strings.Contains(line, "stuck") {
+			t.Errorf("want the stuck loop named, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the restart is not logged")
+	}
+}
+
+func TestLivenessWatchdogAlive(t *testing.T) {
+	up, _ := newTestUplink()
+	w := NewLivenessWatchdog(up, 100*time.Millisecond)
+	w.Probe("alive", 10*time.Millisecond, func() {})
+	// A slow probe is fine, as long as it returns within the timeout.
+	w.Probe("slow", 10*time.Millisecond, func() { time.Sleep(50 * time.Millisecond) })
+	time.Sleep(500 * time.Millisecond)
+	if name, since := w.stalled(); name != "" {
+		t.Errorf("want all loops alive, got %s stalled for %v", name, since)
+	}
+}
+
+func TestLivenessWatchdogForget(t *testing.T) {
+	up, _ := newTestUplink()
+	w := NewLivenessWatchdog(up, 50*time.Millisecond)
+	w.Beat("executor")
+	time.Sleep(100 * time.Millisecond)
+	if name, _ := w.stalled(); name != "executor" {
+		t.Errorf("want the executor stalled without beats, got %q", name)
+	}
+	// Between jobs, the executor is not watched.
+	w.Forget("executor")
+	if name, since := w.stalled(); name != "" {
+		t.Errorf("want nothing watched after Forget, got %s stalled for %v", name, since)
+	}
+	// A nil watchdog is disabled.
+	var disabled *LivenessWatchdog
+	disabled.Beat("shell")
+	disabled.Forget("shell")
+	disabled.Sleep("shell", time.Millisecond)
+}
+
+// slowDownlink is a dry-run downlink, which takes a while to confirm a command, like M109 or a dwell.
+// If chatty, it receives something meanwhile, like the temperatures.
+type slowDownlink struct {
+	*DryRunDownlink
+	chatty bool
+
+	mu      sync.Mutex
+	bytesIn int64
+}
+
+func (dl *slowDownlink) Stats() LinkStats {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return LinkStats{BytesIn: dl.bytesIn}
+}
+
+func (dl *slowDownlink) WriteAndWaitForOK(ctx context.Context, cmd string) error {
+	for i := 0; i < 30; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if dl.chatty {
+			dl.mu.Lock()
+			dl.bytesIn += 20
+			dl.mu.Unlock()
+		}
+	}
+	return dl.DryRunDownlink.WriteAndWaitForOK(ctx, cmd)
+}
+
+func TestLivenessWatchdogLongCommand(t *testing.T) {
+	for _, chatty := range []bool{true, false} {
+		up, _ := newTestUplink()
+		w := NewLivenessWatchdog(up, 100*time.Millisecond)
+		w.interval = 10 * time.Millisecond
+		exe := NewExecutor(up, true /*virtual*/, nil)
+		exe.down = &slowDownlink{DryRunDownlink: NewDryRunDownlink(up), chatty: chatty}
+		exe.wd = w
+
+		w.Beat("executor")
+		stalled := make(chan string, 1)
+		go func() {
+			time.Sleep(250 * time.Millisecond)
+			name, _ := w.stalled()
+			stalled <- name
+		}()
+		if err := exe.writeAndBeat(context.Background(), "G4 P300"); err != nil {
+			t.Fatalf("writeAndBeat: %v", err)
+		}
+		name := <-stalled
+		if chatty && name != "" {
+			t.Errorf("want the executor alive, while the printer reports the temperatures, got %q stalled", name)
+		}
+		if !chatty && name != "executor" {
+			t.Errorf("want the executor stalled, while the printer is silent, got %q", name)
+		}
+	}
+}